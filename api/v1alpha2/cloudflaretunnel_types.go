@@ -19,28 +19,382 @@ package v1alpha2
 import (
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 // CloudflareTunnelSpec defines the desired state of CloudflareTunnel
 type CloudflareTunnelSpec struct {
+	// Domain routed to Service, required unless Ingress is set
+	// +kubebuilder:validation:Optional
 	// +kubebuilder:validation:Format="url"
-	Domain  string                   `json:"domain"`
-	Zone    string                   `json:"zone"`
+	Domain string `json:"domain"`
+	// Zone of the CNAME record of the domain. Defaults to the zone of the account which is the longest suffix of
+	// the DNS record name.
+	// +kubebuilder:validation:Optional
+	Zone string `json:"zone,omitempty"`
+	// Service the tunnel routes to, required unless DNSOnly or Ingress is set
+	// +kubebuilder:validation:Optional
 	Service *CloudflareTunnelService `json:"service"`
+	// Ingress routes several hostnames through the tunnel, each to its own service, replacing Domain and Service.
+	// Domain defaults to the hostname of the first rule and, if set, must be one of the hostnames. It is used for the
+	// status and the load balancer, while a CNAME record is created for each of the other hostnames. Retries applies
+	// to the whole tunnel, so only the one of the first rule is used.
+	// +kubebuilder:validation:Optional
+	Ingress []CloudflareTunnelIngressRule `json:"ingress,omitempty"`
+	// SkipUnownedHostnames skips the CNAME records of the ingress hostnames whose zone is not in the account instead
+	// of failing, for hostnames whose DNS is managed elsewhere. They are still routed by cloudflared and reported by
+	// the HostnamesOwned condition. The domain must always be within a zone of the account.
+	// +kubebuilder:validation:Optional
+	SkipUnownedHostnames bool `json:"skipUnownedHostnames,omitempty"`
 	// +kubebuilder:validation:Optional
 	Container       *CloudflareTunnelContainer `json:"container"`
 	TokenSecretName string                     `json:"tokenSecretName"`
-	Replicas        int32                      `json:"replicas"`
+	// TokenKey is the key of the token secret holding the Cloudflare API token, defaults to token
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:default=token
+	// +kubebuilder:validation:Pattern=`^[-._a-zA-Z0-9]+$`
+	TokenKey string `json:"tokenKey,omitempty"`
+	// AccountIDKey is the key of the token secret holding the account ID, defaults to accountID
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:default=accountID
+	// +kubebuilder:validation:Pattern=`^[-._a-zA-Z0-9]+$`
+	AccountIDKey string `json:"accountIDKey,omitempty"`
+	// APIKeyKey is the key of the token secret holding the global API key, defaults to apiKey
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:default=apiKey
+	// +kubebuilder:validation:Pattern=`^[-._a-zA-Z0-9]+$`
+	APIKeyKey string `json:"apiKeyKey,omitempty"`
+	// AuthType selects how the operator authenticates against the Cloudflare API. token uses the API token of the
+	// token secret, apiKey the global API key and the email of its APIKeyKey and email keys. If empty, the global
+	// API key is used when the secret has both the APIKeyKey and email keys and the API token otherwise.
+	// +kubebuilder:validation:Optional
+	AuthType CloudflareTunnelAuthType `json:"authType,omitempty"`
+	// Replicas of cloudflared, defaults to 2 so that the tunnel stays connected while a pod is replaced.
+	// 0 is defaulted as well, as a tunnel without connectors cannot serve anything. It can be scaled by a
+	// HorizontalPodAutoscaler through the scale subresource, unless ReplicasFromEndpoints is set.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:default=2
+	Replicas int32 `json:"replicas"`
+	// ManageDeployment runs cloudflared in a Deployment, defaults to true. Set it to false to run cloudflared
+	// elsewhere, such as in a DaemonSet, mounting the secret and the config map named <name>-cf-tunnel which are
+	// still managed. The secret holds the tunnel credentials under <tunnel ID>.json and the origin certificate under
+	// cert.pem, the config map holds the cloudflared configuration under config.yaml, unless renamed with Files.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:default=true
+	ManageDeployment *bool `json:"manageDeployment,omitempty"`
+	// DNSOnly only manages the DNS record of the tunnel TunnelID, whose cloudflared runs outside of the cluster.
+	// No tunnel, secret, config map or deployment is created and the tunnel is not deleted with the resource.
+	// +kubebuilder:validation:Optional
+	DNSOnly bool `json:"dnsOnly,omitempty"`
+	// ManageDNS creates and deletes the CNAME records of the domain and the ingress hostnames, defaults to true.
+	// Set it to false when the records are managed by another tool such as external-dns, the tunnel is then
+	// reconciled without touching DNS and the target of the records is reported in the status.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:default=true
+	ManageDNS *bool `json:"manageDNS,omitempty"`
+	// TunnelID is the ID of the external tunnel the DNS record points to, required when DNSOnly is set.
+	// Otherwise it pins the tunnel to use, e.g. when several tunnels share the name of the resource. The tunnel
+	// is then never created, the reconcile fails until it exists.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Format="uuid"
+	TunnelID string `json:"tunnelID,omitempty"`
+	// DNSRecordName is the name of the CNAME record pointing at the tunnel, for setups where it differs from the
+	// hostname routed by cloudflared such as split-horizon DNS or CDN chaining. It must be within the zone and
+	// defaults to Domain.
+	// +kubebuilder:validation:Optional
+	DNSRecordName string `json:"dnsRecordName,omitempty"`
+	// DNSProxied sets whether the CNAME records are proxied through Cloudflare, defaults to true
+	// +kubebuilder:validation:Optional
+	DNSProxied *bool `json:"dnsProxied,omitempty"`
+	// DNSTTL is the TTL in seconds of the CNAME records, 1 meaning automatic, otherwise between 60 and 86400. It only
+	// applies to records which are not proxied, as Cloudflare manages the TTL of proxied records. Defaults to automatic.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=86400
+	DNSTTL *int `json:"dnsTTL,omitempty"`
+	// AccountID selects the account to use when the token secret contains credentials for multiple accounts, or
+	// when it has no accountID and its token has access to multiple accounts
+	// +kubebuilder:validation:Optional
+	AccountID string `json:"accountID,omitempty"`
+	// PodLabels are added to the cloudflared pods, e.g. to opt out of service mesh sidecar injection
+	// +kubebuilder:validation:Optional
+	PodLabels map[string]string `json:"podLabels,omitempty"`
+	// AutomountServiceAccountToken mounts the service account token in the cloudflared pods.
+	// cloudflared does not use the Kubernetes API, so it is not mounted by default.
+	// +kubebuilder:validation:Optional
+	AutomountServiceAccountToken *bool `json:"automountServiceAccountToken,omitempty"`
+	// ServiceAccountName is the service account the cloudflared pods run as, the default one of the namespace if empty
+	// +kubebuilder:validation:Optional
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+	// ImagePullSecrets are used to pull the cloudflared image, e.g. from a registry mirror requiring authentication
+	// +kubebuilder:validation:Optional
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+	// SecretStore exports the tunnel credentials to an external store in addition to the Kubernetes Secret
+	// +kubebuilder:validation:Optional
+	SecretStore *CloudflareTunnelSecretStore `json:"secretStore,omitempty"`
+	// ReplicasFromEndpoints derives the replicas from the ready endpoints of the target service, overriding Replicas
+	// +kubebuilder:validation:Optional
+	ReplicasFromEndpoints *CloudflareTunnelReplicasFromEndpoints `json:"replicasFromEndpoints,omitempty"`
+	// LivenessProbe restarts cloudflared once it has lost its connections to the edge, no probe is added if unset
+	// +kubebuilder:validation:Optional
+	LivenessProbe *CloudflareTunnelLivenessProbe `json:"livenessProbe,omitempty"`
+	// +kubebuilder:validation:Optional
+	ReadinessProbe *CloudflareTunnelReadinessProbe `json:"readinessProbe,omitempty"`
+	// NodeSelector restricts the nodes the cloudflared pods are scheduled on
+	// +kubebuilder:validation:Optional
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// Tolerations of the cloudflared pods, e.g. to run them on a tainted pool of egress nodes
+	// +kubebuilder:validation:Optional
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+	// Affinity of the cloudflared pods, e.g. to spread the replicas across nodes
+	// +kubebuilder:validation:Optional
+	Affinity *corev1.Affinity `json:"affinity,omitempty"`
+	// GracePeriodSeconds is how long cloudflared keeps serving in-flight requests after receiving a shutdown signal.
+	// The termination grace period of the pods is always extended beyond it so that they are not killed mid-drain.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	GracePeriodSeconds *int32 `json:"gracePeriodSeconds,omitempty"`
+	// LogLevel of cloudflared, the cloudflared default (info) is used if empty
+	// +kubebuilder:validation:Optional
+	LogLevel CloudflareTunnelLogLevel `json:"logLevel,omitempty"`
+	// TransportLogLevel of the connections to the edge, independent of LogLevel so that connectivity issues can be
+	// debugged without flooding the logs. The cloudflared default (info) is used if empty.
+	// +kubebuilder:validation:Optional
+	TransportLogLevel CloudflareTunnelLogLevel `json:"transportLogLevel,omitempty"`
+	// Transport is the protocol cloudflared connects to the edge with. quic needs outbound UDP on port 7844, http2
+	// only TCP, e.g. behind a firewall blocking UDP. The cloudflared default, auto, tries quic and falls back to
+	// http2.
+	// +kubebuilder:validation:Optional
+	Transport CloudflareTunnelTransport `json:"transport,omitempty"`
+	// MetricsService creates a ClusterIP Service in front of the cloudflared metrics, to be scraped under a stable name
+	// +kubebuilder:validation:Optional
+	MetricsService bool `json:"metricsService,omitempty"`
+	// Metrics has cloudflared scraped by the Prometheus Operator
+	// +kubebuilder:validation:Optional
+	Metrics *CloudflareTunnelMetrics `json:"metrics,omitempty"`
+	// +kubebuilder:validation:Optional
+	Files *CloudflareTunnelFiles `json:"files,omitempty"`
+	// TokenRefreshInterval periodically fetches the tunnel token again and rolls the cloudflared pods
+	// +kubebuilder:validation:Optional
+	TokenRefreshInterval *metav1.Duration `json:"tokenRefreshInterval,omitempty"`
+	// LoadBalancer registers the tunnel as an origin of a load balancer pool instead of creating a CNAME record,
+	// so that the domain can be served by the tunnels of several clusters
+	// +kubebuilder:validation:Optional
+	LoadBalancer *CloudflareTunnelLoadBalancer `json:"loadBalancer,omitempty"`
+}
+
+// CloudflareTunnelLoadBalancer configures the load balancer of the domain. The pool and the load balancer are created
+// if missing and shared with the other clusters using the same pool, only the origin of this tunnel is managed.
+type CloudflareTunnelLoadBalancer struct {
+	// Pool is the name of the origin pool of the account the tunnel is added to
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinLength=1
+	Pool string `json:"pool"`
+	// OriginName identifies the tunnel in the pool and must be unique across clusters, defaults to the tunnel ID.
+	// Setting it keeps the origin in place when the tunnel is recreated instead of leaving the previous one behind.
+	// +kubebuilder:validation:Optional
+	OriginName string `json:"originName,omitempty"`
+	// MonitorPath is the path checked by the health monitor attached to the pool when it is created.
+	// No monitor is attached if empty.
+	// +kubebuilder:validation:Optional
+	MonitorPath string `json:"monitorPath,omitempty"`
+}
+
+// CloudflareTunnelMetrics configures the scraping of the cloudflared metrics
+type CloudflareTunnelMetrics struct {
+	// Enabled creates the metrics service, along with a ServiceMonitor scraping it when the ServiceMonitor CRD of the
+	// Prometheus Operator is installed
+	// +kubebuilder:validation:Optional
+	Enabled bool `json:"enabled,omitempty"`
+	// Interval between the scrapes, defaults to the interval configured in Prometheus
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Pattern=`^([0-9]+(ms|s|m|h))+$`
+	Interval string `json:"interval,omitempty"`
+	// Labels of the ServiceMonitor, to match the serviceMonitorSelector of Prometheus
+	// +kubebuilder:validation:Optional
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// CloudflareTunnelFiles overrides the keys of the managed config map and secret, which are also the names of the
+// files mounted in cloudflared
+type CloudflareTunnelFiles struct {
+	// Config is the name of the cloudflared configuration, defaults to config.yaml
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Pattern=`^[-._a-zA-Z0-9]+$`
+	Config string `json:"config,omitempty"`
+	// Credentials is the name of the tunnel credentials, defaults to <tunnel ID>.json
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Pattern=`^[-._a-zA-Z0-9]+$`
+	Credentials string `json:"credentials,omitempty"`
+	// OriginCert is the name of the origin certificate, defaults to cert.pem
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Pattern=`^[-._a-zA-Z0-9]+$`
+	OriginCert string `json:"originCert,omitempty"`
+}
+
+// CloudflareTunnelLivenessProbe restarts cloudflared once it has lost all its connections to the edge for a while.
+// The probe is only added when set and the default container args are used, since it relies on the metrics server.
+type CloudflareTunnelLivenessProbe struct {
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:default=true
+	Enabled *bool `json:"enabled,omitempty"`
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	InitialDelaySeconds int32 `json:"initialDelaySeconds,omitempty"`
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	PeriodSeconds int32 `json:"periodSeconds,omitempty"`
+	// FailureThreshold is the number of consecutive failed probes after which the container is restarted
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	FailureThreshold int32 `json:"failureThreshold,omitempty"`
+}
+
+// CloudflareTunnelReadinessProbe reports cloudflared as ready once it is connected to the edge, so that a rollout
+// only replaces the next pod once the new one serves the tunnel. Like the liveness probe, it is only added when the
+// default container args are used.
+type CloudflareTunnelReadinessProbe struct {
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:default=true
+	Enabled *bool `json:"enabled,omitempty"`
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	InitialDelaySeconds int32 `json:"initialDelaySeconds,omitempty"`
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	PeriodSeconds int32 `json:"periodSeconds,omitempty"`
+	// FailureThreshold is the number of consecutive failed probes after which the pod is reported as not ready
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	FailureThreshold int32 `json:"failureThreshold,omitempty"`
+}
+
+// CloudflareTunnelReplicasFromEndpoints defines how the replicas scale with the ready endpoints of the target service
+type CloudflareTunnelReplicasFromEndpoints struct {
+	// EndpointsPerReplica is the number of ready endpoints served by a single replica
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=1
+	EndpointsPerReplica int32 `json:"endpointsPerReplica"`
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:default=1
+	MinReplicas int32 `json:"minReplicas"`
+	// +kubebuilder:validation:Minimum=1
+	MaxReplicas int32 `json:"maxReplicas"`
+}
+
+// CloudflareTunnelSecretStore defines the external store the tunnel credentials are exported to
+type CloudflareTunnelSecretStore struct {
+	// +kubebuilder:validation:Optional
+	Vault *CloudflareTunnelVaultStore `json:"vault,omitempty"`
+}
+
+// CloudflareTunnelVaultStore defines a HashiCorp Vault KV version 2 secrets engine
+type CloudflareTunnelVaultStore struct {
+	// +kubebuilder:validation:Format="url"
+	Address string `json:"address"`
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:default=secret
+	Mount string `json:"mount"`
+	Path  string `json:"path"`
+	// TokenSecretName is the name of a secret in the namespace of the resource containing the Vault token in the key `token`
+	TokenSecretName string `json:"tokenSecretName"`
+}
+
+// CloudflareTunnelIngressRule routes the requests for a hostname, optionally restricted to the paths matching
+// Service.Path, to the service
+type CloudflareTunnelIngressRule struct {
+	// Hostname routed by the rule. The rule without hostname nor path is the catch-all, routing the requests matched
+	// by no other rule. It has to be the last rule, and one answering 404 is appended if there is none.
+	// +kubebuilder:validation:Optional
+	Hostname string `json:"hostname,omitempty"`
+	// Zone of the CNAME record of the hostname. Defaults to the zone of the tunnel if the hostname is within it,
+	// otherwise to the zone of the account which is the longest suffix of the hostname.
+	// +kubebuilder:validation:Optional
+	Zone string `json:"zone,omitempty"`
+	// Service the requests are routed to. The unix protocol is not supported.
+	Service CloudflareTunnelService `json:"service"`
 }
 
 type CloudflareTunnelService struct {
-	Name      string `json:"name"`
+	// Name of the target service, required unless Protocol is unix or OriginURL is set
+	// +kubebuilder:validation:Optional
+	Name string `json:"name"`
+	// +kubebuilder:validation:Optional
 	Namespace string `json:"namespace"`
-	// +kubebuilder:validation:Enum=http;https
-	Protocol string `json:"protocol"`
-	Port     int32  `json:"port"`
+	// Protocol used to reach the origin, required unless OriginURL is set. It is the scheme of the cloudflared
+	// service: http and https proxy HTTP requests to http://<name>.<namespace>:<port> and https://..., while tcp, ssh
+	// and rdp proxy the raw connections of clients running cloudflared access to tcp://..., ssh://... and rdp://...,
+	// e.g. for databases. unix connects to the socket configured in Socket instead of the service.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Enum=http;https;tcp;ssh;rdp;unix
+	Protocol string `json:"protocol,omitempty"`
+	// Port of the target service, either its number or its name, required unless Protocol is unix or OriginURL is set
+	// +kubebuilder:validation:Optional
+	Port intstr.IntOrString `json:"port"`
+	// OriginURL is the literal URL of an origin which is not a service of the cluster, e.g. https://internal.corp:8443.
+	// It is used as is instead of looking up the target service, which must not be set.
+	// +kubebuilder:validation:Optional
+	OriginURL string `json:"originURL,omitempty"`
+	// Socket is the unix socket of the origin, required when Protocol is unix
+	// +kubebuilder:validation:Optional
+	Socket *CloudflareTunnelServiceSocket `json:"socket,omitempty"`
 	// +kubebuilder:validation:Optional
 	OriginRequest []*CloudflareTunnelServiceOriginRequest `json:"originRequest"`
+	// +kubebuilder:validation:Optional
+	Proxy *CloudflareTunnelServiceProxy `json:"proxy,omitempty"`
+	// NoHappyEyeballs disables the racing of IPv4 and IPv6 connections to the origin
+	// +kubebuilder:validation:Optional
+	NoHappyEyeballs bool `json:"noHappyEyeballs,omitempty"`
+	// Timeouts tune the connections to the origin of this rule
+	// +kubebuilder:validation:Optional
+	Timeouts *CloudflareTunnelServiceTimeouts `json:"timeouts,omitempty"`
+	// Retries is the maximum number of retries on connection errors. cloudflared only supports it for the whole
+	// tunnel, so it applies to all the rules.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	Retries *int32 `json:"retries,omitempty"`
+	// Path restricts the rule to the requests matching this regular expression
+	// +kubebuilder:validation:Optional
+	Path string `json:"path,omitempty"`
+	// TLSPassthrough proxies the TLS connections to the origin without terminating them, routing them by SNI.
+	// The origin is reached over tcp regardless of Protocol and Path cannot be set.
+	// +kubebuilder:validation:Optional
+	TLSPassthrough bool `json:"tlsPassthrough,omitempty"`
+}
+
+// CloudflareTunnelServiceSocket defines a unix socket of the origin. The origin runs in other pods, so the socket can
+// only be reached through a volume shared with them, e.g. a hostPath or a ReadWriteMany persistent volume claim.
+type CloudflareTunnelServiceSocket struct {
+	// Path of the socket relative to the root of the volume
+	// +kubebuilder:validation:MinLength=1
+	Path string `json:"path"`
+	// Volume containing the socket, mounted in the cloudflared pods
+	Volume corev1.VolumeSource `json:"volume"`
+}
+
+// CloudflareTunnelServiceTimeouts defines the timeouts of the connections to the origin as Go durations, e.g. 30s.
+// cloudflared defaults are used for the unset ones.
+type CloudflareTunnelServiceTimeouts struct {
+	// +kubebuilder:validation:Optional
+	ConnectTimeout string `json:"connectTimeout,omitempty"`
+	// +kubebuilder:validation:Optional
+	TLSTimeout string `json:"tlsTimeout,omitempty"`
+	// +kubebuilder:validation:Optional
+	TCPKeepAlive string `json:"tcpKeepAlive,omitempty"`
+}
+
+// CloudflareTunnelServiceProxy defines the local proxy cloudflared runs for the origin
+type CloudflareTunnelServiceProxy struct {
+	Address string `json:"address"`
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=65535
+	Port int32 `json:"port,omitempty"`
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Enum=socks
+	Type string `json:"type,omitempty"`
 }
 
 // CloudflareTunnelServiceOriginRequest defines an origin request configuration parameter
@@ -51,23 +405,200 @@ type CloudflareTunnelServiceOriginRequest struct {
 
 type CloudflareTunnelContainer struct {
 	// +kubebuilder:validation:Optional
-	Image string `json:"image"`
+	// +kubebuilder:validation:MaxLength=63
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	Name string `json:"name,omitempty"`
+	// Image of cloudflared, e.g. a pinned version or a mirror, defaults to cloudflare/cloudflared:latest
+	// +kubebuilder:validation:Optional
+	Image string `json:"image,omitempty"`
 	// +kubebuilder:validation:Optional
 	// +kubebuilder:validation:Enum=IfNotPresent;Always;Never
-	ImagePullPolicy corev1.PullPolicy `json:"imagePullPolicy"`
+	ImagePullPolicy corev1.PullPolicy `json:"imagePullPolicy,omitempty"`
+	// +kubebuilder:validation:Optional
+	Command []string `json:"command,omitempty"`
+	// +kubebuilder:validation:Optional
+	Args []string `json:"args,omitempty"`
+	// Size selects predefined resources for the cloudflared container, memory is limited but CPU is not:
+	// small requests 50m CPU and 64Mi memory limited to 128Mi,
+	// medium requests 200m CPU and 128Mi memory limited to 256Mi,
+	// large requests 500m CPU and 256Mi memory limited to 512Mi.
+	// +kubebuilder:validation:Optional
+	Size CloudflareTunnelSize `json:"size,omitempty"`
+	// Resources of the cloudflared container, overriding Size when both are set. If neither is set, 100m CPU and
+	// 128Mi memory limited to 256Mi are requested. Set it to {} to request no resources.
 	// +kubebuilder:validation:Optional
-	Command []string `json:"command"`
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+	// TerminationMessagePolicy set to FallbackToLogsOnError shows the last logs of a crashed cloudflared in the
+	// termination message of the pod. Defaults to the Kubernetes default, File.
 	// +kubebuilder:validation:Optional
-	Args []string `json:"args"`
+	// +kubebuilder:validation:Enum=File;FallbackToLogsOnError
+	TerminationMessagePolicy corev1.TerminationMessagePolicy `json:"terminationMessagePolicy,omitempty"`
+	// SecurityContext of the cloudflared container, replacing the default one. By default, cloudflared runs as
+	// a non-root user on a read-only root filesystem without any capability, as required by the restricted Pod
+	// Security Standard. The default pins runAsUser to 65532, the nonroot user of the image, since the image sets
+	// its user by name which the kubelet cannot verify to be non-root. Where the UID is assigned by the platform,
+	// like the restricted SCC of OpenShift, set a security context without runAsUser.
+	// +kubebuilder:validation:Optional
+	SecurityContext *corev1.SecurityContext `json:"securityContext,omitempty"`
 }
 
+const (
+	// DefaultReplicas is the number of cloudflared pods when the spec does not set it
+	DefaultReplicas = 2
+	// DefaultImage is the image of cloudflared when the container does not set one
+	DefaultImage = "cloudflare/cloudflared:latest"
+	// DefaultProtocol is the protocol of the service when it has no origin URL nor protocol
+	DefaultProtocol = "http"
+)
+
+// CloudflareTunnelSize is a preset of resources for the cloudflared container
+// +kubebuilder:validation:Enum=small;medium;large
+type CloudflareTunnelSize string
+
+// CloudflareTunnelAuthType is the kind of credentials used to authenticate against the Cloudflare API
+// +kubebuilder:validation:Enum=token;apiKey
+type CloudflareTunnelAuthType string
+
+const (
+	AuthToken  CloudflareTunnelAuthType = "token"
+	AuthAPIKey CloudflareTunnelAuthType = "apiKey"
+)
+
+// CloudflareTunnelLogLevel is a log level accepted by cloudflared
+// +kubebuilder:validation:Enum=debug;info;warn;error;fatal
+type CloudflareTunnelLogLevel string
+
+const (
+	LogLevelDebug CloudflareTunnelLogLevel = "debug"
+	LogLevelInfo  CloudflareTunnelLogLevel = "info"
+	LogLevelWarn  CloudflareTunnelLogLevel = "warn"
+	LogLevelError CloudflareTunnelLogLevel = "error"
+	LogLevelFatal CloudflareTunnelLogLevel = "fatal"
+)
+
+// CloudflareTunnelTransport is a protocol of the connections of cloudflared to the edge
+// +kubebuilder:validation:Enum=auto;quic;http2
+type CloudflareTunnelTransport string
+
+const (
+	TransportAuto  CloudflareTunnelTransport = "auto"
+	TransportQUIC  CloudflareTunnelTransport = "quic"
+	TransportHTTP2 CloudflareTunnelTransport = "http2"
+)
+
+const (
+	SizeSmall  CloudflareTunnelSize = "small"
+	SizeMedium CloudflareTunnelSize = "medium"
+	SizeLarge  CloudflareTunnelSize = "large"
+)
+
+// CloudflareTunnelPhase is a coarse summary of the state of the tunnel, derived from the conditions
+// +kubebuilder:validation:Enum=Pending;Provisioning;Ready;Degraded;Deleting
+type CloudflareTunnelPhase string
+
+const (
+	PhasePending      CloudflareTunnelPhase = "Pending"
+	PhaseProvisioning CloudflareTunnelPhase = "Provisioning"
+	PhaseReady        CloudflareTunnelPhase = "Ready"
+	PhaseDegraded     CloudflareTunnelPhase = "Degraded"
+	PhaseDeleting     CloudflareTunnelPhase = "Deleting"
+)
+
+// CloudflareTunnelHealth is the health of the connections of the tunnel to the Cloudflare edge
+// +kubebuilder:validation:Enum=healthy;degraded;down
+type CloudflareTunnelHealth string
+
+const (
+	TunnelHealthy  CloudflareTunnelHealth = "healthy"
+	TunnelDegraded CloudflareTunnelHealth = "degraded"
+	TunnelDown     CloudflareTunnelHealth = "down"
+)
+
 // CloudflareTunnelStatus defines the observed state of CloudflareTunnel
 type CloudflareTunnelStatus struct {
+	// +kubebuilder:validation:Optional
+	Phase CloudflareTunnelPhase `json:"phase,omitempty"`
+	// ObservedGeneration is the generation of the resource the status has last been written for
+	// +kubebuilder:validation:Optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
 	// +kubebuilder:validation:Format="uuid"
 	TunnelID    string                        `json:"tunnelID,omitempty"`
 	Connections []CloudflareTunnelConnections `json:"connections"`
+	// TunnelStatus is healthy when every expected connector is connected to the edge, degraded when some are
+	// missing or reconnecting and down without any active connection
+	// +kubebuilder:validation:Optional
+	TunnelStatus CloudflareTunnelHealth `json:"tunnelStatus,omitempty"`
+	// ActiveConnections is the number of connections to the edge which are not pending a reconnect
+	// +kubebuilder:validation:Optional
+	ActiveConnections int `json:"activeConnections,omitempty"`
+	// ConnectorIDs are the IDs of the cloudflared instances connected to the tunnel
+	// +kubebuilder:validation:Optional
+	ConnectorIDs []string `json:"connectorIDs,omitempty"`
+	// +kubebuilder:validation:Optional
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+	// LastTokenRefresh is the time the tunnel token has last been refreshed
+	// +kubebuilder:validation:Optional
+	LastTokenRefresh *metav1.Time `json:"lastTokenRefresh,omitempty"`
+	// URL is the public URL of the tunnel, set once the domain has been routed to the tunnel
+	// +kubebuilder:validation:Optional
+	URL string `json:"url,omitempty"`
+	// CNAMETarget is the target of the CNAME record of the domain, unset when a load balancer is used
+	// +kubebuilder:validation:Optional
+	CNAMETarget string `json:"cnameTarget,omitempty"`
+	// DNSRecordID is the ID of the CNAME record of the domain, to update it without looking it up
+	// +kubebuilder:validation:Optional
+	DNSRecordID string `json:"dnsRecordID,omitempty"`
+	// Zone is the zone of the CNAME record of the domain, as set in the spec or detected from the domain
+	// +kubebuilder:validation:Optional
+	Zone string `json:"zone,omitempty"`
+	// ZoneID is the ID of Zone, to skip looking it up
+	// +kubebuilder:validation:Optional
+	ZoneID string `json:"zoneID,omitempty"`
+	// IngressZones are the zones holding the CNAME records of the ingress hostnames, swept on every reconcile so that
+	// the records of the removed hostnames are deleted
+	// +kubebuilder:validation:Optional
+	IngressZones []string `json:"ingressZones,omitempty"`
+	// ServiceMonitor is set while the ServiceMonitor created by the operator exists, so that it is only looked up
+	// to be deleted once the metrics are disabled if it does
+	// +kubebuilder:validation:Optional
+	ServiceMonitor bool `json:"serviceMonitor,omitempty"`
+	// ConfigHash is the hash of the config map last written by the operator, to detect changes made by others
+	// +kubebuilder:validation:Optional
+	ConfigHash string `json:"configHash,omitempty"`
+	// Replicas is the number of cloudflared pods of the deployment, reported by the scale subresource
+	// +kubebuilder:validation:Optional
+	Replicas int32 `json:"replicas,omitempty"`
+	// Selector of the cloudflared pods, used by the HorizontalPodAutoscaler to find the pods of the tunnel
+	// +kubebuilder:validation:Optional
+	Selector string `json:"selector,omitempty"`
 }
 
+const (
+	// ConditionReady reports whether all the resources of the tunnel have been reconciled
+	ConditionReady = "Ready"
+	// ConditionCredentialsValid reports whether the token has the permissions required to manage the tunnel
+	ConditionCredentialsValid = "CredentialsValid"
+	// ConditionTunnelReady reports whether the tunnel exists in the account
+	ConditionTunnelReady = "TunnelReady"
+	// ConditionDNSReady reports whether the DNS record points to the tunnel
+	ConditionDNSReady = "DNSReady"
+	// ConditionDeploymentReady reports whether the pods of the deployment are up to date and available
+	ConditionDeploymentReady = "DeploymentReady"
+	// ConditionServiceProtocol reports whether the protocol of the service matches the hints of the target port.
+	// It is only a warning, as the hints are optional and might be missing or wrong.
+	ConditionServiceProtocol = "ServiceProtocolMatches"
+	// ConditionHostnamesOwned reports whether the zones of all the hostnames are in the account, only set when
+	// SkipUnownedHostnames is. It is only a warning, as the DNS of the other hostnames is managed elsewhere.
+	ConditionHostnamesOwned = "HostnamesOwned"
+	// ConditionDegraded reports whether the tunnel is reconciled in a degraded state, like the target service having no
+	// ready endpoints to derive the replicas from. It is only a warning, as the tunnel recovers on its own.
+	ConditionDegraded = "Degraded"
+)
+
 type CloudflareTunnelConnections struct {
 	ConnectorID  string      `json:"connectorID,omitempty"`
 	Created      metav1.Time `json:"created,omitempty"`
@@ -79,7 +610,13 @@ type CloudflareTunnelConnections struct {
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:subresource:scale:specpath=.spec.replicas,statuspath=.status.replicas,selectorpath=.status.selector
 //+kubebuilder:storageversion
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Tunnel Status",type=string,JSONPath=`.status.tunnelStatus`
+//+kubebuilder:printcolumn:name="Connections",type=integer,JSONPath=`.status.activeConnections`
+//+kubebuilder:printcolumn:name="URL",type=string,JSONPath=`.status.url`,priority=1
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // CloudflareTunnel is the Schema for the cloudflaretunnels API
 type CloudflareTunnel struct {
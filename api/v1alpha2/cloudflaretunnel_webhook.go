@@ -0,0 +1,168 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+// log is for logging in this package.
+var cloudflaretunnellog = logf.Log.WithName("cloudflaretunnel-resource")
+
+func (r *CloudflareTunnel) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/mutate-cloudflare-tunnel-operator-beezlabs-app-v1alpha2-cloudflaretunnel,mutating=true,failurePolicy=fail,sideEffects=None,groups=cloudflare-tunnel-operator.beezlabs.app,resources=cloudflaretunnels,verbs=create;update,versions=v1alpha2,name=mcloudflaretunnel.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Defaulter = &CloudflareTunnel{}
+
+// Default implements webhook.Defaulter so a webhook will be registered for the type.
+// It sets the fields whose zero value makes no sense, so that the reconcile does not have to check them:
+//   - Replicas to DefaultReplicas when it is 0, unless only the DNS record is managed
+//   - the protocol of the services without an origin URL to DefaultProtocol
+//   - the image of the container to DefaultImage
+func (r *CloudflareTunnel) Default() {
+	cloudflaretunnellog.V(1).Info("default", "name", r.Name)
+	if r.Spec.Service != nil {
+		defaultService(r.Spec.Service)
+	}
+	for i := range r.Spec.Ingress {
+		defaultService(&r.Spec.Ingress[i].Service)
+	}
+	// no deployment is created for an external tunnel
+	if r.Spec.DNSOnly {
+		return
+	}
+	if r.Spec.Replicas == 0 {
+		r.Spec.Replicas = DefaultReplicas
+	}
+	if r.Spec.Container == nil {
+		r.Spec.Container = &CloudflareTunnelContainer{}
+	}
+	if r.Spec.Container.Image == "" {
+		r.Spec.Container.Image = DefaultImage
+	}
+}
+
+// defaultService sets the protocol of the service, which is part of the origin URL unless the URL is given
+func defaultService(service *CloudflareTunnelService) {
+	if service.Protocol == "" && service.OriginURL == "" {
+		service.Protocol = DefaultProtocol
+	}
+}
+
+//+kubebuilder:webhook:path=/validate-cloudflare-tunnel-operator-beezlabs-app-v1alpha2-cloudflaretunnel,mutating=false,failurePolicy=fail,sideEffects=None,groups=cloudflare-tunnel-operator.beezlabs.app,resources=cloudflaretunnels,verbs=create;update,versions=v1alpha2,name=vcloudflaretunnel.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Validator = &CloudflareTunnel{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *CloudflareTunnel) ValidateCreate() error {
+	cloudflaretunnellog.V(1).Info("validate create", "name", r.Name)
+	return r.validate()
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type.
+// Updates leaving the spec untouched are allowed, so that the finalizer of a resource created before the webhook
+// can still be removed.
+func (r *CloudflareTunnel) ValidateUpdate(old runtime.Object) error {
+	cloudflaretunnellog.V(1).Info("validate update", "name", r.Name)
+	if previous, ok := old.(*CloudflareTunnel); ok && equality.Semantic.DeepEqual(previous.Spec, r.Spec) {
+		return nil
+	}
+	return r.validate()
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *CloudflareTunnel) ValidateDelete() error {
+	return nil
+}
+
+// validate rejects the specs the reconcile can never succeed with, so that the mistake is reported at apply time
+// instead of in the logs of the operator. The zones are only checked syntactically, without calling Cloudflare.
+func (r *CloudflareTunnel) validate() error {
+	var allErrs field.ErrorList
+	spec := field.NewPath("spec")
+	if strings.TrimSpace(r.Spec.TokenSecretName) == "" {
+		allErrs = append(allErrs, field.Required(spec.Child("tokenSecretName"),
+			"the name of the secret holding the Cloudflare API token is required"))
+	}
+	if r.Spec.Replicas < 0 {
+		allErrs = append(allErrs, field.Invalid(spec.Child("replicas"), r.Spec.Replicas, "must not be negative"))
+	}
+	if ttl := r.Spec.DNSTTL; ttl != nil && *ttl > 1 && *ttl < 60 {
+		// the schema only checks the bounds, Cloudflare has no TTL between automatic and a minute
+		allErrs = append(allErrs, field.Invalid(spec.Child("dnsTTL"), *ttl, "must be 1 for automatic or at least 60"))
+	}
+	if r.Spec.DNSOnly && r.Spec.ManageDNS != nil && !*r.Spec.ManageDNS {
+		allErrs = append(allErrs, field.Forbidden(spec.Child("manageDNS"),
+			"must not be false when dnsOnly is set, as there would be nothing left to manage"))
+	}
+	if r.Spec.Zone != "" {
+		// the DNS record name is the one created in the zone, the domain can be outside of it when it is set
+		path, name := spec.Child("domain"), r.Spec.Domain
+		if r.Spec.DNSRecordName != "" {
+			path, name = spec.Child("dnsRecordName"), r.Spec.DNSRecordName
+		}
+		if name != "" && !withinZone(hostname(name), r.Spec.Zone) {
+			allErrs = append(allErrs, field.Invalid(path, name, fmt.Sprintf("must be within the zone %s", r.Spec.Zone)))
+		}
+	}
+	for i, rule := range r.Spec.Ingress {
+		if rule.Zone != "" && rule.Hostname != "" && !withinZone(hostname(rule.Hostname), rule.Zone) {
+			allErrs = append(allErrs, field.Invalid(spec.Child("ingress").Index(i).Child("hostname"), rule.Hostname,
+				fmt.Sprintf("must be within the zone %s", rule.Zone)))
+		}
+	}
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("CloudflareTunnel").GroupKind(), r.Name, allErrs)
+}
+
+// hostname returns the lower cased host of a domain, which may be given as a URL
+func hostname(domain string) string {
+	host := strings.TrimSpace(domain)
+	if strings.Contains(host, "://") {
+		if parsed, err := url.Parse(host); err == nil {
+			host = parsed.Host
+		}
+	}
+	if splitHost, _, err := net.SplitHostPort(host); err == nil {
+		host = splitHost
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// withinZone checks if the host is the zone or one of its subdomains
+func withinZone(host, zone string) bool {
+	zone = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(zone), "."))
+	return host == zone || strings.HasSuffix(host, "."+zone)
+}
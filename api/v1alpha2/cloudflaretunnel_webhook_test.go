@@ -0,0 +1,191 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestValidate(t *testing.T) {
+	valid := CloudflareTunnelSpec{Domain: "app.example.com", Zone: "example.com", TokenSecretName: "credentials", Replicas: 1}
+	tests := []struct {
+		name    string
+		mutate  func(spec *CloudflareTunnelSpec)
+		wantErr string
+	}{
+		{name: "valid", mutate: func(spec *CloudflareTunnelSpec) {}},
+		{name: "zone detected", mutate: func(spec *CloudflareTunnelSpec) { spec.Zone = "" }},
+		{name: "domain as URL", mutate: func(spec *CloudflareTunnelSpec) { spec.Domain = "https://App.Example.com:443" }},
+		{name: "domain of the zone", mutate: func(spec *CloudflareTunnelSpec) { spec.Domain = "example.com." }},
+		{
+			name:    "missing token secret",
+			mutate:  func(spec *CloudflareTunnelSpec) { spec.TokenSecretName = "" },
+			wantErr: "spec.tokenSecretName: Required value",
+		},
+		{
+			name:    "negative replicas",
+			mutate:  func(spec *CloudflareTunnelSpec) { spec.Replicas = -1 },
+			wantErr: "spec.replicas: Invalid value: -1",
+		},
+		{
+			name:   "automatic DNS TTL",
+			mutate: func(spec *CloudflareTunnelSpec) { ttl := 1; spec.DNSTTL = &ttl },
+		},
+		{
+			name:    "DNS TTL below a minute",
+			mutate:  func(spec *CloudflareTunnelSpec) { ttl := 30; spec.DNSTTL = &ttl },
+			wantErr: "spec.dnsTTL: Invalid value: 30",
+		},
+		{
+			name:    "domain outside of the zone",
+			mutate:  func(spec *CloudflareTunnelSpec) { spec.Domain = "app.notexample.com" },
+			wantErr: "spec.domain: Invalid value: \"app.notexample.com\": must be within the zone example.com",
+		},
+		{
+			name: "DNS record name within the zone",
+			mutate: func(spec *CloudflareTunnelSpec) {
+				spec.Domain = "app.internal"
+				spec.DNSRecordName = "app.example.com"
+			},
+		},
+		{
+			name:    "DNS record name outside of the zone",
+			mutate:  func(spec *CloudflareTunnelSpec) { spec.DNSRecordName = "app.example.org" },
+			wantErr: "spec.dnsRecordName: Invalid value",
+		},
+		{
+			name: "ingress hostname outside of its zone",
+			mutate: func(spec *CloudflareTunnelSpec) {
+				spec.Ingress = []CloudflareTunnelIngressRule{
+					{Hostname: "app.example.org", Zone: "example.org"},
+					{Hostname: "api.example.com", Zone: "example.org"},
+				}
+			},
+			wantErr: "spec.ingress[1].hostname: Invalid value",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tunnel := &CloudflareTunnel{ObjectMeta: metav1.ObjectMeta{Name: "tunnel"}, Spec: valid}
+			tt.mutate(&tunnel.Spec)
+			err := tunnel.ValidateCreate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("expected no error, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected an error containing %q, got %v", tt.wantErr, err)
+			}
+			if err := tunnel.ValidateUpdate(&CloudflareTunnel{Spec: valid}); err == nil {
+				t.Error("expected the update to be rejected as well")
+			}
+			if err := tunnel.ValidateUpdate(tunnel.DeepCopy()); err != nil {
+				t.Errorf("expected an update leaving the spec untouched to be allowed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestDefault(t *testing.T) {
+	tests := []struct {
+		name  string
+		spec  CloudflareTunnelSpec
+		check func(t *testing.T, spec CloudflareTunnelSpec)
+	}{
+		{
+			name: "replicas",
+			spec: CloudflareTunnelSpec{},
+			check: func(t *testing.T, spec CloudflareTunnelSpec) {
+				if spec.Replicas != DefaultReplicas {
+					t.Errorf("expected %d replicas, got %d", DefaultReplicas, spec.Replicas)
+				}
+			},
+		},
+		{
+			name: "replicas set",
+			spec: CloudflareTunnelSpec{Replicas: 3},
+			check: func(t *testing.T, spec CloudflareTunnelSpec) {
+				if spec.Replicas != 3 {
+					t.Errorf("expected the replicas to be kept, got %d", spec.Replicas)
+				}
+			},
+		},
+		{
+			name: "protocol",
+			spec: CloudflareTunnelSpec{
+				Service: &CloudflareTunnelService{Name: "app"},
+				Ingress: []CloudflareTunnelIngressRule{
+					{Hostname: "api.example.com", Service: CloudflareTunnelService{Name: "api"}},
+					{Hostname: "ssh.example.com", Service: CloudflareTunnelService{Name: "ssh", Protocol: "ssh"}},
+					{Hostname: "legacy.example.com", Service: CloudflareTunnelService{OriginURL: "https://legacy.corp"}},
+				},
+			},
+			check: func(t *testing.T, spec CloudflareTunnelSpec) {
+				if spec.Service.Protocol != DefaultProtocol {
+					t.Errorf("expected the protocol of the service to be defaulted, got %q", spec.Service.Protocol)
+				}
+				var protocols []string
+				for _, rule := range spec.Ingress {
+					protocols = append(protocols, rule.Service.Protocol)
+				}
+				if !reflect.DeepEqual(protocols, []string{DefaultProtocol, "ssh", ""}) {
+					t.Errorf("expected only the protocol of the rules without protocol nor origin URL to be set, got %v", protocols)
+				}
+			},
+		},
+		{
+			name: "image",
+			spec: CloudflareTunnelSpec{},
+			check: func(t *testing.T, spec CloudflareTunnelSpec) {
+				if spec.Container == nil || spec.Container.Image != DefaultImage {
+					t.Errorf("expected the default image, got %v", spec.Container)
+				}
+			},
+		},
+		{
+			name: "image set",
+			spec: CloudflareTunnelSpec{Container: &CloudflareTunnelContainer{Name: "tunnel", Image: "mirror/cloudflared:2022.6.0"}},
+			check: func(t *testing.T, spec CloudflareTunnelSpec) {
+				if spec.Container.Image != "mirror/cloudflared:2022.6.0" || spec.Container.Name != "tunnel" {
+					t.Errorf("expected the container to be kept, got %v", spec.Container)
+				}
+			},
+		},
+		{
+			name: "external tunnel",
+			spec: CloudflareTunnelSpec{DNSOnly: true, TunnelID: "tunnel-id"},
+			check: func(t *testing.T, spec CloudflareTunnelSpec) {
+				if spec.Replicas != 0 || spec.Container != nil {
+					t.Errorf("expected no deployment fields to be defaulted, got %d replicas and %v", spec.Replicas, spec.Container)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tunnel := &CloudflareTunnel{Spec: tt.spec}
+			tunnel.Default()
+			tt.check(t, tunnel.Spec)
+		})
+	}
+}
@@ -22,6 +22,8 @@ limitations under the License.
 package v1alpha2
 
 import (
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -81,6 +83,16 @@ func (in *CloudflareTunnelContainer) DeepCopyInto(out *CloudflareTunnelContainer
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.Resources != nil {
+		in, out := &in.Resources, &out.Resources
+		*out = new(v1.ResourceRequirements)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SecurityContext != nil {
+		in, out := &in.SecurityContext, &out.SecurityContext
+		*out = new(v1.SecurityContext)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CloudflareTunnelContainer.
@@ -93,6 +105,37 @@ func (in *CloudflareTunnelContainer) DeepCopy() *CloudflareTunnelContainer {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CloudflareTunnelFiles) DeepCopyInto(out *CloudflareTunnelFiles) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CloudflareTunnelFiles.
+func (in *CloudflareTunnelFiles) DeepCopy() *CloudflareTunnelFiles {
+	if in == nil {
+		return nil
+	}
+	out := new(CloudflareTunnelFiles)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CloudflareTunnelIngressRule) DeepCopyInto(out *CloudflareTunnelIngressRule) {
+	*out = *in
+	in.Service.DeepCopyInto(&out.Service)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CloudflareTunnelIngressRule.
+func (in *CloudflareTunnelIngressRule) DeepCopy() *CloudflareTunnelIngressRule {
+	if in == nil {
+		return nil
+	}
+	out := new(CloudflareTunnelIngressRule)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CloudflareTunnelList) DeepCopyInto(out *CloudflareTunnelList) {
 	*out = *in
@@ -125,9 +168,127 @@ func (in *CloudflareTunnelList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CloudflareTunnelLivenessProbe) DeepCopyInto(out *CloudflareTunnelLivenessProbe) {
+	*out = *in
+	if in.Enabled != nil {
+		in, out := &in.Enabled, &out.Enabled
+		*out = new(bool)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CloudflareTunnelLivenessProbe.
+func (in *CloudflareTunnelLivenessProbe) DeepCopy() *CloudflareTunnelLivenessProbe {
+	if in == nil {
+		return nil
+	}
+	out := new(CloudflareTunnelLivenessProbe)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CloudflareTunnelLoadBalancer) DeepCopyInto(out *CloudflareTunnelLoadBalancer) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CloudflareTunnelLoadBalancer.
+func (in *CloudflareTunnelLoadBalancer) DeepCopy() *CloudflareTunnelLoadBalancer {
+	if in == nil {
+		return nil
+	}
+	out := new(CloudflareTunnelLoadBalancer)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CloudflareTunnelMetrics) DeepCopyInto(out *CloudflareTunnelMetrics) {
+	*out = *in
+	if in.Labels != nil {
+		in, out := &in.Labels, &out.Labels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CloudflareTunnelMetrics.
+func (in *CloudflareTunnelMetrics) DeepCopy() *CloudflareTunnelMetrics {
+	if in == nil {
+		return nil
+	}
+	out := new(CloudflareTunnelMetrics)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CloudflareTunnelReadinessProbe) DeepCopyInto(out *CloudflareTunnelReadinessProbe) {
+	*out = *in
+	if in.Enabled != nil {
+		in, out := &in.Enabled, &out.Enabled
+		*out = new(bool)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CloudflareTunnelReadinessProbe.
+func (in *CloudflareTunnelReadinessProbe) DeepCopy() *CloudflareTunnelReadinessProbe {
+	if in == nil {
+		return nil
+	}
+	out := new(CloudflareTunnelReadinessProbe)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CloudflareTunnelReplicasFromEndpoints) DeepCopyInto(out *CloudflareTunnelReplicasFromEndpoints) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CloudflareTunnelReplicasFromEndpoints.
+func (in *CloudflareTunnelReplicasFromEndpoints) DeepCopy() *CloudflareTunnelReplicasFromEndpoints {
+	if in == nil {
+		return nil
+	}
+	out := new(CloudflareTunnelReplicasFromEndpoints)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CloudflareTunnelSecretStore) DeepCopyInto(out *CloudflareTunnelSecretStore) {
+	*out = *in
+	if in.Vault != nil {
+		in, out := &in.Vault, &out.Vault
+		*out = new(CloudflareTunnelVaultStore)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CloudflareTunnelSecretStore.
+func (in *CloudflareTunnelSecretStore) DeepCopy() *CloudflareTunnelSecretStore {
+	if in == nil {
+		return nil
+	}
+	out := new(CloudflareTunnelSecretStore)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CloudflareTunnelService) DeepCopyInto(out *CloudflareTunnelService) {
 	*out = *in
+	out.Port = in.Port
+	if in.Socket != nil {
+		in, out := &in.Socket, &out.Socket
+		*out = new(CloudflareTunnelServiceSocket)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.OriginRequest != nil {
 		in, out := &in.OriginRequest, &out.OriginRequest
 		*out = make([]*CloudflareTunnelServiceOriginRequest, len(*in))
@@ -139,6 +300,21 @@ func (in *CloudflareTunnelService) DeepCopyInto(out *CloudflareTunnelService) {
 			}
 		}
 	}
+	if in.Proxy != nil {
+		in, out := &in.Proxy, &out.Proxy
+		*out = new(CloudflareTunnelServiceProxy)
+		**out = **in
+	}
+	if in.Timeouts != nil {
+		in, out := &in.Timeouts, &out.Timeouts
+		*out = new(CloudflareTunnelServiceTimeouts)
+		**out = **in
+	}
+	if in.Retries != nil {
+		in, out := &in.Retries, &out.Retries
+		*out = new(int32)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CloudflareTunnelService.
@@ -166,6 +342,52 @@ func (in *CloudflareTunnelServiceOriginRequest) DeepCopy() *CloudflareTunnelServ
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CloudflareTunnelServiceProxy) DeepCopyInto(out *CloudflareTunnelServiceProxy) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CloudflareTunnelServiceProxy.
+func (in *CloudflareTunnelServiceProxy) DeepCopy() *CloudflareTunnelServiceProxy {
+	if in == nil {
+		return nil
+	}
+	out := new(CloudflareTunnelServiceProxy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CloudflareTunnelServiceSocket) DeepCopyInto(out *CloudflareTunnelServiceSocket) {
+	*out = *in
+	in.Volume.DeepCopyInto(&out.Volume)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CloudflareTunnelServiceSocket.
+func (in *CloudflareTunnelServiceSocket) DeepCopy() *CloudflareTunnelServiceSocket {
+	if in == nil {
+		return nil
+	}
+	out := new(CloudflareTunnelServiceSocket)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CloudflareTunnelServiceTimeouts) DeepCopyInto(out *CloudflareTunnelServiceTimeouts) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CloudflareTunnelServiceTimeouts.
+func (in *CloudflareTunnelServiceTimeouts) DeepCopy() *CloudflareTunnelServiceTimeouts {
+	if in == nil {
+		return nil
+	}
+	out := new(CloudflareTunnelServiceTimeouts)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CloudflareTunnelSpec) DeepCopyInto(out *CloudflareTunnelSpec) {
 	*out = *in
@@ -174,11 +396,119 @@ func (in *CloudflareTunnelSpec) DeepCopyInto(out *CloudflareTunnelSpec) {
 		*out = new(CloudflareTunnelService)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.Ingress != nil {
+		in, out := &in.Ingress, &out.Ingress
+		*out = make([]CloudflareTunnelIngressRule, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	if in.Container != nil {
 		in, out := &in.Container, &out.Container
 		*out = new(CloudflareTunnelContainer)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.ManageDeployment != nil {
+		in, out := &in.ManageDeployment, &out.ManageDeployment
+		*out = new(bool)
+		**out = **in
+	}
+	if in.ManageDNS != nil {
+		in, out := &in.ManageDNS, &out.ManageDNS
+		*out = new(bool)
+		**out = **in
+	}
+	if in.DNSProxied != nil {
+		in, out := &in.DNSProxied, &out.DNSProxied
+		*out = new(bool)
+		**out = **in
+	}
+	if in.DNSTTL != nil {
+		in, out := &in.DNSTTL, &out.DNSTTL
+		*out = new(int)
+		**out = **in
+	}
+	if in.PodLabels != nil {
+		in, out := &in.PodLabels, &out.PodLabels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.AutomountServiceAccountToken != nil {
+		in, out := &in.AutomountServiceAccountToken, &out.AutomountServiceAccountToken
+		*out = new(bool)
+		**out = **in
+	}
+	if in.ImagePullSecrets != nil {
+		in, out := &in.ImagePullSecrets, &out.ImagePullSecrets
+		*out = make([]v1.LocalObjectReference, len(*in))
+		copy(*out, *in)
+	}
+	if in.SecretStore != nil {
+		in, out := &in.SecretStore, &out.SecretStore
+		*out = new(CloudflareTunnelSecretStore)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ReplicasFromEndpoints != nil {
+		in, out := &in.ReplicasFromEndpoints, &out.ReplicasFromEndpoints
+		*out = new(CloudflareTunnelReplicasFromEndpoints)
+		**out = **in
+	}
+	if in.LivenessProbe != nil {
+		in, out := &in.LivenessProbe, &out.LivenessProbe
+		*out = new(CloudflareTunnelLivenessProbe)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ReadinessProbe != nil {
+		in, out := &in.ReadinessProbe, &out.ReadinessProbe
+		*out = new(CloudflareTunnelReadinessProbe)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.NodeSelector != nil {
+		in, out := &in.NodeSelector, &out.NodeSelector
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Tolerations != nil {
+		in, out := &in.Tolerations, &out.Tolerations
+		*out = make([]v1.Toleration, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Affinity != nil {
+		in, out := &in.Affinity, &out.Affinity
+		*out = new(v1.Affinity)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.GracePeriodSeconds != nil {
+		in, out := &in.GracePeriodSeconds, &out.GracePeriodSeconds
+		*out = new(int32)
+		**out = **in
+	}
+	if in.Metrics != nil {
+		in, out := &in.Metrics, &out.Metrics
+		*out = new(CloudflareTunnelMetrics)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Files != nil {
+		in, out := &in.Files, &out.Files
+		*out = new(CloudflareTunnelFiles)
+		**out = **in
+	}
+	if in.TokenRefreshInterval != nil {
+		in, out := &in.TokenRefreshInterval, &out.TokenRefreshInterval
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.LoadBalancer != nil {
+		in, out := &in.LoadBalancer, &out.LoadBalancer
+		*out = new(CloudflareTunnelLoadBalancer)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CloudflareTunnelSpec.
@@ -201,6 +531,27 @@ func (in *CloudflareTunnelStatus) DeepCopyInto(out *CloudflareTunnelStatus) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.ConnectorIDs != nil {
+		in, out := &in.ConnectorIDs, &out.ConnectorIDs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]metav1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.LastTokenRefresh != nil {
+		in, out := &in.LastTokenRefresh, &out.LastTokenRefresh
+		*out = (*in).DeepCopy()
+	}
+	if in.IngressZones != nil {
+		in, out := &in.IngressZones, &out.IngressZones
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CloudflareTunnelStatus.
@@ -212,3 +563,18 @@ func (in *CloudflareTunnelStatus) DeepCopy() *CloudflareTunnelStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CloudflareTunnelVaultStore) DeepCopyInto(out *CloudflareTunnelVaultStore) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CloudflareTunnelVaultStore.
+func (in *CloudflareTunnelVaultStore) DeepCopy() *CloudflareTunnelVaultStore {
+	if in == nil {
+		return nil
+	}
+	out := new(CloudflareTunnelVaultStore)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -104,6 +104,7 @@ https://example.sayakm.me
 | image.repository          | string | `"ghcr.io/beezlabs-org/cloudflare-tunnel-operator"` | The image of the operator              |
 | image.pullPolicy          | string | `"IfNotPresent`                                     | The image pull policy for the operator |
 | image.tag                 | string | `"v0.1.0"`                                          | The image tag ofe the operator         |
+| cloudflareAPIBaseURL      | string | `""`                                                | The base URL of the Cloudflare API, the production one if empty |
 
 Current values file [here](https://github.com/beezlabs-org/cloudflare-tunnel-operator/blob/main/charts/values.yaml)
 
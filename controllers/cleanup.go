@@ -0,0 +1,315 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/cloudflare/cloudflare-go"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	cfv2 "github.com/beezlabs-org/cloudflare-tunnel-operator/api/v1alpha2"
+	"github.com/beezlabs-org/cloudflare-tunnel-operator/controllers/constants"
+)
+
+// managedResourceTypes lists the kinds of all the resources that can be created for a CloudflareTunnel,
+// including the ones only created by optional features. New kinds have to be added here to be cleaned up.
+func managedResourceTypes() []client.Object {
+	return []client.Object{
+		&appsv1.Deployment{},
+		&corev1.ConfigMap{},
+		&corev1.Secret{},
+		&corev1.Service{},
+	}
+}
+
+// finalize removes everything created for the resource being deleted and then releases it
+func (r *CloudflareTunnelReconciler) finalize(ctx context.Context, cloudflareTunnel *cfv2.CloudflareTunnel) (ctrl.Result, error) {
+	if !controllerutil.ContainsFinalizer(cloudflareTunnel, constants.Finalizer) {
+		return ctrl.Result{}, nil
+	}
+	r.logger.Info("Resource is being deleted, cleaning up...")
+	// the deployment is deleted first so that the connections of the tunnel are closed before it is deleted
+	if err := r.deleteManagedResources(ctx, cloudflareTunnel); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := r.cleanupRemote(ctx, cloudflareTunnel); err != nil {
+		var waiting *waitingError
+		if errors.As(err, &waiting) {
+			// the status reports the Deleting phase along with the reason of the wait
+			return r.handleError(ctx, cloudflareTunnel, waiting)
+		}
+		return ctrl.Result{}, err
+	}
+	controllerutil.RemoveFinalizer(cloudflareTunnel, constants.Finalizer)
+	if err := r.Client.Update(ctx, cloudflareTunnel); err != nil {
+		r.logger.Error(err, "could not remove finalizer")
+		return ctrl.Result{}, err
+	}
+	tunnelReadiness.forget(client.ObjectKeyFromObject(cloudflareTunnel))
+	return ctrl.Result{}, nil
+}
+
+// cleanupRemote removes the tunnel, its DNS records and its origin in the load balancer pool from the remote.
+// Anything that is already gone, e.g. because it has been deleted in the dashboard, is treated as removed.
+func (r *CloudflareTunnelReconciler) cleanupRemote(ctx context.Context, cloudflareTunnel *cfv2.CloudflareTunnel) error {
+	if cloudflareTunnel.Status.TunnelID == "" {
+		return nil
+	}
+	ctx, cancel := r.remoteContext(ctx)
+	defer cancel()
+	r.TunEx = &TunnelExpanded{
+		Resource:     cloudflareTunnel,
+		TunSpec:      cloudflareTunnel.Spec,
+		Name:         cloudflareTunnel.Name,
+		Namespace:    cloudflareTunnel.Namespace,
+		UID:          cloudflareTunnel.UID,
+		TunnelID:     cloudflareTunnel.Status.TunnelID,
+		DNSRecordID:  cloudflareTunnel.Status.DNSRecordID,
+		IngressZones: cloudflareTunnel.Status.IngressZones,
+	}
+	if err := r.fetchDecodeSecret(ctx); err != nil {
+		if apierrors.IsNotFound(err) {
+			// the deletion must not be blocked forever, e.g. when the whole namespace is being deleted
+			r.logger.Info("Token secret not found, the remote resources have to be removed manually", "tunnelID", r.TunEx.TunnelID)
+			return nil
+		}
+		return err
+	}
+	cf, err := r.cloudflareClient(r.TunEx.AccountToken, r.TunEx.AccountEmail, r.TunEx.AccountTag)
+	if err != nil {
+		r.logger.Error(err, "could not create cloudflare instance")
+		return err
+	}
+	r.TunEx.CloudflareAPI = cf
+	if dnsManaged(r.TunEx.TunSpec) {
+		if err := r.detectZone(ctx, cloudflareTunnel.Status); err != nil {
+			return err
+		}
+		if r.TunEx.TunSpec.LoadBalancer != nil {
+			if err := r.removeLoadBalancerOrigin(ctx); err != nil {
+				return err
+			}
+		}
+		if err := r.deleteDNSRecords(ctx); err != nil {
+			return err
+		}
+	}
+	if r.TunEx.TunSpec.DNSOnly {
+		// the tunnel is managed outside of the operator
+		return nil
+	}
+	return r.deleteTunnelRemote(ctx)
+}
+
+// deleteDNSRecords deletes the CNAME records of the resource. The record stored in the status is deleted directly,
+// it is only looked up by owner and by name if it is gone. Records which do not point to the tunnel are kept, as they
+// have been changed or created by hand.
+func (r *CloudflareTunnelReconciler) deleteDNSRecords(ctx context.Context) error {
+	zoneID, err := r.zoneID(ctx)
+	if err != nil {
+		return err
+	}
+	records, err := r.tunnelDNSRecords(ctx, zoneID)
+	if err != nil {
+		return err
+	}
+	if err := r.deleteRecordsPointingToTunnel(ctx, zoneID, records); err != nil {
+		return err
+	}
+	// the records of the ingress hostnames may live in other zones, including the ones of removed hostnames
+	zones := map[string][]string{}
+	if len(r.TunEx.TunSpec.Ingress) != 0 {
+		if zones, _, err = r.ingressZones(ctx); err != nil {
+			return err
+		}
+	}
+	for _, zone := range r.TunEx.IngressZones {
+		zones[zone] = nil
+	}
+	for zone := range zones {
+		if zone == normalizeZone(r.TunEx.TunSpec.Zone) {
+			continue
+		}
+		zoneID, err := r.zoneIDByName(ctx, zone)
+		if err != nil {
+			return err
+		}
+		owned, err := r.listOwnedDNSRecords(ctx, zoneID)
+		if err != nil {
+			r.logger.Error(err, "could not fetch owned dns list")
+			return err
+		}
+		records := []cloudflare.DNSRecord{}
+		for _, record := range owned {
+			records = append(records, record.DNSRecord)
+		}
+		if err := r.deleteRecordsPointingToTunnel(ctx, zoneID, records); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteRecordsPointingToTunnel deletes the records whose target is the tunnel, the others are left untouched
+func (r *CloudflareTunnelReconciler) deleteRecordsPointingToTunnel(ctx context.Context, zoneID string, records []cloudflare.DNSRecord) error {
+	target := r.TunEx.TunnelID + constants.CNAMESuffix
+	for _, record := range records {
+		if !strings.EqualFold(record.Content, target) {
+			r.logger.Info("Keeping DNS record which does not point to the tunnel", "name", record.Name, "content", record.Content)
+			continue
+		}
+		if err := r.TunEx.CloudflareAPI.DeleteDNSRecord(ctx, zoneID, record.ID); err != nil {
+			if isNotFound(err) {
+				r.logger.V(1).Info("DNS record already deleted", "name", record.Name)
+				continue
+			}
+			r.logger.Error(err, "could not delete DNS record")
+			return err
+		}
+		r.logger.Info("DNS record deleted", "name", record.Name)
+	}
+	return nil
+}
+
+// tunnelDNSRecords returns the CNAME records which might have been created for the resource
+func (r *CloudflareTunnelReconciler) tunnelDNSRecords(ctx context.Context, zoneID string) ([]cloudflare.DNSRecord, error) {
+	// the records of the ingress hostnames are only found through the owned ones
+	if r.TunEx.DNSRecordID != "" && len(r.TunEx.TunSpec.Ingress) == 0 {
+		record, err := r.TunEx.CloudflareAPI.DNSRecord(ctx, zoneID, r.TunEx.DNSRecordID)
+		if err == nil {
+			return []cloudflare.DNSRecord{record}, nil
+		}
+		if !isNotFound(err) {
+			r.logger.Error(err, "could not fetch DNS record")
+			return nil, err
+		}
+	}
+
+	owned, err := r.listOwnedDNSRecords(ctx, zoneID)
+	if err != nil {
+		r.logger.Error(err, "could not fetch owned dns list")
+		return nil, err
+	}
+	records := []cloudflare.DNSRecord{}
+	for _, record := range owned {
+		records = append(records, record.DNSRecord)
+	}
+	if len(records) != 0 {
+		return records, nil
+	}
+
+	// records created before they were marked as owned can only be found by name
+	spec := r.TunEx.TunSpec
+	spec.Domain, err = normalizeDomain(spec.Domain)
+	name := ""
+	if err == nil {
+		name, err = validateDNSRecordName(spec)
+	}
+	if err != nil {
+		r.logger.Info("Invalid DNS record name, not looking up the record by name", "error", err.Error())
+		return nil, nil
+	}
+	records, err = r.TunEx.CloudflareAPI.DNSRecords(ctx, zoneID, cloudflare.DNSRecord{Type: "CNAME", Name: name})
+	if err != nil {
+		r.logger.Error(err, "could not fetch dns list")
+		return nil, err
+	}
+	return records, nil
+}
+
+// deleteTunnelRemote deletes the tunnel from the remote. The remote refuses to delete a tunnel with active connections,
+// so it waits until the pods of the deleted deployment have shut down. The cloudflared run outside of the operator
+// is not stopped along with the resource, so its connections are dropped instead of waiting for them forever.
+func (r *CloudflareTunnelReconciler) deleteTunnelRemote(ctx context.Context) error {
+	accountResourceContainer := cloudflare.AccountIdentifier(r.TunEx.AccountTag)
+	connectors, err := r.TunEx.CloudflareAPI.TunnelConnections(ctx, accountResourceContainer, r.TunEx.TunnelID)
+	if err != nil && !isNotFound(err) {
+		r.logger.Error(err, "could not fetch tunnel connections")
+		return err
+	}
+	connected := false
+	for _, connector := range connectors {
+		connected = connected || len(connector.Connections) != 0
+	}
+	if connected && deploymentManaged(r.TunEx.TunSpec) {
+		return &waitingError{
+			Reason:  "WaitingForDisconnect",
+			Message: "the tunnel still has active connections",
+		}
+	}
+	if connected {
+		r.logger.Info("Dropping the connections of the unmanaged cloudflared", "tunnelID", r.TunEx.TunnelID)
+		if err := r.TunEx.CloudflareAPI.CleanupTunnelConnections(ctx, accountResourceContainer, r.TunEx.TunnelID); err != nil && !isNotFound(err) {
+			r.logger.Error(err, "could not clean up the tunnel connections")
+			return err
+		}
+	}
+	if err := r.TunEx.CloudflareAPI.DeleteTunnel(ctx, accountResourceContainer, r.TunEx.TunnelID); err != nil {
+		if isNotFound(err) {
+			r.logger.Info("Tunnel already deleted", "tunnelID", r.TunEx.TunnelID)
+			return nil
+		}
+		r.logger.Error(err, "could not delete the tunnel")
+		return err
+	}
+	r.logger.Info("Tunnel deleted", "tunnelID", r.TunEx.TunnelID)
+	r.recordTunnelEvent(corev1.EventTypeNormal, "TunnelDeleted", "Deleted tunnel with ID "+r.TunEx.TunnelID)
+	return nil
+}
+
+// isNotFound reports whether err has been caused by the requested item not existing in the remote
+func isNotFound(err error) bool {
+	var notFound *cloudflare.NotFoundError
+	return errors.As(err, &notFound) || hasStatus(err, http.StatusNotFound)
+}
+
+// deleteManagedResources deletes the resources labeled with the UID of the given resource.
+// Selecting them by label instead of by name ensures nothing is missed, whichever features created them.
+func (r *CloudflareTunnelReconciler) deleteManagedResources(ctx context.Context, cloudflareTunnel *cfv2.CloudflareTunnel) error {
+	selector := client.MatchingLabels{constants.InstanceLabel: string(cloudflareTunnel.UID)}
+	for _, obj := range managedResourceTypes() {
+		if err := r.Client.DeleteAllOf(ctx, obj, client.InNamespace(cloudflareTunnel.Namespace), selector); err != nil {
+			r.logger.Error(err, "could not delete managed resources", "kind", fmt.Sprintf("%T", obj))
+			return err
+		}
+	}
+	r.logger.V(1).Info("Managed resources deleted")
+	return nil
+}
+
+// addFinalizer ensures the resource cannot be removed before its managed resources have been cleaned up
+func (r *CloudflareTunnelReconciler) addFinalizer(ctx context.Context, cloudflareTunnel *cfv2.CloudflareTunnel) error {
+	if controllerutil.ContainsFinalizer(cloudflareTunnel, constants.Finalizer) {
+		return nil
+	}
+	controllerutil.AddFinalizer(cloudflareTunnel, constants.Finalizer)
+	if err := r.Client.Update(ctx, cloudflareTunnel); err != nil {
+		r.logger.Error(err, "could not add finalizer")
+		return err
+	}
+	return nil
+}
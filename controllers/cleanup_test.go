@@ -0,0 +1,270 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cfv2 "github.com/beezlabs-org/cloudflare-tunnel-operator/api/v1alpha2"
+	"github.com/beezlabs-org/cloudflare-tunnel-operator/controllers/constants"
+	"github.com/beezlabs-org/cloudflare-tunnel-operator/controllers/models"
+	cfclient "github.com/beezlabs-org/cloudflare-tunnel-operator/internal/cloudflare"
+)
+
+func TestReconcileDeletesLabeledResources(t *testing.T) {
+	now := metav1.Now()
+	tunnel := newTestTunnel("default")
+	tunnel.UID = "3c1b7a52-0d6f-4c4e-9a39-0c2f5c1e7d10"
+	tunnel.DeletionTimestamp = &now
+	tunnel.Finalizers = []string{constants.Finalizer}
+
+	owned := []client.Object{
+		models.Deployment(models.DeploymentModel{Name: "tunnel", Namespace: "default", OwnerUID: string(tunnel.UID)}).GetDeployment(),
+		// created by the optional metrics service feature
+		models.MetricsService(models.MetricsServiceModel{Name: "tunnel", Namespace: "default", OwnerUID: string(tunnel.UID)}).GetService(),
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "tunnel-cf-tunnel", Namespace: "default", Labels: map[string]string{constants.InstanceLabel: string(tunnel.UID)}}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "tunnel-cf-tunnel", Namespace: "default", Labels: map[string]string{constants.InstanceLabel: string(tunnel.UID)}}},
+	}
+	foreign := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "other-cf-tunnel", Namespace: "default", Labels: map[string]string{constants.InstanceLabel: "other-uid"}}}
+	r := newTestReconciler(append(owned, tunnel, foreign)...)
+
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{
+		NamespacedName: types.NamespacedName{Name: "tunnel", Namespace: "default"},
+	}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	for _, obj := range owned {
+		err := r.Client.Get(context.Background(), client.ObjectKeyFromObject(obj), obj)
+		if !errors.IsNotFound(err) {
+			t.Errorf("expected %T %s to be deleted, got %v", obj, obj.GetName(), err)
+		}
+	}
+	if err := r.Client.Get(context.Background(), client.ObjectKeyFromObject(foreign), foreign); err != nil {
+		t.Errorf("expected the resources of another tunnel to be kept, got %v", err)
+	}
+	var fetched cfv2.CloudflareTunnel
+	if err := r.Client.Get(context.Background(), client.ObjectKeyFromObject(tunnel), &fetched); err == nil && len(fetched.Finalizers) != 0 {
+		t.Errorf("expected the finalizer to be removed, got %v", fetched.Finalizers)
+	}
+}
+
+func TestReconcileDeletionRemovesRemote(t *testing.T) {
+	tests := []struct {
+		name          string
+		remoteExists  bool
+		deleteErr     error
+		wantFinalizer bool
+	}{
+		{name: "exists", remoteExists: true},
+		// the tunnel and record have already been deleted in the dashboard
+		{name: "already deleted", remoteExists: false},
+		{name: "failure", remoteExists: true, deleteErr: fmt.Errorf("failure"), wantFinalizer: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote := cfclient.NewFake("example.com")
+			zoneID := remote.Zones["example.com"]
+			if tt.remoteExists {
+				remote.TunnelList = []cloudflare.Tunnel{{ID: "tunnel-id", Name: "tunnel"}}
+				remote.Records[zoneID] = []cfclient.CommentedDNSRecord{
+					{DNSRecord: cloudflare.DNSRecord{ID: "record", Type: "CNAME", Name: "app.example.com", Content: "tunnel-id.cfargotunnel.com"}, Comment: dnsRecordComment("uid")},
+				}
+			}
+			if tt.deleteErr != nil {
+				remote.Errors = map[string]error{"DeleteTunnel": tt.deleteErr}
+			}
+			now := metav1.Now()
+			tunnel := newTestTunnel("default")
+			tunnel.UID = "uid"
+			tunnel.DeletionTimestamp = &now
+			tunnel.Finalizers = []string{constants.Finalizer}
+			tunnel.Status.TunnelID = "tunnel-id"
+			tunnel.Status.DNSRecordID = "record"
+			r := newReconcileFixture(remote, tunnel)
+
+			_, err := r.Reconcile(context.Background(), ctrl.Request{
+				NamespacedName: types.NamespacedName{Name: "tunnel", Namespace: "default"},
+			})
+			if (err != nil) != tt.wantFinalizer {
+				t.Fatalf("expected error %v, got %v", tt.wantFinalizer, err)
+			}
+			if len(remote.Records[zoneID]) != 0 {
+				t.Errorf("expected the DNS record to be deleted, got %v", remote.Records[zoneID])
+			}
+			if !tt.wantFinalizer && len(remote.TunnelList) != 0 {
+				t.Errorf("expected the tunnel to be deleted, got %v", remote.TunnelList)
+			}
+			var fetched cfv2.CloudflareTunnel
+			if err := r.Client.Get(context.Background(), client.ObjectKeyFromObject(tunnel), &fetched); err != nil {
+				if !errors.IsNotFound(err) {
+					t.Fatalf("could not fetch tunnel: %v", err)
+				}
+				fetched.Finalizers = nil
+			}
+			if hasFinalizer := len(fetched.Finalizers) != 0; hasFinalizer != tt.wantFinalizer {
+				t.Errorf("expected the finalizer to be kept %v, got %v", tt.wantFinalizer, fetched.Finalizers)
+			}
+		})
+	}
+}
+
+func TestReconcileDeletionWaitsForDisconnect(t *testing.T) {
+	remote := cfclient.NewFake("example.com")
+	remote.TunnelList = []cloudflare.Tunnel{{ID: "tunnel-id", Name: "tunnel"}}
+	// the pods of the deleted deployment are still shutting down
+	remote.Connections = map[string][]cloudflare.Connection{
+		"tunnel-id": {{ID: "connector", Connections: []cloudflare.TunnelConnection{{ColoName: "ams01"}}}},
+	}
+	now := metav1.Now()
+	tunnel := newTestTunnel("default")
+	tunnel.DeletionTimestamp = &now
+	tunnel.Finalizers = []string{constants.Finalizer}
+	tunnel.Status.TunnelID = "tunnel-id"
+	r := newReconcileFixture(remote, tunnel)
+	request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "tunnel", Namespace: "default"}}
+
+	result, err := r.Reconcile(context.Background(), request)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if result.RequeueAfter != constants.WaitingRequeueInterval {
+		t.Errorf("expected a requeue after %s, got %v", constants.WaitingRequeueInterval, result)
+	}
+	if len(remote.TunnelList) != 1 {
+		t.Errorf("expected the connected tunnel to be kept, got %v", remote.TunnelList)
+	}
+	var fetched cfv2.CloudflareTunnel
+	if err := r.Client.Get(context.Background(), client.ObjectKeyFromObject(tunnel), &fetched); err != nil || len(fetched.Finalizers) == 0 {
+		t.Fatalf("expected the finalizer to be kept, got %v and %v", fetched.Finalizers, err)
+	}
+	if fetched.Status.Phase != cfv2.PhaseDeleting {
+		t.Errorf("expected the phase %s while waiting, got %s", cfv2.PhaseDeleting, fetched.Status.Phase)
+	}
+	if ready := meta.FindStatusCondition(fetched.Status.Conditions, cfv2.ConditionReady); ready == nil || ready.Reason != "WaitingForDisconnect" {
+		t.Errorf("expected the Ready condition to report the wait, got %v", ready)
+	}
+
+	remote.Connections = nil
+	if _, err := r.Reconcile(context.Background(), request); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(remote.TunnelList) != 0 {
+		t.Errorf("expected the tunnel to be deleted once disconnected, got %v", remote.TunnelList)
+	}
+}
+
+func TestReconcileDeletionUnmanagedDeployment(t *testing.T) {
+	remote := cfclient.NewFake("example.com")
+	remote.TunnelList = []cloudflare.Tunnel{{ID: "tunnel-id", Name: "tunnel"}}
+	// the cloudflared run outside of the operator keeps running after the resource is deleted
+	remote.Connections = map[string][]cloudflare.Connection{
+		"tunnel-id": {{ID: "connector", Connections: []cloudflare.TunnelConnection{{ColoName: "ams01"}}}},
+	}
+	now := metav1.Now()
+	manage := false
+	tunnel := newTestTunnel("default")
+	tunnel.Spec.ManageDeployment = &manage
+	tunnel.DeletionTimestamp = &now
+	tunnel.Finalizers = []string{constants.Finalizer}
+	tunnel.Status.TunnelID = "tunnel-id"
+	r := newReconcileFixture(remote, tunnel)
+	request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "tunnel", Namespace: "default"}}
+
+	result, err := r.Reconcile(context.Background(), request)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if result.RequeueAfter != 0 {
+		t.Errorf("expected no requeue, got %v", result)
+	}
+	if len(remote.TunnelList) != 0 {
+		t.Errorf("expected the tunnel to be deleted without waiting for the external cloudflared, got %v", remote.TunnelList)
+	}
+	if len(remote.Connections["tunnel-id"]) != 0 {
+		t.Errorf("expected the connections to be cleaned up, got %v", remote.Connections)
+	}
+}
+
+func TestDeleteDNSRecordsPointingToTunnel(t *testing.T) {
+	tests := []struct {
+		name        string
+		recordID    string
+		record      cfclient.CommentedDNSRecord
+		wantDeleted bool
+	}{
+		{
+			name:        "stored",
+			recordID:    "record",
+			record:      cfclient.CommentedDNSRecord{DNSRecord: cloudflare.DNSRecord{ID: "record", Type: "CNAME", Name: "app.example.com", Content: "tunnel-id.cfargotunnel.com"}},
+			wantDeleted: true,
+		},
+		{
+			name:        "found by name",
+			record:      cfclient.CommentedDNSRecord{DNSRecord: cloudflare.DNSRecord{ID: "record", Type: "CNAME", Name: "app.example.com", Content: "tunnel-id.cfargotunnel.com"}},
+			wantDeleted: true,
+		},
+		{
+			name:   "created by hand",
+			record: cfclient.CommentedDNSRecord{DNSRecord: cloudflare.DNSRecord{ID: "record", Type: "CNAME", Name: "app.example.com", Content: "origin.example.net"}},
+		},
+		{
+			name:     "changed by hand",
+			recordID: "record",
+			record:   cfclient.CommentedDNSRecord{DNSRecord: cloudflare.DNSRecord{ID: "record", Type: "CNAME", Name: "app.example.com", Content: "origin.example.net"}, Comment: dnsRecordComment("uid")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote := cfclient.NewFake("example.com")
+			zoneID := remote.Zones["example.com"]
+			remote.Records[zoneID] = []cfclient.CommentedDNSRecord{tt.record}
+			tunnel := newTestTunnel("default")
+			r := newTestReconciler(tunnel)
+			logger := logr.Discard()
+			r.logger = &logger
+			r.TunEx = &TunnelExpanded{CloudflareAPI: remote, TunSpec: tunnel.Spec, TunnelID: "tunnel-id", UID: "uid", DNSRecordID: tt.recordID}
+
+			if err := r.deleteDNSRecords(context.Background()); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if deleted := len(remote.Records[zoneID]) == 0; deleted != tt.wantDeleted {
+				t.Errorf("expected the record to be deleted %v, got %v", tt.wantDeleted, remote.Records[zoneID])
+			}
+			if tt.recordID != "" {
+				for _, call := range remote.Calls {
+					if call == "DNSRecordsByComment" || call == "DNSRecords" {
+						t.Errorf("expected the stored record not to be looked up, got calls %v", remote.Calls)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	cfclient "github.com/beezlabs-org/cloudflare-tunnel-operator/internal/cloudflare"
+)
+
+// ClientCache keeps the clients of the Cloudflare API across reconciles, so that their connections are reused
+// instead of being set up again on every reconcile. It is shared by the concurrent reconciles. The clients are
+// keyed by a hash of their token and their account, so a rotated token gets a new client while the client of the
+// previous token is dropped once it has not been used for the TTL.
+type ClientCache struct {
+	ttl     time.Duration
+	now     func() time.Time
+	mutex   sync.Mutex
+	entries map[clientKey]clientEntry
+}
+
+type clientKey struct {
+	token     [sha256.Size]byte
+	accountID string
+}
+
+type clientEntry struct {
+	client  cfclient.CloudflareClient
+	expires time.Time
+}
+
+// NewClientCache creates a cache keeping the clients for ttl after their last use, nothing is cached if ttl is not
+// positive
+func NewClientCache(ttl time.Duration) *ClientCache {
+	return &ClientCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: map[clientKey]clientEntry{},
+	}
+}
+
+// get returns the cached client of the token and account, calling create to create it if it is missing or expired.
+// Errors are not cached. A nil cache always calls create.
+func (c *ClientCache) get(token, accountID string, create func() (cfclient.CloudflareClient, error)) (cfclient.CloudflareClient, error) {
+	if c == nil || c.ttl <= 0 {
+		return create()
+	}
+	key := clientKey{token: sha256.Sum256([]byte(token)), accountID: accountID}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := c.now()
+	// the expired clients are dropped here, as the tokens they were created with might never be used again
+	for expiredKey, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, expiredKey)
+		}
+	}
+	entry, ok := c.entries[key]
+	if !ok {
+		// creating a client does not call the API, so it is fine to hold the lock
+		client, err := create()
+		if err != nil {
+			return nil, err
+		}
+		entry.client = client
+	}
+	entry.expires = now.Add(c.ttl)
+	c.entries[key] = entry
+	return entry.client, nil
+}
+
+// invalidate removes the clients of the given token
+func (c *ClientCache) invalidate(token string) {
+	if c == nil {
+		return
+	}
+	hash := sha256.Sum256([]byte(token))
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for key := range c.entries {
+		if key.token == hash {
+			delete(c.entries, key)
+		}
+	}
+}
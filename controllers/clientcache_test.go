@@ -0,0 +1,114 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cfclient "github.com/beezlabs-org/cloudflare-tunnel-operator/internal/cloudflare"
+)
+
+func TestClientCacheParallel(t *testing.T) {
+	cache := NewClientCache(time.Minute)
+	var creates int32
+	var wg sync.WaitGroup
+	clients := make([]cfclient.CloudflareClient, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client, err := cache.get(fmt.Sprintf("token-%d", i%4), "account", func() (cfclient.CloudflareClient, error) {
+				atomic.AddInt32(&creates, 1)
+				return cfclient.NewFake(), nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+			clients[i] = client
+		}(i)
+	}
+	wg.Wait()
+	if creates != 4 {
+		t.Errorf("expected a single client per token, got %d clients", creates)
+	}
+	for i := 4; i < 100; i++ {
+		if clients[i] != clients[i%4] {
+			t.Errorf("expected the client of token-%d to be reused", i%4)
+		}
+	}
+}
+
+func TestClientCacheExpiryAndInvalidation(t *testing.T) {
+	now := time.Now()
+	cache := NewClientCache(time.Minute)
+	cache.now = func() time.Time { return now }
+	creates := 0
+	create := func() (cfclient.CloudflareClient, error) {
+		creates++
+		return cfclient.NewFake(), nil
+	}
+
+	steps := []struct {
+		name        string
+		before      func()
+		token       string
+		accountID   string
+		wantCreates int
+	}{
+		{name: "miss", token: "token", accountID: "account", wantCreates: 1},
+		{name: "hit", token: "token", accountID: "account", wantCreates: 1},
+		{name: "used before expiring", before: func() { now = now.Add(50 * time.Second) }, token: "token", accountID: "account", wantCreates: 1},
+		{name: "used again before expiring", before: func() { now = now.Add(50 * time.Second) }, token: "token", accountID: "account", wantCreates: 1},
+		{name: "other account", token: "token", accountID: "other", wantCreates: 2},
+		{name: "rotated token", token: "rotated", accountID: "account", wantCreates: 3},
+		{name: "expired", before: func() { now = now.Add(2 * time.Minute) }, token: "token", accountID: "account", wantCreates: 4},
+		{name: "invalidated", before: func() { cache.invalidate("token") }, token: "token", accountID: "account", wantCreates: 5},
+	}
+	for _, step := range steps {
+		if step.before != nil {
+			step.before()
+		}
+		if _, err := cache.get(step.token, step.accountID, create); err != nil {
+			t.Fatalf("%s: expected no error, got %v", step.name, err)
+		}
+		if creates != step.wantCreates {
+			t.Errorf("%s: expected %d clients to be created, got %d", step.name, step.wantCreates, creates)
+		}
+	}
+	// the clients of the other account and the rotated token expired without being used
+	if len(cache.entries) != 1 {
+		t.Errorf("expected the expired clients to be dropped, got %d clients", len(cache.entries))
+	}
+
+	if _, err := cache.get("failing", "account", func() (cfclient.CloudflareClient, error) {
+		return nil, fmt.Errorf("failure")
+	}); err == nil {
+		t.Errorf("expected the error to be returned")
+	}
+	if _, err := cache.get("failing", "account", create); err != nil || creates != 6 {
+		t.Errorf("expected errors not to be cached, got %d clients created and %v", creates, err)
+	}
+
+	var disabled *ClientCache
+	if _, err := disabled.get("token", "account", create); err != nil || creates != 7 {
+		t.Errorf("expected a nil cache to always create a client, got %d clients created", creates)
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+	"golang.org/x/time/rate"
+
+	cfclient "github.com/beezlabs-org/cloudflare-tunnel-operator/internal/cloudflare"
+)
+
+// CloudflareAPIOptions configures how the clients of the Cloudflare API handle transient errors.
+// The zero value keeps the defaults of the client: 3 retries, backing off from 1 to 30 seconds.
+type CloudflareAPIOptions struct {
+	Retries       int           // retries of requests failing with a 429 or 5xx, applied with MaxRetryDelay
+	MinRetryDelay time.Duration // delay before the first retry, doubled on each retry with jitter
+	MaxRetryDelay time.Duration // upper bound of the delay between retries, longer Retry-After are requeued instead
+	Timeout       time.Duration // timeout of a single request
+	HTTPClient    *http.Client  // its transport sends the requests instead of the default one if set
+	BaseURL       string        // base URL of the API instead of the production one if set, e.g. for a mock server
+}
+
+// httpClient returns the HTTP client of the Cloudflare client matching the configuration, its requests waiting on
+// limiter if not nil
+func (o CloudflareAPIOptions) httpClient(limiter *rate.Limiter) *http.Client {
+	transport := &cfclient.RetryTransport{
+		Limiter:       limiter,
+		Retries:       3,
+		MinRetryDelay: time.Second,
+		MaxRetryDelay: 30 * time.Second,
+		Timeout:       o.Timeout,
+	}
+	if o.Retries > 0 || o.MaxRetryDelay > 0 {
+		transport.Retries = o.Retries
+		transport.MinRetryDelay = o.MinRetryDelay
+		transport.MaxRetryDelay = o.MaxRetryDelay
+	}
+	httpClient := &http.Client{Transport: transport}
+	if o.HTTPClient != nil {
+		injected := *o.HTTPClient
+		transport.Base = injected.Transport
+		injected.Transport = transport
+		httpClient = &injected
+	}
+	return httpClient
+}
+
+// clientOptions returns the options of the Cloudflare client sending its requests through httpClient
+func (o CloudflareAPIOptions) clientOptions(httpClient *http.Client) []cloudflare.Option {
+	opts := []cloudflare.Option{
+		// the transport retries and limits the requests instead of the client, which neither honors Retry-After nor
+		// shares its limit with the other clients of the account
+		cloudflare.UsingRetryPolicy(0, 0, 0),
+		cloudflare.UsingRateLimit(float64(rate.Inf)),
+		cloudflare.HTTPClient(httpClient),
+	}
+	if o.BaseURL != "" {
+		opts = append(opts, cloudflare.BaseURL(o.BaseURL))
+	}
+	return opts
+}
+
+// newCloudflareAPI creates a client of the Cloudflare API with the configured options. It is authenticated with the
+// token, or with it as the global API key of the user if email is set.
+func (r *CloudflareTunnelReconciler) newCloudflareAPI(token, email, accountID string) (*cfclient.API, error) {
+	httpClient := r.APIOptions.httpClient(r.Limiters.get(accountID))
+	opts := r.APIOptions.clientOptions(httpClient)
+	var api *cfclient.API
+	var err error
+	if email != "" {
+		api, err = cfclient.NewWithAPIKey(token, email, opts...)
+	} else {
+		api, err = cfclient.New(token, opts...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	api.AccountID = accountID
+	api.Client = httpClient
+	return api, nil
+}
+
+// cloudflareClient returns the client of the Cloudflare API used by the reconcile, reusing the cached one if any.
+// The clients are cached by token only, as a global API key belongs to a single user. The duration of its calls is
+// exported as a metric.
+func (r *CloudflareTunnelReconciler) cloudflareClient(token, email, accountID string) (cfclient.CloudflareClient, error) {
+	var client cfclient.CloudflareClient
+	var err error
+	if r.NewCloudflareClient != nil {
+		client, err = r.NewCloudflareClient(token, accountID)
+	} else {
+		client, err = r.Clients.get(token, accountID, func() (cfclient.CloudflareClient, error) {
+			return r.newCloudflareAPI(token, email, accountID)
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &cfclient.Instrumented{Client: client, Observe: observeAPIDuration}, nil
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestNewCloudflareAPIOptions(t *testing.T) {
+	tests := []struct {
+		name         string
+		retries      int
+		wantRequests int
+	}{
+		{name: "no retries", retries: 0, wantRequests: 1},
+		{name: "two retries", retries: 2, wantRequests: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := 0
+			httpClient := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				requests++
+				return &http.Response{
+					StatusCode: http.StatusServiceUnavailable,
+					Header:     http.Header{"Content-Type": []string{"application/json"}},
+					Body:       ioutil.NopCloser(strings.NewReader(`{"success":false,"errors":[],"messages":[],"result":null}`)),
+					Request:    req,
+				}, nil
+			})}
+			r := &CloudflareTunnelReconciler{APIOptions: CloudflareAPIOptions{
+				Retries:       tt.retries,
+				MaxRetryDelay: 1,
+				HTTPClient:    httpClient,
+			}}
+
+			api, err := r.newCloudflareAPI("token", "", "account")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := api.ZoneIDByName(context.Background(), "example.com"); err == nil {
+				t.Fatal("expected the request to fail")
+			}
+			if requests != tt.wantRequests {
+				t.Errorf("expected %d requests through the injected client, got %d", tt.wantRequests, requests)
+			}
+		})
+	}
+}
+
+func TestNewCloudflareAPIAuth(t *testing.T) {
+	tests := []struct {
+		name        string
+		email       string
+		wantHeaders map[string]string
+	}{
+		{name: "token", wantHeaders: map[string]string{"Authorization": "Bearer secret"}},
+		{
+			name:        "global API key",
+			email:       "user@example.com",
+			wantHeaders: map[string]string{"X-Auth-Key": "secret", "X-Auth-Email": "user@example.com", "Authorization": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var header http.Header
+			httpClient := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				header = req.Header
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{"Content-Type": []string{"application/json"}},
+					Body:       ioutil.NopCloser(strings.NewReader(`{"success":true,"errors":[],"messages":[],"result":[]}`)),
+					Request:    req,
+				}, nil
+			})}
+			r := &CloudflareTunnelReconciler{APIOptions: CloudflareAPIOptions{HTTPClient: httpClient}}
+
+			api, err := r.newCloudflareAPI("secret", tt.email, "account")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := api.ListZones(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			for key, want := range tt.wantHeaders {
+				if got := header.Get(key); got != want {
+					t.Errorf("expected header %s to be %q, got %q", key, want, got)
+				}
+			}
+
+			// the requests the client cannot send with a context go through the injected client as well
+			header = nil
+			if _, err := api.Tunnels(context.Background(), cloudflare.AccountIdentifier("account"), cloudflare.TunnelListParams{}); err != nil {
+				t.Fatal(err)
+			}
+			for key, want := range tt.wantHeaders {
+				if got := header.Get(key); got != want {
+					t.Errorf("expected header %s of the tunnels request to be %q, got %q", key, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestNewCloudflareAPIBaseURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		baseURL string
+		want    string
+	}{
+		{name: "default", want: "https://api.cloudflare.com/client/v4/zones"},
+		{name: "overridden", baseURL: "http://mock.local/client/v4", want: "http://mock.local/client/v4/zones"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requested string
+			httpClient := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				requested = req.URL.Scheme + "://" + req.URL.Host + req.URL.Path
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{"Content-Type": []string{"application/json"}},
+					Body:       ioutil.NopCloser(strings.NewReader(`{"success":true,"errors":[],"messages":[],"result":[]}`)),
+					Request:    req,
+				}, nil
+			})}
+			r := &CloudflareTunnelReconciler{APIOptions: CloudflareAPIOptions{HTTPClient: httpClient, BaseURL: tt.baseURL}}
+
+			api, err := r.newCloudflareAPI("token", "", "account")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := api.ListZones(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if requested != tt.want {
+				t.Errorf("expected the request to be sent to %s, got %s", tt.want, requested)
+			}
+		})
+	}
+}
@@ -20,52 +20,108 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"net"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/cloudflare/cloudflare-go"
 	"github.com/go-logr/logr"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	cfv2 "github.com/beezlabs-org/cloudflare-tunnel-operator/api/v1alpha2"
 	"github.com/beezlabs-org/cloudflare-tunnel-operator/controllers/constants"
 	"github.com/beezlabs-org/cloudflare-tunnel-operator/controllers/models"
+	"github.com/beezlabs-org/cloudflare-tunnel-operator/controllers/stores"
+	cfclient "github.com/beezlabs-org/cloudflare-tunnel-operator/internal/cloudflare"
 )
 
 // CloudflareTunnelReconciler reconciles a CloudflareTunnel object
 type CloudflareTunnelReconciler struct {
-	Client client.Client
-	TunEx  *TunnelExpanded
-	Scheme *runtime.Scheme
-	logger *logr.Logger
+	Client          client.Client
+	TunEx           *TunnelExpanded
+	Scheme          *runtime.Scheme
+	Shard           string        // only resources annotated with this shard are reconciled, all resources if empty
+	NamespacedNames bool          // prefixes the remote tunnel names with the namespace of the resource
+	DNSAttempts     int           // how often the DNS record is written before giving up until the next resync
+	DNSRetryDelay   time.Duration // delay before the first DNS retry, doubled on each attempt
+	ResyncInterval  time.Duration // how often reconciled resources are checked against the remote, defaults to 5 minutes
+	RemoteTimeout   time.Duration // bounds the calls to the Cloudflare API of a reconcile, defaults to 2 minutes
+	APIOptions      CloudflareAPIOptions
+	Metadata        *MetadataCache       // caches the zone IDs across reconciles, nothing is cached if nil
+	Clients         *ClientCache         // reuses the clients of the Cloudflare API across reconciles, none if nil
+	Limiters        *AccountLimiters     // limits the rate of the requests to each account, no limit if nil
+	Recorder        record.EventRecorder // records events on the resources, no events are recorded if nil
+	// DeletedTunnelNames defines how tunnels are named when a deleted tunnel with the same name exists, ignored if empty
+	DeletedTunnelNames DeletedTunnelNamePolicy
+	// NewCloudflareClient creates the client of the Cloudflare API for a token and account, defaults to the real API
+	NewCloudflareClient func(token, accountID string) (cfclient.CloudflareClient, error)
+	logger              *logr.Logger
 }
 
 type TunnelExpanded struct {
-	TunSpec           cfv2.CloudflareTunnelSpec
-	CloudflareAPI     *cloudflare.API
-	AccountToken      string // contains the token for the cloudflare account
-	AccountTag        string // contains the user id/tag for the cloudflare account
-	OriginCertificate string // contains the raw Origin Certificate needed for cloudflare tunnel
-	Name              string // name of the CRD as well as the tunnel
-	Namespace         string // namespace of the CRD
-	TunnelID          string // tunnel ID as generated by the remote
-	TunnelSecret      string // the secret that is generated by us to create and then connect to the tunnel
+	Resource             *cfv2.CloudflareTunnel // resource being reconciled, the events are recorded on it
+	TunSpec              cfv2.CloudflareTunnelSpec
+	CloudflareAPI        cfclient.CloudflareClient
+	AccountToken         string               // contains the token for the cloudflare account
+	AccountEmail         string               // email of the user when AccountToken is a global API key
+	AccountTag           string               // contains the user id/tag for the cloudflare account
+	OriginCertificate    string               // contains the raw Origin Certificate needed for cloudflare tunnel
+	Name                 string               // name of the CRD as well as the tunnel
+	Namespace            string               // namespace of the CRD
+	UID                  types.UID            // UID of the CRD, used to mark the DNS records it owns
+	TunnelID             string               // tunnel ID as generated by the remote
+	StatusTunnelID       string               // tunnel ID recorded in the status, differs from TunnelID once the tunnel is recreated
+	TunnelSecret         string               // the secret that is generated by us to create and then connect to the tunnel
+	TokenRefreshedAt     string               // time of the last token refresh, stamped on the pods to roll them on the next refresh
+	DeploymentRollingOut bool                 // whether the pods of the deployment are still being replaced
+	DNSRecordID          string               // ID of the CNAME record written by the previous reconcile, if any
+	ZoneID               string               // ID of the zone of the domain, looked up when empty
+	TargetPort           corev1.ServicePort   // port of the target service the tunnel routes to
+	ConfigHash           string               // hash of the config map as rendered by the operator
+	IngressRules         []models.IngressRule // rules of the config when the tunnel routes several hostnames
+	UnownedHostnames     []string             // ingress hostnames whose DNS record is skipped as they are not in the account
+	IngressZones         []string             // zones holding the records of the ingress hostnames
+	ServiceMonitor       bool                 // whether the ServiceMonitor created by the operator exists
 }
 
 //+kubebuilder:rbac:groups=cloudflare-tunnel-operator.beezlabs.app,resources=cloudflaretunnels,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=cloudflare-tunnel-operator.beezlabs.app,resources=cloudflaretunnels/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=cloudflare-tunnel-operator.beezlabs.app,resources=cloudflaretunnels/finalizers,verbs=update
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=configmaps;secrets;services,verbs=get;list;watch;create;update;patch;delete;deletecollection
+//+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete;deletecollection
+//+kubebuilder:rbac:groups=discovery.k8s.io,resources=endpointslices,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 func (r *CloudflareTunnelReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	result, err := r.reconcile(ctx, req)
+	reconcileResults.WithLabelValues(r.reconcileOutcome(result, err)).Inc()
+	return result, err
+}
+
+func (r *CloudflareTunnelReconciler) reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	lfc := log.FromContext(ctx)
 	r.logger = &lfc
 	lfc.Info("Reconciling...")
@@ -73,71 +129,397 @@ func (r *CloudflareTunnelReconciler) Reconcile(ctx context.Context, req ctrl.Req
 
 	var cloudflareTunnel cfv2.CloudflareTunnel
 	if err := r.Client.Get(ctx, namespacedName, &cloudflareTunnel); err != nil {
+		if errors.IsNotFound(err) {
+			// the resource has been deleted since it was queued, there is nothing left to reconcile
+			tunnelReadiness.forget(namespacedName)
+			return ctrl.Result{}, client.IgnoreNotFound(err)
+		}
 		lfc.Error(err, "could not fetch CloudflareTunnel")
 		return ctrl.Result{}, err
 	}
 	lfc.V(1).Info("Resource fetched")
+	// the events of the managed resources are not filtered, so they might enqueue a resource of another shard
+	if !r.inShard(&cloudflareTunnel) {
+		return ctrl.Result{}, nil
+	}
+
+	// deletion has to be handled first, as the resource must be released even in a terminating namespace
+	if !cloudflareTunnel.DeletionTimestamp.IsZero() {
+		return r.finalize(ctx, &cloudflareTunnel)
+	}
+
+	// child resources cannot be created in a terminating namespace, so there is nothing to reconcile
+	terminating, err := r.namespaceTerminating(ctx, cloudflareTunnel.Namespace)
+	if err != nil {
+		lfc.Error(err, "could not fetch namespace")
+		return ctrl.Result{}, err
+	}
+	if terminating {
+		lfc.Info("Namespace is terminating, skipping reconcile")
+		return ctrl.Result{}, nil
+	}
+
+	if err := r.addFinalizer(ctx, &cloudflareTunnel); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := r.backfillStatus(ctx, &cloudflareTunnel); err != nil {
+		return ctrl.Result{}, err
+	}
 
 	r.TunEx = &TunnelExpanded{
-		TunSpec:   cloudflareTunnel.Spec,
-		Name:      cloudflareTunnel.Name,
-		Namespace: cloudflareTunnel.Namespace,
-		TunnelID:  cloudflareTunnel.Status.TunnelID,
+		Resource:       &cloudflareTunnel,
+		TunSpec:        cloudflareTunnel.Spec,
+		Name:           cloudflareTunnel.Name,
+		Namespace:      cloudflareTunnel.Namespace,
+		UID:            cloudflareTunnel.UID,
+		TunnelID:       cloudflareTunnel.Status.TunnelID,
+		StatusTunnelID: cloudflareTunnel.Status.TunnelID,
+		DNSRecordID:    cloudflareTunnel.Status.DNSRecordID,
+		IngressZones:   cloudflareTunnel.Status.IngressZones,
+		// the ServiceMonitor is only looked up while it is enabled or known to exist
+		ServiceMonitor: cloudflareTunnel.Status.ServiceMonitor,
 	}
 
-	if err := r.fetchDecodeSecret(ctx); err != nil {
+	spec, err := applyIngress(r.TunEx.TunSpec)
+	if err != nil {
+		lfc.Error(err, "invalid ingress")
+		return ctrl.Result{}, err
+	}
+	r.TunEx.TunSpec = spec
+	// the domain is used as a DNS name, so any scheme or port has to be removed
+	domain, err := normalizeDomain(r.TunEx.TunSpec.Domain)
+	if err != nil {
+		lfc.Error(err, "invalid domain")
+		return ctrl.Result{}, err
+	}
+	r.TunEx.TunSpec.Domain = domain
+	dnsRecordName, err := validateDNSRecordName(r.TunEx.TunSpec)
+	if err != nil {
+		lfc.Error(err, "invalid DNS record name")
+		return ctrl.Result{}, err
+	}
+	r.TunEx.TunSpec.DNSRecordName = dnsRecordName
+	if err := validateDNSTTL(r.TunEx.TunSpec.DNSTTL); err != nil {
+		lfc.Error(err, "invalid DNS TTL")
+		return ctrl.Result{}, err
+	}
+	if err := validateDNSOnly(r.TunEx.TunSpec); err != nil {
+		lfc.Error(err, "invalid DNS-only configuration")
+		return ctrl.Result{}, err
+	}
+	if r.TunEx.TunSpec.DNSOnly {
+		return r.reconcileDNSOnly(ctx, &cloudflareTunnel)
+	}
+	if err := validateServiceOrigin(r.TunEx.TunSpec); err != nil {
+		lfc.Error(err, "invalid service")
 		return ctrl.Result{}, err
 	}
 
-	if err := r.createTunnelRemote(ctx); err != nil {
+	// a hung call to the remote fails the reconcile instead of holding the worker, the status is still written
+	remoteCtx, cancel := r.remoteContext(ctx)
+	defer cancel()
+
+	if err := r.fetchDecodeSecret(remoteCtx); err != nil {
 		return ctrl.Result{}, err
 	}
 
+	previousTunnelID := r.TunEx.TunnelID
+	if err := r.createTunnelRemote(remoteCtx); err != nil {
+		meta.SetStatusCondition(&cloudflareTunnel.Status.Conditions, metav1.Condition{
+			Type:               cfv2.ConditionTunnelReady,
+			Status:             metav1.ConditionFalse,
+			ObservedGeneration: cloudflareTunnel.Generation,
+			Reason:             "TunnelFailed",
+			Message:            err.Error(),
+		})
+		return r.handleError(ctx, &cloudflareTunnel, err)
+	}
+	meta.SetStatusCondition(&cloudflareTunnel.Status.Conditions, metav1.Condition{
+		Type:               cfv2.ConditionTunnelReady,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: cloudflareTunnel.Generation,
+		Reason:             "Created",
+		Message:            "the tunnel exists in the account",
+	})
+	if dnsManaged(r.TunEx.TunSpec) {
+		if err := r.detectZone(remoteCtx, cloudflareTunnel.Status); err != nil {
+			return r.handleError(ctx, &cloudflareTunnel, err)
+		}
+		if err := r.repointDNSCNAME(remoteCtx, previousTunnelID); err != nil {
+			return r.handleError(ctx, &cloudflareTunnel, err)
+		}
+	}
+	r.refreshToken(&cloudflareTunnel, time.Now())
+
 	// this concludes checking the remote tunnel config
 	secretCreate, err := r.createSecret(ctx, cloudflareTunnel)
 	if err != nil {
-		return ctrl.Result{}, err
+		return r.handleError(ctx, &cloudflareTunnel, err)
+	}
+
+	if r.TunEx.TunSpec.SecretStore != nil {
+		store, path, err := r.secretStore(ctx)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := r.exportCredentials(remoteCtx, store, path, secretCreate); err != nil {
+			return ctrl.Result{}, err
+		}
 	}
 
 	// now we have to check the deployment status and reconcile
 	url, err := r.getTargetURL(ctx)
 	if err != nil {
-		lfc.Error(err, "could not generate URL")
-		return ctrl.Result{}, err
+		if _, ok := err.(*waitingError); !ok {
+			lfc.Error(err, "could not generate URL")
+		}
+		return r.handleError(ctx, &cloudflareTunnel, err)
+	}
+
+	ingressRules, err := r.ingressRules(remoteCtx)
+	if err != nil {
+		if _, ok := err.(*waitingError); !ok {
+			lfc.Error(err, "could not generate ingress rules")
+		}
+		return r.handleError(ctx, &cloudflareTunnel, err)
 	}
+	r.TunEx.IngressRules = ingressRules
+
+	r.setServiceProtocolCondition(&cloudflareTunnel)
 
 	configMapCreate, err := r.createConfigMap(ctx, cloudflareTunnel, url)
 	if err != nil {
-		return ctrl.Result{}, err
+		return r.handleError(ctx, &cloudflareTunnel, err)
 	}
 
-	if _, err = r.createDeployment(ctx, cloudflareTunnel, secretCreate, configMapCreate); err != nil {
-		return ctrl.Result{}, err
+	if !deploymentManaged(r.TunEx.TunSpec) {
+		if err := r.deleteDeployment(ctx, cloudflareTunnel); err != nil {
+			return ctrl.Result{}, err
+		}
+		meta.RemoveStatusCondition(&cloudflareTunnel.Status.Conditions, cfv2.ConditionDeploymentReady)
+	} else if r.TunEx.TunSpec.ReplicasFromEndpoints != nil {
+		readyEndpoints, err := r.countReadyEndpoints(ctx)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		// the endpoint slices are watched, so the replicas follow the endpoints as soon as they are ready again
+		setEndpointsDegradedCondition(&cloudflareTunnel, readyEndpoints)
+		r.TunEx.TunSpec.Replicas = replicasFromEndpoints(readyEndpoints, r.TunEx.TunSpec.ReplicasFromEndpoints)
+		lfc.V(1).Info("Replicas derived from endpoints", "endpoints", readyEndpoints, "replicas", r.TunEx.TunSpec.Replicas)
+	}
+	if !deploymentManaged(r.TunEx.TunSpec) || r.TunEx.TunSpec.ReplicasFromEndpoints == nil {
+		meta.RemoveStatusCondition(&cloudflareTunnel.Status.Conditions, cfv2.ConditionDegraded)
 	}
 
-	// finally we need to check if a CNAME exists for the given domain and create if not
-	if err = r.createDNSCNAME(ctx); err != nil {
-		return ctrl.Result{}, err
+	cloudflareTunnel.Status.Replicas, cloudflareTunnel.Status.Selector = 0, ""
+	if deploymentManaged(r.TunEx.TunSpec) {
+		deployment, err := r.createDeployment(ctx, cloudflareTunnel, secretCreate, configMapCreate)
+		if err != nil {
+			meta.SetStatusCondition(&cloudflareTunnel.Status.Conditions, metav1.Condition{
+				Type:               cfv2.ConditionDeploymentReady,
+				Status:             metav1.ConditionFalse,
+				ObservedGeneration: cloudflareTunnel.Generation,
+				Reason:             "DeploymentFailed",
+				Message:            err.Error(),
+			})
+			return r.handleError(ctx, &cloudflareTunnel, err)
+		}
+		r.setDeploymentReadyCondition(&cloudflareTunnel)
+		// reported for the scale subresource, through which the replicas of the spec may be changed by an autoscaler
+		selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+		if err != nil {
+			lfc.Error(err, "invalid deployment selector")
+			return ctrl.Result{}, err
+		}
+		cloudflareTunnel.Status.Replicas = deployment.Status.Replicas
+		cloudflareTunnel.Status.Selector = selector.String()
+	}
+
+	if err := r.createMetricsService(ctx, cloudflareTunnel); err != nil {
+		return r.handleError(ctx, &cloudflareTunnel, err)
+	}
+	if err := r.createServiceMonitor(ctx, cloudflareTunnel); err != nil {
+		return r.handleError(ctx, &cloudflareTunnel, err)
 	}
 
+	// finally we need to check if a CNAME or load balancer exists for the given domain and create if not
+	if dnsManaged(r.TunEx.TunSpec) {
+		if err = r.reconcileDNS(remoteCtx); err != nil {
+			return r.handleError(ctx, &cloudflareTunnel, err)
+		}
+		r.setHostnamesOwnedCondition(&cloudflareTunnel)
+		meta.SetStatusCondition(&cloudflareTunnel.Status.Conditions, metav1.Condition{
+			Type:               cfv2.ConditionDNSReady,
+			Status:             metav1.ConditionTrue,
+			ObservedGeneration: cloudflareTunnel.Generation,
+			Reason:             "Reconciled",
+			Message:            "the DNS record points to the tunnel",
+		})
+	} else {
+		// the target is still reported so that the external tool knows where to point the records
+		meta.RemoveStatusCondition(&cloudflareTunnel.Status.Conditions, cfv2.ConditionHostnamesOwned)
+		meta.SetStatusCondition(&cloudflareTunnel.Status.Conditions, metav1.Condition{
+			Type:               cfv2.ConditionDNSReady,
+			Status:             metav1.ConditionUnknown,
+			ObservedGeneration: cloudflareTunnel.Generation,
+			Reason:             "ExternallyManaged",
+			Message:            "the DNS records are managed outside of the operator",
+		})
+	}
+	r.setEndpointStatus(&cloudflareTunnel)
+
 	// update the status of the custom resource
-	if err := r.updateStatus(ctx, &cloudflareTunnel); err != nil {
-		return ctrl.Result{}, err
+	if err := r.updateStatus(remoteCtx, &cloudflareTunnel); err != nil {
+		return r.handleError(ctx, &cloudflareTunnel, err)
 	}
-	if err := r.Client.Status().Update(ctx, &cloudflareTunnel); err != nil {
+	meta.SetStatusCondition(&cloudflareTunnel.Status.Conditions, metav1.Condition{
+		Type:               cfv2.ConditionCredentialsValid,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: cloudflareTunnel.Generation,
+		Reason:             "Valid",
+		Message:            "the token has the required permissions",
+	})
+	meta.SetStatusCondition(&cloudflareTunnel.Status.Conditions, metav1.Condition{
+		Type:               cfv2.ConditionReady,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: cloudflareTunnel.Generation,
+		Reason:             "Reconciled",
+		Message:            "all resources have been reconciled",
+	})
+	if err := r.writeStatus(ctx, &cloudflareTunnel); err != nil {
 		return ctrl.Result{}, err
 	}
-	return ctrl.Result{RequeueAfter: time.Minute * 5}, nil
+	if r.TunEx.DeploymentRollingOut {
+		// check again soon so that the status reflects the deployment once it has settled
+		return ctrl.Result{RequeueAfter: constants.WaitingRequeueInterval}, nil
+	}
+	return ctrl.Result{RequeueAfter: r.resyncInterval()}, nil
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *CloudflareTunnelReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.Recorder == nil {
+		r.Recorder = mgr.GetEventRecorderFor("cloudflare-tunnel-operator")
+	}
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&cfv2.CloudflareTunnel{}).
-		//Owns(&appsv1.Deployment{}).
+		For(&cfv2.CloudflareTunnel{}, builder.WithPredicates(r.eventFilter())).
+		// the managed resources are only updated when they differ, so that they are repaired without looping
+		// the rollout annotation is written by the operator itself, its status updates still trigger a reconcile
+		Owns(&appsv1.Deployment{}, builder.WithPredicates(ignoreAnnotationUpdates())).
+		Owns(&corev1.Secret{}).
+		Owns(&corev1.ConfigMap{}).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, r.credentialsHandler()).
+		Watches(&source.Kind{Type: &discoveryv1.EndpointSlice{}}, r.endpointsHandler()).
 		Complete(r)
 }
 
+// eventFilter selects the events of the resources in the shard which need a reconcile. Status updates do not change
+// the generation, so that writing the status does not trigger another reconcile.
+func (r *CloudflareTunnelReconciler) eventFilter() predicate.Predicate {
+	return predicate.And(
+		predicate.NewPredicateFuncs(r.inShard),
+		predicate.Or(predicate.GenerationChangedPredicate{}, predicate.AnnotationChangedPredicate{}, predicate.LabelChangedPredicate{}),
+	)
+}
+
+// normalizeDomain strips any scheme, port and trailing dot from the domain and validates that the rest is a DNS name
+func normalizeDomain(domain string) (string, error) {
+	host := strings.TrimSpace(domain)
+	if strings.Contains(host, "://") {
+		parsed, err := url.Parse(host)
+		if err != nil {
+			return "", fmt.Errorf("invalid domain %q: %w", domain, err)
+		}
+		if parsed.Path != "" && parsed.Path != "/" {
+			return "", fmt.Errorf("invalid domain %q: must not contain a path", domain)
+		}
+		host = parsed.Host
+	}
+	if splitHost, _, err := net.SplitHostPort(host); err == nil {
+		host = splitHost
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	// wildcard records are allowed by cloudflare but are not valid DNS-1123 subdomains
+	if errs := validation.IsDNS1123Subdomain(strings.TrimPrefix(host, "*.")); len(errs) != 0 {
+		return "", fmt.Errorf("invalid domain %q: %s", domain, strings.Join(errs, ", "))
+	}
+	return host, nil
+}
+
+// validateDNSRecordName normalizes the name of the CNAME record, defaulting to the already normalized domain,
+// and checks that it is within the zone as the record could not be created otherwise
+func validateDNSRecordName(spec cfv2.CloudflareTunnelSpec) (string, error) {
+	name := spec.Domain
+	if spec.DNSRecordName != "" {
+		normalized, err := normalizeDomain(spec.DNSRecordName)
+		if err != nil {
+			return "", err
+		}
+		name = normalized
+	}
+	// the zone is detected from the name when it is not set
+	if spec.Zone != "" && !withinZone(name, spec.Zone) {
+		return "", fmt.Errorf("invalid DNS record name %q: not within the zone %q", name, spec.Zone)
+	}
+	return name, nil
+}
+
+// validateDNSTTL checks that Cloudflare accepts the TTL of the records, which is either automatic or at least a minute
+func validateDNSTTL(ttl *int) error {
+	if ttl == nil || *ttl == 1 || (*ttl >= 60 && *ttl <= 86400) {
+		return nil
+	}
+	return fmt.Errorf("invalid DNS TTL %d, must be 1 for automatic or between 60 and 86400", *ttl)
+}
+
+// withinZone checks if the normalized name is the zone or one of its subdomains
+func withinZone(name, zone string) bool {
+	zone = normalizeZone(zone)
+	return name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// normalizeZone strips the trailing dot of the zone name and lower cases it
+func normalizeZone(zone string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(zone), "."))
+}
+
+// recordEvent records an event on the resource if a recorder is set
+func (r *CloudflareTunnelReconciler) recordEvent(obj runtime.Object, eventType, reason, message string) {
+	if r.Recorder == nil {
+		return
+	}
+	r.Recorder.Event(obj, eventType, reason, message)
+}
+
+// recordTunnelEvent records an event on the resource being reconciled, for the steps which only have its TunEx
+func (r *CloudflareTunnelReconciler) recordTunnelEvent(eventType, reason, message string) {
+	if r.TunEx == nil || r.TunEx.Resource == nil {
+		return
+	}
+	r.recordEvent(r.TunEx.Resource, eventType, reason, message)
+}
+
+// inShard checks if the resource belongs to the shard handled by this instance of the operator
+func (r *CloudflareTunnelReconciler) inShard(obj client.Object) bool {
+	if r.Shard == "" {
+		return true
+	}
+	return obj.GetAnnotations()[constants.ShardAnnotation] == r.Shard
+}
+
+func (r *CloudflareTunnelReconciler) namespaceTerminating(ctx context.Context, name string) (bool, error) {
+	var namespace corev1.Namespace
+	if err := r.Client.Get(ctx, types.NamespacedName{Name: name}, &namespace); err != nil {
+		if errors.IsNotFound(err) {
+			// the namespace is already gone
+			return true, nil
+		}
+		return false, err
+	}
+	return namespace.DeletionTimestamp != nil || namespace.Status.Phase == corev1.NamespaceTerminating, nil
+}
+
 func (r *CloudflareTunnelReconciler) fetchDecodeSecret(ctx context.Context) error {
 	// check if a secret name is mentioned in the resource or not
 	// TokenSecretName is the name of the secret resource that contains the account id and account token
@@ -156,29 +538,39 @@ func (r *CloudflareTunnelReconciler) fetchDecodeSecret(ctx context.Context) erro
 		if errors.IsNotFound(err) {
 			// write a log only if the secret was not found and not for other errors
 			r.logger.Error(err, "could not find secret with name "+r.TunEx.TunSpec.TokenSecretName)
+			r.recordTunnelEvent(corev1.EventTypeWarning, "SecretNotFound", "Secret "+r.TunEx.TunSpec.TokenSecretName+" not found")
 		}
 		return err
 	}
 	r.logger.V(1).Info("Secret fetched")
 
 	// secret found, decode the token
-	encodedToken, okCred := secret.Data["token"]
-	encodedAccountID, okAccount := secret.Data["accountID"]
-	encodedOriginCertificate, okCert := secret.Data["originCertificate"]
-
-	if !okCred {
-		err := fmt.Errorf("invalid key")
-		r.logger.Error(err, "key credentials not found")
+	keys := credentialKeysOf(r.TunEx.TunSpec)
+	email, err := apiKeyEmail(secret.Data, keys, r.TunEx.TunSpec.AuthType)
+	if err != nil {
+		r.logger.Error(err, "could not decode credentials")
 		return err
 	}
-
-	if !okAccount {
-		err := fmt.Errorf("invalid key")
-		r.logger.Error(err, "key accountID not found")
+	if email != "" {
+		keys.Token = keys.APIKey
+	}
+	accountTag, accountToken, err := decodeCredentials(secret.Data, keys, r.TunEx.TunSpec.AccountID)
+	if err != nil {
+		r.logger.Error(err, "could not decode credentials")
 		return err
 	}
+	if accountTag == "" {
+		accountTag, err = r.detectAccountTag(ctx, accountToken, email)
+		if err != nil {
+			r.logger.Error(err, "could not detect the account of the token")
+			return err
+		}
+		r.logger.V(1).Info("Account detected from the token", "account", accountTag)
+	}
 
-	if !okCert {
+	// the origin certificate is only mounted in cloudflared, which is not run in DNS-only mode
+	encodedOriginCertificate, okCert := secret.Data["originCertificate"]
+	if !okCert && !r.TunEx.TunSpec.DNSOnly {
 		err := fmt.Errorf("invalid key")
 		r.logger.Error(err, "key originCertificate not found")
 		return err
@@ -186,38 +578,164 @@ func (r *CloudflareTunnelReconciler) fetchDecodeSecret(ctx context.Context) erro
 
 	r.logger.V(1).Info("Secret decoded")
 
-	r.TunEx.AccountTag = string(encodedAccountID)
-	r.TunEx.AccountToken = string(encodedToken)
+	r.TunEx.AccountTag = accountTag
+	r.TunEx.AccountToken = accountToken
+	r.TunEx.AccountEmail = email
 	r.TunEx.OriginCertificate = string(encodedOriginCertificate)
 	return nil // everything good
 }
 
+// credentialKeys are the keys of the token secret holding the API token, the global API key and the account ID
+type credentialKeys struct {
+	Token     string
+	APIKey    string
+	AccountID string
+}
+
+// credentialKeysOf returns the keys set in the spec, defaulting to `token`, `apiKey` and `accountID`
+func credentialKeysOf(spec cfv2.CloudflareTunnelSpec) credentialKeys {
+	keys := credentialKeys{Token: spec.TokenKey, APIKey: spec.APIKeyKey, AccountID: spec.AccountIDKey}
+	if keys.Token == "" {
+		keys.Token = "token"
+	}
+	if keys.APIKey == "" {
+		keys.APIKey = "apiKey"
+	}
+	if keys.AccountID == "" {
+		keys.AccountID = "accountID"
+	}
+	return keys
+}
+
+// apiKeyEmail returns the email to authenticate with along with the global API key of the secret, or an empty string
+// when the API token is used. Unless authType is set, the API key is used when the secret has an API key and an email.
+func apiKeyEmail(data map[string][]byte, keys credentialKeys, authType cfv2.CloudflareTunnelAuthType) (string, error) {
+	email := data["email"]
+	_, okKey := data[keys.APIKey]
+	switch authType {
+	case cfv2.AuthToken:
+		return "", nil
+	case cfv2.AuthAPIKey:
+		if !okKey {
+			return "", fmt.Errorf("key %s not found", keys.APIKey)
+		}
+		if len(email) == 0 {
+			return "", fmt.Errorf("key email not found")
+		}
+		return string(email), nil
+	}
+	if okKey && len(email) != 0 {
+		return string(email), nil
+	}
+	return "", nil
+}
+
+// decodeCredentials returns the account tag and token to use from the data of the token secret.
+// The secret either contains a single account ID/token pair under keys or an `accounts` key holding a JSON object
+// which maps account IDs to their tokens. In the latter case, accountID selects the entry to use.
+func decodeCredentials(data map[string][]byte, keys credentialKeys, accountID string) (string, string, error) {
+	if encodedAccounts, ok := data["accounts"]; ok {
+		var accounts map[string]string
+		if err := json.Unmarshal(encodedAccounts, &accounts); err != nil {
+			return "", "", fmt.Errorf("could not parse key accounts: %w", err)
+		}
+		if accountID == "" {
+			if len(accounts) != 1 {
+				return "", "", fmt.Errorf("key accounts contains %d accounts, accountID must be set to select one", len(accounts))
+			}
+			for tag, token := range accounts {
+				return tag, token, nil
+			}
+		}
+		token, ok := accounts[accountID]
+		if !ok {
+			return "", "", fmt.Errorf("account %s not found in key accounts", accountID)
+		}
+		return accountID, token, nil
+	}
+
+	token, okCred := data[keys.Token]
+	if !okCred {
+		return "", "", fmt.Errorf("key %s not found", keys.Token)
+	}
+	accountTag, okAccount := data[keys.AccountID]
+	if !okAccount {
+		// the account is detected from the token if it is not selected either
+		return accountID, string(token), nil
+	}
+	if accountID != "" && accountID != string(accountTag) {
+		return "", "", fmt.Errorf("account %s not found in key %s", accountID, keys.AccountID)
+	}
+	return string(accountTag), string(token), nil
+}
+
+// detectAccountTag returns the ID of the account the token has access to, for the secrets without accountID.
+// The token must have access to a single account, as the one to use cannot be guessed otherwise. It is detected on
+// every reconcile rather than cached, as the accounts of the token may change at any time.
+func (r *CloudflareTunnelReconciler) detectAccountTag(ctx context.Context, token, email string) (string, error) {
+	cf, err := r.cloudflareClient(token, email, "")
+	if err != nil {
+		return "", err
+	}
+	// a second account is enough to know that the account cannot be detected
+	accounts, _, err := cf.Accounts(ctx, cloudflare.AccountsListParams{PaginationOptions: cloudflare.PaginationOptions{PerPage: 2}})
+	if err != nil {
+		return "", err
+	}
+	switch len(accounts) {
+	case 0:
+		return "", fmt.Errorf("the token has access to no account, accountID must be set in the secret")
+	case 1:
+		return accounts[0].ID, nil
+	}
+	return "", fmt.Errorf("the token has access to multiple accounts, accountID must be set in the secret or the resource to select one")
+}
+
+// selectTunnel picks the tunnel with the given ID among tunnels sharing the same name.
+// The error lists the IDs of the tunnels so that the user can set one of them in the spec.
+func selectTunnel(tunnels []cloudflare.Tunnel, id string) (cloudflare.Tunnel, error) {
+	ids := make([]string, 0, len(tunnels))
+	for _, tunnel := range tunnels {
+		if id != "" && tunnel.ID == id {
+			return tunnel, nil
+		}
+		ids = append(ids, tunnel.ID)
+	}
+	if id != "" {
+		return cloudflare.Tunnel{}, fmt.Errorf("multiple tunnels exist and none has the tunnel ID %s: %s", id, strings.Join(ids, ", "))
+	}
+	return cloudflare.Tunnel{}, fmt.Errorf("multiple tunnels exist, set the tunnel ID to one of: %s", strings.Join(ids, ", "))
+}
+
 func (r *CloudflareTunnelReconciler) createTunnelRemote(ctx context.Context) error {
-	cf, err := cloudflare.NewWithAPIToken(r.TunEx.AccountToken) // create new instance of cloudflare sdk
-	r.TunEx.CloudflareAPI = cf
+	cf, err := r.cloudflareClient(r.TunEx.AccountToken, r.TunEx.AccountEmail, r.TunEx.AccountTag) // create new instance of cloudflare sdk
 	if err != nil {
 		r.logger.Error(err, "could not create cloudflare instance")
 		return err
 	}
+	r.TunEx.CloudflareAPI = cf
 	r.logger.V(1).Info("Cloudflare instance successfully created")
 
-	cf.AccountID = r.TunEx.AccountTag
-
 	falsePointer := false // needed as the function below only accepts a *bool
 
 	// first, we are checking if tunnels with the given name exists in the remote or not
 	// if they exist, we will be getting one or more of them, since cloudflare allows duplicate named tunnels
 	// if 2 or more exists, we check if the current CRD status already has the TunnelID or not
 	// if it has, we check if the returned tunnels has one with the same connector id and use it
-	// else, we cannot accurately figure out which one of them to use and error out
+	// else we error out, listing the tunnels so that one of them can be set as the tunnel ID of the spec
+	// the tunnel ID of the spec pins the tunnel whatever its name, it is never created and has to exist
 	tunnelListParams := cloudflare.TunnelListParams{
-		Name:      r.TunEx.Name,
+		Name:      r.remoteTunnelName(),
 		IsDeleted: &falsePointer,
 	}
-	accountResourceContainer := cloudflare.AccountIdentifier(cf.AccountID)
-	// check if tunnelID already existed as part of the resource Status
-	if r.TunEx.TunnelID != "" {
-		tunnelListParams.UUID = r.TunEx.TunnelID
+	accountResourceContainer := cloudflare.AccountIdentifier(r.TunEx.AccountTag)
+	pinned := r.TunEx.TunSpec.TunnelID
+	if pinned != "" {
+		tunnelListParams = cloudflare.TunnelListParams{UUID: pinned, IsDeleted: &falsePointer}
+	} else if r.TunEx.TunnelID != "" {
+		// the tunnel of the status is looked up by ID alone, as it might have been created under another name to
+		// avoid a deleted tunnel which has been purged since
+		tunnelListParams = cloudflare.TunnelListParams{UUID: r.TunEx.TunnelID, IsDeleted: &falsePointer}
 	}
 	tunnels, err := cf.Tunnels(ctx, accountResourceContainer, tunnelListParams)
 	if err != nil {
@@ -225,13 +743,41 @@ func (r *CloudflareTunnelReconciler) createTunnelRemote(ctx context.Context) err
 		return err
 	}
 	r.logger.V(1).Info("Existing tunnels fetched")
+	if pinned != "" && len(tunnels) == 0 {
+		err := fmt.Errorf("no tunnel with the ID %s found in the account", pinned)
+		r.logger.Error(err, "could not find the tunnel of the spec")
+		r.recordTunnelEvent(corev1.EventTypeWarning, "TunnelNotFound", err.Error())
+		return err
+	}
+
+	// a deleted tunnel may still hold the name, in which case the tunnel is looked up again under the name it
+	// would have been created with
+	tunnelName := r.remoteTunnelName()
+	if len(tunnels) == 0 {
+		tunnelName, err = r.tunnelNameAvoidingDeleted(ctx, cf, accountResourceContainer, tunnelName)
+		if err != nil {
+			return err
+		}
+		if tunnelName != r.remoteTunnelName() {
+			tunnelListParams.Name = tunnelName
+			tunnels, err = cf.Tunnels(ctx, accountResourceContainer, tunnelListParams)
+			if err != nil {
+				r.logger.Error(err, "could not fetch tunnel list")
+				return err
+			}
+		}
+	}
 
 	var tunnel cloudflare.Tunnel
 
 	if len(tunnels) >= 2 {
-		err := fmt.Errorf("multiple tunnels exist")
-		r.logger.Error(err, "2 or more tunnels already exists with the given name. Unable to choose between one of them")
-		return err
+		tunnel, err = selectTunnel(tunnels, r.TunEx.TunSpec.TunnelID)
+		if err != nil {
+			r.logger.Error(err, "2 or more tunnels already exists with the given name. Unable to choose between one of them")
+			r.recordTunnelEvent(corev1.EventTypeWarning, "MultipleTunnelsFound", err.Error())
+			return err
+		}
+		r.logger.Info("Multiple tunnels exist, using the one selected by the spec. Reconciling...", "tunnelID", tunnel.ID)
 	} else if len(tunnels) == 1 {
 		// a single tunnel found with the same name, so we use that
 		r.logger.Info("Tunnel already exists. Reconciling...")
@@ -246,7 +792,7 @@ func (r *CloudflareTunnelReconciler) createTunnelRemote(ctx context.Context) err
 		r.logger.V(1).Info("Cloudflare Tunnel secret generated")
 
 		tunnelParams := cloudflare.TunnelCreateParams{
-			Name:   r.TunEx.Name, // name of the tunnel is the same as the name of the CRD
+			Name:   tunnelName,   // name of the tunnel is derived from the name of the CRD
 			Secret: tunnelSecret, // use the randomly generated secret
 		}
 
@@ -255,6 +801,7 @@ func (r *CloudflareTunnelReconciler) createTunnelRemote(ctx context.Context) err
 			r.logger.Error(err, "could not create the tunnel")
 			return err
 		}
+		r.recordTunnelEvent(corev1.EventTypeNormal, "TunnelCreated", "Created tunnel "+tunnel.Name+" with ID "+tunnel.ID)
 	}
 	r.TunEx.TunnelID = tunnel.ID // assign the tunnelID from the created tunnel
 
@@ -268,157 +815,569 @@ func (r *CloudflareTunnelReconciler) createTunnelRemote(ctx context.Context) err
 		r.logger.Error(err, "could not decode tunnel token")
 		return err
 	}
+	// a broken token would be written to the secret and mounted in cloudflared, which would then crash loop
+	if err := validateTunnelToken(tunnelTokenDecodedBytes, tunnel.ID); err != nil {
+		r.logger.Error(err, "invalid tunnel token")
+		return err
+	}
 	r.TunEx.TunnelSecret = string(tunnelTokenDecodedBytes)
 	return nil
 }
 
-func (r *CloudflareTunnelReconciler) createDNSCNAME(ctx context.Context) error {
-	zoneID, err := r.TunEx.CloudflareAPI.ZoneIDByName(r.TunEx.TunSpec.Zone)
+// zoneID returns the ID of the zone of the domain
+func (r *CloudflareTunnelReconciler) zoneID(ctx context.Context) (string, error) {
+	if r.TunEx.ZoneID != "" {
+		return r.TunEx.ZoneID, nil
+	}
+	zoneID, err := r.zoneIDByName(ctx, r.TunEx.TunSpec.Zone)
+	if err != nil {
+		return "", err
+	}
+	r.TunEx.ZoneID = zoneID
+	return zoneID, nil
+}
+
+// detectZone sets the zone of the domain when it is not set in the spec. The zone stored in the status is reused
+// as long as the DNS record name is within it, otherwise the zone of the account which is the longest suffix of the
+// name is looked up.
+func (r *CloudflareTunnelReconciler) detectZone(ctx context.Context, status cfv2.CloudflareTunnelStatus) error {
+	// the spec is not normalized yet when cleaning up
+	name, err := normalizeDomain(r.dnsRecordName())
 	if err != nil {
-		r.logger.Error(err, "could not fetch zone id")
 		return err
 	}
-	dnsRecords, err := r.TunEx.CloudflareAPI.DNSRecords(ctx, zoneID, cloudflare.DNSRecord{
-		Type: "CNAME",
-		Name: r.TunEx.TunSpec.Domain,
+	zone := normalizeZone(r.TunEx.TunSpec.Zone)
+	if zone == "" && status.Zone != "" && withinZone(name, status.Zone) {
+		zone = status.Zone
+	}
+	if zone != "" {
+		r.TunEx.TunSpec.Zone = zone
+		if zone == status.Zone {
+			r.TunEx.ZoneID = status.ZoneID
+		}
+		return nil
+	}
+
+	// the parent domains of the name, the top-level domain excluded, are the candidates
+	labels := strings.Split(name, ".")
+	candidates := make([]string, 0, len(labels))
+	for i := 0; i < len(labels)-1; i++ {
+		candidates = append(candidates, strings.Join(labels[i:], "."))
+	}
+	var zoneID string
+	zone, err = r.Metadata.get(r.TunEx.AccountToken, "domain zone", name, func() (string, error) {
+		zones, err := r.TunEx.CloudflareAPI.ListZones(ctx, candidates...)
+		if err != nil {
+			return "", err
+		}
+		longest, err := longestZone(name, zones)
+		if err != nil {
+			return "", err
+		}
+		for _, accountZone := range zones {
+			if normalizeZone(accountZone.Name) == longest {
+				zoneID = accountZone.ID
+			}
+		}
+		return longest, nil
 	})
 	if err != nil {
-		r.logger.Error(err, "could not fetch dns list")
+		r.logger.Error(err, "could not detect the zone of the domain", "name", name)
+		return err
+	}
+	// the ID found along with the zone is cached by the name of the zone, for the zone cached without it
+	zoneID, err = r.Metadata.get(r.TunEx.AccountToken, "zone", zone, func() (string, error) {
+		if zoneID != "" {
+			return zoneID, nil
+		}
+		return r.TunEx.CloudflareAPI.ZoneIDByName(ctx, zone)
+	})
+	if err != nil {
+		r.logger.Error(err, "could not fetch zone id", "zone", zone)
 		return err
 	}
-	truePointer := true // needed as the struct below only accepts a *bool
+	r.logger.V(1).Info("Zone detected from the domain", "zone", zone)
+	r.TunEx.TunSpec.Zone = zone
+	r.TunEx.ZoneID = zoneID
+	return nil
+}
+
+// zoneIDByName returns the ID of the zone with the given name
+func (r *CloudflareTunnelReconciler) zoneIDByName(ctx context.Context, zone string) (string, error) {
+	zoneID, err := r.Metadata.get(r.TunEx.AccountToken, "zone", zone, func() (string, error) {
+		return r.TunEx.CloudflareAPI.ZoneIDByName(ctx, zone)
+	})
+	if err != nil {
+		r.logger.Error(err, "could not fetch zone id")
+		return "", err
+	}
+	return zoneID, nil
+}
+
+// dnsRecordName returns the name of the CNAME record, which is the routed hostname unless set otherwise
+func (r *CloudflareTunnelReconciler) dnsRecordName() string {
+	if r.TunEx.TunSpec.DNSRecordName != "" {
+		return r.TunEx.TunSpec.DNSRecordName
+	}
+	return r.TunEx.TunSpec.Domain
+}
+
+// desiredDNSRecord returns the CNAME record with the given name pointing at the tunnel
+func (r *CloudflareTunnelReconciler) desiredDNSRecord(name string) cloudflare.DNSRecord {
+	proxied := true
+	if r.TunEx.TunSpec.DNSProxied != nil {
+		proxied = *r.TunEx.TunSpec.DNSProxied
+	}
 	dnsRecord := cloudflare.DNSRecord{
 		Type:    "CNAME",
-		Name:    r.TunEx.TunSpec.Domain,
+		Name:    name,
 		Content: r.TunEx.TunnelID + constants.CNAMESuffix,
-		TTL:     0,
-		Proxied: &truePointer,
+		Proxied: &proxied,
+	}
+	// the TTL of proxied records is managed by Cloudflare, so it is left unset
+	if !proxied {
+		dnsRecord.TTL = 1
+		if r.TunEx.TunSpec.DNSTTL != nil {
+			dnsRecord.TTL = *r.TunEx.TunSpec.DNSTTL
+		}
+	}
+	return dnsRecord
+}
+
+func (r *CloudflareTunnelReconciler) createDNSCNAME(ctx context.Context) error {
+	zoneID, err := r.zoneID(ctx)
+	if err != nil {
+		return err
+	}
+	dnsRecord := r.desiredDNSRecord(r.dnsRecordName())
+
+	// the record written by the previous reconcile is updated directly, it only has to be looked up if it is gone
+	if r.TunEx.DNSRecordID != "" {
+		found, err := r.updateDNSRecordByID(ctx, zoneID, dnsRecord)
+		if err != nil || found {
+			return err
+		}
+	}
+
+	// records carrying our UID are ours even if the domain has been changed since they were created
+	owned, err := r.listOwnedDNSRecords(ctx, zoneID)
+	if err != nil {
+		r.logger.Error(err, "could not fetch owned dns list")
+		return err
+	}
+	owned = withoutIngressRecords(owned, ingressHostnames(r.TunEx.TunSpec))
+	if len(owned) > 0 {
+		// only one record is ever created for the domain, any other is a leftover and can be removed safely
+		for _, stale := range owned[1:] {
+			r.logger.V(1).Info("Deleting stale DNS record", "name", stale.Name)
+			if err := r.TunEx.CloudflareAPI.DeleteDNSRecord(ctx, zoneID, stale.ID); err != nil {
+				r.logger.Error(err, "could not delete stale DNS record")
+				return err
+			}
+		}
+		r.TunEx.DNSRecordID = owned[0].ID
+		if dnsRecordMatches(owned[0].DNSRecord, dnsRecord) {
+			r.logger.V(1).Info("DNS record exists and is up to date")
+			return nil
+		}
+		r.logger.V(1).Info("DNS record exists, updating", "name", owned[0].Name)
+		if err := r.retryDNS(func() error {
+			return r.TunEx.CloudflareAPI.UpdateDNSRecord(ctx, zoneID, owned[0].ID, dnsRecord)
+		}); err != nil {
+			r.logger.Error(err, "could not update DNS record")
+			return err
+		}
+		r.recordTunnelEvent(corev1.EventTypeNormal, "DNSRecordUpdated", "Updated DNS record "+dnsRecord.Name)
+		return nil
+	}
+
+	recordID, err := r.upsertDNSRecordByName(ctx, zoneID, dnsRecord)
+	if err != nil {
+		return err
+	}
+	r.TunEx.DNSRecordID = recordID
+	return nil
+}
+
+// upsertDNSRecordByName creates the record, or updates the existing one with the same name, and marks it as owned.
+// It returns the ID of the record.
+func (r *CloudflareTunnelReconciler) upsertDNSRecordByName(ctx context.Context, zoneID string, dnsRecord cloudflare.DNSRecord) (string, error) {
+	dnsRecords, err := r.TunEx.CloudflareAPI.DNSRecords(ctx, zoneID, cloudflare.DNSRecord{
+		Type: "CNAME",
+		Name: dnsRecord.Name,
+	})
+	if err != nil {
+		r.logger.Error(err, "could not fetch dns list")
+		return "", err
 	}
 	if len(dnsRecords) >= 2 {
 		err := fmt.Errorf("multiple DNS records exist")
 		r.logger.Error(err, "2 or more DNS CNAME records already exists for the given name. Unable to choose between one of them")
-		return err
+		return "", err
 	}
+	recordID := ""
 	if len(dnsRecords) == 1 {
-		r.logger.V(1).Info("DNS record exists, updating")
-		if err := r.TunEx.CloudflareAPI.UpdateDNSRecord(ctx, zoneID, dnsRecords[0].ID, dnsRecord); err != nil {
-			r.logger.Error(err, "could not update DNS record")
-			return err
+		recordID = dnsRecords[0].ID
+		if !dnsRecordMatches(dnsRecords[0], dnsRecord) {
+			r.logger.V(1).Info("DNS record exists, updating")
+			if err := r.retryDNS(func() error {
+				return r.TunEx.CloudflareAPI.UpdateDNSRecord(ctx, zoneID, recordID, dnsRecord)
+			}); err != nil {
+				r.logger.Error(err, "could not update DNS record")
+				return "", err
+			}
+			r.recordTunnelEvent(corev1.EventTypeNormal, "DNSRecordUpdated", "Updated DNS record "+dnsRecord.Name)
 		}
 	} else {
 		r.logger.V(1).Info("DNS record doesn't exist, creating")
-		_, err = r.TunEx.CloudflareAPI.CreateDNSRecord(ctx, zoneID, dnsRecord)
-		if err != nil {
+		if err := r.retryDNS(func() error {
+			created, err := r.TunEx.CloudflareAPI.CreateDNSRecord(ctx, zoneID, dnsRecord)
+			if err != nil {
+				return err
+			}
+			recordID = created.Result.ID
+			return nil
+		}); err != nil {
 			r.logger.Error(err, "could not create DNS record")
-			return err
+			return "", err
 		}
+		r.recordTunnelEvent(corev1.EventTypeNormal, "DNSRecordCreated", "Created DNS record "+dnsRecord.Name)
 	}
-	return nil
+	if err := r.markDNSRecordOwned(ctx, zoneID, recordID); err != nil {
+		r.logger.Error(err, "could not mark DNS record as owned")
+		return "", err
+	}
+	return recordID, nil
+}
+
+// repointDNSCNAME updates the CNAME straight away when the tunnel has been recreated with a new ID.
+// The regular DNS step runs last and can be delayed indefinitely while waiting for the target service,
+// during which the record would keep routing to a tunnel that no longer exists.
+func (r *CloudflareTunnelReconciler) repointDNSCNAME(ctx context.Context, previousTunnelID string) error {
+	if previousTunnelID == "" || previousTunnelID == r.TunEx.TunnelID {
+		return nil
+	}
+	r.logger.Info("Tunnel has been recreated, updating DNS record", "previous", previousTunnelID, "current", r.TunEx.TunnelID)
+	return r.reconcileDNS(ctx)
+}
+
+// dnsRecordMatches checks if the existing record already has the fields managed by the operator.
+// Fields that are set by Cloudflare, like the TTL of proxied records, are ignored to avoid perpetual updates.
+func dnsRecordMatches(existing, desired cloudflare.DNSRecord) bool {
+	if existing.Type != desired.Type ||
+		!strings.EqualFold(strings.TrimSuffix(existing.Name, "."), strings.TrimSuffix(desired.Name, ".")) ||
+		!strings.EqualFold(strings.TrimSuffix(existing.Content, "."), strings.TrimSuffix(desired.Content, ".")) {
+		return false
+	}
+	// a missing value means that the remote did not report it, which is not considered drift
+	if existing.Proxied != nil && desired.Proxied != nil && *existing.Proxied != *desired.Proxied {
+		return false
+	}
+	// the TTL is only set for records which are not proxied
+	if desired.TTL != 0 && existing.TTL != desired.TTL {
+		return false
+	}
+	return true
 }
 
 func (r *CloudflareTunnelReconciler) createSecret(ctx context.Context, cloudflareTunnel cfv2.CloudflareTunnel) (*corev1.Secret, error) {
 	// now first we create the secret containing the creds to the tunnel
 	// this is fully contained in the fetched tunnel secret including the tunnel id and account tag
-	var secretFetch corev1.Secret
+	files := r.fileNames()
+	if err := files.Validate(r.TunEx.TunnelID); err != nil {
+		r.logger.Error(err, "invalid file names")
+		return nil, err
+	}
 	secretCreate, err := models.Secret(models.SecretModel{
 		Name:              r.TunEx.Name,
 		Namespace:         r.TunEx.Namespace,
+		OwnerUID:          string(r.TunEx.UID),
 		TunnelToken:       r.TunEx.TunnelSecret,
 		TunnelID:          r.TunEx.TunnelID,
 		OriginCertificate: r.TunEx.OriginCertificate,
+		Files:             files,
 	}).GetSecret()
 	if err != nil {
 		return nil, err
 	}
 
-	// the secret needs to have an owner reference back to the controller
-	if err := ctrl.SetControllerReference(&cloudflareTunnel, secretCreate, r.Scheme); err != nil {
-		r.logger.Error(err, "could not create controller reference in secret")
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: secretCreate.Name, Namespace: r.TunEx.Namespace}}
+	var current *corev1.Secret
+	result, err := controllerutil.CreateOrUpdate(ctx, r.Client, secret, func() error {
+		current = secret.DeepCopy()
+		if secret.ResourceVersion == "" {
+			// the type is immutable, so it is only set on creation
+			secret.Type = secretCreate.Type
+		}
+		secret.Labels = mergeStrings(secret.Labels, secretCreate.Labels)
+		secret.Annotations = mergeStrings(secret.Annotations, secretCreate.Annotations)
+		// the API server only returns the encoded data, so it is set instead of stringData to be compared.
+		// It is replaced as a whole so that the keys of files which have been renamed are dropped.
+		secret.Data = map[string][]byte{}
+		for key, value := range secretCreate.Data {
+			secret.Data[key] = value
+		}
+		for key, value := range secretCreate.StringData {
+			secret.Data[key] = []byte(value)
+		}
+		secret.StringData = nil
+		// the secret needs to have an owner reference back to the controller
+		if err := ctrl.SetControllerReference(&cloudflareTunnel, secret, r.Scheme); err != nil {
+			r.logger.Error(err, "could not create controller reference in secret")
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		r.logger.Error(err, "could not create or update secret")
 		return nil, err
 	}
-	r.logger.V(1).Info("Owner Reference for Secret created")
+	if result == controllerutil.OperationResultUpdated {
+		r.logChanges("secret", current, secretCreate)
+	}
+	r.logger.V(1).Info("Secret reconciled", "result", result)
+	return secret, nil
+}
 
-	// try to get an existing secret with the given name
-	if err := r.Client.Get(ctx, types.NamespacedName{Name: secretCreate.Name, Namespace: r.TunEx.Namespace}, &secretFetch); err != nil {
-		if errors.IsNotFound(err) {
-			// error due to secret not being present, so, create one
-			r.logger.Info("creating secret...")
-			if err := r.Client.Create(ctx, secretCreate); err != nil {
-				r.logger.Error(err, "could not create secret in cluster")
-				return nil, err
-			}
-		}
-		return nil, err
-	} else {
-		// secret exists, so update it to ensure it is consistent
-		if err := r.Client.Update(ctx, secretCreate); err != nil {
-			r.logger.Error(err, "could not update secret")
-			return nil, err
-		}
+// mergeStrings returns current with the entries of desired set, keeping the ones added by others
+func mergeStrings(current, desired map[string]string) map[string]string {
+	if len(desired) == 0 {
+		return current
+	}
+	if current == nil {
+		current = map[string]string{}
+	}
+	for key, value := range desired {
+		current[key] = value
+	}
+	return current
+}
+
+// secretStore builds the external secret store configured in the spec along with the path to write to
+func (r *CloudflareTunnelReconciler) secretStore(ctx context.Context) (stores.Store, string, error) {
+	vault := r.TunEx.TunSpec.SecretStore.Vault
+	if vault == nil {
+		err := fmt.Errorf("no secret store configured")
+		r.logger.Error(err, "could not create secret store")
+		return nil, "", err
+	}
+
+	var tokenSecret corev1.Secret
+	if err := r.Client.Get(ctx, types.NamespacedName{Name: vault.TokenSecretName, Namespace: r.TunEx.Namespace}, &tokenSecret); err != nil {
+		r.logger.Error(err, "could not fetch vault token secret with name "+vault.TokenSecretName)
+		return nil, "", err
+	}
+	token, ok := tokenSecret.Data["token"]
+	if !ok {
+		err := fmt.Errorf("invalid key")
+		r.logger.Error(err, "key token not found in vault token secret")
+		return nil, "", err
+	}
+
+	return stores.Vault(stores.VaultModel{
+		Address: vault.Address,
+		Mount:   vault.Mount,
+		Token:   string(token),
+	}), vault.Path, nil
+}
+
+// fileNames returns the file names overridden in the spec, the models default the unset ones
+func (r *CloudflareTunnelReconciler) fileNames() models.FileNames {
+	if r.TunEx.TunSpec.Files == nil {
+		return models.FileNames{}
+	}
+	return models.FileNames{
+		Config:      r.TunEx.TunSpec.Files.Config,
+		Credentials: r.TunEx.TunSpec.Files.Credentials,
+		OriginCert:  r.TunEx.TunSpec.Files.OriginCert,
+	}
+}
+
+// exportCredentials writes the tunnel credentials from the generated secret to the external store, unless they are
+// already stored there. They are read back on every reconcile, so that credentials changed or deleted in the store
+// are written again.
+func (r *CloudflareTunnelReconciler) exportCredentials(ctx context.Context, store stores.Store, path string, secret *corev1.Secret) error {
+	data := make(map[string]string, len(secret.Data))
+	for key, value := range secret.Data {
+		data[key] = string(value)
+	}
+	stored, err := store.Read(ctx, path)
+	if err != nil {
+		r.logger.Error(err, "could not read credentials from secret store")
+		return err
+	}
+	if len(stored) != 0 && equality.Semantic.DeepEqual(stored, data) {
+		r.logger.V(1).Info("Credentials already exported to secret store")
+		return nil
 	}
-	return secretCreate, nil
+	if err := store.Write(ctx, path, data); err != nil {
+		r.logger.Error(err, "could not export credentials to secret store")
+		return err
+	}
+	r.logger.V(1).Info("Credentials exported to secret store")
+	return nil
 }
 
 func (r *CloudflareTunnelReconciler) createConfigMap(ctx context.Context, cloudflareTunnel cfv2.CloudflareTunnel, url string) (*corev1.ConfigMap, error) {
 	// now first we create the configMap containing the configuration to the tunnel
-	var configMapFetch corev1.ConfigMap
-	configMapCreate, err := models.ConfigMap(models.ConfigMapModel{
-		Name:       r.TunEx.Name,
-		Namespace:  r.TunEx.Namespace,
-		Service:    url,
-		TunnelID:   r.TunEx.TunnelID,
-		Domain:     r.TunEx.TunSpec.Domain,
-		OriginRequest: r.TunEx.TunSpec.Service.OriginRequest,
-		ConfigsDir: constants.ConfigsDir,
-	}).GetConfigMap()
+	configMapModel := models.ConfigMapModel{
+		Name:            r.TunEx.Name,
+		Namespace:       r.TunEx.Namespace,
+		OwnerUID:        string(r.TunEx.UID),
+		Service:         url,
+		TunnelID:        r.TunEx.TunnelID,
+		Domain:          r.TunEx.TunSpec.Domain,
+		OriginRequest:   r.TunEx.TunSpec.Service.OriginRequest,
+		NoHappyEyeballs: r.TunEx.TunSpec.Service.NoHappyEyeballs,
+		ConfigsDir:      constants.ConfigsDir,
+		Files:           r.fileNames(),
+	}
+	if proxy := r.TunEx.TunSpec.Service.Proxy; proxy != nil {
+		configMapModel.ProxyAddress = proxy.Address
+		configMapModel.ProxyPort = proxy.Port
+		configMapModel.ProxyType = proxy.Type
+	}
+	if timeouts := r.TunEx.TunSpec.Service.Timeouts; timeouts != nil {
+		configMapModel.ConnectTimeout = timeouts.ConnectTimeout
+		configMapModel.TLSTimeout = timeouts.TLSTimeout
+		configMapModel.TCPKeepAlive = timeouts.TCPKeepAlive
+	}
+	configMapModel.Retries = r.TunEx.TunSpec.Service.Retries
+	configMapModel.Path = r.TunEx.TunSpec.Service.Path
+	configMapModel.TLSPassthrough = r.TunEx.TunSpec.Service.TLSPassthrough
+	configMapModel.Ingress = r.TunEx.IngressRules
+	configMapCreate, err := models.ConfigMap(configMapModel).GetConfigMap()
 	if err != nil {
 		return nil, err
 	}
 
-	// the secret needs to have an owner reference back to the controller
-	if err := ctrl.SetControllerReference(&cloudflareTunnel, configMapCreate, r.Scheme); err != nil {
-		r.logger.Error(err, "could not create controller reference in configMap")
+	configMap := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: configMapCreate.Name, Namespace: r.TunEx.Namespace}}
+	var current *corev1.ConfigMap
+	result, err := controllerutil.CreateOrUpdate(ctx, r.Client, configMap, func() error {
+		current = configMap.DeepCopy()
+		configMap.Labels = mergeStrings(configMap.Labels, configMapCreate.Labels)
+		configMap.Annotations = mergeStrings(configMap.Annotations, configMapCreate.Annotations)
+		configMap.Data = configMapCreate.Data
+		// the configMap needs to have an owner reference back to the controller
+		if err := ctrl.SetControllerReference(&cloudflareTunnel, configMap, r.Scheme); err != nil {
+			r.logger.Error(err, "could not create controller reference in configMap")
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		r.logger.Error(err, "could not create or update ConfigMap")
 		return nil, err
 	}
-	r.logger.V(1).Info("Owner Reference for ConfigMap created")
+	if result == controllerutil.OperationResultUpdated {
+		r.detectConfigTampering(&cloudflareTunnel, current)
+		r.logChanges("ConfigMap", current, configMapCreate)
+	}
+	// the hash is only stored once the config map has been written, so that a failed write is not seen as tampering
+	r.TunEx.ConfigHash = configHash(configMapCreate.Data)
+	r.logger.V(1).Info("ConfigMap reconciled", "result", result)
+	return configMap, nil
+}
+
+// validateLogLevel checks that cloudflared accepts the log level, as it refuses to start otherwise
+func validateLogLevel(level cfv2.CloudflareTunnelLogLevel) error {
+	switch level {
+	case "", cfv2.LogLevelDebug, cfv2.LogLevelInfo, cfv2.LogLevelWarn, cfv2.LogLevelError, cfv2.LogLevelFatal:
+		return nil
+	}
+	return fmt.Errorf("invalid log level %q, must be one of debug, info, warn, error or fatal", level)
+}
+
+// validateTransport checks that cloudflared accepts the protocol to the edge, as it refuses to start otherwise
+func validateTransport(transport cfv2.CloudflareTunnelTransport) error {
+	switch transport {
+	case "", cfv2.TransportAuto, cfv2.TransportQUIC, cfv2.TransportHTTP2:
+		return nil
+	}
+	return fmt.Errorf("invalid transport %q, must be one of auto, quic or http2", transport)
+}
 
-	// try to get an existing secret with the given name
-	if err := r.Client.Get(ctx, types.NamespacedName{Name: configMapCreate.Name, Namespace: r.TunEx.Namespace}, &configMapFetch); err != nil {
+// deleteDeployment removes the deployment created for the resource once cloudflared is run outside of the operator,
+// so that the tunnel is not served by both
+func (r *CloudflareTunnelReconciler) deleteDeployment(ctx context.Context, cloudflareTunnel cfv2.CloudflareTunnel) error {
+	var deploymentFetch appsv1.Deployment
+	name := types.NamespacedName{Name: r.TunEx.Name + "-" + constants.ResourceSuffix, Namespace: r.TunEx.Namespace}
+	if err := r.Client.Get(ctx, name, &deploymentFetch); err != nil {
 		if errors.IsNotFound(err) {
-			// error due to secret not being present, so, create one
-			r.logger.Info("creating ConfigMap...")
-			if err := r.Client.Create(ctx, configMapCreate); err != nil {
-				r.logger.Error(err, "could not create ConfigMap in cluster")
-				return nil, err
-			}
-		}
-		return nil, err
-	} else {
-		// secret exists, so update it to ensure it is consistent
-		if err := r.Client.Update(ctx, configMapCreate); err != nil {
-			r.logger.Error(err, "could not update ConfigMap")
-			return nil, err
+			return nil
 		}
+		r.logger.Error(err, "could not fetch deployment")
+		return err
+	}
+	// only remove the deployment if it was created for this resource
+	if !metav1.IsControlledBy(&deploymentFetch, &cloudflareTunnel) {
+		return nil
+	}
+	r.logger.Info("deleting deployment...")
+	if err := r.Client.Delete(ctx, &deploymentFetch); err != nil && !errors.IsNotFound(err) {
+		r.logger.Error(err, "could not delete deployment")
+		return err
 	}
-	return configMapCreate, nil
+	return nil
 }
 
 func (r *CloudflareTunnelReconciler) createDeployment(ctx context.Context, cloudflareTunnel cfv2.CloudflareTunnel, secret *corev1.Secret, configMap *corev1.ConfigMap) (*appsv1.Deployment, error) {
-	// now first we create the configMap containing the configuration to the tunnel
-	var deploymentFetch appsv1.Deployment
-
+	// now first we create the deployment running the tunnel
 	tunnelDeploymentModel := models.DeploymentModel{
-		Name:       r.TunEx.Name,
-		Namespace:  r.TunEx.Namespace,
-		Replicas:   r.TunEx.TunSpec.Replicas,
-		TunnelID:   r.TunEx.TunnelID,
-		Secret:     secret,
-		ConfigMap:  configMap,
-		ConfigsDir: constants.ConfigsDir,
+		Name:               r.TunEx.Name,
+		Namespace:          r.TunEx.Namespace,
+		OwnerUID:           string(r.TunEx.UID),
+		Replicas:           r.TunEx.TunSpec.Replicas,
+		TunnelID:           r.TunEx.TunnelID,
+		Secret:             secret,
+		ConfigMap:          configMap,
+		ConfigsDir:         constants.ConfigsDir,
+		PodLabels:          r.TunEx.TunSpec.PodLabels,
+		AutomountToken:     r.TunEx.TunSpec.AutomountServiceAccountToken,
+		ServiceAccountName: r.TunEx.TunSpec.ServiceAccountName,
+		ImagePullSecrets:   r.TunEx.TunSpec.ImagePullSecrets,
+		MetricsExposed:     metricsEnabled(r.TunEx.TunSpec),
+		LivenessProbe:      r.TunEx.TunSpec.LivenessProbe,
+		ReadinessProbe:     r.TunEx.TunSpec.ReadinessProbe,
+		NodeSelector:       r.TunEx.TunSpec.NodeSelector,
+		Tolerations:        r.TunEx.TunSpec.Tolerations,
+		Affinity:           r.TunEx.TunSpec.Affinity,
+		GracePeriod:        r.TunEx.TunSpec.GracePeriodSeconds,
+		LogLevel:           r.TunEx.TunSpec.LogLevel,
+		TransportLogLevel:  r.TunEx.TunSpec.TransportLogLevel,
+		Transport:          r.TunEx.TunSpec.Transport,
+		Files:              r.fileNames(),
+		RefreshedAt:        r.TunEx.TokenRefreshedAt,
+		// the value is copied as is, so the pods are only restarted again once it is changed
+		RestartedAt:    cloudflareTunnel.Annotations[constants.RestartedAtAnnotation],
+		ConfigChecksum: r.TunEx.ConfigHash,
+	}
+
+	for _, level := range []cfv2.CloudflareTunnelLogLevel{r.TunEx.TunSpec.LogLevel, r.TunEx.TunSpec.TransportLogLevel} {
+		if err := validateLogLevel(level); err != nil {
+			r.logger.Error(err, "could not create deployment")
+			return nil, err
+		}
+	}
+	if err := validateTransport(r.TunEx.TunSpec.Transport); err != nil {
+		r.logger.Error(err, "could not create deployment")
+		return nil, err
 	}
 
 	if r.TunEx.TunSpec.Container != nil {
+		if r.TunEx.TunSpec.Container.Name != "" {
+			if errs := validation.IsDNS1123Label(r.TunEx.TunSpec.Container.Name); len(errs) != 0 {
+				err := fmt.Errorf("invalid container name %q: %s", r.TunEx.TunSpec.Container.Name, strings.Join(errs, ", "))
+				r.logger.Error(err, "could not create deployment")
+				return nil, err
+			}
+			tunnelDeploymentModel.ContainerName = r.TunEx.TunSpec.Container.Name
+		}
 		if r.TunEx.TunSpec.Container.Image != "" {
+			if err := validateImage(r.TunEx.TunSpec.Container.Image); err != nil {
+				r.logger.Error(err, "could not create deployment")
+				return nil, err
+			}
 			tunnelDeploymentModel.Image = r.TunEx.TunSpec.Container.Image
 		}
 		if r.TunEx.TunSpec.Container.ImagePullPolicy != "" {
@@ -430,6 +1389,13 @@ func (r *CloudflareTunnelReconciler) createDeployment(ctx context.Context, cloud
 		if len(r.TunEx.TunSpec.Container.Args) != 0 {
 			tunnelDeploymentModel.Args = r.TunEx.TunSpec.Container.Args
 		}
+		tunnelDeploymentModel.Size = r.TunEx.TunSpec.Container.Size
+		tunnelDeploymentModel.Resources = r.TunEx.TunSpec.Container.Resources
+		tunnelDeploymentModel.TerminationMessagePolicy = r.TunEx.TunSpec.Container.TerminationMessagePolicy
+		tunnelDeploymentModel.SecurityContext = r.TunEx.TunSpec.Container.SecurityContext
+	}
+	if r.TunEx.TunSpec.Service.Protocol == protocolUnix {
+		tunnelDeploymentModel.SocketVolume = &r.TunEx.TunSpec.Service.Socket.Volume
 	}
 
 	deploymentCreate := models.Deployment(tunnelDeploymentModel).GetDeployment()
@@ -440,67 +1406,280 @@ func (r *CloudflareTunnelReconciler) createDeployment(ctx context.Context, cloud
 		return nil, err
 	}
 	r.logger.V(1).Info("Owner Reference for deployment created")
+	if err := setTemplateHash(deploymentCreate); err != nil {
+		r.logger.Error(err, "could not hash deployment template")
+		return nil, err
+	}
 
-	// try to get an existing deployment with the given name
-	if err := r.Client.Get(ctx, types.NamespacedName{Name: deploymentCreate.Name, Namespace: r.TunEx.Namespace}, &deploymentFetch); err != nil {
-		if errors.IsNotFound(err) {
-			// error due to secret not being present, so, create one
-			r.logger.Info("creating deployment...")
-			if err := r.Client.Create(ctx, deploymentCreate); err != nil {
-				r.logger.Error(err, "could not create deployment in cluster")
-				return nil, err
-			}
+	deployed, changed := "", false
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: deploymentCreate.Name, Namespace: r.TunEx.Namespace}}
+	result, err := controllerutil.CreateOrUpdate(ctx, r.Client, deployment, func() error {
+		if deployment.ResourceVersion == "" {
+			deploymentCreate.DeepCopyInto(deployment)
+			return nil
+		}
+		deployed = deploymentTunnelID(deployment)
+		// only the fields that differ are updated, to keep the state of an ongoing rollout
+		var deploymentUpdate *appsv1.Deployment
+		deploymentUpdate, changed = mergeDeployment(deployment, deploymentCreate)
+		templateChanged := !equality.Semantic.DeepEqual(deploymentUpdate.Spec.Template, deployment.Spec.Template)
+		if changed {
+			r.logChanges("deployment", deployment, deploymentCreate)
+			deploymentUpdate.DeepCopyInto(deployment)
+		}
+		if updateRolloutAnnotation(deployment, templateChanged, time.Now()) {
+			r.logger.V(1).Info("Rollout annotation updated", "inProgress", templateChanged)
 		}
+		return nil
+	})
+	if err != nil {
+		r.logger.Error(err, "could not create or update deployment")
 		return nil, err
-	} else {
-		// deployment exists, so update it to ensure it is consistent
-		if err := r.Client.Update(ctx, deploymentCreate); err != nil {
-			r.logger.Error(err, "could not update deployment")
-			return nil, err
+	}
+	r.logger.V(1).Info("Deployment reconciled", "result", result)
+	switch result {
+	case controllerutil.OperationResultCreated:
+		r.recordEvent(&cloudflareTunnel, corev1.EventTypeNormal, "DeploymentCreated", "Created deployment "+deployment.Name)
+	case controllerutil.OperationResultUpdated:
+		r.recordEvent(&cloudflareTunnel, corev1.EventTypeNormal, "DeploymentUpdated", "Updated deployment "+deployment.Name)
+	}
+	if result == controllerutil.OperationResultCreated {
+		// the pods of a new deployment are still starting
+		r.TunEx.DeploymentRollingOut = true
+		return deployment, nil
+	}
+	if deployed != r.TunEx.TunnelID {
+		// the pods still run with the credentials of another tunnel, e.g. after it has been recreated
+		r.logger.Info("Deployment references a stale tunnel, forcing a rollout", "deployed", deployed, "current", r.TunEx.TunnelID)
+	}
+	// the status of an updated deployment is stale, so it is checked again on the next reconcile
+	r.TunEx.DeploymentRollingOut = changed || !deploymentRolledOut(deployment)
+	return deployment, nil
+}
+
+// deploymentTunnelID returns the ID of the tunnel the pods of the deployment have been started with
+func deploymentTunnelID(deployment *appsv1.Deployment) string {
+	return deployment.Spec.Template.Annotations[constants.TunnelIDAnnotation]
+}
+
+// createMetricsService creates the service exposing the cloudflared metrics when enabled, and removes it otherwise
+func (r *CloudflareTunnelReconciler) createMetricsService(ctx context.Context, cloudflareTunnel cfv2.CloudflareTunnel) error {
+	serviceCreate := models.MetricsService(models.MetricsServiceModel{
+		Name:      r.TunEx.Name,
+		Namespace: r.TunEx.Namespace,
+		OwnerUID:  string(r.TunEx.UID),
+		TunnelID:  r.TunEx.TunnelID,
+	}).GetService()
+
+	if !metricsEnabled(r.TunEx.TunSpec) {
+		var serviceFetch corev1.Service
+		if err := r.Client.Get(ctx, types.NamespacedName{Name: serviceCreate.Name, Namespace: r.TunEx.Namespace}, &serviceFetch); err != nil {
+			if errors.IsNotFound(err) {
+				return nil
+			}
+			r.logger.Error(err, "could not fetch metrics service")
+			return err
+		}
+		// only remove the service if it was created for this resource
+		if !metav1.IsControlledBy(&serviceFetch, &cloudflareTunnel) {
+			return nil
+		}
+		r.logger.Info("deleting metrics service...")
+		if err := r.Client.Delete(ctx, &serviceFetch); err != nil && !errors.IsNotFound(err) {
+			r.logger.Error(err, "could not delete metrics service")
+			return err
+		}
+		return nil
+	}
+
+	service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: serviceCreate.Name, Namespace: r.TunEx.Namespace}}
+	var current *corev1.Service
+	result, err := controllerutil.CreateOrUpdate(ctx, r.Client, service, func() error {
+		current = service.DeepCopy()
+		service.Labels = mergeStrings(service.Labels, serviceCreate.Labels)
+		// only the fields of the model are set, the cluster IP and the other defaults of the API server are kept
+		service.Spec.Type = serviceCreate.Spec.Type
+		service.Spec.Selector = serviceCreate.Spec.Selector
+		service.Spec.Ports = serviceCreate.Spec.Ports
+		if err := ctrl.SetControllerReference(&cloudflareTunnel, service, r.Scheme); err != nil {
+			r.logger.Error(err, "could not create controller reference in metrics service")
+			return err
 		}
+		return nil
+	})
+	if err != nil {
+		r.logger.Error(err, "could not create or update metrics service")
+		return err
+	}
+	if result == controllerutil.OperationResultUpdated {
+		r.logChanges("metrics service", current, serviceCreate)
 	}
-	return deploymentCreate, nil
+	r.logger.V(1).Info("Metrics service reconciled", "result", result)
+	return nil
 }
 
 func (r *CloudflareTunnelReconciler) getTargetURL(ctx context.Context) (string, error) {
+	url, targetPort, err := r.serviceURL(ctx, r.TunEx.TunSpec.Service)
+	if err != nil {
+		return "", err
+	}
+	r.TunEx.TargetPort = targetPort
+	return url, nil
+}
+
+// serviceURL returns the URL cloudflared reaches the origin of the service at, along with the matched service port
+func (r *CloudflareTunnelReconciler) serviceURL(ctx context.Context, service *cfv2.CloudflareTunnelService) (string, corev1.ServicePort, error) {
+	// the origin is not a service of the cluster, so there is nothing to look up
+	if service.OriginURL != "" {
+		return originURL(service), corev1.ServicePort{}, nil
+	}
+	// the socket is reached through the shared volume, so there is no target service to look up
+	if service.Protocol == protocolUnix {
+		return socketURL(service.Socket), corev1.ServicePort{}, nil
+	}
 	// first get the url for the targeted service
 	var targetService corev1.Service
+	var targetPort corev1.ServicePort
 	if err := r.Client.Get(ctx, types.NamespacedName{
-		Name:      r.TunEx.TunSpec.Service.Name,
-		Namespace: r.TunEx.TunSpec.Service.Namespace,
+		Name:      service.Name,
+		Namespace: service.Namespace,
 	}, &targetService); err != nil {
 		if errors.IsNotFound(err) {
 			// error due to service not being present
 			r.logger.Error(err, "target service not present")
 		}
-		return "", err
+		return "", targetPort, err
 	} else {
 		// service exists, check if port is open
-		var port corev1.ServicePort
+		found := false
 		for _, servicePort := range targetService.Spec.Ports {
-			if servicePort.Port == r.TunEx.TunSpec.Service.Port {
+			if portMatches(servicePort, service.Port) {
 				r.logger.V(1).Info("Ports matched")
-				port = servicePort
+				targetPort = servicePort
+				found = true
 				break
 			}
 		}
-		if &port == nil {
+		if !found {
+			err := fmt.Errorf("port %s not found on service %s", service.Port.String(), targetService.Name)
 			r.logger.Error(err, "port doesn't exist in service")
-			return "", err
+			return "", targetPort, err
 		}
 	}
 
-	// if the service is a LoadBalancer then use the ingress IP as the host
+	// TLS passthrough forwards the raw connections, so the origin is always reached over tcp
+	protocol := service.Protocol
+	if service.TLSPassthrough {
+		protocol = "tcp"
+	}
+
+	// if the service is a LoadBalancer then use the ingress IP, or the hostname some providers report instead, as the host
 	if targetService.Spec.Type == corev1.ServiceTypeLoadBalancer {
-		return r.TunEx.TunSpec.Service.Protocol + "://" + targetService.Status.LoadBalancer.Ingress[0].IP + ":" + strconv.Itoa(int(r.TunEx.TunSpec.Service.Port)), nil
+		host := ""
+		if ingress := targetService.Status.LoadBalancer.Ingress; len(ingress) != 0 {
+			host = ingress[0].IP
+			if host == "" {
+				host = ingress[0].Hostname
+			}
+		}
+		if host == "" {
+			return "", targetPort, &waitingError{
+				Reason:  "WaitingForLoadBalancer",
+				Message: "target service has no load balancer ingress yet",
+			}
+		}
+		return protocol + "://" + net.JoinHostPort(host, strconv.Itoa(int(targetPort.Port))), targetPort, nil
 	}
 	// else generate the URL of the form `service-name.namespace:port`
 	// see https://kubernetes.io/docs/concepts/services-networking/dns-pod-service/#a-aaaa-records
-	return r.TunEx.TunSpec.Service.Protocol + "://" + r.TunEx.TunSpec.Service.Name + "." + r.TunEx.TunSpec.Service.Namespace + ":" + strconv.Itoa(int(r.TunEx.TunSpec.Service.Port)), nil
+	return protocol + "://" + service.Name + "." + service.Namespace + ":" + strconv.Itoa(int(targetPort.Port)), targetPort, nil
+}
+
+// portMatches checks if the port of the service is the one referenced by its number or its name
+func portMatches(servicePort corev1.ServicePort, port intstr.IntOrString) bool {
+	if port.Type == intstr.String {
+		return servicePort.Name == port.StrVal
+	}
+	return servicePort.Port == port.IntVal
+}
+
+// portSet checks if the port is referenced by a number or a name
+func portSet(port intstr.IntOrString) bool {
+	if port.Type == intstr.String {
+		return port.StrVal != ""
+	}
+	return port.IntVal != 0
+}
+
+// countReadyEndpoints counts the distinct ready endpoints backing the target service
+func (r *CloudflareTunnelReconciler) countReadyEndpoints(ctx context.Context) (int32, error) {
+	var endpointSlices discoveryv1.EndpointSliceList
+	if err := r.Client.List(ctx, &endpointSlices,
+		client.InNamespace(r.TunEx.TunSpec.Service.Namespace),
+		client.MatchingLabels{discoveryv1.LabelServiceName: r.TunEx.TunSpec.Service.Name},
+	); err != nil {
+		r.logger.Error(err, "could not list endpoint slices of target service")
+		return 0, err
+	}
+
+	// the same endpoint can appear in multiple slices, e.g. one per address family
+	ready := map[string]struct{}{}
+	for _, endpointSlice := range endpointSlices.Items {
+		for _, endpoint := range endpointSlice.Endpoints {
+			// a missing ready condition has to be interpreted as ready
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			key := strings.Join(endpoint.Addresses, ",")
+			if endpoint.TargetRef != nil {
+				key = string(endpoint.TargetRef.UID) + "/" + endpoint.TargetRef.Name
+			}
+			ready[key] = struct{}{}
+		}
+	}
+	return int32(len(ready)), nil
+}
+
+// setEndpointsDegradedCondition reports the tunnel as degraded while the target service has no ready endpoints, in
+// which case the replicas fall back to the minimum
+func setEndpointsDegradedCondition(cloudflareTunnel *cfv2.CloudflareTunnel, readyEndpoints int32) {
+	if readyEndpoints == 0 {
+		meta.SetStatusCondition(&cloudflareTunnel.Status.Conditions, metav1.Condition{
+			Type:               cfv2.ConditionDegraded,
+			Status:             metav1.ConditionTrue,
+			ObservedGeneration: cloudflareTunnel.Generation,
+			Reason:             "NoReadyEndpoints",
+			Message:            "target service has no ready endpoints, running the minimum replicas",
+		})
+		return
+	}
+	meta.SetStatusCondition(&cloudflareTunnel.Status.Conditions, metav1.Condition{
+		Type:               cfv2.ConditionDegraded,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: cloudflareTunnel.Generation,
+		Reason:             "ReadyEndpoints",
+		Message:            "the replicas are derived from the ready endpoints of the target service",
+	})
+}
+
+// replicasFromEndpoints computes the replicas needed to serve the ready endpoints, bounded by the configured limits
+func replicasFromEndpoints(readyEndpoints int32, config *cfv2.CloudflareTunnelReplicasFromEndpoints) int32 {
+	endpointsPerReplica := config.EndpointsPerReplica
+	if endpointsPerReplica < 1 {
+		endpointsPerReplica = 1
+	}
+	replicas := (readyEndpoints + endpointsPerReplica - 1) / endpointsPerReplica
+	if replicas < config.MinReplicas {
+		replicas = config.MinReplicas
+	}
+	if config.MaxReplicas > 0 && replicas > config.MaxReplicas {
+		replicas = config.MaxReplicas
+	}
+	return replicas
 }
 
 func (r *CloudflareTunnelReconciler) updateStatus(ctx context.Context, cloudflareTunnel *cfv2.CloudflareTunnel) error {
-	accountResourceContainer := cloudflare.AccountIdentifier(r.TunEx.CloudflareAPI.AccountID)
+	accountResourceContainer := cloudflare.AccountIdentifier(r.TunEx.AccountTag)
 	tunnelConnections, err := r.TunEx.CloudflareAPI.TunnelConnections(ctx, accountResourceContainer, r.TunEx.TunnelID)
 	if err != nil {
 		r.logger.Error(err, "could not fetch tunnel connections")
@@ -508,10 +1687,16 @@ func (r *CloudflareTunnelReconciler) updateStatus(ctx context.Context, cloudflar
 	}
 	var connections []cfv2.CloudflareTunnelConnections
 	for _, connectionMeta := range tunnelConnections { // 0 index since it will always return a single tunnel
+		// the remote does not report when connectors that are still starting have been run
+		var created metav1.Time
+		if connectionMeta.RunAt != nil {
+			// the status only stores seconds, a finer time would differ from the stored one at every reconcile
+			created = metav1.Time{Time: connectionMeta.RunAt.Truncate(time.Second)}
+		}
 		for _, connection := range connectionMeta.Connections {
 			connections = append(connections, cfv2.CloudflareTunnelConnections{
 				ConnectorID:  connectionMeta.ID,
-				Created:      metav1.Time{Time: *connectionMeta.RunAt},
+				Created:      created,
 				Architecture: connectionMeta.Arch,
 				Version:      connectionMeta.Version,
 				OriginIP:     connection.OriginIP,
@@ -519,13 +1704,109 @@ func (r *CloudflareTunnelReconciler) updateStatus(ctx context.Context, cloudflar
 			})
 		}
 	}
-	cloudflareTunnel.Status = cfv2.CloudflareTunnelStatus{
-		TunnelID:    r.TunEx.TunnelID,
-		Connections: connections,
+	cloudflareTunnel.Status.TunnelID = r.TunEx.TunnelID
+	cloudflareTunnel.Status.DNSRecordID = r.TunEx.DNSRecordID
+	cloudflareTunnel.Status.Zone = r.TunEx.TunSpec.Zone
+	cloudflareTunnel.Status.ZoneID = r.TunEx.ZoneID
+	cloudflareTunnel.Status.IngressZones = r.TunEx.IngressZones
+	cloudflareTunnel.Status.ConfigHash = r.TunEx.ConfigHash
+	cloudflareTunnel.Status.ServiceMonitor = r.TunEx.ServiceMonitor
+	cloudflareTunnel.Status.Connections = connections
+	// the replicas of an external cloudflared are unknown, any connector is then enough for it to be healthy
+	expected := int32(1)
+	if !r.TunEx.TunSpec.DNSOnly && deploymentManaged(r.TunEx.TunSpec) {
+		expected = r.TunEx.TunSpec.Replicas
 	}
+	cloudflareTunnel.Status.TunnelStatus, cloudflareTunnel.Status.ActiveConnections, cloudflareTunnel.Status.ConnectorIDs =
+		tunnelHealth(tunnelConnections, expected)
 	return nil
 }
 
+// setDeploymentReadyCondition reports whether the pods of the deployment have been rolled out
+func (r *CloudflareTunnelReconciler) setDeploymentReadyCondition(cloudflareTunnel *cfv2.CloudflareTunnel) {
+	condition := metav1.Condition{
+		Type:               cfv2.ConditionDeploymentReady,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: cloudflareTunnel.Generation,
+		Reason:             "Available",
+		Message:            "the pods of the deployment are up to date and available",
+	}
+	if r.TunEx.DeploymentRollingOut {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "RollingOut"
+		condition.Message = "the pods of the deployment are being replaced"
+	}
+	meta.SetStatusCondition(&cloudflareTunnel.Status.Conditions, condition)
+}
+
+// deploymentManaged reports whether cloudflared is run by the operator, which is the default
+func deploymentManaged(spec cfv2.CloudflareTunnelSpec) bool {
+	return spec.ManageDeployment == nil || *spec.ManageDeployment
+}
+
+// dnsManaged reports whether the operator manages the DNS records of the resource, which is the default
+func dnsManaged(spec cfv2.CloudflareTunnelSpec) bool {
+	return spec.ManageDNS == nil || *spec.ManageDNS
+}
+
+// setEndpointStatus reports where the tunnel can be reached, once the domain has been routed to it
+func (r *CloudflareTunnelReconciler) setEndpointStatus(cloudflareTunnel *cfv2.CloudflareTunnel) {
+	cloudflareTunnel.Status.URL = "https://" + r.TunEx.TunSpec.Domain
+	cloudflareTunnel.Status.CNAMETarget = ""
+	// the load balancer is part of the DNS managed by the operator, without it the records point to the tunnel
+	if r.TunEx.TunSpec.LoadBalancer == nil || !dnsManaged(r.TunEx.TunSpec) {
+		cloudflareTunnel.Status.CNAMETarget = r.TunEx.TunnelID + constants.CNAMESuffix
+	}
+}
+
+// validateTunnelToken checks that the decoded token contains the credentials cloudflared needs for the tunnel
+func validateTunnelToken(decoded []byte, tunnelID string) error {
+	var token struct {
+		AccountTag   string `json:"a"`
+		TunnelSecret string `json:"s"`
+		TunnelID     string `json:"t"`
+	}
+	if err := json.Unmarshal(decoded, &token); err != nil {
+		return fmt.Errorf("tunnel token is not valid JSON: %w", err)
+	}
+	if token.AccountTag == "" || token.TunnelSecret == "" || token.TunnelID == "" {
+		return fmt.Errorf("tunnel token is missing the account tag, tunnel secret or tunnel ID")
+	}
+	if _, err := base64.StdEncoding.DecodeString(token.TunnelSecret); err != nil {
+		return fmt.Errorf("tunnel secret is not valid base64: %w", err)
+	}
+	if token.TunnelID != tunnelID {
+		return fmt.Errorf("tunnel token is for tunnel %s instead of %s", token.TunnelID, tunnelID)
+	}
+	return nil
+}
+
+// resyncInterval returns how long to wait before reconciling a successfully reconciled resource again, so that
+// changes made to the tunnel or the DNS record outside of the operator are reverted
+func (r *CloudflareTunnelReconciler) resyncInterval() time.Duration {
+	if r.ResyncInterval <= 0 {
+		return constants.ResyncInterval
+	}
+	return r.ResyncInterval
+}
+
+// remoteContext returns a context bounding the calls to the Cloudflare API of a reconcile
+func (r *CloudflareTunnelReconciler) remoteContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.RemoteTimeout <= 0 {
+		return context.WithTimeout(ctx, constants.RemoteTimeout)
+	}
+	return context.WithTimeout(ctx, r.RemoteTimeout)
+}
+
+// remoteTunnelName returns the name of the tunnel in the Cloudflare account. It is the name of the resource,
+// prefixed with its namespace if enabled to avoid collisions between namespaces sharing an account.
+func (r *CloudflareTunnelReconciler) remoteTunnelName() string {
+	if r.NamespacedNames {
+		return r.TunEx.Namespace + "-" + r.TunEx.Name
+	}
+	return r.TunEx.Name
+}
+
 func generateTunnelSecret() (string, error) {
 	randomBytes := make([]byte, 32)
 	_, err := rand.Read(randomBytes)
@@ -0,0 +1,1688 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	cfv2 "github.com/beezlabs-org/cloudflare-tunnel-operator/api/v1alpha2"
+	"github.com/beezlabs-org/cloudflare-tunnel-operator/controllers/constants"
+	cfclient "github.com/beezlabs-org/cloudflare-tunnel-operator/internal/cloudflare"
+)
+
+func newTestReconciler(objs ...client.Object) *CloudflareTunnelReconciler {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = cfv2.AddToScheme(scheme)
+	return &CloudflareTunnelReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build(),
+		Scheme: scheme,
+	}
+}
+
+// newReconcileFixture returns a reconciler talking to remote, whose cluster holds the tunnel along with its namespace,
+// its credentials and its target service. The given objects are added, replacing the default ones of the same name.
+func newReconcileFixture(remote *cfclient.Fake, tunnel *cfv2.CloudflareTunnel, objs ...client.Object) *CloudflareTunnelReconciler {
+	defaults := []client.Object{
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: tunnel.Namespace}},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "credentials", Namespace: tunnel.Namespace},
+			Data: map[string][]byte{
+				"accountID":         []byte("account"),
+				"token":             []byte("token"),
+				"originCertificate": []byte("certificate"),
+			},
+		},
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: tunnel.Namespace},
+			Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 80}}},
+		},
+	}
+	all := append([]client.Object{tunnel}, objs...)
+	for _, obj := range defaults {
+		replaced := false
+		for _, given := range objs {
+			replaced = replaced || reflect.TypeOf(given) == reflect.TypeOf(obj) && client.ObjectKeyFromObject(given) == client.ObjectKeyFromObject(obj)
+		}
+		if !replaced {
+			all = append(all, obj)
+		}
+	}
+	r := newTestReconciler(all...)
+	r.NewCloudflareClient = func(token, accountID string) (cfclient.CloudflareClient, error) {
+		return remote, nil
+	}
+	return r
+}
+
+func newTestTunnel(namespace string) *cfv2.CloudflareTunnel {
+	return &cfv2.CloudflareTunnel{
+		ObjectMeta: metav1.ObjectMeta{Name: "tunnel", Namespace: namespace},
+		Spec: cfv2.CloudflareTunnelSpec{
+			Domain:          "app.example.com",
+			Zone:            "example.com",
+			TokenSecretName: "credentials",
+			Replicas:        1,
+			Service: &cfv2.CloudflareTunnelService{
+				Name:      "app",
+				Namespace: namespace,
+				Protocol:  "http",
+				Port:      intstr.FromInt(80),
+			},
+		},
+	}
+}
+
+func TestReconcileTerminatingNamespace(t *testing.T) {
+	namespace := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "terminating"},
+		Status:     corev1.NamespaceStatus{Phase: corev1.NamespaceTerminating},
+	}
+	r := newTestReconciler(namespace, newTestTunnel(namespace.Name))
+
+	result, err := r.Reconcile(context.Background(), ctrl.Request{
+		NamespacedName: types.NamespacedName{Name: "tunnel", Namespace: namespace.Name},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if result != (ctrl.Result{}) {
+		t.Errorf("expected no requeue, got %v", result)
+	}
+	var deployments appsv1.DeploymentList
+	if err := r.Client.List(context.Background(), &deployments); err != nil {
+		t.Fatal(err)
+	}
+	if len(deployments.Items) != 0 {
+		t.Errorf("expected no deployments to be created, got %d", len(deployments.Items))
+	}
+}
+
+func TestDecodeCredentials(t *testing.T) {
+	multiAccount := map[string][]byte{
+		"accounts": []byte(`{"account-a": "token-a", "account-b": "token-b"}`),
+	}
+	tests := []struct {
+		name         string
+		data         map[string][]byte
+		tokenKey     string
+		accountIDKey string
+		accountID    string
+		wantTag      string
+		wantToken    string
+		wantErr      bool
+	}{
+		{
+			name:      "single pair",
+			data:      map[string][]byte{"accountID": []byte("account-a"), "token": []byte("token-a")},
+			wantTag:   "account-a",
+			wantToken: "token-a",
+		},
+		{
+			name:      "single pair with matching account",
+			data:      map[string][]byte{"accountID": []byte("account-a"), "token": []byte("token-a")},
+			accountID: "account-a",
+			wantTag:   "account-a",
+			wantToken: "token-a",
+		},
+		{
+			name:      "single pair with other account",
+			data:      map[string][]byte{"accountID": []byte("account-a"), "token": []byte("token-a")},
+			accountID: "account-b",
+			wantErr:   true,
+		},
+		{
+			name:      "multiple accounts",
+			data:      multiAccount,
+			accountID: "account-b",
+			wantTag:   "account-b",
+			wantToken: "token-b",
+		},
+		{
+			name:      "multiple accounts with missing account",
+			data:      multiAccount,
+			accountID: "account-c",
+			wantErr:   true,
+		},
+		{
+			name:    "multiple accounts without selection",
+			data:    multiAccount,
+			wantErr: true,
+		},
+		{
+			name:      "token without account",
+			data:      map[string][]byte{"token": []byte("token-a")},
+			wantToken: "token-a",
+		},
+		{
+			name:      "token with selected account",
+			data:      map[string][]byte{"token": []byte("token-a")},
+			accountID: "account-a",
+			wantTag:   "account-a",
+			wantToken: "token-a",
+		},
+		{
+			name:    "missing token",
+			data:    map[string][]byte{"accountID": []byte("account-a")},
+			wantErr: true,
+		},
+		{
+			name:         "custom keys",
+			data:         map[string][]byte{"cf-account-id": []byte("account-a"), "cf-api-token": []byte("token-a")},
+			tokenKey:     "cf-api-token",
+			accountIDKey: "cf-account-id",
+			wantTag:      "account-a",
+			wantToken:    "token-a",
+		},
+		{
+			name:     "default keys with custom token key",
+			data:     map[string][]byte{"accountID": []byte("account-a"), "token": []byte("token-a")},
+			tokenKey: "cf-api-token",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := credentialKeysOf(cfv2.CloudflareTunnelSpec{TokenKey: tt.tokenKey, AccountIDKey: tt.accountIDKey})
+			tag, token, err := decodeCredentials(tt.data, keys, tt.accountID)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if tag != tt.wantTag || token != tt.wantToken {
+				t.Errorf("expected %s/%s, got %s/%s", tt.wantTag, tt.wantToken, tag, token)
+			}
+		})
+	}
+}
+
+func TestAPIKeyEmail(t *testing.T) {
+	apiKey := map[string][]byte{"apiKey": []byte("key"), "email": []byte("user@example.com")}
+	tests := []struct {
+		name      string
+		data      map[string][]byte
+		apiKeyKey string
+		authType  cfv2.CloudflareTunnelAuthType
+		wantEmail string
+		wantErr   bool
+	}{
+		{name: "token", data: map[string][]byte{"token": []byte("token")}},
+		{name: "detected API key", data: apiKey, wantEmail: "user@example.com"},
+		{name: "API key without email", data: map[string][]byte{"apiKey": []byte("key"), "token": []byte("token")}},
+		{name: "token selected", data: apiKey, authType: cfv2.AuthToken},
+		{name: "API key selected", data: apiKey, authType: cfv2.AuthAPIKey, wantEmail: "user@example.com"},
+		{
+			name:     "API key selected without email",
+			data:     map[string][]byte{"apiKey": []byte("key")},
+			authType: cfv2.AuthAPIKey,
+			wantErr:  true,
+		},
+		{name: "API key selected without key", data: map[string][]byte{"token": []byte("token")}, authType: cfv2.AuthAPIKey, wantErr: true},
+		{
+			name:      "custom API key key",
+			data:      map[string][]byte{"cf-api-key": []byte("key"), "email": []byte("user@example.com")},
+			apiKeyKey: "cf-api-key",
+			wantEmail: "user@example.com",
+		},
+		{name: "default API key key with custom key", data: apiKey, apiKeyKey: "cf-api-key", authType: cfv2.AuthAPIKey, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			email, err := apiKeyEmail(tt.data, credentialKeysOf(cfv2.CloudflareTunnelSpec{APIKeyKey: tt.apiKeyKey}), tt.authType)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if email != tt.wantEmail {
+				t.Errorf("expected email %q, got %q", tt.wantEmail, email)
+			}
+		})
+	}
+}
+
+func TestDetectAccountTag(t *testing.T) {
+	tests := []struct {
+		name     string
+		accounts []cloudflare.Account
+		wantTag  string
+		wantErr  bool
+	}{
+		{name: "single account", accounts: []cloudflare.Account{{ID: "account-a"}}, wantTag: "account-a"},
+		{name: "multiple accounts", accounts: []cloudflare.Account{{ID: "account-a"}, {ID: "account-b"}}, wantErr: true},
+		{name: "no account", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote := cfclient.NewFake()
+			remote.AccountList = tt.accounts
+			r := newTestReconciler()
+			r.NewCloudflareClient = func(token, accountID string) (cfclient.CloudflareClient, error) {
+				return remote, nil
+			}
+			tag, err := r.detectAccountTag(context.Background(), "token", "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if tag != tt.wantTag {
+				t.Errorf("expected account %q, got %q", tt.wantTag, tag)
+			}
+		})
+	}
+
+	// an account granted to the token since the last reconcile makes the detection ambiguous right away
+	remote := cfclient.NewFake()
+	remote.AccountList = []cloudflare.Account{{ID: "account-a"}}
+	r := newTestReconciler()
+	r.Metadata = NewMetadataCache(time.Minute)
+	r.NewCloudflareClient = func(token, accountID string) (cfclient.CloudflareClient, error) {
+		return remote, nil
+	}
+	if tag, err := r.detectAccountTag(context.Background(), "token", ""); err != nil || tag != "account-a" {
+		t.Fatalf("expected account-a, got %q and %v", tag, err)
+	}
+	remote.AccountList = append(remote.AccountList, cloudflare.Account{ID: "account-b"})
+	if _, err := r.detectAccountTag(context.Background(), "token", ""); err == nil {
+		t.Error("expected the change of the accounts of the token to be detected")
+	}
+}
+
+func TestReconcileDetectsAccount(t *testing.T) {
+	remote := cfclient.NewFake("example.com")
+	remote.AccountList = []cloudflare.Account{{ID: "account-a"}}
+	tunnel := newTestTunnel("default")
+	tunnel.UID = "uid"
+	r := newTestReconciler(
+		tunnel,
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+		// the secret only holds the token
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "credentials", Namespace: "default"},
+			Data: map[string][]byte{
+				"token":             []byte("token"),
+				"originCertificate": []byte("certificate"),
+			},
+		},
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+			Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 80}}},
+		},
+	)
+	accounts := map[string]bool{}
+	r.NewCloudflareClient = func(token, accountID string) (cfclient.CloudflareClient, error) {
+		accounts[accountID] = true
+		return remote, nil
+	}
+
+	request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "tunnel", Namespace: "default"}}
+	if _, err := r.Reconcile(context.Background(), request); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !accounts["account-a"] {
+		t.Errorf("expected the detected account to be used, got %v", accounts)
+	}
+	if len(remote.TunnelList) != 1 {
+		t.Errorf("expected the tunnel to be created, got %v", remote.TunnelList)
+	}
+
+	// the account to use cannot be guessed once the token has access to another one
+	remote.AccountList = append(remote.AccountList, cloudflare.Account{ID: "account-b"})
+	if _, err := r.Reconcile(context.Background(), request); err == nil || !strings.Contains(err.Error(), "multiple accounts") {
+		t.Errorf("expected an error about the multiple accounts, got %v", err)
+	}
+}
+
+func TestDetectZone(t *testing.T) {
+	tests := []struct {
+		name       string
+		zone       string
+		status     cfv2.CloudflareTunnelStatus
+		wantZone   string
+		wantZoneID string
+		wantLookup bool
+		wantErr    bool
+	}{
+		{name: "explicit", zone: "example.com", wantZone: "example.com"},
+		{name: "explicit and stored", zone: "example.com", status: cfv2.CloudflareTunnelStatus{Zone: "example.com", ZoneID: "stored-id"}, wantZone: "example.com", wantZoneID: "stored-id"},
+		{name: "explicit and stored other", zone: "example.com", status: cfv2.CloudflareTunnelStatus{Zone: "team.example.com", ZoneID: "stored-id"}, wantZone: "example.com"},
+		{name: "stored", status: cfv2.CloudflareTunnelStatus{Zone: "example.com", ZoneID: "stored-id"}, wantZone: "example.com", wantZoneID: "stored-id"},
+		{name: "detected", wantZone: "team.example.com", wantZoneID: "team-id", wantLookup: true},
+		{name: "stored outside of the domain", status: cfv2.CloudflareTunnelStatus{Zone: "example.org", ZoneID: "stored-id"}, wantZone: "team.example.com", wantZoneID: "team-id", wantLookup: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote := cfclient.NewFake("example.com", "example.org")
+			remote.Zones["team.example.com"] = "team-id"
+			tunnel := newTestTunnel("default")
+			tunnel.Spec.Domain = "app.team.example.com"
+			tunnel.Spec.Zone = tt.zone
+			r := newTestReconciler(tunnel)
+			logger := logr.Discard()
+			r.logger = &logger
+			r.TunEx = &TunnelExpanded{CloudflareAPI: remote, TunSpec: tunnel.Spec}
+
+			if err := r.detectZone(context.Background(), tt.status); (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if r.TunEx.TunSpec.Zone != tt.wantZone || r.TunEx.ZoneID != tt.wantZoneID {
+				t.Errorf("expected zone %s with ID %q, got %s with ID %q", tt.wantZone, tt.wantZoneID, r.TunEx.TunSpec.Zone, r.TunEx.ZoneID)
+			}
+			if lookedUp := len(remote.Calls) != 0; lookedUp != tt.wantLookup {
+				t.Errorf("expected the zone to be looked up %v, got calls %v", tt.wantLookup, remote.Calls)
+			}
+		})
+	}
+
+	// the zone detected by a previous reconcile comes with its ID
+	remote := cfclient.NewFake("example.com")
+	tunnel := newTestTunnel("default")
+	tunnel.Spec.Zone = ""
+	r := newTestReconciler(tunnel)
+	logger := logr.Discard()
+	r.logger = &logger
+	r.Metadata = NewMetadataCache(time.Minute)
+	for i := 0; i < 2; i++ {
+		r.TunEx = &TunnelExpanded{CloudflareAPI: remote, TunSpec: tunnel.Spec}
+		if err := r.detectZone(context.Background(), tunnel.Status); err != nil {
+			t.Fatal(err)
+		}
+		if r.TunEx.ZoneID != remote.Zones["example.com"] {
+			t.Errorf("expected the ID of the detected zone on reconcile %d, got %q", i+1, r.TunEx.ZoneID)
+		}
+	}
+	if len(remote.Calls) != 1 {
+		t.Errorf("expected the zone to be looked up once, got calls %v", remote.Calls)
+	}
+
+	remote = cfclient.NewFake("example.org")
+	tunnel = newTestTunnel("default")
+	tunnel.Spec.Zone = ""
+	r = newTestReconciler(tunnel)
+	r.logger = &logger
+	r.TunEx = &TunnelExpanded{CloudflareAPI: remote, TunSpec: tunnel.Spec}
+	if err := r.detectZone(context.Background(), tunnel.Status); err == nil {
+		t.Errorf("expected an error when no zone of the account contains the domain")
+	}
+}
+
+func TestReconcileDetectsZone(t *testing.T) {
+	remote := cfclient.NewFake("example.com")
+	zoneID := remote.Zones["example.com"]
+	tunnel := newTestTunnel("default")
+	tunnel.UID = "uid"
+	tunnel.Spec.Zone = ""
+	r := newReconcileFixture(remote, tunnel)
+
+	request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "tunnel", Namespace: "default"}}
+	if _, err := r.Reconcile(context.Background(), request); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if records := remote.Records[zoneID]; len(records) != 1 || records[0].Name != "app.example.com" {
+		t.Errorf("expected the record to be created in the detected zone, got %v", records)
+	}
+	var current cfv2.CloudflareTunnel
+	if err := r.Client.Get(context.Background(), request.NamespacedName, &current); err != nil {
+		t.Fatal(err)
+	}
+	if current.Status.Zone != "example.com" || current.Status.ZoneID != zoneID {
+		t.Errorf("expected the zone to be stored in the status, got %s with ID %q", current.Status.Zone, current.Status.ZoneID)
+	}
+}
+
+func TestDNSRecordMatches(t *testing.T) {
+	truePointer := true
+	falsePointer := false
+	desired := cloudflare.DNSRecord{
+		Type:    "CNAME",
+		Name:    "app.example.com",
+		Content: "tunnel-id" + constants.CNAMESuffix,
+		TTL:     0,
+		Proxied: &truePointer,
+	}
+	steadyState := cloudflare.DNSRecord{
+		ID:       "record-id",
+		Type:     "CNAME",
+		Name:     "App.Example.com",
+		Content:  "tunnel-id" + constants.CNAMESuffix,
+		TTL:      1,
+		Proxied:  &truePointer,
+		ZoneID:   "zone-id",
+		ZoneName: "example.com",
+	}
+	notProxied := steadyState
+	notProxied.Proxied = &falsePointer
+	staleContent := steadyState
+	staleContent.Content = "old-tunnel-id" + constants.CNAMESuffix
+	proxiedUnknown := steadyState
+	proxiedUnknown.Proxied = nil
+
+	tests := []struct {
+		name     string
+		existing cloudflare.DNSRecord
+		want     bool
+	}{
+		{name: "steady state", existing: steadyState, want: true},
+		{name: "proxied unknown", existing: proxiedUnknown, want: true},
+		{name: "not proxied", existing: notProxied, want: false},
+		{name: "stale content", existing: staleContent, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dnsRecordMatches(tt.existing, desired); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	desiredTTL := desired
+	desiredTTL.Proxied = &falsePointer
+	desiredTTL.TTL = 300
+	if dnsRecordMatches(notProxied, desiredTTL) {
+		t.Errorf("expected a record with another TTL not to match")
+	}
+	notProxied.TTL = 300
+	if !dnsRecordMatches(notProxied, desiredTTL) {
+		t.Errorf("expected a record with the same TTL to match")
+	}
+}
+
+func TestCreateDNSCNAMEProxied(t *testing.T) {
+	truePointer := true
+	falsePointer := false
+	ttl := 300
+	tests := []struct {
+		name        string
+		proxied     *bool
+		ttl         *int
+		wantProxied bool
+		wantTTL     int
+	}{
+		{name: "default", wantProxied: true},
+		{name: "proxied", proxied: &truePointer, ttl: &ttl, wantProxied: true},
+		{name: "not proxied", proxied: &falsePointer, wantProxied: false, wantTTL: 1},
+		{name: "not proxied with TTL", proxied: &falsePointer, ttl: &ttl, wantProxied: false, wantTTL: 300},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote := cfclient.NewFake("example.com")
+			zoneID := remote.Zones["example.com"]
+			tunnel := newTestTunnel("default")
+			tunnel.Spec.DNSProxied = tt.proxied
+			tunnel.Spec.DNSTTL = tt.ttl
+			r := newTestReconciler(tunnel)
+			logger := logr.Discard()
+			r.logger = &logger
+			r.TunEx = &TunnelExpanded{CloudflareAPI: remote, TunSpec: tunnel.Spec, TunnelID: "tunnel-id", UID: "uid"}
+
+			// the record is created first, and updated once the opposite setting has been applied out of band
+			for i := 0; i < 2; i++ {
+				if err := r.createDNSCNAME(context.Background()); err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				records := remote.Records[zoneID]
+				if len(records) != 1 {
+					t.Fatalf("expected a single record, got %v", records)
+				}
+				record := records[0]
+				if record.Proxied == nil || *record.Proxied != tt.wantProxied || record.TTL != tt.wantTTL {
+					t.Errorf("expected proxied %v with TTL %d, got %v with TTL %d", tt.wantProxied, tt.wantTTL, record.Proxied, record.TTL)
+				}
+				proxied := !tt.wantProxied
+				remote.Records[zoneID][0].Proxied = &proxied
+				remote.Records[zoneID][0].TTL = 120
+			}
+		})
+	}
+}
+
+type mockStore struct {
+	writes map[string]map[string]string
+	count  int // number of writes
+	err    error
+}
+
+func (m *mockStore) Read(_ context.Context, path string) (map[string]string, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	return m.writes[path], nil
+}
+
+func (m *mockStore) Write(_ context.Context, path string, data map[string]string) error {
+	if m.err != nil {
+		return m.err
+	}
+	if m.writes == nil {
+		m.writes = map[string]map[string]string{}
+	}
+	m.writes[path] = data
+	m.count++
+	return nil
+}
+
+func TestExportCredentials(t *testing.T) {
+	r := newTestReconciler()
+	logger := logr.Discard()
+	r.logger = &logger
+	secret := &corev1.Secret{Data: map[string][]byte{"tunnel-id.json": []byte(`{"TunnelID": "tunnel-id"}`)}}
+
+	store := &mockStore{}
+	if err := r.exportCredentials(context.Background(), store, "tunnels/tunnel", secret); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if got := store.writes["tunnels/tunnel"]["tunnel-id.json"]; got != `{"TunnelID": "tunnel-id"}` {
+		t.Errorf("unexpected exported credentials %q", got)
+	}
+
+	// the credentials are only written again once the stored ones differ
+	if err := r.exportCredentials(context.Background(), store, "tunnels/tunnel", secret); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if store.count != 1 {
+		t.Errorf("expected the unchanged credentials not to be written again, got %d writes", store.count)
+	}
+	store.writes["tunnels/tunnel"] = map[string]string{"tunnel-id.json": "{}"}
+	if err := r.exportCredentials(context.Background(), store, "tunnels/tunnel", secret); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if got := store.writes["tunnels/tunnel"]["tunnel-id.json"]; store.count != 2 || got != `{"TunnelID": "tunnel-id"}` {
+		t.Errorf("expected the changed credentials to be restored, got %q after %d writes", got, store.count)
+	}
+
+	failingStore := &mockStore{err: fmt.Errorf("store unavailable")}
+	if err := r.exportCredentials(context.Background(), failingStore, "tunnels/tunnel", secret); err == nil {
+		t.Error("expected an error from a failing store")
+	}
+}
+
+func TestReplicasFromEndpoints(t *testing.T) {
+	config := &cfv2.CloudflareTunnelReplicasFromEndpoints{EndpointsPerReplica: 3, MinReplicas: 2, MaxReplicas: 5}
+	tests := []struct {
+		endpoints int32
+		want      int32
+	}{
+		{endpoints: 0, want: 2},
+		{endpoints: 4, want: 2},
+		{endpoints: 7, want: 3},
+		{endpoints: 9, want: 3},
+		{endpoints: 12, want: 4},
+		{endpoints: 100, want: 5},
+	}
+	for _, tt := range tests {
+		if got := replicasFromEndpoints(tt.endpoints, config); got != tt.want {
+			t.Errorf("expected %d replicas for %d endpoints, got %d", tt.want, tt.endpoints, got)
+		}
+	}
+}
+
+func TestCountReadyEndpoints(t *testing.T) {
+	truePointer := true
+	falsePointer := false
+	endpointSlice := func(name string, endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+		return &discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+				Labels:    map[string]string{discoveryv1.LabelServiceName: "app"},
+			},
+			AddressType: discoveryv1.AddressTypeIPv4,
+			Endpoints:   endpoints,
+		}
+	}
+	r := newTestReconciler(
+		endpointSlice("app-ipv4",
+			discoveryv1.Endpoint{Addresses: []string{"10.0.0.1"}, Conditions: discoveryv1.EndpointConditions{Ready: &truePointer}},
+			discoveryv1.Endpoint{Addresses: []string{"10.0.0.2"}},
+			discoveryv1.Endpoint{Addresses: []string{"10.0.0.3"}, Conditions: discoveryv1.EndpointConditions{Ready: &falsePointer}},
+		),
+		endpointSlice("app-ipv4-duplicate",
+			discoveryv1.Endpoint{Addresses: []string{"10.0.0.1"}, Conditions: discoveryv1.EndpointConditions{Ready: &truePointer}},
+		),
+	)
+	logger := logr.Discard()
+	r.logger = &logger
+	r.TunEx = &TunnelExpanded{TunSpec: newTestTunnel("default").Spec}
+
+	count, err := r.countReadyEndpoints(context.Background())
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if count != 2 {
+		t.Errorf("expected 2 ready endpoints, got %d", count)
+	}
+}
+
+func TestReconcileWithoutReadyEndpoints(t *testing.T) {
+	remote := cfclient.NewFake("example.com")
+	tunnel := newTestTunnel("default")
+	tunnel.Spec.ReplicasFromEndpoints = &cfv2.CloudflareTunnelReplicasFromEndpoints{EndpointsPerReplica: 1, MinReplicas: 1, MaxReplicas: 3}
+	r := newReconcileFixture(remote, tunnel)
+	request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "tunnel", Namespace: "default"}}
+	key := types.NamespacedName{Name: "tunnel-" + constants.ResourceSuffix, Namespace: "default"}
+
+	check := func(wantDegraded metav1.ConditionStatus, wantReplicas int32) {
+		t.Helper()
+		if _, err := r.Reconcile(context.Background(), request); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		var reconciled cfv2.CloudflareTunnel
+		if err := r.Client.Get(context.Background(), request.NamespacedName, &reconciled); err != nil {
+			t.Fatal(err)
+		}
+		if condition := meta.FindStatusCondition(reconciled.Status.Conditions, cfv2.ConditionDegraded); condition == nil || condition.Status != wantDegraded {
+			t.Errorf("expected the Degraded condition to be %s, got %v", wantDegraded, condition)
+		}
+		var deployment appsv1.Deployment
+		if err := r.Client.Get(context.Background(), key, &deployment); err != nil {
+			t.Fatalf("expected the deployment to be reconciled, got %v", err)
+		}
+		if *deployment.Spec.Replicas != wantReplicas {
+			t.Errorf("expected %d replicas, got %d", wantReplicas, *deployment.Spec.Replicas)
+		}
+	}
+
+	// the tunnel is still reconciled with the minimum replicas
+	check(metav1.ConditionTrue, 1)
+
+	if err := r.Client.Create(context.Background(), &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-ipv4",
+			Namespace: "default",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "app"},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints:   []discoveryv1.Endpoint{{Addresses: []string{"10.0.0.1"}}, {Addresses: []string{"10.0.0.2"}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	check(metav1.ConditionFalse, 2)
+}
+
+func TestNormalizeDomain(t *testing.T) {
+	tests := []struct {
+		domain  string
+		want    string
+		wantErr bool
+	}{
+		{domain: "app.example.com", want: "app.example.com"},
+		{domain: "https://app.example.com", want: "app.example.com"},
+		{domain: "https://app.example.com/", want: "app.example.com"},
+		{domain: "app.example.com:443", want: "app.example.com"},
+		{domain: "http://App.Example.com:8080", want: "app.example.com"},
+		{domain: "app.example.com.", want: "app.example.com"},
+		{domain: "*.example.com", want: "*.example.com"},
+		{domain: "https://app.example.com/path", wantErr: true},
+		{domain: "app_example.com", wantErr: true},
+		{domain: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			got, err := normalizeDomain(tt.domain)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestValidateDNSRecordName(t *testing.T) {
+	tests := []struct {
+		name          string
+		domain        string
+		dnsRecordName string
+		want          string
+		wantErr       bool
+	}{
+		{name: "defaults to the domain", domain: "app.example.com", want: "app.example.com"},
+		{name: "decoupled", domain: "app.example.org", dnsRecordName: "Edge.Example.com.", want: "edge.example.com"},
+		{name: "zone apex", domain: "app.example.com", dnsRecordName: "example.com", want: "example.com"},
+		{name: "domain outside the zone", domain: "app.example.org", wantErr: true},
+		{name: "record outside the zone", domain: "app.example.com", dnsRecordName: "app.notexample.com", wantErr: true},
+		{name: "invalid record", domain: "app.example.com", dnsRecordName: "app_edge.example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := validateDNSRecordName(cfv2.CloudflareTunnelSpec{
+				Domain:        tt.domain,
+				DNSRecordName: tt.dnsRecordName,
+				Zone:          "example.com",
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestInShard(t *testing.T) {
+	tunnel := func(shard string) *cfv2.CloudflareTunnel {
+		tunnel := newTestTunnel("default")
+		if shard != "" {
+			tunnel.Annotations = map[string]string{constants.ShardAnnotation: shard}
+		}
+		return tunnel
+	}
+	tests := []struct {
+		name   string
+		shard  string
+		tunnel *cfv2.CloudflareTunnel
+		want   bool
+	}{
+		{name: "unsharded operator", shard: "", tunnel: tunnel("a"), want: true},
+		{name: "unsharded operator and resource", shard: "", tunnel: tunnel(""), want: true},
+		{name: "same shard", shard: "a", tunnel: tunnel("a"), want: true},
+		{name: "other shard", shard: "a", tunnel: tunnel("b"), want: false},
+		{name: "unsharded resource", shard: "a", tunnel: tunnel(""), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &CloudflareTunnelReconciler{Shard: tt.shard}
+			if got := r.inShard(tt.tunnel); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCreateMetricsService(t *testing.T) {
+	tunnel := newTestTunnel("default")
+	tunnel.UID = "tunnel-uid"
+	r := newTestReconciler(tunnel)
+	logger := logr.Discard()
+	r.logger = &logger
+	r.TunEx = &TunnelExpanded{Name: tunnel.Name, Namespace: tunnel.Namespace, TunSpec: tunnel.Spec}
+	key := types.NamespacedName{Name: "tunnel-cf-tunnel-metrics", Namespace: "default"}
+
+	r.TunEx.TunSpec.MetricsService = true
+	if err := r.createMetricsService(context.Background(), *tunnel); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	var service corev1.Service
+	if err := r.Client.Get(context.Background(), key, &service); err != nil {
+		t.Fatalf("expected metrics service to be created, got %v", err)
+	}
+	if !metav1.IsControlledBy(&service, tunnel) {
+		t.Errorf("expected metrics service to be owned by the tunnel, got %v", service.OwnerReferences)
+	}
+	if service.Spec.Type != corev1.ServiceTypeClusterIP || service.Spec.Ports[0].Port != 9090 {
+		t.Errorf("unexpected metrics service spec %v", service.Spec)
+	}
+	// a second pass must be a no-op
+	version := service.ResourceVersion
+	if err := r.createMetricsService(context.Background(), *tunnel); err != nil {
+		t.Fatalf("expected no error on update, got %v", err)
+	}
+	if err := r.Client.Get(context.Background(), key, &service); err != nil {
+		t.Fatal(err)
+	}
+	if service.ResourceVersion != version {
+		t.Errorf("expected the unchanged metrics service not to be written again, got version %s instead of %s", service.ResourceVersion, version)
+	}
+	// an edited service is restored, keeping its cluster IP
+	service.Spec.ClusterIP = "10.0.0.10"
+	service.Spec.Selector = map[string]string{"app": "other"}
+	if err := r.Client.Update(context.Background(), &service); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.createMetricsService(context.Background(), *tunnel); err != nil {
+		t.Fatalf("expected no error on update, got %v", err)
+	}
+	if err := r.Client.Get(context.Background(), key, &service); err != nil {
+		t.Fatal(err)
+	}
+	if service.Spec.Selector["app.kubernetes.io/name"] != "tunnel" || service.Spec.ClusterIP != "10.0.0.10" {
+		t.Errorf("expected the selector to be restored and the cluster IP kept, got %v", service.Spec)
+	}
+
+	r.TunEx.TunSpec.MetricsService = false
+	if err := r.createMetricsService(context.Background(), *tunnel); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := r.Client.Get(context.Background(), key, &service); !errors.IsNotFound(err) {
+		t.Errorf("expected metrics service to be deleted, got %v", err)
+	}
+}
+
+func TestReconcileReportsMetricsServiceError(t *testing.T) {
+	remote := cfclient.NewFake("example.com")
+	tunnel := newTestTunnel("default")
+	tunnel.UID = "uid"
+	tunnel.Spec.MetricsService = true
+	controller := true
+	r := newReconcileFixture(remote, tunnel, &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "tunnel-cf-tunnel-metrics",
+			Namespace: "default",
+			OwnerReferences: []metav1.OwnerReference{
+				{APIVersion: "apps/v1", Kind: "Deployment", Name: "other", UID: "other-uid", Controller: &controller},
+			},
+		},
+	})
+	request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "tunnel", Namespace: "default"}}
+	if _, err := r.Reconcile(context.Background(), request); err == nil {
+		t.Fatal("expected an error")
+	}
+	var current cfv2.CloudflareTunnel
+	if err := r.Client.Get(context.Background(), request.NamespacedName, &current); err != nil {
+		t.Fatal(err)
+	}
+	condition := meta.FindStatusCondition(current.Status.Conditions, cfv2.ConditionReady)
+	if condition == nil || condition.Status != metav1.ConditionFalse || condition.Reason != "ReconcileFailed" {
+		t.Errorf("expected the failure to be reported in the Ready condition, got %v", condition)
+	}
+}
+
+func TestCreateDeploymentCorrectsStaleTunnelID(t *testing.T) {
+	tunnel := newTestTunnel("default")
+	stale := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "tunnel-cf-tunnel", Namespace: "default"},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{constants.TunnelIDAnnotation: "old-tunnel"},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "cloudflared", Image: "cloudflare/cloudflared:latest"}},
+				},
+			},
+		},
+	}
+	r := newTestReconciler(tunnel, stale)
+	logger := logr.Discard()
+	r.logger = &logger
+	r.TunEx = &TunnelExpanded{Name: tunnel.Name, Namespace: tunnel.Namespace, TunSpec: tunnel.Spec, TunnelID: "new-tunnel"}
+
+	if _, err := r.createDeployment(context.Background(), *tunnel, nil, nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	var deployment appsv1.Deployment
+	if err := r.Client.Get(context.Background(), types.NamespacedName{Name: "tunnel-cf-tunnel", Namespace: "default"}, &deployment); err != nil {
+		t.Fatal(err)
+	}
+	// the pods are rolled by the tunnel ID of their template, not by the rollout annotation
+	if id := deployment.Spec.Template.Annotations[constants.TunnelIDAnnotation]; id != "new-tunnel" {
+		t.Errorf("expected the pods to be rolled to the current tunnel, got %q", id)
+	}
+}
+
+func TestRemoteTunnelName(t *testing.T) {
+	tests := []struct {
+		name            string
+		namespacedNames bool
+		want            string
+	}{
+		{name: "default", want: "tunnel"},
+		{name: "namespaced", namespacedNames: true, want: "team-a-tunnel"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &CloudflareTunnelReconciler{
+				NamespacedNames: tt.namespacedNames,
+				TunEx:           &TunnelExpanded{Name: "tunnel", Namespace: "team-a"},
+			}
+			if name := r.remoteTunnelName(); name != tt.want {
+				t.Errorf("expected remote tunnel name %s, got %s", tt.want, name)
+			}
+		})
+	}
+}
+
+func TestValidateTunnelToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		decoded string
+		wantErr bool
+	}{
+		{name: "valid", decoded: `{"a":"account","s":"c2VjcmV0","t":"tunnel-id"}`},
+		{name: "not json", decoded: `account:secret`, wantErr: true},
+		{name: "missing secret", decoded: `{"a":"account","t":"tunnel-id"}`, wantErr: true},
+		{name: "secret not base64", decoded: `{"a":"account","s":"not base64!","t":"tunnel-id"}`, wantErr: true},
+		{name: "other tunnel", decoded: `{"a":"account","s":"c2VjcmV0","t":"other-tunnel"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateTunnelToken([]byte(tt.decoded), "tunnel-id")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestCreateTunnelRemoteReusesTunnel(t *testing.T) {
+	remote := cfclient.NewFake("example.com")
+	r := &CloudflareTunnelReconciler{
+		NewCloudflareClient: func(token, accountID string) (cfclient.CloudflareClient, error) {
+			return remote, nil
+		},
+		TunEx: &TunnelExpanded{Name: "tunnel", Namespace: "default", AccountTag: "account"},
+	}
+	logger := logr.Discard()
+	r.logger = &logger
+
+	if err := r.createTunnelRemote(context.Background()); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	tunnelID := r.TunEx.TunnelID
+	if err := r.createTunnelRemote(context.Background()); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(remote.TunnelList) != 1 {
+		t.Fatalf("expected a single remote tunnel, got %v", remote.TunnelList)
+	}
+	if r.TunEx.TunnelID != tunnelID || remote.TunnelList[0].Name != "tunnel" {
+		t.Errorf("expected the existing tunnel %s to be reused, got %s", tunnelID, r.TunEx.TunnelID)
+	}
+	if err := validateTunnelToken([]byte(r.TunEx.TunnelSecret), tunnelID); err != nil {
+		t.Errorf("expected a valid tunnel secret, got %v", err)
+	}
+}
+
+func TestCreateTunnelRemoteDuplicateNames(t *testing.T) {
+	tests := []struct {
+		name     string
+		tunnels  int
+		tunnelID string
+		wantErr  string
+	}{
+		{name: "without selector", tunnels: 2, wantErr: "first-id, second-id"},
+		{name: "with selector", tunnels: 2, tunnelID: "second-id"},
+		{name: "with unknown selector", tunnels: 2, tunnelID: "unknown-id", wantErr: "unknown-id"},
+		{name: "with unknown selector and a single tunnel", tunnels: 1, tunnelID: "unknown-id", wantErr: "unknown-id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote := cfclient.NewFake("example.com")
+			remote.TunnelList = []cloudflare.Tunnel{
+				{ID: "first-id", Name: "tunnel", Secret: "first-secret"},
+				{ID: "second-id", Name: "tunnel", Secret: "second-secret"},
+			}[:tt.tunnels]
+			r := &CloudflareTunnelReconciler{
+				NewCloudflareClient: func(token, accountID string) (cfclient.CloudflareClient, error) {
+					return remote, nil
+				},
+				TunEx: &TunnelExpanded{
+					Name:       "tunnel",
+					Namespace:  "default",
+					AccountTag: "account",
+					TunSpec:    cfv2.CloudflareTunnelSpec{TunnelID: tt.tunnelID},
+				},
+			}
+			logger := logr.Discard()
+			r.logger = &logger
+
+			err := r.createTunnelRemote(context.Background())
+			if (err != nil) != (tt.wantErr != "") {
+				t.Fatalf("expected error %q, got %v", tt.wantErr, err)
+			}
+			if len(remote.TunnelList) != tt.tunnels {
+				t.Errorf("expected no tunnel to be created, got %v", remote.TunnelList)
+			}
+			if err != nil {
+				if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("expected the error to contain %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if r.TunEx.TunnelID != tt.tunnelID {
+				t.Errorf("expected the tunnel %s to be selected, got %s", tt.tunnelID, r.TunEx.TunnelID)
+			}
+		})
+	}
+}
+
+func TestCreateDeploymentReplicasDuringRollout(t *testing.T) {
+	tunnel := newTestTunnel("default")
+	tunnel.Spec.Replicas = 2
+	r := newTestReconciler(tunnel)
+	logger := logr.Discard()
+	r.logger = &logger
+	r.TunEx = &TunnelExpanded{Name: tunnel.Name, Namespace: tunnel.Namespace, TunSpec: tunnel.Spec, TunnelID: "tunnel-id"}
+	key := types.NamespacedName{Name: "tunnel-cf-tunnel", Namespace: "default"}
+	_, _ = r.createDeployment(context.Background(), *tunnel, nil, nil)
+
+	// simulate the API server defaulting the template and a rollout halfway through
+	var deployment appsv1.Deployment
+	if err := r.Client.Get(context.Background(), key, &deployment); err != nil {
+		t.Fatal(err)
+	}
+	deployment.Spec.Template.Spec.Containers[0].TerminationMessagePath = corev1.TerminationMessagePathDefault
+	deployment.Status = appsv1.DeploymentStatus{Replicas: 3, UpdatedReplicas: 1, AvailableReplicas: 2}
+	if err := r.Client.Update(context.Background(), &deployment); err != nil {
+		t.Fatal(err)
+	}
+
+	r.TunEx.TunSpec.Replicas = 3
+	if _, err := r.createDeployment(context.Background(), *tunnel, nil, nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := r.Client.Get(context.Background(), key, &deployment); err != nil {
+		t.Fatal(err)
+	}
+	if *deployment.Spec.Replicas != 3 {
+		t.Errorf("expected the replicas to be updated to 3, got %d", *deployment.Spec.Replicas)
+	}
+	if path := deployment.Spec.Template.Spec.Containers[0].TerminationMessagePath; path != corev1.TerminationMessagePathDefault {
+		t.Errorf("expected the template to be left alone, got the termination message path %q", path)
+	}
+	if !r.TunEx.DeploymentRollingOut {
+		t.Error("expected the rollout to be reported in progress")
+	}
+
+	// nothing changes until the rollout is done
+	resourceVersion := deployment.ResourceVersion
+	if _, err := r.createDeployment(context.Background(), *tunnel, nil, nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := r.Client.Get(context.Background(), key, &deployment); err != nil {
+		t.Fatal(err)
+	}
+	if deployment.ResourceVersion != resourceVersion {
+		t.Error("expected the deployment not to be updated again")
+	}
+	if !r.TunEx.DeploymentRollingOut {
+		t.Error("expected the rollout to still be in progress")
+	}
+
+	deployment.Status = appsv1.DeploymentStatus{Replicas: 3, UpdatedReplicas: 3, AvailableReplicas: 3}
+	if err := r.Client.Update(context.Background(), &deployment); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.createDeployment(context.Background(), *tunnel, nil, nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if r.TunEx.DeploymentRollingOut {
+		t.Error("expected the rollout to be done")
+	}
+}
+
+func TestCreateDeploymentRestartTrigger(t *testing.T) {
+	tunnel := newTestTunnel("default")
+	r := newTestReconciler(tunnel)
+	logger := logr.Discard()
+	r.logger = &logger
+	r.TunEx = &TunnelExpanded{Name: tunnel.Name, Namespace: tunnel.Namespace, TunSpec: tunnel.Spec, TunnelID: "tunnel-id"}
+	key := types.NamespacedName{Name: "tunnel-cf-tunnel", Namespace: "default"}
+	if _, err := r.createDeployment(context.Background(), *tunnel, nil, nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	var deployment appsv1.Deployment
+	for i, restartedAt := range []string{"2022-06-01T10:00:00Z", "2022-06-01T10:00:00Z", "2022-06-02T08:30:00Z"} {
+		if err := r.Client.Get(context.Background(), key, &deployment); err != nil {
+			t.Fatal(err)
+		}
+		resourceVersion := deployment.ResourceVersion
+		tunnel.Annotations = map[string]string{constants.RestartedAtAnnotation: restartedAt}
+		if _, err := r.createDeployment(context.Background(), *tunnel, nil, nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if err := r.Client.Get(context.Background(), key, &deployment); err != nil {
+			t.Fatal(err)
+		}
+		if value := deployment.Spec.Template.Annotations[constants.RestartedAtAnnotation]; value != restartedAt {
+			t.Errorf("expected the pods to be annotated with %s, got %q", restartedAt, value)
+		}
+		// reconciling again with the same value must not restart the pods again
+		if updated := deployment.ResourceVersion != resourceVersion; updated != (i != 1) {
+			t.Errorf("expected the deployment to be updated %v for %s, got %v", i != 1, restartedAt, updated)
+		}
+	}
+}
+
+func TestCreateDeploymentLogLevels(t *testing.T) {
+	tests := []struct {
+		name              string
+		logLevel          cfv2.CloudflareTunnelLogLevel
+		transportLogLevel cfv2.CloudflareTunnelLogLevel
+		wantErr           bool
+	}{
+		{name: "default"},
+		{name: "valid", logLevel: cfv2.LogLevelInfo, transportLogLevel: cfv2.LogLevelDebug},
+		{name: "invalid log level", logLevel: "verbose", wantErr: true},
+		{name: "invalid transport log level", transportLogLevel: "trace", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tunnel := newTestTunnel("default")
+			tunnel.Spec.LogLevel = tt.logLevel
+			tunnel.Spec.TransportLogLevel = tt.transportLogLevel
+			r := newTestReconciler(tunnel)
+			logger := logr.Discard()
+			r.logger = &logger
+			r.TunEx = &TunnelExpanded{Name: tunnel.Name, Namespace: tunnel.Namespace, TunSpec: tunnel.Spec, TunnelID: "tunnel-id"}
+
+			_, err := r.createDeployment(context.Background(), *tunnel, nil, nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestValidateDNSTTL(t *testing.T) {
+	for _, ttl := range []int{1, 60, 3600, 86400} {
+		ttl := ttl
+		if err := validateDNSTTL(&ttl); err != nil {
+			t.Errorf("expected %d to be valid, got %v", ttl, err)
+		}
+	}
+	if err := validateDNSTTL(nil); err != nil {
+		t.Errorf("expected an unset TTL to be valid, got %v", err)
+	}
+	for _, ttl := range []int{0, 2, 59, 86401} {
+		ttl := ttl
+		if err := validateDNSTTL(&ttl); err == nil {
+			t.Errorf("expected %d to be rejected", ttl)
+		}
+	}
+}
+
+func TestValidateTransport(t *testing.T) {
+	for _, transport := range []cfv2.CloudflareTunnelTransport{"", cfv2.TransportAuto, cfv2.TransportQUIC, cfv2.TransportHTTP2} {
+		if err := validateTransport(transport); err != nil {
+			t.Errorf("expected %q to be valid, got %v", transport, err)
+		}
+	}
+	if err := validateTransport("h2mux"); err == nil {
+		t.Error("expected h2mux to be rejected")
+	}
+}
+
+func TestReconcileFreshCluster(t *testing.T) {
+	remote := cfclient.NewFake("example.com")
+	tunnel := newTestTunnel("default")
+	// none of the managed resources exist yet
+	r := newReconcileFixture(remote, tunnel)
+
+	result, err := r.Reconcile(context.Background(), ctrl.Request{
+		NamespacedName: types.NamespacedName{Name: "tunnel", Namespace: "default"},
+	})
+	if err != nil {
+		t.Fatalf("expected the first reconcile to succeed, got %v", err)
+	}
+	if result.RequeueAfter != constants.WaitingRequeueInterval {
+		t.Errorf("expected a requeue while the new deployment rolls out, got %v", result)
+	}
+	key := types.NamespacedName{Name: "tunnel-" + constants.ResourceSuffix, Namespace: "default"}
+	for _, obj := range []client.Object{&corev1.Secret{}, &corev1.ConfigMap{}, &appsv1.Deployment{}} {
+		if err := r.Client.Get(context.Background(), key, obj); err != nil {
+			t.Errorf("expected %T to be created, got %v", obj, err)
+		}
+	}
+}
+
+func TestReconcileThroughCloudflareClient(t *testing.T) {
+	remote := cfclient.NewFake("example.com")
+	tunnel := newTestTunnel("default")
+	r := newReconcileFixture(remote, tunnel)
+
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{
+		NamespacedName: types.NamespacedName{Name: "tunnel", Namespace: "default"},
+	}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// every call to Cloudflare goes through the client, in the order of the reconcile
+	want := []string{"Tunnels", "CreateTunnel", "TunnelToken", "CreateDNSRecord"}
+	next := 0
+	for _, call := range remote.Calls {
+		if next < len(want) && call == want[next] {
+			next++
+		}
+	}
+	if next != len(want) {
+		t.Errorf("expected the tunnel and its record to be created through the client, got calls %v", remote.Calls)
+	}
+	if len(remote.TunnelList) != 1 {
+		t.Fatalf("expected a single tunnel to be created, got %v", remote.TunnelList)
+	}
+	records := remote.Records[remote.Zones["example.com"]]
+	if len(records) != 1 || records[0].Content != remote.TunnelList[0].ID+constants.CNAMESuffix {
+		t.Errorf("expected a CNAME to the created tunnel, got %v", records)
+	}
+}
+
+func TestReconcileRemoteDeadline(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	cases := []struct {
+		name    string
+		ctx     context.Context
+		timeout time.Duration
+		want    error
+	}{
+		{name: "cancelled context", ctx: cancelled, want: context.Canceled},
+		{name: "remote timeout", ctx: context.Background(), timeout: time.Nanosecond, want: context.DeadlineExceeded},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			remote := cfclient.NewFake("example.com")
+			r := newReconcileFixture(remote, newTestTunnel("default"))
+			r.RemoteTimeout = c.timeout
+
+			_, err := r.Reconcile(c.ctx, ctrl.Request{
+				NamespacedName: types.NamespacedName{Name: "tunnel", Namespace: "default"},
+			})
+			if !stderrors.Is(err, c.want) {
+				t.Fatalf("expected the reconcile to be aborted with %v, got %v", c.want, err)
+			}
+			if len(remote.TunnelList) != 0 {
+				t.Errorf("expected no tunnel to be created, got %v", remote.TunnelList)
+			}
+			key := types.NamespacedName{Name: "tunnel-" + constants.ResourceSuffix, Namespace: "default"}
+			if err := r.Client.Get(context.Background(), key, &appsv1.Deployment{}); !errors.IsNotFound(err) {
+				t.Errorf("expected no deployment to be created, got %v", err)
+			}
+		})
+	}
+}
+
+func TestReconcileSteadyState(t *testing.T) {
+	remote := cfclient.NewFake("example.com")
+	tunnel := newTestTunnel("default")
+	tunnel.UID = "uid"
+	r := newReconcileFixture(remote, tunnel)
+	request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "tunnel", Namespace: "default"}}
+
+	firstResult, err := r.Reconcile(context.Background(), request)
+	if err != nil {
+		t.Fatalf("expected the first reconcile to succeed, got %v", err)
+	}
+	var reconciled cfv2.CloudflareTunnel
+	if err := r.Client.Get(context.Background(), request.NamespacedName, &reconciled); err != nil {
+		t.Fatal(err)
+	}
+	if !meta.IsStatusConditionTrue(reconciled.Status.Conditions, cfv2.ConditionReady) {
+		t.Fatalf("expected the first reconcile to write the status, got %v", reconciled.Status)
+	}
+
+	for i := 0; i < 3; i++ {
+		result, err := r.Reconcile(context.Background(), request)
+		if err != nil {
+			t.Fatalf("expected reconcile %d to succeed, got %v", i+2, err)
+		}
+		if result != firstResult {
+			t.Errorf("expected reconcile %d to be requeued like the first one %v, got %v", i+2, firstResult, result)
+		}
+		var current cfv2.CloudflareTunnel
+		if err := r.Client.Get(context.Background(), request.NamespacedName, &current); err != nil {
+			t.Fatal(err)
+		}
+		if current.ResourceVersion != reconciled.ResourceVersion {
+			t.Fatalf("expected no write once the resource has been reconciled, got a write at reconcile %d: %v", i+2, current.Status)
+		}
+	}
+}
+
+func TestReconcileRepairsManagedResources(t *testing.T) {
+	remote := cfclient.NewFake("example.com")
+	tunnel := newTestTunnel("default")
+	tunnel.UID = "uid"
+	r := newReconcileFixture(remote, tunnel)
+	request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "tunnel", Namespace: "default"}}
+	key := types.NamespacedName{Name: "tunnel-" + constants.ResourceSuffix, Namespace: "default"}
+	resourceVersions := func() map[string]string {
+		t.Helper()
+		versions := map[string]string{}
+		for _, obj := range []client.Object{&corev1.Secret{}, &corev1.ConfigMap{}, &appsv1.Deployment{}} {
+			if err := r.Client.Get(context.Background(), key, obj); err != nil {
+				t.Fatalf("expected %T to exist, got %v", obj, err)
+			}
+			versions[fmt.Sprintf("%T", obj)] = obj.GetResourceVersion()
+		}
+		return versions
+	}
+
+	if _, err := r.Reconcile(context.Background(), request); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	reconciled := resourceVersions()
+
+	// the managed resources are watched, so writing them when nothing changed would trigger reconciles forever
+	if _, err := r.Reconcile(context.Background(), request); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for kind, version := range resourceVersions() {
+		if version != reconciled[kind] {
+			t.Errorf("expected the %s not to be written again, got version %s instead of %s", kind, version, reconciled[kind])
+		}
+	}
+
+	// the fields defaulted by the API server are not reverted
+	var deployment appsv1.Deployment
+	if err := r.Client.Get(context.Background(), key, &deployment); err != nil {
+		t.Fatal(err)
+	}
+	image := deployment.Spec.Template.Spec.Containers[0].Image
+	deployment.Spec.Template.Spec.DNSPolicy = corev1.DNSClusterFirst
+	deployment.Spec.Template.Spec.Containers[0].TerminationMessagePath = corev1.TerminationMessagePathDefault
+	deployment.Spec.Template.Spec.Containers[0].ReadinessProbe.SuccessThreshold = 1
+	if err := r.Client.Update(context.Background(), &deployment); err != nil {
+		t.Fatal(err)
+	}
+	defaulted := deployment.ResourceVersion
+	if _, err := r.Reconcile(context.Background(), request); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := r.Client.Get(context.Background(), key, &deployment); err != nil {
+		t.Fatal(err)
+	}
+	if deployment.ResourceVersion != defaulted {
+		t.Errorf("expected the defaulted deployment not to be written again, got version %s instead of %s", deployment.ResourceVersion, defaulted)
+	}
+
+	// an edit of the template is reverted even though the hash annotation is left untouched
+	deployment.Spec.Template.Spec.Containers[0].Image = "cloudflare/cloudflared:edited"
+	if err := r.Client.Update(context.Background(), &deployment); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(context.Background(), request); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := r.Client.Get(context.Background(), key, &deployment); err != nil {
+		t.Fatal(err)
+	}
+	if got := deployment.Spec.Template.Spec.Containers[0].Image; got != image {
+		t.Errorf("expected the edited image to be reverted to %s, got %s", image, got)
+	}
+
+	if err := r.Client.Delete(context.Background(), &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(context.Background(), request); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := r.Client.Get(context.Background(), key, &deployment); err != nil {
+		t.Fatalf("expected the deleted deployment to be recreated, got %v", err)
+	}
+	if !metav1.IsControlledBy(&deployment, tunnel) {
+		t.Errorf("expected the recreated deployment to be controlled by the tunnel, got %v", deployment.OwnerReferences)
+	}
+}
+
+func TestReconcileScaledReplicas(t *testing.T) {
+	remote := cfclient.NewFake("example.com")
+	tunnel := newTestTunnel("default")
+	r := newReconcileFixture(remote, tunnel)
+	request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "tunnel", Namespace: "default"}}
+	key := types.NamespacedName{Name: "tunnel-" + constants.ResourceSuffix, Namespace: "default"}
+
+	if _, err := r.Reconcile(context.Background(), request); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	var fetched cfv2.CloudflareTunnel
+	if err := r.Client.Get(context.Background(), request.NamespacedName, &fetched); err != nil {
+		t.Fatal(err)
+	}
+	if fetched.Status.Selector != "app.kubernetes.io/name=tunnel" {
+		t.Errorf("expected the selector of the pods in the status, got %q", fetched.Status.Selector)
+	}
+	// an autoscaler changes the replicas of the spec through the scale subresource
+	fetched.Spec.Replicas = 3
+	if err := r.Client.Update(context.Background(), &fetched); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(context.Background(), request); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	var deployment appsv1.Deployment
+	if err := r.Client.Get(context.Background(), key, &deployment); err != nil {
+		t.Fatal(err)
+	}
+	if deployment.Spec.Replicas == nil || *deployment.Spec.Replicas != 3 {
+		t.Errorf("expected the deployment to be scaled to 3 replicas, got %v", deployment.Spec.Replicas)
+	}
+}
+
+func TestReconcileUnmanagedDeployment(t *testing.T) {
+	remote := cfclient.NewFake("example.com")
+	tunnel := newTestTunnel("default")
+	tunnel.UID = "uid"
+	r := newReconcileFixture(remote, tunnel)
+	request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "tunnel", Namespace: "default"}}
+	key := types.NamespacedName{Name: "tunnel-" + constants.ResourceSuffix, Namespace: "default"}
+
+	if _, err := r.Reconcile(context.Background(), request); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	var fetched cfv2.CloudflareTunnel
+	if err := r.Client.Get(context.Background(), request.NamespacedName, &fetched); err != nil {
+		t.Fatal(err)
+	}
+	// cloudflared is moved out of the operator, the deployment created so far has to go
+	fetched.Spec.ManageDeployment = new(bool)
+	if err := r.Client.Update(context.Background(), &fetched); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(context.Background(), request); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if err := r.Client.Get(context.Background(), key, &appsv1.Deployment{}); !errors.IsNotFound(err) {
+		t.Errorf("expected the deployment to be deleted, got %v", err)
+	}
+	var secret corev1.Secret
+	if err := r.Client.Get(context.Background(), key, &secret); err != nil {
+		t.Fatalf("expected the secret to be kept for the external cloudflared, got %v", err)
+	}
+	if err := r.Client.Get(context.Background(), request.NamespacedName, &fetched); err != nil {
+		t.Fatal(err)
+	}
+	credentials := fetched.Status.TunnelID + ".json"
+	if _, ok := secret.Data[credentials]; !ok {
+		if _, ok := secret.StringData[credentials]; !ok {
+			t.Errorf("expected the credentials under %s, got %v", credentials, secret.Data)
+		}
+	}
+	if meta.FindStatusCondition(fetched.Status.Conditions, cfv2.ConditionDeploymentReady) != nil {
+		t.Errorf("expected no deployment condition, got %v", fetched.Status.Conditions)
+	}
+	if !meta.IsStatusConditionTrue(fetched.Status.Conditions, cfv2.ConditionReady) {
+		t.Errorf("expected the tunnel to be ready, got %v", fetched.Status.Conditions)
+	}
+}
+
+func TestReconcileRecordsEvents(t *testing.T) {
+	remote := cfclient.NewFake("example.com")
+	tunnel := newTestTunnel("default")
+	r := newReconcileFixture(remote, tunnel)
+	recorder := record.NewFakeRecorder(20)
+	r.Recorder = recorder
+	request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "tunnel", Namespace: "default"}}
+	events := func() []string {
+		var events []string
+		for len(recorder.Events) != 0 {
+			event := <-recorder.Events
+			events = append(events, strings.Join(strings.Fields(event)[:2], " "))
+		}
+		return events
+	}
+
+	if _, err := r.Reconcile(context.Background(), request); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	want := []string{"Normal TunnelCreated", "Normal DeploymentCreated", "Normal DNSRecordCreated"}
+	if got := events(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected events %v, got %v", want, got)
+	}
+
+	// nothing happens when the resources are up to date, so nothing is recorded
+	if _, err := r.Reconcile(context.Background(), request); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if got := events(); len(got) != 0 {
+		t.Errorf("expected no events, got %v", got)
+	}
+
+	if err := r.Client.Delete(context.Background(), &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "credentials", Namespace: "default"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(context.Background(), request); err == nil {
+		t.Fatal("expected an error without the token secret")
+	}
+	if got := events(); !reflect.DeepEqual(got, []string{"Warning SecretNotFound"}) {
+		t.Errorf("expected the missing secret to be recorded, got %v", got)
+	}
+}
+
+func TestReconcileConditions(t *testing.T) {
+	remote := cfclient.NewFake("example.com")
+	tunnel := newTestTunnel("default")
+	tunnel.UID = "uid"
+	tunnel.Generation = 2
+	r := newReconcileFixture(remote, tunnel)
+	request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "tunnel", Namespace: "default"}}
+	reconcile := func() cfv2.CloudflareTunnelStatus {
+		t.Helper()
+		_, _ = r.Reconcile(context.Background(), request)
+		var current cfv2.CloudflareTunnel
+		if err := r.Client.Get(context.Background(), request.NamespacedName, &current); err != nil {
+			t.Fatal(err)
+		}
+		return current.Status
+	}
+	expectCondition := func(status cfv2.CloudflareTunnelStatus, conditionType string, want metav1.ConditionStatus, reason string) {
+		t.Helper()
+		condition := meta.FindStatusCondition(status.Conditions, conditionType)
+		if condition == nil || condition.Status != want || condition.Reason != reason {
+			t.Errorf("expected the %s condition to be %s with reason %s, got %v", conditionType, want, reason, condition)
+		}
+	}
+
+	remote.Errors["CreateTunnel"] = fmt.Errorf("failure")
+	status := reconcile()
+	expectCondition(status, cfv2.ConditionTunnelReady, metav1.ConditionFalse, "TunnelFailed")
+	expectCondition(status, cfv2.ConditionReady, metav1.ConditionFalse, "ReconcileFailed")
+
+	delete(remote.Errors, "CreateTunnel")
+	status = reconcile()
+	expectCondition(status, cfv2.ConditionTunnelReady, metav1.ConditionTrue, "Created")
+	expectCondition(status, cfv2.ConditionDNSReady, metav1.ConditionTrue, "Reconciled")
+	expectCondition(status, cfv2.ConditionDeploymentReady, metav1.ConditionFalse, "RollingOut")
+	expectCondition(status, cfv2.ConditionReady, metav1.ConditionTrue, "Reconciled")
+	if status.ObservedGeneration != 2 {
+		t.Errorf("expected the observed generation to be 2, got %d", status.ObservedGeneration)
+	}
+
+	var deployment appsv1.Deployment
+	if err := r.Client.Get(context.Background(), types.NamespacedName{Name: "tunnel-cf-tunnel", Namespace: "default"}, &deployment); err != nil {
+		t.Fatal(err)
+	}
+	deployment.Status = appsv1.DeploymentStatus{ObservedGeneration: deployment.Generation, Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1}
+	if err := r.Client.Status().Update(context.Background(), &deployment); err != nil {
+		t.Fatal(err)
+	}
+	status = reconcile()
+	expectCondition(status, cfv2.ConditionDeploymentReady, metav1.ConditionTrue, "Available")
+}
+
+func TestStatusUpdatesDoNotTriggerReconcile(t *testing.T) {
+	r := newTestReconciler()
+	filter := r.eventFilter()
+	old := newTestTunnel("default")
+	old.Generation = 1
+
+	statusUpdated := old.DeepCopy()
+	statusUpdated.Status.Phase = cfv2.PhaseReady
+	if filter.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: statusUpdated}) {
+		t.Errorf("expected a status update not to trigger a reconcile")
+	}
+	specUpdated := old.DeepCopy()
+	specUpdated.Generation = 2
+	if !filter.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: specUpdated}) {
+		t.Errorf("expected a spec update to trigger a reconcile")
+	}
+	annotated := old.DeepCopy()
+	annotated.Annotations = map[string]string{constants.RestartedAtAnnotation: "2022-06-01T10:00:00Z"}
+	if !filter.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: annotated}) {
+		t.Errorf("expected an annotation update to trigger a reconcile")
+	}
+}
+
+func TestGetTargetURLPort(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol string
+		port     intstr.IntOrString
+		want     string
+		wantErr  bool
+	}{
+		{name: "exposed", port: intstr.FromInt(80), want: "http://app.default:80"},
+		{name: "not exposed", port: intstr.FromInt(9090), wantErr: true},
+		{name: "named", port: intstr.FromString("web"), want: "http://app.default:8000"},
+		{name: "named not exposed", port: intstr.FromString("metrics"), wantErr: true},
+		// the number of the service port is matched, not its target port
+		{name: "target port", port: intstr.FromInt(8080), wantErr: true},
+		{name: "tcp", protocol: "tcp", port: intstr.FromInt(80), want: "tcp://app.default:80"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+				Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{
+					{Port: 80},
+					{Name: "web", Port: 8000, TargetPort: intstr.FromInt(8080)},
+				}},
+			}
+			r := newTestReconciler(service)
+			logger := logr.Discard()
+			r.logger = &logger
+			r.TunEx = &TunnelExpanded{TunSpec: newTestTunnel("default").Spec}
+			r.TunEx.TunSpec.Service.Port = tt.port
+			if tt.protocol != "" {
+				r.TunEx.TunSpec.Service.Protocol = tt.protocol
+			}
+
+			got, err := r.getTargetURL(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
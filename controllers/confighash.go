@@ -0,0 +1,58 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+
+	cfv2 "github.com/beezlabs-org/cloudflare-tunnel-operator/api/v1alpha2"
+)
+
+// configHash hashes the data of the config map. Only the config map is hashed: the tunnel credentials are kept in
+// the secret and never part of the input, so the hash stored in the status reveals nothing about them.
+func configHash(data map[string]string) string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	hash := sha256.New()
+	for _, key := range keys {
+		// the lengths are written so that moving content between keys changes the hash
+		for _, value := range []string{key, data[key]} {
+			hash.Write([]byte(strconv.Itoa(len(value)) + ":" + value))
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// detectConfigTampering reports when the config map overwritten by an update differs from the one last written by
+// the operator, which means it had been edited by someone else and has just been restored.
+func (r *CloudflareTunnelReconciler) detectConfigTampering(cloudflareTunnel *cfv2.CloudflareTunnel, live *corev1.ConfigMap) bool {
+	if cloudflareTunnel.Status.ConfigHash == "" || configHash(live.Data) == cloudflareTunnel.Status.ConfigHash {
+		return false
+	}
+	message := "ConfigMap " + live.Name + " has been modified outside of the operator, restoring it"
+	r.logger.Info("WARNING: " + message)
+	r.recordEvent(cloudflareTunnel, corev1.EventTypeWarning, "ConfigRestored", message)
+	return true
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cfv2 "github.com/beezlabs-org/cloudflare-tunnel-operator/api/v1alpha2"
+	"github.com/beezlabs-org/cloudflare-tunnel-operator/controllers/constants"
+	cfclient "github.com/beezlabs-org/cloudflare-tunnel-operator/internal/cloudflare"
+)
+
+func TestConfigHash(t *testing.T) {
+	hash := configHash(map[string]string{"config.yaml": "tunnel: a", "other": "b"})
+	if hash != configHash(map[string]string{"other": "b", "config.yaml": "tunnel: a"}) {
+		t.Errorf("expected the hash not to depend on the order of the keys")
+	}
+	if hash == configHash(map[string]string{"config.yaml": "tunnel: ab", "other": ""}) {
+		t.Errorf("expected moving content between keys to change the hash")
+	}
+}
+
+func TestCreateConfigMapRestoresTamperedConfig(t *testing.T) {
+	ctx := context.Background()
+	tunnel := newTestTunnel("default")
+	configMap := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "tunnel-" + constants.ResourceSuffix, Namespace: "default"}}
+	r := newTestReconciler(tunnel, configMap)
+	logger := logr.Discard()
+	r.logger = &logger
+	recorder := record.NewFakeRecorder(10)
+	r.Recorder = recorder
+	r.TunEx = &TunnelExpanded{Name: "tunnel", Namespace: "default", TunSpec: tunnel.Spec, TunnelID: "tunnel-id", UID: "uid"}
+	url := "http://app.default:80"
+
+	if _, err := r.createConfigMap(ctx, *tunnel, url); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	tunnel.Status.ConfigHash = r.TunEx.ConfigHash
+	if _, err := r.createConfigMap(ctx, *tunnel, url); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(recorder.Events) != 0 {
+		t.Fatalf("expected no event for the config map written by the operator, got %s", <-recorder.Events)
+	}
+
+	if err := r.Client.Get(ctx, client.ObjectKeyFromObject(configMap), configMap); err != nil {
+		t.Fatalf("could not fetch config map: %v", err)
+	}
+	for key := range configMap.Data {
+		configMap.Data[key] = "tunnel: someone-else"
+	}
+	if err := r.Client.Update(ctx, configMap); err != nil {
+		t.Fatalf("could not update config map: %v", err)
+	}
+
+	if _, err := r.createConfigMap(ctx, *tunnel, url); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, "ConfigRestored") {
+			t.Errorf("expected a ConfigRestored event, got %s", event)
+		}
+	default:
+		t.Errorf("expected an event for the modified config map")
+	}
+	if err := r.Client.Get(ctx, client.ObjectKeyFromObject(configMap), configMap); err != nil {
+		t.Fatalf("could not fetch config map: %v", err)
+	}
+	if configHash(configMap.Data) != tunnel.Status.ConfigHash {
+		t.Errorf("expected the config map to be restored, got %v", configMap.Data)
+	}
+}
+
+func TestReconcileRollsDeploymentOnConfigChange(t *testing.T) {
+	remote := cfclient.NewFake("example.com")
+	tunnel := newTestTunnel("default")
+	tunnel.UID = "uid"
+	r := newReconcileFixture(
+		remote,
+		tunnel,
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+			Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 80}, {Port: 8080}}},
+		},
+	)
+	request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "tunnel", Namespace: "default"}}
+	reconcile := func() appsv1.Deployment {
+		t.Helper()
+		if _, err := r.Reconcile(context.Background(), request); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		var deployment appsv1.Deployment
+		key := types.NamespacedName{Name: "tunnel-" + constants.ResourceSuffix, Namespace: "default"}
+		if err := r.Client.Get(context.Background(), key, &deployment); err != nil {
+			t.Fatal(err)
+		}
+		return deployment
+	}
+
+	deployment := reconcile()
+	checksum := deployment.Spec.Template.Annotations[constants.ConfigChecksumAnnotation]
+	if checksum == "" || checksum != r.TunEx.ConfigHash {
+		t.Fatalf("expected the pods to be annotated with the config hash %s, got %q", r.TunEx.ConfigHash, checksum)
+	}
+
+	// an unchanged config keeps the checksum, so the pods are not rolled
+	unchanged := reconcile()
+	if value := unchanged.Spec.Template.Annotations[constants.ConfigChecksumAnnotation]; value != checksum {
+		t.Errorf("expected the checksum %s to be kept, got %s", checksum, value)
+	}
+	if !equality.Semantic.DeepEqual(unchanged.Spec.Template, deployment.Spec.Template) {
+		t.Errorf("expected the pod template to be left untouched, got %v instead of %v", unchanged.Spec.Template, deployment.Spec.Template)
+	}
+
+	var updated cfv2.CloudflareTunnel
+	if err := r.Client.Get(context.Background(), request.NamespacedName, &updated); err != nil {
+		t.Fatal(err)
+	}
+	updated.Spec.Service.Port = intstr.FromInt(8080)
+	if err := r.Client.Update(context.Background(), &updated); err != nil {
+		t.Fatal(err)
+	}
+	changed := reconcile()
+	if value := changed.Spec.Template.Annotations[constants.ConfigChecksumAnnotation]; value == checksum || value != r.TunEx.ConfigHash {
+		t.Errorf("expected the checksum to follow the new config %s, got %s", r.TunEx.ConfigHash, value)
+	}
+}
+
+func TestReconcileFailureAfterConfigWrite(t *testing.T) {
+	remote := cfclient.NewFake("example.com")
+	tunnel := newTestTunnel("default")
+	tunnel.UID = "uid"
+	r := newReconcileFixture(
+		remote,
+		tunnel,
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+			Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 80}, {Port: 8080}}},
+		},
+	)
+	recorder := record.NewFakeRecorder(100)
+	r.Recorder = recorder
+	request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "tunnel", Namespace: "default"}}
+	if _, err := r.Reconcile(context.Background(), request); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// the config changes, but the reconcile fails once the config map has been written
+	var updated cfv2.CloudflareTunnel
+	if err := r.Client.Get(context.Background(), request.NamespacedName, &updated); err != nil {
+		t.Fatal(err)
+	}
+	updated.Spec.Service.Port = intstr.FromInt(8080)
+	if err := r.Client.Update(context.Background(), &updated); err != nil {
+		t.Fatal(err)
+	}
+	remote.Errors["TunnelConnections"] = fmt.Errorf("connections unavailable")
+	if _, err := r.Reconcile(context.Background(), request); err == nil {
+		t.Fatal("expected an error")
+	}
+	delete(remote.Errors, "TunnelConnections")
+	if _, err := r.Reconcile(context.Background(), request); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	close(recorder.Events)
+	for event := range recorder.Events {
+		if strings.Contains(event, "ConfigRestored") {
+			t.Errorf("expected the config map written by the operator not to be restored, got %s", event)
+		}
+	}
+}
@@ -16,9 +16,34 @@ limitations under the License.
 
 package constants
 
+import "time"
+
 const (
 	OperatorName   = "cloudflare-tunnel-operator"
 	ResourceSuffix = "cf-tunnel"
 	CNAMESuffix    = ".cfargotunnel.com"
 	ConfigsDir     = "/etc/cloudflared"
+	SocketDir      = "/var/run/origin" // mount path of the volume containing the unix socket of the origin
+
+	DNSCommentPrefix = "managed by cloudflare-tunnel-operator, uid=" // followed by the UID of the owning resource
+
+	RolloutInProgressAnnotation = "cloudflare-tunnel-operator.beezlabs.app/rollout-in-progress"
+	ShardAnnotation             = "cloudflare-tunnel-operator.beezlabs.app/shard"
+	TunnelIDAnnotation          = "cloudflare-tunnel-operator.beezlabs.app/tunnel-id"
+	TokenRefreshedAnnotation    = "cloudflare-tunnel-operator.beezlabs.app/token-refreshed-at"
+	TemplateHashAnnotation      = "cloudflare-tunnel-operator.beezlabs.app/template-hash"
+	// RestartedAtAnnotation is copied from the resource to the pods, changing its value restarts cloudflared
+	RestartedAtAnnotation = "cloudflare-tunnel-operator.beezlabs.app/restarted-at"
+	// ConfigChecksumAnnotation is the hash of the config of the pods, cloudflared is restarted when it changes as
+	// it does not reload the mounted config
+	ConfigChecksumAnnotation = "cloudflare-tunnel-operator.beezlabs.app/config-checksum"
+
+	InstanceLabel = "cloudflare-tunnel-operator.beezlabs.app/instance" // set to the UID of the owning resource
+	TunnelLabel   = "cloudflare-tunnel-operator.beezlabs.app/tunnel"   // set to the name of the owning resource
+	TunnelIDLabel = "cloudflare-tunnel-operator.beezlabs.app/tunnel-id"
+	Finalizer     = "cloudflare-tunnel-operator.beezlabs.app/cleanup"
+
+	WaitingRequeueInterval = 30 * time.Second // how often to check again while waiting for an external dependency
+	ResyncInterval         = 5 * time.Minute  // default of how often resources are reconciled again after a successful reconcile
+	RemoteTimeout          = 2 * time.Minute  // default of how long the calls to the Cloudflare API of a reconcile may take
 )
@@ -0,0 +1,75 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cloudflare/cloudflare-go"
+
+	cfclient "github.com/beezlabs-org/cloudflare-tunnel-operator/internal/cloudflare"
+)
+
+// DeletedTunnelNamePolicy defines how a tunnel is created when a deleted tunnel with the same name still exists
+type DeletedTunnelNamePolicy string
+
+const (
+	// DeletedTunnelNameIgnore creates the tunnel with the same name anyway
+	DeletedTunnelNameIgnore DeletedTunnelNamePolicy = "ignore"
+	// DeletedTunnelNameRename creates the tunnel with the UID of the resource appended to its name
+	DeletedTunnelNameRename DeletedTunnelNamePolicy = "rename"
+	// DeletedTunnelNameError refuses to create the tunnel until the name is free
+	DeletedTunnelNameError DeletedTunnelNamePolicy = "error"
+)
+
+// ParseDeletedTunnelNamePolicy validates the policy, an empty one defaults to ignore
+func ParseDeletedTunnelNamePolicy(value string) (DeletedTunnelNamePolicy, error) {
+	switch policy := DeletedTunnelNamePolicy(value); policy {
+	case "":
+		return DeletedTunnelNameIgnore, nil
+	case DeletedTunnelNameIgnore, DeletedTunnelNameRename, DeletedTunnelNameError:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid deleted tunnel name policy %q, must be one of ignore, rename or error", value)
+}
+
+// tunnelNameAvoidingDeleted returns the name to create the tunnel with according to the policy, if a deleted tunnel
+// with the given name is still returned by the remote. The renamed name only depends on the resource, so that the
+// tunnel created with it is found again by the next reconciles.
+func (r *CloudflareTunnelReconciler) tunnelNameAvoidingDeleted(ctx context.Context, cf cfclient.CloudflareClient, rc *cloudflare.ResourceContainer, name string) (string, error) {
+	if r.DeletedTunnelNames == "" || r.DeletedTunnelNames == DeletedTunnelNameIgnore {
+		return name, nil
+	}
+	truePointer := true // needed as the struct below only accepts a *bool
+	deleted, err := cf.Tunnels(ctx, rc, cloudflare.TunnelListParams{Name: name, IsDeleted: &truePointer})
+	if err != nil {
+		r.logger.Error(err, "could not fetch deleted tunnel list")
+		return "", err
+	}
+	if len(deleted) == 0 {
+		return name, nil
+	}
+	if r.DeletedTunnelNames == DeletedTunnelNameError {
+		err := fmt.Errorf("a deleted tunnel named %q still exists in the account", name)
+		r.logger.Error(err, "refusing to create a tunnel with the name of a deleted one")
+		return "", err
+	}
+	renamed := name + "-" + string(r.TunEx.UID)
+	r.logger.Info("A deleted tunnel with the same name exists, renaming the tunnel", "name", name, "renamed", renamed)
+	return renamed, nil
+}
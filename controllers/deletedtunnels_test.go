@@ -0,0 +1,102 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/go-logr/logr"
+
+	cfclient "github.com/beezlabs-org/cloudflare-tunnel-operator/internal/cloudflare"
+)
+
+func TestParseDeletedTunnelNamePolicy(t *testing.T) {
+	if policy, err := ParseDeletedTunnelNamePolicy(""); err != nil || policy != DeletedTunnelNameIgnore {
+		t.Errorf("expected the policy to default to ignore, got %q and %v", policy, err)
+	}
+	if _, err := ParseDeletedTunnelNamePolicy("reuse"); err == nil {
+		t.Errorf("expected an unknown policy to be rejected")
+	}
+}
+
+func TestCreateTunnelRemoteDeletedSameName(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   DeletedTunnelNamePolicy
+		wantName string
+		wantErr  bool
+	}{
+		{name: "ignore", policy: DeletedTunnelNameIgnore, wantName: "tunnel"},
+		{name: "rename", policy: DeletedTunnelNameRename, wantName: "tunnel-uid"},
+		{name: "error", policy: DeletedTunnelNameError, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deletedAt := time.Now()
+			remote := cfclient.NewFake("example.com")
+			remote.TunnelList = []cloudflare.Tunnel{{ID: "deleted-id", Name: "tunnel", DeletedAt: &deletedAt}}
+			tunnel := newTestTunnel("default")
+			r := newReconcileFixture(remote, tunnel)
+			r.DeletedTunnelNames = tt.policy
+			logger := logr.Discard()
+			r.logger = &logger
+			r.TunEx = &TunnelExpanded{Name: "tunnel", Namespace: "default", AccountTag: "account", TunSpec: tunnel.Spec, UID: "uid"}
+
+			err := r.createTunnelRemote(context.Background())
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				if len(remote.TunnelList) != 1 {
+					t.Errorf("expected no tunnel to be created, got %v", remote.TunnelList)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if len(remote.TunnelList) != 2 {
+				t.Fatalf("expected a tunnel to be created, got %v", remote.TunnelList)
+			}
+			created := remote.TunnelList[1]
+			if created.Name != tt.wantName || r.TunEx.TunnelID != created.ID {
+				t.Errorf("expected the tunnel %s to be used, got %v and %s", tt.wantName, created, r.TunEx.TunnelID)
+			}
+
+			// the next reconcile finds the tunnel again instead of creating another one
+			r.TunEx.TunnelID = ""
+			if err := r.createTunnelRemote(context.Background()); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if len(remote.TunnelList) != 2 || r.TunEx.TunnelID != created.ID {
+				t.Errorf("expected the tunnel %s to be reused, got %v", created.ID, remote.TunnelList)
+			}
+
+			// the tunnel stored in the status is still found once the deleted tunnel has been purged
+			remote.TunnelList = remote.TunnelList[1:]
+			if err := r.createTunnelRemote(context.Background()); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if len(remote.TunnelList) != 1 || r.TunEx.TunnelID != created.ID {
+				t.Errorf("expected the tunnel %s to be reused after the purge, got %v", created.ID, remote.TunnelList)
+			}
+		})
+	}
+}
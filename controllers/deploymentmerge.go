@@ -0,0 +1,126 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/conversion"
+
+	"github.com/beezlabs-org/cloudflare-tunnel-operator/controllers/constants"
+)
+
+// templateHash returns a hash of the fields of the deployment which trigger a rollout when changed
+func templateHash(deployment *appsv1.Deployment) (string, error) {
+	encoded, err := json.Marshal(struct {
+		Template interface{}
+		Strategy interface{}
+	}{deployment.Spec.Template, deployment.Spec.Strategy})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// setTemplateHash stamps the deployment with the hash of its template, to be compared on the next reconcile
+func setTemplateHash(deployment *appsv1.Deployment) error {
+	hash, err := templateHash(deployment)
+	if err != nil {
+		return err
+	}
+	if deployment.Annotations == nil {
+		deployment.Annotations = map[string]string{}
+	}
+	deployment.Annotations[constants.TemplateHashAnnotation] = hash
+	return nil
+}
+
+// templateEquality compares the template rendered by the operator with the live one, ignoring the fields left unset
+// in the rendered one as the API server defaults them. This includes the numbers, as an unset number cannot be told
+// apart from zero.
+var templateEquality = func() conversion.Equalities {
+	e := conversion.EqualitiesOrDie(
+		func(a, b int32) bool { return a == 0 || a == b },
+		func(a, b int64) bool { return a == 0 || a == b },
+	)
+	for typ, eq := range equality.Semantic.Equalities {
+		e.Equalities[typ] = eq
+	}
+	return e
+}()
+
+// templateDrifted reports whether the template or the strategy of current have been changed by someone else
+func templateDrifted(current, desired *appsv1.Deployment) bool {
+	return !templateEquality.DeepDerivative(desired.Spec.Template, current.Spec.Template) ||
+		!templateEquality.DeepDerivative(desired.Spec.Strategy, current.Spec.Strategy)
+}
+
+// mergeDeployment returns current with only the fields that differ from desired changed, and whether any did.
+// The template is compared by the hash stamped on the deployment, and field by field with the defaults of the API
+// server ignored so that the edits made by others are reverted. Everything else, like the state of an ongoing
+// rollout, is left as is so that changing the replicas in the middle of a rollout does not restart it.
+func mergeDeployment(current, desired *appsv1.Deployment) (*appsv1.Deployment, bool) {
+	updated := current.DeepCopy()
+	changed := false
+	if updated.Spec.Replicas == nil || *updated.Spec.Replicas != *desired.Spec.Replicas {
+		replicas := *desired.Spec.Replicas
+		updated.Spec.Replicas = &replicas
+		changed = true
+	}
+	hash := desired.Annotations[constants.TemplateHashAnnotation]
+	if updated.Annotations[constants.TemplateHashAnnotation] != hash || templateDrifted(current, desired) {
+		updated.Spec.Template = *desired.Spec.Template.DeepCopy()
+		updated.Spec.Strategy = *desired.Spec.Strategy.DeepCopy()
+		if updated.Annotations == nil {
+			updated.Annotations = map[string]string{}
+		}
+		updated.Annotations[constants.TemplateHashAnnotation] = hash
+		changed = true
+	}
+	for key, value := range desired.Labels {
+		if updated.Labels[key] != value {
+			if updated.Labels == nil {
+				updated.Labels = map[string]string{}
+			}
+			updated.Labels[key] = value
+			changed = true
+		}
+	}
+	if !equality.Semantic.DeepEqual(updated.OwnerReferences, desired.OwnerReferences) {
+		updated.OwnerReferences = desired.OwnerReferences
+		changed = true
+	}
+	return updated, changed
+}
+
+// deploymentRolledOut reports whether all the replicas of the deployment run its current template
+func deploymentRolledOut(deployment *appsv1.Deployment) bool {
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	status := deployment.Status
+	return status.ObservedGeneration >= deployment.Generation &&
+		status.UpdatedReplicas == replicas &&
+		status.Replicas == replicas &&
+		status.AvailableReplicas == replicas
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/base64"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// diffedFields are the top level fields of a managed object that are compared when logging changes
+var diffedFields = []string{"metadata", "spec", "data", "stringData"}
+
+// logChanges logs the fields that will be changed when current is updated to desired.
+// Only the paths of the fields are logged, never the values, so that secret data is not leaked.
+func (r *CloudflareTunnelReconciler) logChanges(kind string, current, desired client.Object) {
+	changed, err := changedFields(current, desired)
+	if err != nil {
+		r.logger.V(1).Info("could not compute changes for "+kind, "error", err.Error())
+		return
+	}
+	if len(changed) == 0 {
+		return
+	}
+	r.logger.V(1).Info("Updating "+kind, "changed", changed)
+}
+
+// changedFields returns the sorted paths of the fields set in desired which differ from the ones in current.
+// Fields that are only present in current are ignored as they are usually defaulted by the API server.
+func changedFields(current, desired client.Object) ([]string, error) {
+	currentMap, err := runtime.DefaultUnstructuredConverter.ToUnstructured(current)
+	if err != nil {
+		return nil, err
+	}
+	desiredMap, err := runtime.DefaultUnstructuredConverter.ToUnstructured(desired)
+	if err != nil {
+		return nil, err
+	}
+
+	// the API server never returns stringData, so it has to be compared against the encoded data
+	if stringData, ok := desiredMap["stringData"].(map[string]interface{}); ok {
+		data, _ := desiredMap["data"].(map[string]interface{})
+		if data == nil {
+			data = map[string]interface{}{}
+		}
+		for key, value := range stringData {
+			data[key] = base64.StdEncoding.EncodeToString([]byte(value.(string)))
+		}
+		desiredMap["data"] = data
+		delete(desiredMap, "stringData")
+	}
+
+	var changed []string
+	for _, field := range diffedFields {
+		desiredValue, ok := desiredMap[field]
+		if !ok {
+			continue
+		}
+		changed = append(changed, diffValues(field, currentMap[field], desiredValue)...)
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+func diffValues(path string, current, desired interface{}) []string {
+	switch desiredValue := desired.(type) {
+	case nil:
+		return nil
+	case map[string]interface{}:
+		currentValue, ok := current.(map[string]interface{})
+		if !ok {
+			return []string{path}
+		}
+		var changed []string
+		for key, value := range desiredValue {
+			changed = append(changed, diffValues(path+"."+key, currentValue[key], value)...)
+		}
+		return changed
+	case []interface{}:
+		currentValue, ok := current.([]interface{})
+		if !ok || len(currentValue) != len(desiredValue) {
+			return []string{path}
+		}
+		var changed []string
+		for i, value := range desiredValue {
+			changed = append(changed, diffValues(path+"["+strconv.Itoa(i)+"]", currentValue[i], value)...)
+		}
+		return changed
+	default:
+		if !reflect.DeepEqual(current, desired) {
+			return []string{path}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr/funcr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestLogChanges(t *testing.T) {
+	desired := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "tunnel-cf-tunnel", Namespace: "default"},
+		StringData: map[string]string{"cert.pem": "super-secret-cert"},
+	}
+	unchanged := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "tunnel-cf-tunnel", Namespace: "default", ResourceVersion: "42"},
+		Data:       map[string][]byte{"cert.pem": []byte("super-secret-cert")},
+		Type:       corev1.SecretTypeOpaque,
+	}
+	changed := unchanged.DeepCopy()
+	changed.Data["cert.pem"] = []byte("old-cert")
+
+	tests := []struct {
+		name    string
+		current *corev1.Secret
+		want    string
+	}{
+		{name: "unchanged", current: unchanged, want: ""},
+		{name: "changed", current: changed, want: `"changed"=["data.cert.pem"]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs []string
+			logger := funcr.New(func(prefix, args string) {
+				logs = append(logs, args)
+			}, funcr.Options{Verbosity: 1})
+			r := &CloudflareTunnelReconciler{logger: &logger}
+
+			r.logChanges("secret", tt.current, desired)
+
+			output := strings.Join(logs, "\n")
+			if tt.want == "" && output != "" {
+				t.Fatalf("expected no log, got %s", output)
+			}
+			if !strings.Contains(output, tt.want) {
+				t.Fatalf("expected log to contain %s, got %s", tt.want, output)
+			}
+			if strings.Contains(output, "secret-cert") || strings.Contains(output, "old-cert") {
+				t.Fatalf("secret values leaked into log: %s", output)
+			}
+		})
+	}
+}
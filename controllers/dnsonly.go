@@ -0,0 +1,91 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	cfv2 "github.com/beezlabs-org/cloudflare-tunnel-operator/api/v1alpha2"
+)
+
+// validateDNSOnly checks that the tunnel is known when only the DNS record is managed
+func validateDNSOnly(spec cfv2.CloudflareTunnelSpec) error {
+	if !spec.DNSOnly {
+		return nil
+	}
+	if spec.TunnelID == "" {
+		return fmt.Errorf("tunnelID is required when dnsOnly is set")
+	}
+	if !dnsManaged(spec) {
+		return fmt.Errorf("manageDNS must not be false when dnsOnly is set")
+	}
+	return nil
+}
+
+// reconcileDNSOnly points the DNS record to the external tunnel given in the spec, without creating the tunnel
+// or running cloudflared
+func (r *CloudflareTunnelReconciler) reconcileDNSOnly(ctx context.Context, cloudflareTunnel *cfv2.CloudflareTunnel) (ctrl.Result, error) {
+	remoteCtx, cancel := r.remoteContext(ctx)
+	defer cancel()
+
+	if err := r.fetchDecodeSecret(remoteCtx); err != nil {
+		return ctrl.Result{}, err
+	}
+	cf, err := r.cloudflareClient(r.TunEx.AccountToken, r.TunEx.AccountEmail, r.TunEx.AccountTag)
+	if err != nil {
+		r.logger.Error(err, "could not create cloudflare instance")
+		return ctrl.Result{}, err
+	}
+	r.TunEx.CloudflareAPI = cf
+	r.TunEx.TunnelID = r.TunEx.TunSpec.TunnelID
+	if err := r.detectZone(remoteCtx, cloudflareTunnel.Status); err != nil {
+		return r.handleError(ctx, cloudflareTunnel, err)
+	}
+
+	if err := r.reconcileDNS(remoteCtx); err != nil {
+		return r.handleError(ctx, cloudflareTunnel, err)
+	}
+	r.setEndpointStatus(cloudflareTunnel)
+	meta.SetStatusCondition(&cloudflareTunnel.Status.Conditions, metav1.Condition{
+		Type:               cfv2.ConditionDNSReady,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: cloudflareTunnel.Generation,
+		Reason:             "Reconciled",
+		Message:            "the DNS record points to the tunnel",
+	})
+
+	// the connections of the external cloudflared are still reported
+	if err := r.updateStatus(remoteCtx, cloudflareTunnel); err != nil {
+		return r.handleError(ctx, cloudflareTunnel, err)
+	}
+	meta.SetStatusCondition(&cloudflareTunnel.Status.Conditions, metav1.Condition{
+		Type:               cfv2.ConditionReady,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: cloudflareTunnel.Generation,
+		Reason:             "Reconciled",
+		Message:            "the DNS record of the external tunnel has been reconciled",
+	})
+	if err := r.writeStatus(ctx, cloudflareTunnel); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: r.resyncInterval()}, nil
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cfv2 "github.com/beezlabs-org/cloudflare-tunnel-operator/api/v1alpha2"
+	"github.com/beezlabs-org/cloudflare-tunnel-operator/controllers/constants"
+	cfclient "github.com/beezlabs-org/cloudflare-tunnel-operator/internal/cloudflare"
+)
+
+func TestValidateDNSOnly(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    cfv2.CloudflareTunnelSpec
+		wantErr bool
+	}{
+		{name: "managed tunnel", spec: cfv2.CloudflareTunnelSpec{}},
+		{name: "tunnel ID of a managed tunnel", spec: cfv2.CloudflareTunnelSpec{TunnelID: "tunnel-id"}},
+		{name: "external tunnel", spec: cfv2.CloudflareTunnelSpec{DNSOnly: true, TunnelID: "tunnel-id"}},
+		{name: "external tunnel without ID", spec: cfv2.CloudflareTunnelSpec{DNSOnly: true}, wantErr: true},
+		{
+			name:    "external tunnel without DNS",
+			spec:    cfv2.CloudflareTunnelSpec{DNSOnly: true, TunnelID: "tunnel-id", ManageDNS: new(bool)},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateDNSOnly(tt.spec); (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestReconcileDNSOnly(t *testing.T) {
+	ctx := context.Background()
+	remote := cfclient.NewFake("example.com")
+	zoneID := remote.Zones["example.com"]
+	tunnel := newTestTunnel("default")
+	tunnel.Spec.DNSOnly = true
+	tunnel.Spec.TunnelID = "external-id"
+	tunnel.Spec.Service = nil
+	r := newReconcileFixture(remote, tunnel,
+		// the origin certificate is not needed as cloudflared is not run
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "credentials", Namespace: "default"},
+			Data:       map[string][]byte{"accountID": []byte("account"), "token": []byte("token")},
+		},
+	)
+	r.ResyncInterval = time.Minute
+	request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "tunnel", Namespace: "default"}}
+
+	result, err := r.Reconcile(ctx, request)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if result.RequeueAfter != time.Minute {
+		t.Errorf("expected a requeue at the configured resync interval, got %v", result.RequeueAfter)
+	}
+
+	if records := remote.Records[zoneID]; len(records) != 1 || records[0].Content != "external-id"+constants.CNAMESuffix {
+		t.Errorf("expected the CNAME to point to the external tunnel, got %v", records)
+	}
+	for _, call := range remote.Calls {
+		if call == "CreateTunnel" || call == "Tunnels" {
+			t.Errorf("expected the tunnel not to be managed, got calls %v", remote.Calls)
+		}
+	}
+	var deployments appsv1.DeploymentList
+	if err := r.Client.List(ctx, &deployments, client.InNamespace("default")); err != nil || len(deployments.Items) != 0 {
+		t.Errorf("expected no deployment, got %v and %v", deployments.Items, err)
+	}
+	var fetched cfv2.CloudflareTunnel
+	if err := r.Client.Get(ctx, request.NamespacedName, &fetched); err != nil {
+		t.Fatalf("could not fetch tunnel: %v", err)
+	}
+	if fetched.Status.TunnelID != "external-id" || !meta.IsStatusConditionTrue(fetched.Status.Conditions, cfv2.ConditionReady) {
+		t.Errorf("expected the external tunnel to be reported as ready, got %+v", fetched.Status)
+	}
+
+	// the DNS record is removed with the resource but the external tunnel is kept
+	remote.TunnelList = append(remote.TunnelList, cloudflare.Tunnel{ID: "external-id", Name: "external"})
+	now := metav1.Now()
+	fetched.DeletionTimestamp = &now
+	if _, err := r.finalize(ctx, &fetched); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(remote.Records[zoneID]) != 0 {
+		t.Errorf("expected the DNS record to be deleted, got %v", remote.Records[zoneID])
+	}
+	if len(remote.TunnelList) != 1 {
+		t.Errorf("expected the external tunnel to be kept, got %v", remote.TunnelList)
+	}
+}
+
+func TestReconcileExternallyManagedDNS(t *testing.T) {
+	ctx := context.Background()
+	remote := cfclient.NewFake("example.com")
+	tunnel := newTestTunnel("default")
+	tunnel.Spec.ManageDNS = new(bool)
+	r := newReconcileFixture(remote, tunnel)
+	request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "tunnel", Namespace: "default"}}
+
+	if _, err := r.Reconcile(ctx, request); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for _, call := range remote.Calls {
+		if call == "ZoneIDByName" || strings.Contains(call, "DNSRecord") {
+			t.Errorf("expected DNS not to be touched, got calls %v", remote.Calls)
+		}
+	}
+	var deployments appsv1.DeploymentList
+	if err := r.Client.List(ctx, &deployments, client.InNamespace("default")); err != nil || len(deployments.Items) != 1 {
+		t.Errorf("expected the deployment to be created, got %v and %v", deployments.Items, err)
+	}
+	var fetched cfv2.CloudflareTunnel
+	if err := r.Client.Get(ctx, request.NamespacedName, &fetched); err != nil {
+		t.Fatalf("could not fetch tunnel: %v", err)
+	}
+	status := fetched.Status
+	if !meta.IsStatusConditionTrue(status.Conditions, cfv2.ConditionReady) {
+		t.Errorf("expected the tunnel to be ready, got %v", status.Conditions)
+	}
+	if dns := meta.FindStatusCondition(status.Conditions, cfv2.ConditionDNSReady); dns == nil || dns.Reason != "ExternallyManaged" {
+		t.Errorf("expected the DNS to be reported as externally managed, got %v", dns)
+	}
+	if status.CNAMETarget != status.TunnelID+constants.CNAMESuffix {
+		t.Errorf("expected the target of the records to be reported, got %s", status.CNAMETarget)
+	}
+
+	// the tunnel is deleted with the resource, the records are left to their manager
+	remote.Calls = nil
+	now := metav1.Now()
+	fetched.DeletionTimestamp = &now
+	if _, err := r.finalize(ctx, &fetched); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for _, call := range remote.Calls {
+		if call == "ZoneIDByName" || strings.Contains(call, "DNSRecord") {
+			t.Errorf("expected DNS not to be touched, got calls %v", remote.Calls)
+		}
+	}
+	if len(remote.TunnelList) != 0 {
+		t.Errorf("expected the tunnel to be deleted, got %v", remote.TunnelList)
+	}
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/cloudflare/cloudflare-go"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/beezlabs-org/cloudflare-tunnel-operator/controllers/constants"
+	cfclient "github.com/beezlabs-org/cloudflare-tunnel-operator/internal/cloudflare"
+)
+
+// dnsRecordComment returns the comment marking a DNS record as owned by the resource with the given UID.
+// The UID is used instead of the name so that the record can still be found after the domain or the resource changes.
+func dnsRecordComment(uid types.UID) string {
+	return constants.DNSCommentPrefix + string(uid)
+}
+
+// ownedDNSRecords returns the records whose comment marks them as owned by the resource with the given UID
+func ownedDNSRecords(records []cfclient.CommentedDNSRecord, uid types.UID) []cfclient.CommentedDNSRecord {
+	if uid == "" {
+		return nil
+	}
+	comment := dnsRecordComment(uid)
+	var owned []cfclient.CommentedDNSRecord
+	for _, record := range records {
+		if record.Comment == comment {
+			owned = append(owned, record)
+		}
+	}
+	return owned
+}
+
+// listOwnedDNSRecords fetches the CNAME records of the zone which are owned by the current resource
+func (r *CloudflareTunnelReconciler) listOwnedDNSRecords(ctx context.Context, zoneID string) ([]cfclient.CommentedDNSRecord, error) {
+	records, err := r.TunEx.CloudflareAPI.DNSRecordsByComment(ctx, zoneID, "CNAME", dnsRecordComment(r.TunEx.UID))
+	if err != nil {
+		return nil, err
+	}
+	// the filter is applied again in case the remote ignored it
+	return ownedDNSRecords(records, r.TunEx.UID), nil
+}
+
+// markDNSRecordOwned sets the comment of the record to the UID marker of the current resource
+func (r *CloudflareTunnelReconciler) markDNSRecordOwned(ctx context.Context, zoneID, recordID string) error {
+	return r.TunEx.CloudflareAPI.SetDNSRecordComment(ctx, zoneID, recordID, dnsRecordComment(r.TunEx.UID))
+}
+
+// updateDNSRecordByID updates the record stored in the status if it differs from dnsRecord.
+// It reports false if the record is gone or has been replaced by a record of another type, so that it is looked up.
+func (r *CloudflareTunnelReconciler) updateDNSRecordByID(ctx context.Context, zoneID string, dnsRecord cloudflare.DNSRecord) (bool, error) {
+	existing, err := r.TunEx.CloudflareAPI.DNSRecord(ctx, zoneID, r.TunEx.DNSRecordID)
+	if err != nil {
+		if !isNotFound(err) {
+			r.logger.Error(err, "could not fetch DNS record")
+			return false, err
+		}
+		existing = cloudflare.DNSRecord{}
+	}
+	if existing.Type != dnsRecord.Type {
+		r.logger.V(1).Info("Stored DNS record is gone, looking it up", "id", r.TunEx.DNSRecordID)
+		r.TunEx.DNSRecordID = ""
+		return false, nil
+	}
+	if dnsRecordMatches(existing, dnsRecord) {
+		r.logger.V(1).Info("DNS record exists and is up to date")
+		return true, nil
+	}
+	r.logger.V(1).Info("DNS record exists, updating", "name", existing.Name)
+	if err := r.retryDNS(func() error {
+		return r.TunEx.CloudflareAPI.UpdateDNSRecord(ctx, zoneID, existing.ID, dnsRecord)
+	}); err != nil {
+		r.logger.Error(err, "could not update DNS record")
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,265 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	cfv2 "github.com/beezlabs-org/cloudflare-tunnel-operator/api/v1alpha2"
+	"github.com/beezlabs-org/cloudflare-tunnel-operator/controllers/constants"
+	cfclient "github.com/beezlabs-org/cloudflare-tunnel-operator/internal/cloudflare"
+)
+
+func TestOwnedDNSRecords(t *testing.T) {
+	uid := types.UID("3c1b7a52-0d6f-4c4e-9a39-0c2f5c1e7d10")
+	records := []cfclient.CommentedDNSRecord{
+		{DNSRecord: cloudflare.DNSRecord{ID: "renamed", Name: "old.example.com"}, Comment: dnsRecordComment(uid)},
+		{DNSRecord: cloudflare.DNSRecord{ID: "foreign", Name: "app.example.com"}, Comment: dnsRecordComment("other-uid")},
+		{DNSRecord: cloudflare.DNSRecord{ID: "manual", Name: "app.example.com"}, Comment: "created by hand"},
+		{DNSRecord: cloudflare.DNSRecord{ID: "uncommented", Name: "app.example.com"}},
+	}
+
+	owned := ownedDNSRecords(records, uid)
+	if len(owned) != 1 || owned[0].ID != "renamed" {
+		t.Fatalf("expected only the record carrying the UID to be owned, got %v", owned)
+	}
+	if owned := ownedDNSRecords(records, ""); len(owned) != 0 {
+		t.Fatalf("expected no record to be owned without a UID, got %v", owned)
+	}
+}
+
+func TestCreateDNSCNAMEMatchesByUID(t *testing.T) {
+	uid := types.UID("3c1b7a52-0d6f-4c4e-9a39-0c2f5c1e7d10")
+	fake := cfclient.NewFake("example.com")
+	zoneID := fake.Zones["example.com"]
+	fake.Records[zoneID] = []cfclient.CommentedDNSRecord{
+		// created for the previous domain of the resource
+		{DNSRecord: cloudflare.DNSRecord{ID: "renamed", Type: "CNAME", Name: "old.example.com", Content: "old.cfargotunnel.com"}, Comment: dnsRecordComment(uid)},
+		// a leftover of a previous reconcile
+		{DNSRecord: cloudflare.DNSRecord{ID: "stale", Type: "CNAME", Name: "older.example.com", Content: "old.cfargotunnel.com"}, Comment: dnsRecordComment(uid)},
+		{DNSRecord: cloudflare.DNSRecord{ID: "foreign", Type: "CNAME", Name: "other.example.com", Content: "other.cfargotunnel.com"}, Comment: dnsRecordComment("other-uid")},
+	}
+	tunnel := newTestTunnel("default")
+	r := newTestReconciler(tunnel)
+	logger := logr.Discard()
+	r.logger = &logger
+	r.TunEx = &TunnelExpanded{CloudflareAPI: fake, TunSpec: tunnel.Spec, TunnelID: "tunnel-id", UID: uid}
+
+	if err := r.createDNSCNAME(context.Background()); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	records := map[string]cfclient.CommentedDNSRecord{}
+	for _, record := range fake.Records[zoneID] {
+		records[record.ID] = record
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected the stale record to be removed, got %v", fake.Records[zoneID])
+	}
+	if renamed := records["renamed"]; renamed.Name != "app.example.com" || renamed.Content != "tunnel-id.cfargotunnel.com" {
+		t.Errorf("expected the owned record to follow the domain, got %v", renamed)
+	}
+	if foreign := records["foreign"]; foreign.Name != "other.example.com" {
+		t.Errorf("expected the record of another resource to be left untouched, got %v", foreign)
+	}
+}
+
+func TestRepointDNSCNAMEAfterRecreation(t *testing.T) {
+	uid := types.UID("3c1b7a52-0d6f-4c4e-9a39-0c2f5c1e7d10")
+	remote := cfclient.NewFake("example.com")
+	zoneID := remote.Zones["example.com"]
+	remote.Records[zoneID] = []cfclient.CommentedDNSRecord{
+		{DNSRecord: cloudflare.DNSRecord{ID: "record", Type: "CNAME", Name: "app.example.com", Content: "deleted-id.cfargotunnel.com"}, Comment: dnsRecordComment(uid)},
+	}
+	tunnel := newTestTunnel("default")
+	r := newReconcileFixture(remote, tunnel)
+	logger := logr.Discard()
+	r.logger = &logger
+	// the status still references a tunnel which has been deleted from the remote
+	r.TunEx = &TunnelExpanded{Name: "tunnel", Namespace: "default", AccountTag: "account", TunSpec: tunnel.Spec, TunnelID: "deleted-id", UID: uid}
+
+	previousTunnelID := r.TunEx.TunnelID
+	if err := r.createTunnelRemote(context.Background()); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if r.TunEx.TunnelID == previousTunnelID {
+		t.Fatalf("expected the tunnel to be recreated with a new ID")
+	}
+	if err := r.repointDNSCNAME(context.Background(), previousTunnelID); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	records := remote.Records[zoneID]
+	if len(records) != 1 || records[0].Content != r.TunEx.TunnelID+constants.CNAMESuffix {
+		t.Errorf("expected the CNAME to point to the new tunnel %s, got %v", r.TunEx.TunnelID, records)
+	}
+}
+
+func TestSetEndpointStatus(t *testing.T) {
+	remote := cfclient.NewFake("example.com")
+	zoneID := remote.Zones["example.com"]
+	tunnel := newTestTunnel("default")
+	r := newTestReconciler(tunnel)
+	logger := logr.Discard()
+	r.logger = &logger
+	r.TunEx = &TunnelExpanded{CloudflareAPI: remote, TunSpec: tunnel.Spec, TunnelID: "tunnel-id", UID: "uid"}
+
+	if err := r.createDNSCNAME(context.Background()); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	r.setEndpointStatus(tunnel)
+
+	record := remote.Records[zoneID][0]
+	if tunnel.Status.CNAMETarget != record.Content {
+		t.Errorf("expected the CNAME target %s, got %s", record.Content, tunnel.Status.CNAMETarget)
+	}
+	if tunnel.Status.URL != "https://"+record.Name {
+		t.Errorf("expected the URL of %s, got %s", record.Name, tunnel.Status.URL)
+	}
+
+	// the domain is routed through the load balancer instead
+	r.TunEx.TunSpec.LoadBalancer = &cfv2.CloudflareTunnelLoadBalancer{Pool: "app"}
+	r.setEndpointStatus(tunnel)
+	if tunnel.Status.CNAMETarget != "" || tunnel.Status.URL != "https://app.example.com" {
+		t.Errorf("expected only the URL to be set, got %s and %s", tunnel.Status.URL, tunnel.Status.CNAMETarget)
+	}
+
+	if _, err := r.handleError(context.Background(), tunnel, &dnsError{err: fmt.Errorf("failure")}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if tunnel.Status.URL != "" || tunnel.Status.CNAMETarget != "" {
+		t.Errorf("expected the endpoint to be cleared when the DNS record cannot be written, got %s and %s", tunnel.Status.URL, tunnel.Status.CNAMETarget)
+	}
+}
+
+func TestCreateDNSCNAMEByID(t *testing.T) {
+	tests := []struct {
+		name       string
+		recordID   string
+		wantLookup bool
+	}{
+		{name: "stored", recordID: "record", wantLookup: false},
+		{name: "gone", recordID: "deleted", wantLookup: true},
+		{name: "missing", recordID: "", wantLookup: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote := cfclient.NewFake("example.com")
+			zoneID := remote.Zones["example.com"]
+			remote.Records[zoneID] = []cfclient.CommentedDNSRecord{
+				{DNSRecord: cloudflare.DNSRecord{ID: "record", Type: "CNAME", Name: "app.example.com", Content: "old-id.cfargotunnel.com"}, Comment: dnsRecordComment("uid")},
+			}
+			tunnel := newTestTunnel("default")
+			r := newTestReconciler(tunnel)
+			logger := logr.Discard()
+			r.logger = &logger
+			r.TunEx = &TunnelExpanded{CloudflareAPI: remote, TunSpec: tunnel.Spec, TunnelID: "tunnel-id", UID: "uid", DNSRecordID: tt.recordID}
+
+			if err := r.createDNSCNAME(context.Background()); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if records := remote.Records[zoneID]; len(records) != 1 || records[0].Content != "tunnel-id.cfargotunnel.com" {
+				t.Errorf("expected the record to be updated, got %v", records)
+			}
+			if r.TunEx.DNSRecordID != "record" {
+				t.Errorf("expected the record ID to be stored, got %q", r.TunEx.DNSRecordID)
+			}
+			lookedUp := false
+			for _, call := range remote.Calls {
+				if call == "DNSRecordsByComment" || call == "DNSRecords" {
+					lookedUp = true
+				}
+			}
+			if lookedUp != tt.wantLookup {
+				t.Errorf("expected the record to be looked up %v, got calls %v", tt.wantLookup, remote.Calls)
+			}
+		})
+	}
+}
+
+func TestCreateDNSCNAMEDecoupledName(t *testing.T) {
+	remote := cfclient.NewFake("example.com")
+	zoneID := remote.Zones["example.com"]
+	tunnel := newTestTunnel("default")
+	// cloudflared routes the hostname of the CDN in front while the record lives in the zone
+	tunnel.Spec.Domain = "app.example.org"
+	tunnel.Spec.DNSRecordName = "edge.example.com"
+	existing := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "tunnel-" + constants.ResourceSuffix, Namespace: "default"}}
+	r := newTestReconciler(tunnel, existing)
+	logger := logr.Discard()
+	r.logger = &logger
+	r.TunEx = &TunnelExpanded{CloudflareAPI: remote, Name: "tunnel", Namespace: "default", TunSpec: tunnel.Spec, TunnelID: "tunnel-id", UID: "uid"}
+
+	if err := r.createDNSCNAME(context.Background()); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if records := remote.Records[zoneID]; len(records) != 1 || records[0].Name != "edge.example.com" {
+		t.Errorf("expected the record to be named after the DNS record name, got %v", records)
+	}
+
+	configMap, err := r.createConfigMap(context.Background(), *tunnel, "http://app.default.svc:80")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	config := ""
+	for _, data := range configMap.Data {
+		config += data
+	}
+	if !strings.Contains(config, "app.example.org") || strings.Contains(config, "edge.example.com") {
+		t.Errorf("expected the ingress rule to use the domain only, got %s", config)
+	}
+}
+
+func TestReconcileCorrectsCNAMEOfRecreatedTunnel(t *testing.T) {
+	remote := cfclient.NewFake("example.com")
+	zoneID := remote.Zones["example.com"]
+	// the record predates the ownership comments and still points at the deleted tunnel
+	remote.Records[zoneID] = []cfclient.CommentedDNSRecord{
+		{DNSRecord: cloudflare.DNSRecord{ID: "record", Type: "CNAME", Name: "app.example.com", Content: "deleted-id" + constants.CNAMESuffix}},
+	}
+	tunnel := newTestTunnel("default")
+	tunnel.UID = "uid"
+	tunnel.Status.TunnelID = "deleted-id"
+	r := newReconcileFixture(remote, tunnel)
+
+	request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "tunnel", Namespace: "default"}}
+	if _, err := r.Reconcile(context.Background(), request); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	var current cfv2.CloudflareTunnel
+	if err := r.Client.Get(context.Background(), request.NamespacedName, &current); err != nil {
+		t.Fatal(err)
+	}
+	if current.Status.TunnelID == "" || current.Status.TunnelID == "deleted-id" {
+		t.Fatalf("expected the tunnel to be recreated, got %q", current.Status.TunnelID)
+	}
+	records := remote.Records[zoneID]
+	if len(records) != 1 || records[0].Content != current.Status.TunnelID+constants.CNAMESuffix {
+		t.Errorf("expected the CNAME to point at the new tunnel %s, got %v", current.Status.TunnelID, records)
+	}
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+)
+
+// dnsError signals that the DNS record could not be written even after retrying.
+// The rest of the tunnel is working, so the reconcile is retried at the resync interval instead of backing off.
+type dnsError struct {
+	err error
+}
+
+func (e *dnsError) Error() string {
+	return e.err.Error()
+}
+
+func (e *dnsError) Unwrap() error {
+	return e.err
+}
+
+// retryDNS calls write until it succeeds or the configured attempts are exhausted, backing off between attempts.
+// Errors caused by missing permissions are not retried as they are not transient, nor are requests which are still
+// rate limited, as the reconcile is requeued once the remote allows requests again.
+func (r *CloudflareTunnelReconciler) retryDNS(write func() error) error {
+	attempts := r.DNSAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	backoff := wait.Backoff{
+		Steps:    attempts,
+		Duration: r.DNSRetryDelay,
+		Factor:   2,
+		Jitter:   0.1,
+	}
+	err := retry.OnError(backoff, func(err error) bool {
+		if isInsufficientScope(err) || isRateLimited(err) {
+			return false
+		}
+		r.logger.V(1).Info("Could not write DNS record, retrying", "error", err.Error())
+		return true
+	}, write)
+	if err != nil && !isInsufficientScope(err) && !isRateLimited(err) {
+		return &dnsError{err: err}
+	}
+	return err
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cfv2 "github.com/beezlabs-org/cloudflare-tunnel-operator/api/v1alpha2"
+	"github.com/beezlabs-org/cloudflare-tunnel-operator/controllers/constants"
+	cfclient "github.com/beezlabs-org/cloudflare-tunnel-operator/internal/cloudflare"
+)
+
+// newDNSServer fakes the DNS API of a zone without records, failing the first failures record creations
+func newDNSServer(failures int) (*httptest.Server, *int) {
+	creations := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case req.URL.Path == "/zones":
+			fmt.Fprint(w, `{"success":true,"errors":[],"messages":[],"result":[{"id":"zone-id","name":"example.com"}],
+				"result_info":{"page":1,"per_page":50,"count":1,"total_count":1,"total_pages":1}}`)
+		case req.Method == http.MethodGet && strings.HasSuffix(req.URL.Path, "/dns_records"):
+			fmt.Fprint(w, `{"success":true,"errors":[],"messages":[],"result":[],
+				"result_info":{"page":1,"per_page":100,"count":0,"total_count":0,"total_pages":1}}`)
+		case req.Method == http.MethodPost:
+			creations++
+			if creations <= failures {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"success":false,"errors":[{"code":1004,"message":"DNS Validation Error"}],"messages":[],"result":null}`)
+				return
+			}
+			fmt.Fprint(w, `{"success":true,"errors":[],"messages":[],"result":{"id":"record-id","type":"CNAME"}}`)
+		default:
+			fmt.Fprint(w, `{"success":true,"errors":[],"messages":[],"result":{"id":"record-id"}}`)
+		}
+	}))
+	return server, &creations
+}
+
+func TestCreateDNSCNAMERetries(t *testing.T) {
+	tests := []struct {
+		name          string
+		failures      int
+		wantErr       bool
+		wantCreations int
+	}{
+		{name: "success after retry", failures: 2, wantCreations: 3},
+		{name: "retries exhausted", failures: 5, wantErr: true, wantCreations: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, creations := newDNSServer(tt.failures)
+			defer server.Close()
+			api, err := cfclient.New("token", cloudflare.BaseURL(server.URL), cloudflare.UsingRateLimit(1000))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tunnel := newTestTunnel("default")
+			r := newTestReconciler(tunnel)
+			r.DNSAttempts = 3
+			logger := logr.Discard()
+			r.logger = &logger
+			r.TunEx = &TunnelExpanded{CloudflareAPI: api, TunSpec: tunnel.Spec, TunnelID: "tunnel-id", UID: "tunnel-uid"}
+
+			err = r.createDNSCNAME(context.Background())
+			if *creations != tt.wantCreations {
+				t.Errorf("expected %d attempts, got %d", tt.wantCreations, *creations)
+			}
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				return
+			}
+			if _, ok := err.(*dnsError); !ok {
+				t.Fatalf("expected a DNS error, got %v", err)
+			}
+			result, err := r.handleError(context.Background(), tunnel, err)
+			if err != nil {
+				t.Fatalf("expected the reconcile to be requeued without an error, got %v", err)
+			}
+			if result.RequeueAfter != constants.ResyncInterval {
+				t.Errorf("expected a requeue at the resync interval, got %v", result.RequeueAfter)
+			}
+			condition := meta.FindStatusCondition(tunnel.Status.Conditions, cfv2.ConditionDNSReady)
+			if condition == nil || condition.Status != metav1.ConditionFalse {
+				t.Errorf("unexpected DNS condition %v", condition)
+			}
+		})
+	}
+}
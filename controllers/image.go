@@ -0,0 +1,51 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// imageReference matches the image references accepted by the container runtimes, following the grammar of
+// github.com/distribution/distribution/reference: [registry[:port]/]path[:tag][@digest]
+var imageReference = func() *regexp.Regexp {
+	domainComponent := `(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])`
+	// the first component is only a registry if it has a dot or a port or is localhost, like in the docker CLI
+	domain := `(?:localhost(?::[0-9]+)?|` + domainComponent + `(?:\.` + domainComponent + `)+(?::[0-9]+)?|` +
+		domainComponent + `:[0-9]+)`
+	pathComponent := `[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*`
+	name := `(?:` + domain + `/)?` + pathComponent + `(?:/` + pathComponent + `)*`
+	tag := `[\w][\w.-]{0,127}`
+	digest := `[A-Za-z][A-Za-z0-9]*(?:[-_+.][A-Za-z][A-Za-z0-9]*)*:[0-9a-fA-F]{32,}`
+	return regexp.MustCompile(`^(` + name + `)(?::` + tag + `)?(?:@` + digest + `)?$`)
+}()
+
+// maxImageNameLength is the maximum length of the name of an image, without its tag and digest
+const maxImageNameLength = 255
+
+// validateImage checks that the image is a valid reference, so that the pods do not fail to pull it
+func validateImage(image string) error {
+	matches := imageReference.FindStringSubmatch(image)
+	if matches == nil {
+		return fmt.Errorf("invalid image %q: not a valid image reference", image)
+	}
+	if len(matches[1]) > maxImageNameLength {
+		return fmt.Errorf("invalid image %q: the name is longer than %d characters", image, maxImageNameLength)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import "testing"
+
+func TestValidateImage(t *testing.T) {
+	tests := []struct {
+		image   string
+		wantErr bool
+	}{
+		{image: "cloudflared"},
+		{image: "cloudflare/cloudflared:2022.7.1"},
+		{image: "registry.internal:5000/mirror/cloudflare/cloudflared:2022.7.1"},
+		{image: "cloudflare/cloudflared@sha256:8c3a5bbd6f3c4e4a52c0b0e4e1a1f6c5a0a2f0a9c2b3d4e5f60718293a4b5c6d"},
+		{image: "localhost/cloudflared:latest@sha256:8c3a5bbd6f3c4e4a52c0b0e4e1a1f6c5a0a2f0a9c2b3d4e5f60718293a4b5c6d"},
+		{image: "Cloudflare/cloudflared", wantErr: true},
+		{image: "cloudflare/cloudflared:", wantErr: true},
+		{image: "cloudflare/cloudflared:-latest", wantErr: true},
+		{image: "cloudflare/cloudflared@sha256:abc", wantErr: true},
+		{image: "https://registry.internal/cloudflared", wantErr: true},
+		{image: "cloudflare/cloudflared latest", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			if err := validateImage(tt.image); (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,407 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cloudflare/cloudflare-go"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cfv2 "github.com/beezlabs-org/cloudflare-tunnel-operator/api/v1alpha2"
+	"github.com/beezlabs-org/cloudflare-tunnel-operator/controllers/models"
+	cfclient "github.com/beezlabs-org/cloudflare-tunnel-operator/internal/cloudflare"
+)
+
+// applyIngress validates the ingress rules and returns the spec with the Domain and Service of the first rule, so
+// that the rest of the reconcile handles it like a tunnel routing a single domain. The hostnames are normalized.
+func applyIngress(spec cfv2.CloudflareTunnelSpec) (cfv2.CloudflareTunnelSpec, error) {
+	if len(spec.Ingress) == 0 {
+		return spec, nil
+	}
+	if spec.DNSOnly {
+		return spec, fmt.Errorf("ingress cannot be used with dnsOnly, the rules of an external tunnel are not managed")
+	}
+	if spec.Service != nil {
+		return spec, fmt.Errorf("service cannot be set along with ingress")
+	}
+	// the rules are modified, so they must not share the slice of the resource
+	rules := make([]cfv2.CloudflareTunnelIngressRule, len(spec.Ingress))
+	copy(rules, spec.Ingress)
+	zones := map[string]string{}
+	for i := range rules {
+		// the rules without hostname are named after their index in the errors
+		name := fmt.Sprintf("rule %d", i)
+		if rules[i].Hostname == "" {
+			if err := validateHostlessRule(rules, i); err != nil {
+				return spec, err
+			}
+		} else {
+			hostname, err := normalizeDomain(rules[i].Hostname)
+			if err != nil {
+				return spec, err
+			}
+			if rules[i].Zone != "" && !withinZone(hostname, rules[i].Zone) {
+				return spec, fmt.Errorf("invalid hostname %q: not within the zone %q", hostname, rules[i].Zone)
+			}
+			// a hostname has a single CNAME record, so the rules routing it must agree on its zone
+			if zone, ok := zones[hostname]; ok && zone != normalizeZone(rules[i].Zone) {
+				return spec, fmt.Errorf("the rules of the hostname %s have different zones", hostname)
+			}
+			zones[hostname] = normalizeZone(rules[i].Zone)
+			rules[i].Hostname = hostname
+			name = "rule for " + hostname
+		}
+		// the socket would have to be mounted for each rule, which is not supported
+		if rules[i].Service.Protocol == protocolUnix {
+			return spec, fmt.Errorf("invalid %s: the unix protocol cannot be used with ingress", name)
+		}
+		if err := validateServiceOrigin(cfv2.CloudflareTunnelSpec{Service: &rules[i].Service}); err != nil {
+			return spec, fmt.Errorf("invalid %s: %w", name, err)
+		}
+	}
+	spec.Ingress = rules
+	if spec.Domain == "" {
+		for _, rule := range rules {
+			if rule.Hostname != "" {
+				spec.Domain = rule.Hostname
+				break
+			}
+		}
+		if spec.Domain == "" {
+			return spec, fmt.Errorf("at least one ingress rule must have a hostname")
+		}
+	} else {
+		domain, err := normalizeDomain(spec.Domain)
+		if err != nil {
+			return spec, err
+		}
+		found := false
+		for _, rule := range rules {
+			found = found || rule.Hostname == domain
+		}
+		if !found {
+			return spec, fmt.Errorf("the domain %s is not routed by any ingress rule", domain)
+		}
+	}
+	spec.Service = &rules[0].Service
+	return spec, nil
+}
+
+// validateHostlessRule checks the rule i, which has no hostname and matches the requests for all of them.
+// cloudflared applies the first matching rule, so a catch-all rule would shadow the rules after it.
+func validateHostlessRule(rules []cfv2.CloudflareTunnelIngressRule, i int) error {
+	rule := rules[i]
+	if rule.Zone != "" {
+		return fmt.Errorf("invalid rule %d: the zone cannot be set without a hostname", i)
+	}
+	if rule.Service.Path == "" && i != len(rules)-1 {
+		return fmt.Errorf("invalid rule %d: the catch-all rule, without hostname nor path, must be the last rule as it would "+
+			"shadow the %d rules after it", i, len(rules)-1-i)
+	}
+	return nil
+}
+
+// ingressHostnames returns the hostnames of the ingress rules other than the domain, which need their own CNAME record
+func ingressHostnames(spec cfv2.CloudflareTunnelSpec) []string {
+	var hostnames []string
+	// the rules without hostname match any hostname, they have no record of their own
+	seen := map[string]bool{spec.Domain: true, "": true}
+	for _, rule := range spec.Ingress {
+		if !seen[rule.Hostname] {
+			seen[rule.Hostname] = true
+			hostnames = append(hostnames, rule.Hostname)
+		}
+	}
+	return hostnames
+}
+
+// withoutIngressRecords filters out the records of the ingress hostnames, which are reconciled separately
+func withoutIngressRecords(records []cfclient.CommentedDNSRecord, hostnames []string) []cfclient.CommentedDNSRecord {
+	if len(hostnames) == 0 {
+		return records
+	}
+	var filtered []cfclient.CommentedDNSRecord
+	for _, record := range records {
+		if !containsHostname(hostnames, record.Name) {
+			filtered = append(filtered, record)
+		}
+	}
+	return filtered
+}
+
+func containsHostname(hostnames []string, name string) bool {
+	for _, hostname := range hostnames {
+		if strings.EqualFold(hostname, strings.TrimSuffix(name, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// ingressRules returns the rules of the config, with the URL of the origin of each rule
+func (r *CloudflareTunnelReconciler) ingressRules(ctx context.Context) ([]models.IngressRule, error) {
+	var rules []models.IngressRule
+	for i := range r.TunEx.TunSpec.Ingress {
+		rule := &r.TunEx.TunSpec.Ingress[i]
+		url, _, err := r.serviceURL(ctx, &rule.Service)
+		if err != nil {
+			return nil, err
+		}
+		configRule := models.IngressRule{
+			Hostname:        rule.Hostname,
+			Service:         url,
+			Path:            rule.Service.Path,
+			TLSPassthrough:  rule.Service.TLSPassthrough,
+			OriginRequest:   rule.Service.OriginRequest,
+			NoHappyEyeballs: rule.Service.NoHappyEyeballs,
+		}
+		if proxy := rule.Service.Proxy; proxy != nil {
+			configRule.ProxyAddress = proxy.Address
+			configRule.ProxyPort = proxy.Port
+			configRule.ProxyType = proxy.Type
+		}
+		if timeouts := rule.Service.Timeouts; timeouts != nil {
+			configRule.ConnectTimeout = timeouts.ConnectTimeout
+			configRule.TLSTimeout = timeouts.TLSTimeout
+			configRule.TCPKeepAlive = timeouts.TCPKeepAlive
+		}
+		rules = append(rules, configRule)
+	}
+	return rules, nil
+}
+
+// zoneNotFoundError reports that the zone of a hostname is not in the account
+type zoneNotFoundError struct {
+	hostname string
+}
+
+func (e *zoneNotFoundError) Error() string {
+	return fmt.Sprintf("no zone of the account found for the hostname %s", e.hostname)
+}
+
+// ingressZones returns the hostnames of the ingress rules other than the domain by the name of their zone, which
+// is the zone of the rule, the zone of the tunnel if the hostname is within it, or the zone of the account which is
+// the longest suffix of the hostname. If SkipUnownedHostnames is set, the hostnames whose zone is not in the account
+// are returned separately instead of failing.
+func (r *CloudflareTunnelReconciler) ingressZones(ctx context.Context) (map[string][]string, []string, error) {
+	zones := map[string][]string{}
+	var unowned []string
+	seen := map[string]bool{}
+	for _, rule := range r.TunEx.TunSpec.Ingress {
+		if rule.Hostname == "" {
+			continue
+		}
+		hostname, err := normalizeDomain(rule.Hostname)
+		if err != nil {
+			return nil, nil, err
+		}
+		if hostname == r.TunEx.TunSpec.Domain || seen[hostname] {
+			continue
+		}
+		seen[hostname] = true
+		zone := normalizeZone(rule.Zone)
+		if zone == "" && withinZone(hostname, r.TunEx.TunSpec.Zone) {
+			zone = normalizeZone(r.TunEx.TunSpec.Zone)
+		} else if zone == "" || r.TunEx.TunSpec.SkipUnownedHostnames {
+			// the zone of the rule is only checked when the error would be skipped, it fails later otherwise
+			zone, err = r.resolveZone(ctx, hostname, zone)
+			var notFound *zoneNotFoundError
+			if errors.As(err, &notFound) && r.TunEx.TunSpec.SkipUnownedHostnames {
+				r.logger.Info("WARNING: skipping the DNS record of a hostname outside of the account", "hostname", hostname)
+				unowned = append(unowned, hostname)
+				continue
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		zones[zone] = append(zones[zone], hostname)
+	}
+	return zones, unowned, nil
+}
+
+// resolveZone returns the zone of the hostname, which is the given zone if it is in the account, or if empty the
+// zone of the account which is the longest suffix of the hostname
+func (r *CloudflareTunnelReconciler) resolveZone(ctx context.Context, hostname, zone string) (string, error) {
+	resolved, err := r.Metadata.get(r.TunEx.AccountToken, "hostname zone", zone+"/"+hostname, func() (string, error) {
+		zones, err := r.TunEx.CloudflareAPI.ListZones(ctx)
+		if err != nil {
+			return "", err
+		}
+		if zone == "" {
+			return longestZone(hostname, zones)
+		}
+		for _, accountZone := range zones {
+			if normalizeZone(accountZone.Name) == zone {
+				return zone, nil
+			}
+		}
+		return "", &zoneNotFoundError{hostname: hostname}
+	})
+	if err != nil {
+		var notFound *zoneNotFoundError
+		if !errors.As(err, &notFound) || !r.TunEx.TunSpec.SkipUnownedHostnames {
+			r.logger.Error(err, "could not resolve the zone of the hostname", "hostname", hostname)
+		}
+		return "", err
+	}
+	return resolved, nil
+}
+
+// longestZone returns the name of the zone which is the longest suffix of the hostname. It fails if there is none,
+// or if several zones of the same name are accessible, e.g. in different accounts.
+func longestZone(hostname string, zones []cloudflare.Zone) (string, error) {
+	longest := ""
+	count := 0
+	for _, zone := range zones {
+		name := normalizeZone(zone.Name)
+		if !withinZone(hostname, name) || len(name) < len(longest) {
+			continue
+		}
+		if name == longest {
+			count++
+			continue
+		}
+		longest = name
+		count = 1
+	}
+	if count == 0 {
+		return "", &zoneNotFoundError{hostname: hostname}
+	}
+	if count > 1 {
+		return "", fmt.Errorf("%d zones named %s found for the hostname %s, set the zone of the rule", count, longest, hostname)
+	}
+	return longest, nil
+}
+
+// setHostnamesOwnedCondition reports the hostnames whose DNS record has been skipped as they are not in the account
+func (r *CloudflareTunnelReconciler) setHostnamesOwnedCondition(cloudflareTunnel *cfv2.CloudflareTunnel) {
+	if !r.TunEx.TunSpec.SkipUnownedHostnames {
+		meta.RemoveStatusCondition(&cloudflareTunnel.Status.Conditions, cfv2.ConditionHostnamesOwned)
+		return
+	}
+	condition := metav1.Condition{
+		Type:               cfv2.ConditionHostnamesOwned,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: cloudflareTunnel.Generation,
+		Reason:             "Owned",
+		Message:            "the zones of all the hostnames are in the account",
+	}
+	if len(r.TunEx.UnownedHostnames) != 0 {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "UnownedHostnames"
+		condition.Message = "no DNS record is managed for the hostnames outside of the account: " +
+			strings.Join(r.TunEx.UnownedHostnames, ", ")
+	}
+	meta.SetStatusCondition(&cloudflareTunnel.Status.Conditions, condition)
+}
+
+// createIngressDNSCNAMEs creates a CNAME record for each hostname of the ingress rules other than the domain, whose
+// record is handled by createDNSCNAME, and removes the records of the hostnames no longer routed. The zones holding
+// records are kept in the status, so that they are swept even once none of their hostnames is left.
+func (r *CloudflareTunnelReconciler) createIngressDNSCNAMEs(ctx context.Context) error {
+	zones := map[string][]string{}
+	if len(ingressHostnames(r.TunEx.TunSpec)) != 0 {
+		var unowned []string
+		var err error
+		zones, unowned, err = r.ingressZones(ctx)
+		if err != nil {
+			return err
+		}
+		r.TunEx.UnownedHostnames = unowned
+		// the zone of the tunnel is always checked, so that the records of the removed rules are deleted
+		tunnelZone := normalizeZone(r.TunEx.TunSpec.Zone)
+		if _, ok := zones[tunnelZone]; !ok {
+			zones[tunnelZone] = nil
+		}
+	}
+	for _, zone := range r.TunEx.IngressZones {
+		if _, ok := zones[zone]; !ok {
+			zones[zone] = nil
+		}
+	}
+	names := make([]string, 0, len(zones))
+	for zone := range zones {
+		names = append(names, zone)
+	}
+	sort.Strings(names)
+	var written []string
+	for _, zone := range names {
+		if err := r.createZoneDNSCNAMEs(ctx, zone, zones[zone]); err != nil {
+			return err
+		}
+		if len(zones[zone]) != 0 {
+			written = append(written, zone)
+		}
+	}
+	r.TunEx.IngressZones = written
+	return nil
+}
+
+// createZoneDNSCNAMEs creates the CNAME records of the hostnames of the zone and removes the other owned ones
+func (r *CloudflareTunnelReconciler) createZoneDNSCNAMEs(ctx context.Context, zone string, hostnames []string) error {
+	zoneID, err := r.zoneIDByName(ctx, zone)
+	if err != nil {
+		return err
+	}
+	owned, err := r.listOwnedDNSRecords(ctx, zoneID)
+	if err != nil {
+		r.logger.Error(err, "could not fetch owned dns list")
+		return err
+	}
+	ownedByName := map[string]cfclient.CommentedDNSRecord{}
+	for _, record := range owned {
+		ownedByName[strings.ToLower(strings.TrimSuffix(record.Name, "."))] = record
+	}
+	for _, hostname := range hostnames {
+		dnsRecord := r.desiredDNSRecord(hostname)
+		existing, ok := ownedByName[hostname]
+		if !ok {
+			if _, err := r.upsertDNSRecordByName(ctx, zoneID, dnsRecord); err != nil {
+				return err
+			}
+			continue
+		}
+		if dnsRecordMatches(existing.DNSRecord, dnsRecord) {
+			continue
+		}
+		r.logger.V(1).Info("DNS record exists, updating", "name", existing.Name)
+		if err := r.retryDNS(func() error {
+			return r.TunEx.CloudflareAPI.UpdateDNSRecord(ctx, zoneID, existing.ID, dnsRecord)
+		}); err != nil {
+			r.logger.Error(err, "could not update DNS record")
+			return err
+		}
+	}
+
+	// the record of the domain is kept, it is handled by createDNSCNAME
+	keep := append([]string{r.dnsRecordName()}, hostnames...)
+	for _, stale := range withoutIngressRecords(owned, keep) {
+		r.logger.V(1).Info("Deleting DNS record of a removed ingress rule", "name", stale.Name)
+		if err := r.TunEx.CloudflareAPI.DeleteDNSRecord(ctx, zoneID, stale.ID); err != nil && !isNotFound(err) {
+			r.logger.Error(err, "could not delete stale DNS record")
+			return err
+		}
+	}
+	return nil
+}
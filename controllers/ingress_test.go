@@ -0,0 +1,504 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	cfv2 "github.com/beezlabs-org/cloudflare-tunnel-operator/api/v1alpha2"
+	"github.com/beezlabs-org/cloudflare-tunnel-operator/controllers/constants"
+	cfclient "github.com/beezlabs-org/cloudflare-tunnel-operator/internal/cloudflare"
+)
+
+func TestApplyIngress(t *testing.T) {
+	app := cfv2.CloudflareTunnelService{Name: "app", Namespace: "default", Protocol: "http", Port: intstr.FromInt(80)}
+	api := cfv2.CloudflareTunnelService{Name: "api", Namespace: "default", Protocol: "https", Port: intstr.FromInt(443)}
+	tests := []struct {
+		name        string
+		spec        cfv2.CloudflareTunnelSpec
+		wantDomain  string
+		wantService string
+		wantErr     bool
+	}{
+		{
+			name:        "single domain",
+			spec:        cfv2.CloudflareTunnelSpec{Domain: "app.example.com", Zone: "example.com", Service: &app},
+			wantDomain:  "app.example.com",
+			wantService: "app",
+		},
+		{
+			name: "defaults to the first rule",
+			spec: cfv2.CloudflareTunnelSpec{Zone: "example.com", Ingress: []cfv2.CloudflareTunnelIngressRule{
+				{Hostname: "API.example.com.", Service: api},
+				{Hostname: "app.example.com", Service: app},
+			}},
+			wantDomain:  "api.example.com",
+			wantService: "api",
+		},
+		{
+			name: "domain routed by a rule",
+			spec: cfv2.CloudflareTunnelSpec{Domain: "app.example.com", Zone: "example.com", Ingress: []cfv2.CloudflareTunnelIngressRule{
+				{Hostname: "api.example.com", Service: api},
+				{Hostname: "app.example.com", Service: app},
+			}},
+			wantDomain:  "app.example.com",
+			wantService: "api",
+		},
+		{
+			name: "domain not routed",
+			spec: cfv2.CloudflareTunnelSpec{Domain: "www.example.com", Zone: "example.com", Ingress: []cfv2.CloudflareTunnelIngressRule{
+				{Hostname: "app.example.com", Service: app},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "service along with ingress",
+			spec: cfv2.CloudflareTunnelSpec{Zone: "example.com", Service: &app, Ingress: []cfv2.CloudflareTunnelIngressRule{
+				{Hostname: "app.example.com", Service: app},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "hostname outside of the zone of the rule",
+			spec: cfv2.CloudflareTunnelSpec{Zone: "example.com", Ingress: []cfv2.CloudflareTunnelIngressRule{
+				{Hostname: "app.example.com", Service: app},
+				{Hostname: "app.example.org", Zone: "example.net", Service: app},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "hostname with different zones",
+			spec: cfv2.CloudflareTunnelSpec{Zone: "example.com", Ingress: []cfv2.CloudflareTunnelIngressRule{
+				{Hostname: "app.example.com", Service: app},
+				{Hostname: "api.eu.example.org", Zone: "example.org", Service: app},
+				{Hostname: "api.eu.example.org", Zone: "eu.example.org", Service: api},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "rule without port",
+			spec: cfv2.CloudflareTunnelSpec{Zone: "example.com", Ingress: []cfv2.CloudflareTunnelIngressRule{
+				{Hostname: "app.example.com", Service: cfv2.CloudflareTunnelService{Name: "app", Protocol: "http"}},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "unix socket",
+			spec: cfv2.CloudflareTunnelSpec{Zone: "example.com", Ingress: []cfv2.CloudflareTunnelIngressRule{
+				{Hostname: "app.example.com", Service: cfv2.CloudflareTunnelService{Protocol: "unix", Socket: &cfv2.CloudflareTunnelServiceSocket{Path: "app.sock"}}},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "catch-all last",
+			spec: cfv2.CloudflareTunnelSpec{Zone: "example.com", Ingress: []cfv2.CloudflareTunnelIngressRule{
+				{Hostname: "api.example.com", Service: api},
+				{Service: cfv2.CloudflareTunnelService{Name: "static", Namespace: "default", Protocol: "http", Port: intstr.FromInt(80), Path: "^/assets/"}},
+				{Service: app},
+			}},
+			wantDomain:  "api.example.com",
+			wantService: "api",
+		},
+		{
+			name: "defaults to the first rule with a hostname",
+			spec: cfv2.CloudflareTunnelSpec{Zone: "example.com", Ingress: []cfv2.CloudflareTunnelIngressRule{
+				{Service: cfv2.CloudflareTunnelService{Name: "static", Namespace: "default", Protocol: "http", Port: intstr.FromInt(80), Path: "^/assets/"}},
+				{Hostname: "app.example.com", Service: app},
+			}},
+			wantDomain:  "app.example.com",
+			wantService: "static",
+		},
+		{
+			name: "catch-all before a specific rule",
+			spec: cfv2.CloudflareTunnelSpec{Zone: "example.com", Ingress: []cfv2.CloudflareTunnelIngressRule{
+				{Hostname: "api.example.com", Service: api},
+				{Service: app},
+				{Hostname: "app.example.com", Service: app},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "two catch-alls",
+			spec: cfv2.CloudflareTunnelSpec{Zone: "example.com", Ingress: []cfv2.CloudflareTunnelIngressRule{
+				{Hostname: "api.example.com", Service: api},
+				{Service: api},
+				{Service: app},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "only a catch-all",
+			spec: cfv2.CloudflareTunnelSpec{Zone: "example.com", Ingress: []cfv2.CloudflareTunnelIngressRule{
+				{Service: app},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "zone without hostname",
+			spec: cfv2.CloudflareTunnelSpec{Zone: "example.com", Ingress: []cfv2.CloudflareTunnelIngressRule{
+				{Hostname: "app.example.com", Service: app},
+				{Zone: "example.com", Service: app},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "dns only",
+			spec: cfv2.CloudflareTunnelSpec{Zone: "example.com", DNSOnly: true, Ingress: []cfv2.CloudflareTunnelIngressRule{
+				{Hostname: "app.example.com", Service: app},
+			}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec, err := applyIngress(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if err != nil {
+				return
+			}
+			if spec.Domain != tt.wantDomain || spec.Service.Name != tt.wantService {
+				t.Errorf("expected %s routed to %s, got %s routed to %s", tt.wantDomain, tt.wantService, spec.Domain, spec.Service.Name)
+			}
+		})
+	}
+}
+
+func TestReconcileIngress(t *testing.T) {
+	remote := cfclient.NewFake("example.com")
+	zoneID := remote.Zones["example.com"]
+	tunnel := newTestTunnel("default")
+	tunnel.UID = "3c1b7a52-0d6f-4c4e-9a39-0c2f5c1e7d10"
+	tunnel.Spec.Domain = ""
+	tunnel.Spec.Service = nil
+	tunnel.Spec.Ingress = []cfv2.CloudflareTunnelIngressRule{
+		{Hostname: "app.example.com", Service: cfv2.CloudflareTunnelService{Name: "app", Namespace: "default", Protocol: "http", Port: intstr.FromInt(80)}},
+		{Hostname: "api.example.com", Service: cfv2.CloudflareTunnelService{Name: "api", Namespace: "default", Protocol: "http", Port: intstr.FromInt(8080), Path: "^/v1/"}},
+		{Hostname: "admin.example.com", Service: cfv2.CloudflareTunnelService{Name: "app", Namespace: "default", Protocol: "http", Port: intstr.FromInt(80)}},
+		// an origin outside of the cluster, which has no service to look up
+		{Hostname: "legacy.example.com", Service: cfv2.CloudflareTunnelService{OriginURL: "https://internal.corp:8443/"}},
+	}
+	r := newReconcileFixture(
+		remote,
+		tunnel,
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default"},
+			Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 8080}}},
+		},
+	)
+	request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "tunnel", Namespace: "default"}}
+
+	if _, err := r.Reconcile(context.Background(), request); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	var configMap corev1.ConfigMap
+	key := types.NamespacedName{Name: "tunnel-" + constants.ResourceSuffix, Namespace: "default"}
+	if err := r.Client.Get(context.Background(), key, &configMap); err != nil {
+		t.Fatal(err)
+	}
+	config := ""
+	for _, data := range configMap.Data {
+		config += data
+	}
+	for _, want := range []string{
+		"service: http://app.default:80\n    hostname: app.example.com",
+		"service: http://api.default:8080\n    hostname: api.example.com",
+		"service: http://app.default:80\n    hostname: admin.example.com",
+		"service: https://internal.corp:8443\n    hostname: legacy.example.com",
+		"service: http_status:404",
+	} {
+		if !strings.Contains(config, want) {
+			t.Errorf("expected config to contain %q, got\n%s", want, config)
+		}
+	}
+
+	target := r.TunEx.TunnelID + constants.CNAMESuffix
+	names := map[string]bool{}
+	for _, record := range remote.Records[zoneID] {
+		if record.Content != target || record.Comment != dnsRecordComment(tunnel.UID) {
+			t.Errorf("expected an owned record pointing at the tunnel, got %v", record)
+		}
+		names[record.Name] = true
+	}
+	if len(names) != 4 || !names["app.example.com"] || !names["api.example.com"] || !names["admin.example.com"] || !names["legacy.example.com"] {
+		t.Errorf("expected a CNAME record for each hostname, got %v", remote.Records[zoneID])
+	}
+
+	// the record of a removed rule is deleted on the next reconcile
+	var updated cfv2.CloudflareTunnel
+	if err := r.Client.Get(context.Background(), request.NamespacedName, &updated); err != nil {
+		t.Fatal(err)
+	}
+	updated.Spec.Ingress = updated.Spec.Ingress[:2]
+	if err := r.Client.Update(context.Background(), &updated); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(context.Background(), request); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if records := remote.Records[zoneID]; len(records) != 2 {
+		t.Errorf("expected the record of the removed rule to be deleted, got %v", records)
+	}
+}
+
+func TestLongestZone(t *testing.T) {
+	zones := []cloudflare.Zone{{Name: "example.com"}, {Name: "example.org"}, {Name: "eu.example.org"}, {Name: "example.net"}, {Name: "example.net"}}
+	tests := []struct {
+		hostname string
+		want     string
+		wantErr  bool
+	}{
+		{hostname: "app.example.com", want: "example.com"},
+		{hostname: "example.org", want: "example.org"},
+		{hostname: "api.eu.example.org", want: "eu.example.org"},
+		{hostname: "api.us.example.org", want: "example.org"},
+		{hostname: "app.example.io", wantErr: true},
+		// the zone is accessible in two accounts
+		{hostname: "app.example.net", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.hostname, func(t *testing.T) {
+			zone, err := longestZone(tt.hostname, zones)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if zone != tt.want {
+				t.Errorf("expected the zone %q, got %q", tt.want, zone)
+			}
+		})
+	}
+}
+
+func TestReconcileIngressMultipleZones(t *testing.T) {
+	remote := cfclient.NewFake("example.com", "example.org", "eu.example.org")
+	tunnel := newTestTunnel("default")
+	tunnel.UID = "3c1b7a52-0d6f-4c4e-9a39-0c2f5c1e7d10"
+	app := cfv2.CloudflareTunnelService{Name: "app", Namespace: "default", Protocol: "http", Port: intstr.FromInt(80)}
+	tunnel.Spec.Service = nil
+	tunnel.Spec.Ingress = []cfv2.CloudflareTunnelIngressRule{
+		{Hostname: "app.example.com", Service: app},
+		{Hostname: "www.example.org", Service: app},
+		{Hostname: "api.eu.example.org", Service: app},
+		// the record is kept in the parent zone, e.g. while the subzone is being set up
+		{Hostname: "static.eu.example.org", Zone: "example.org", Service: app},
+	}
+	r := newReconcileFixture(remote, tunnel)
+	r.Metadata = NewMetadataCache(time.Minute)
+	request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "tunnel", Namespace: "default"}}
+
+	for i := 0; i < 2; i++ {
+		if _, err := r.Reconcile(context.Background(), request); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+
+	want := map[string][]string{
+		"example.com":    {"app.example.com"},
+		"example.org":    {"static.eu.example.org", "www.example.org"},
+		"eu.example.org": {"api.eu.example.org"},
+	}
+	for zone, names := range want {
+		var got []string
+		for _, record := range remote.Records[remote.Zones[zone]] {
+			got = append(got, record.Name)
+		}
+		sort.Strings(got)
+		if strings.Join(got, ",") != strings.Join(names, ",") {
+			t.Errorf("expected the records %v in the zone %s, got %v", names, zone, got)
+		}
+	}
+	listed := 0
+	for _, call := range remote.Calls {
+		if call == "ListZones" {
+			listed++
+		}
+	}
+	if listed != 2 {
+		t.Errorf("expected the zones of the two resolved hostnames to be looked up once, got %d lookups", listed)
+	}
+
+	// the records of all the zones are deleted with the resource
+	if err := r.Client.Delete(context.Background(), tunnel); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(context.Background(), request); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for zone := range want {
+		if records := remote.Records[remote.Zones[zone]]; len(records) != 0 {
+			t.Errorf("expected the records of the zone %s to be deleted, got %v", zone, records)
+		}
+	}
+}
+
+func TestReconcileIngressUnownedHostnames(t *testing.T) {
+	tests := []struct {
+		name      string
+		skip      bool
+		wantReady bool
+	}{
+		{name: "skipped", skip: true, wantReady: true},
+		{name: "failing", skip: false, wantReady: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote := cfclient.NewFake("example.com")
+			tunnel := newTestTunnel("default")
+			tunnel.UID = "3c1b7a52-0d6f-4c4e-9a39-0c2f5c1e7d10"
+			app := cfv2.CloudflareTunnelService{Name: "app", Namespace: "default", Protocol: "http", Port: intstr.FromInt(80)}
+			tunnel.Spec.Service = nil
+			tunnel.Spec.SkipUnownedHostnames = tt.skip
+			tunnel.Spec.Ingress = []cfv2.CloudflareTunnelIngressRule{
+				{Hostname: "app.example.com", Service: app},
+				{Hostname: "api.example.com", Service: app},
+				// the DNS of the partner domains is managed in another account
+				{Hostname: "app.partner.io", Service: app},
+				{Hostname: "cdn.partner.net", Zone: "partner.net", Service: app},
+			}
+			r := newReconcileFixture(remote, tunnel)
+			request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "tunnel", Namespace: "default"}}
+
+			_, _ = r.Reconcile(context.Background(), request)
+
+			var configMap corev1.ConfigMap
+			key := types.NamespacedName{Name: "tunnel-" + constants.ResourceSuffix, Namespace: "default"}
+			if err := r.Client.Get(context.Background(), key, &configMap); err != nil {
+				t.Fatal(err)
+			}
+			config := ""
+			for _, data := range configMap.Data {
+				config += data
+			}
+			for _, hostname := range []string{"app.example.com", "api.example.com", "app.partner.io", "cdn.partner.net"} {
+				if !strings.Contains(config, "hostname: "+hostname) {
+					t.Errorf("expected %s to be routed, got\n%s", hostname, config)
+				}
+			}
+
+			var updated cfv2.CloudflareTunnel
+			if err := r.Client.Get(context.Background(), request.NamespacedName, &updated); err != nil {
+				t.Fatal(err)
+			}
+			if ready := meta.IsStatusConditionTrue(updated.Status.Conditions, cfv2.ConditionDNSReady); ready != tt.wantReady {
+				t.Errorf("expected the DNS to be ready %v, got %v", tt.wantReady, updated.Status.Conditions)
+			}
+			owned := meta.FindStatusCondition(updated.Status.Conditions, cfv2.ConditionHostnamesOwned)
+			if !tt.skip {
+				if owned != nil {
+					t.Errorf("expected no ownership condition, got %v", owned)
+				}
+				return
+			}
+			if owned == nil || owned.Status != metav1.ConditionFalse || !strings.Contains(owned.Message, "app.partner.io, cdn.partner.net") {
+				t.Errorf("expected the unowned hostnames to be reported, got %v", owned)
+			}
+			var names []string
+			for _, record := range remote.Records[remote.Zones["example.com"]] {
+				names = append(names, record.Name)
+			}
+			sort.Strings(names)
+			if strings.Join(names, ",") != "api.example.com,app.example.com" {
+				t.Errorf("expected records for the owned hostnames only, got %v", names)
+			}
+		})
+	}
+}
+
+func TestReconcileIngressRemovedHostnames(t *testing.T) {
+	tests := []struct {
+		name     string
+		hostname string
+		zone     string
+	}{
+		{name: "last hostname removed", hostname: "www.example.com", zone: "example.com"},
+		{name: "hostname in another zone removed", hostname: "www.example.org", zone: "example.org"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote := cfclient.NewFake("example.com", "example.org")
+			zoneID := remote.Zones[tt.zone]
+			tunnel := newTestTunnel("default")
+			tunnel.UID = "3c1b7a52-0d6f-4c4e-9a39-0c2f5c1e7d10"
+			app := cfv2.CloudflareTunnelService{Name: "app", Namespace: "default", Protocol: "http", Port: intstr.FromInt(80)}
+			tunnel.Spec.Service = nil
+			tunnel.Spec.Ingress = []cfv2.CloudflareTunnelIngressRule{
+				{Hostname: "app.example.com", Service: app},
+				{Hostname: tt.hostname, Service: app},
+			}
+			r := newReconcileFixture(remote, tunnel)
+			request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "tunnel", Namespace: "default"}}
+
+			if _, err := r.Reconcile(context.Background(), request); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if !containsRecord(remote.Records[zoneID], tt.hostname) {
+				t.Fatalf("expected a record for %s, got %v", tt.hostname, remote.Records[zoneID])
+			}
+
+			var updated cfv2.CloudflareTunnel
+			if err := r.Client.Get(context.Background(), request.NamespacedName, &updated); err != nil {
+				t.Fatal(err)
+			}
+			if len(updated.Status.IngressZones) != 1 || updated.Status.IngressZones[0] != tt.zone {
+				t.Errorf("expected the zone %s to be recorded, got %v", tt.zone, updated.Status.IngressZones)
+			}
+			updated.Spec.Ingress = updated.Spec.Ingress[:1]
+			if err := r.Client.Update(context.Background(), &updated); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := r.Reconcile(context.Background(), request); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if containsRecord(remote.Records[zoneID], tt.hostname) {
+				t.Errorf("expected the record of %s to be deleted, got %v", tt.hostname, remote.Records[zoneID])
+			}
+			if !containsRecord(remote.Records[remote.Zones["example.com"]], "app.example.com") {
+				t.Errorf("expected the record of the domain to be kept, got %v", remote.Records[remote.Zones["example.com"]])
+			}
+			if err := r.Client.Get(context.Background(), request.NamespacedName, &updated); err != nil {
+				t.Fatal(err)
+			}
+			if len(updated.Status.IngressZones) != 0 {
+				t.Errorf("expected no zone to be recorded, got %v", updated.Status.IngressZones)
+			}
+		})
+	}
+}
+
+func containsRecord(records []cfclient.CommentedDNSRecord, name string) bool {
+	for _, record := range records {
+		if record.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,280 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	"github.com/cloudflare/cloudflare-go"
+
+	"github.com/beezlabs-org/cloudflare-tunnel-operator/controllers/constants"
+)
+
+// loadBalancerDescription marks the pools and monitors created by the operator
+const loadBalancerDescription = "created by " + constants.OperatorName
+
+// reconcileDNS routes the domain to the tunnel, either with a CNAME record or through a load balancer pool, and the
+// other hostnames of the ingress rules with their own CNAME record
+func (r *CloudflareTunnelReconciler) reconcileDNS(ctx context.Context) error {
+	if r.TunEx.TunSpec.LoadBalancer != nil {
+		if err := r.reconcileLoadBalancer(ctx); err != nil {
+			return err
+		}
+	} else if err := r.createDNSCNAME(ctx); err != nil {
+		return err
+	}
+	return r.createIngressDNSCNAMEs(ctx)
+}
+
+// loadBalancerOrigin returns the origin of the current tunnel in the pool
+func (r *CloudflareTunnelReconciler) loadBalancerOrigin() cloudflare.LoadBalancerOrigin {
+	name := r.TunEx.TunSpec.LoadBalancer.OriginName
+	if name == "" {
+		name = r.TunEx.TunnelID
+	}
+	return cloudflare.LoadBalancerOrigin{
+		Name:    name,
+		Address: r.TunEx.TunnelID + constants.CNAMESuffix,
+		Enabled: true,
+		Weight:  1,
+	}
+}
+
+// previousTunnelID returns the ID of the tunnel stored in the status if the tunnel has been recreated since
+func (r *CloudflareTunnelReconciler) previousTunnelID() string {
+	if r.TunEx.StatusTunnelID == r.TunEx.TunnelID {
+		return ""
+	}
+	return r.TunEx.StatusTunnelID
+}
+
+// reconcileLoadBalancer adds the tunnel to the pool and ensures the load balancer of the domain uses the pool.
+// The pool and the load balancer are created if missing, but the other origins and pools are left untouched,
+// as they belong to the other clusters serving the domain.
+func (r *CloudflareTunnelReconciler) reconcileLoadBalancer(ctx context.Context) error {
+	pool, err := r.findLoadBalancerPool(ctx)
+	if err != nil {
+		return err
+	}
+	origin := r.loadBalancerOrigin()
+	if pool == nil {
+		pool, err = r.createLoadBalancerPool(ctx, origin)
+		if err != nil {
+			return err
+		}
+	} else {
+		// the origin of the tunnel the resource used before being recreated would be left behind otherwise,
+		// as it is named after the ID of that tunnel by default
+		origins, removed := withoutTunnelOrigins(pool.Origins, r.previousTunnelID())
+		origins, changed := withOrigin(origins, origin)
+		if removed || changed {
+			r.logger.Info("Updating origin in load balancer pool", "pool", pool.Name, "origin", origin.Name)
+			pool.Origins = origins
+			if _, err := r.TunEx.CloudflareAPI.ModifyLoadBalancerPool(ctx, *pool); err != nil {
+				r.logger.Error(err, "could not update load balancer pool")
+				return err
+			}
+		}
+	}
+
+	zoneID, err := r.zoneID(ctx)
+	if err != nil {
+		return err
+	}
+	loadBalancers, err := r.TunEx.CloudflareAPI.ListLoadBalancers(ctx, zoneID)
+	if err != nil {
+		r.logger.Error(err, "could not fetch load balancer list")
+		return err
+	}
+	for _, loadBalancer := range loadBalancers {
+		if !strings.EqualFold(strings.TrimSuffix(loadBalancer.Name, "."), r.dnsRecordName()) {
+			continue
+		}
+		for _, poolID := range loadBalancer.DefaultPools {
+			if poolID == pool.ID {
+				r.logger.V(1).Info("Load balancer exists and uses the pool")
+				return nil
+			}
+		}
+		r.logger.Info("Adding pool to load balancer", "pool", pool.Name)
+		loadBalancer.DefaultPools = append(loadBalancer.DefaultPools, pool.ID)
+		if _, err := r.TunEx.CloudflareAPI.ModifyLoadBalancer(ctx, zoneID, loadBalancer); err != nil {
+			r.logger.Error(err, "could not update load balancer")
+			return err
+		}
+		return nil
+	}
+
+	r.logger.Info("Load balancer doesn't exist, creating")
+	if _, err := r.TunEx.CloudflareAPI.CreateLoadBalancer(ctx, zoneID, cloudflare.LoadBalancer{
+		Name:         r.dnsRecordName(),
+		Description:  loadBalancerDescription,
+		DefaultPools: []string{pool.ID},
+		FallbackPool: pool.ID,
+		Proxied:      true,
+	}); err != nil {
+		r.logger.Error(err, "could not create load balancer")
+		return err
+	}
+	return nil
+}
+
+// removeLoadBalancerOrigin removes the origin of the tunnel from the pool.
+// A pool cannot be left without origins, so the last one is disabled instead.
+func (r *CloudflareTunnelReconciler) removeLoadBalancerOrigin(ctx context.Context) error {
+	pool, err := r.findLoadBalancerPool(ctx)
+	if err != nil || pool == nil {
+		return err
+	}
+	origin := r.loadBalancerOrigin()
+	origins, changed := withoutOrigin(pool.Origins, origin.Name)
+	if !changed {
+		return nil
+	}
+	if len(origins) == 0 {
+		r.logger.Info("Disabling the last origin of the load balancer pool", "pool", pool.Name, "origin", origin.Name)
+		origin.Enabled = false
+		origins = []cloudflare.LoadBalancerOrigin{origin}
+	} else {
+		r.logger.Info("Removing origin from load balancer pool", "pool", pool.Name, "origin", origin.Name)
+	}
+	pool.Origins = origins
+	if _, err := r.TunEx.CloudflareAPI.ModifyLoadBalancerPool(ctx, *pool); err != nil {
+		r.logger.Error(err, "could not update load balancer pool")
+		return err
+	}
+	return nil
+}
+
+// findLoadBalancerPool returns the pool configured in the spec, or nil if it doesn't exist
+func (r *CloudflareTunnelReconciler) findLoadBalancerPool(ctx context.Context) (*cloudflare.LoadBalancerPool, error) {
+	pools, err := r.TunEx.CloudflareAPI.ListLoadBalancerPools(ctx)
+	if err != nil {
+		r.logger.Error(err, "could not fetch load balancer pool list")
+		return nil, err
+	}
+	for i := range pools {
+		if pools[i].Name == r.TunEx.TunSpec.LoadBalancer.Pool {
+			return &pools[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *CloudflareTunnelReconciler) createLoadBalancerPool(ctx context.Context, origin cloudflare.LoadBalancerOrigin) (*cloudflare.LoadBalancerPool, error) {
+	monitorID, err := r.loadBalancerMonitor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r.logger.Info("Load balancer pool doesn't exist, creating", "pool", r.TunEx.TunSpec.LoadBalancer.Pool)
+	pool, err := r.TunEx.CloudflareAPI.CreateLoadBalancerPool(ctx, cloudflare.LoadBalancerPool{
+		Name:        r.TunEx.TunSpec.LoadBalancer.Pool,
+		Description: loadBalancerDescription,
+		Enabled:     true,
+		Monitor:     monitorID,
+		Origins:     []cloudflare.LoadBalancerOrigin{origin},
+	})
+	if err != nil {
+		r.logger.Error(err, "could not create load balancer pool")
+		return nil, err
+	}
+	return &pool, nil
+}
+
+// loadBalancerMonitor returns the ID of the monitor checking the configured path of the domain, creating it if needed.
+// No monitor is used if the path is not set.
+func (r *CloudflareTunnelReconciler) loadBalancerMonitor(ctx context.Context) (string, error) {
+	path := r.TunEx.TunSpec.LoadBalancer.MonitorPath
+	if path == "" {
+		return "", nil
+	}
+	monitors, err := r.TunEx.CloudflareAPI.ListLoadBalancerMonitors(ctx)
+	if err != nil {
+		r.logger.Error(err, "could not fetch load balancer monitor list")
+		return "", err
+	}
+	// the tunnel routes requests by host, so the monitor has to use the domain
+	header := map[string][]string{"Host": {r.TunEx.TunSpec.Domain}}
+	for _, monitor := range monitors {
+		if monitor.Description == loadBalancerDescription && monitor.Path == path &&
+			len(monitor.Header["Host"]) == 1 && monitor.Header["Host"][0] == r.TunEx.TunSpec.Domain {
+			return monitor.ID, nil
+		}
+	}
+	monitor, err := r.TunEx.CloudflareAPI.CreateLoadBalancerMonitor(ctx, cloudflare.LoadBalancerMonitor{
+		Type:          "https",
+		Description:   loadBalancerDescription,
+		Method:        "GET",
+		Path:          path,
+		Header:        header,
+		Timeout:       5,
+		Retries:       2,
+		Interval:      60,
+		ExpectedCodes: "2xx",
+	})
+	if err != nil {
+		r.logger.Error(err, "could not create load balancer monitor")
+		return "", err
+	}
+	return monitor.ID, nil
+}
+
+// withOrigin returns the origins with the given one added or replacing the one of the same name,
+// and whether anything has changed
+func withOrigin(origins []cloudflare.LoadBalancerOrigin, origin cloudflare.LoadBalancerOrigin) ([]cloudflare.LoadBalancerOrigin, bool) {
+	for i, existing := range origins {
+		if existing.Name != origin.Name {
+			continue
+		}
+		if existing.Address == origin.Address && existing.Enabled {
+			return origins, false
+		}
+		// the weight and headers might have been tuned on the remote
+		existing.Address = origin.Address
+		existing.Enabled = true
+		updated := append([]cloudflare.LoadBalancerOrigin{}, origins...)
+		updated[i] = existing
+		return updated, true
+	}
+	return append(append([]cloudflare.LoadBalancerOrigin{}, origins...), origin), true
+}
+
+// withoutTunnelOrigins returns the origins without the ones pointing to the given tunnel, and whether any did
+func withoutTunnelOrigins(origins []cloudflare.LoadBalancerOrigin, tunnelID string) ([]cloudflare.LoadBalancerOrigin, bool) {
+	if tunnelID == "" {
+		return origins, false
+	}
+	var remaining []cloudflare.LoadBalancerOrigin
+	for _, origin := range origins {
+		if !strings.EqualFold(origin.Address, tunnelID+constants.CNAMESuffix) {
+			remaining = append(remaining, origin)
+		}
+	}
+	return remaining, len(remaining) != len(origins)
+}
+
+// withoutOrigin returns the origins without the one of the given name, and whether it was present
+func withoutOrigin(origins []cloudflare.LoadBalancerOrigin, name string) ([]cloudflare.LoadBalancerOrigin, bool) {
+	var remaining []cloudflare.LoadBalancerOrigin
+	for _, origin := range origins {
+		if origin.Name != name {
+			remaining = append(remaining, origin)
+		}
+	}
+	return remaining, len(remaining) != len(origins)
+}
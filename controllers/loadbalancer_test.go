@@ -0,0 +1,155 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	cfv2 "github.com/beezlabs-org/cloudflare-tunnel-operator/api/v1alpha2"
+	"github.com/beezlabs-org/cloudflare-tunnel-operator/controllers/constants"
+	cfclient "github.com/beezlabs-org/cloudflare-tunnel-operator/internal/cloudflare"
+)
+
+func TestLoadBalancerPoolMembership(t *testing.T) {
+	remote := cfclient.NewFake("example.com")
+	zoneID := remote.Zones["example.com"]
+	// the same resource deployed in two clusters
+	clusters := map[string]*CloudflareTunnelReconciler{}
+	for cluster, tunnelID := range map[string]string{"us": "tunnel-us", "eu": "tunnel-eu"} {
+		tunnel := newTestTunnel("default")
+		tunnel.Spec.LoadBalancer = &cfv2.CloudflareTunnelLoadBalancer{Pool: "app", OriginName: cluster, MonitorPath: "/healthz"}
+		r := newTestReconciler(tunnel)
+		logger := logr.Discard()
+		r.logger = &logger
+		r.TunEx = &TunnelExpanded{CloudflareAPI: remote, TunSpec: tunnel.Spec, TunnelID: tunnelID}
+		clusters[cluster] = r
+	}
+	origins := func() map[string]cloudflare.LoadBalancerOrigin {
+		if len(remote.Pools) != 1 {
+			t.Fatalf("expected a single pool, got %v", remote.Pools)
+		}
+		origins := map[string]cloudflare.LoadBalancerOrigin{}
+		for _, origin := range remote.Pools[0].Origins {
+			origins[origin.Name] = origin
+		}
+		return origins
+	}
+
+	for _, cluster := range []string{"us", "eu", "us"} {
+		if err := clusters[cluster].reconcileDNS(context.Background()); err != nil {
+			t.Fatalf("expected no error adding %s, got %v", cluster, err)
+		}
+	}
+	if got := origins(); len(got) != 2 || got["us"].Address != "tunnel-us.cfargotunnel.com" || got["eu"].Address != "tunnel-eu.cfargotunnel.com" {
+		t.Errorf("expected both tunnels to be origins of the pool, got %v", got)
+	}
+	if lbs := remote.LoadBalancers[zoneID]; len(lbs) != 1 || len(lbs[0].DefaultPools) != 1 || lbs[0].DefaultPools[0] != remote.Pools[0].ID {
+		t.Errorf("expected a single load balancer using the pool, got %v", lbs)
+	}
+	if len(remote.Monitors) != 1 || remote.Pools[0].Monitor != remote.Monitors[0].ID {
+		t.Errorf("expected the pool to be monitored, got %v", remote.Monitors)
+	}
+	if records := remote.Records[zoneID]; len(records) != 0 {
+		t.Errorf("expected no CNAME record, got %v", records)
+	}
+
+	// the tunnel of a cluster has been recreated
+	clusters["eu"].TunEx.TunnelID = "tunnel-eu-2"
+	if err := clusters["eu"].reconcileDNS(context.Background()); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if got := origins(); len(got) != 2 || got["eu"].Address != "tunnel-eu-2.cfargotunnel.com" {
+		t.Errorf("expected the origin to follow the tunnel, got %v", got)
+	}
+
+	if err := clusters["us"].removeLoadBalancerOrigin(context.Background()); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if got := origins(); len(got) != 1 || !got["eu"].Enabled {
+		t.Errorf("expected only the other cluster to be left in the pool, got %v", got)
+	}
+	if err := clusters["eu"].removeLoadBalancerOrigin(context.Background()); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if got := origins(); len(got) != 1 || got["eu"].Enabled {
+		t.Errorf("expected the last origin to be disabled, got %v", got)
+	}
+}
+
+func TestLoadBalancerOriginOfRecreatedTunnel(t *testing.T) {
+	remote := cfclient.NewFake("example.com")
+	remote.Pools = []cloudflare.LoadBalancerPool{{
+		ID:   "pool",
+		Name: "app",
+		Origins: []cloudflare.LoadBalancerOrigin{
+			{Name: "old-id", Address: "old-id.cfargotunnel.com", Enabled: true},
+			{Name: "other", Address: "other-id.cfargotunnel.com", Enabled: true},
+		},
+	}}
+	tunnel := newTestTunnel("default")
+	tunnel.Spec.LoadBalancer = &cfv2.CloudflareTunnelLoadBalancer{Pool: "app"}
+	r := newTestReconciler(tunnel)
+	logger := logr.Discard()
+	r.logger = &logger
+	r.TunEx = &TunnelExpanded{CloudflareAPI: remote, TunSpec: tunnel.Spec, TunnelID: "new-id", StatusTunnelID: "old-id"}
+
+	if err := r.reconcileDNS(context.Background()); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	var names []string
+	for _, origin := range remote.Pools[0].Origins {
+		names = append(names, origin.Name)
+	}
+	if len(names) != 2 || names[0] != "other" || names[1] != "new-id" {
+		t.Errorf("expected the origin of the previous tunnel to be replaced, got %v", remote.Pools[0].Origins)
+	}
+}
+
+func TestReconcileDeletionRemovesLoadBalancerOrigin(t *testing.T) {
+	remote := cfclient.NewFake("example.com")
+	remote.Pools = []cloudflare.LoadBalancerPool{{
+		ID:   "pool-id",
+		Name: "app",
+		Origins: []cloudflare.LoadBalancerOrigin{
+			{Name: "tunnel-id", Address: "tunnel-id.cfargotunnel.com", Enabled: true},
+			{Name: "other", Address: "other.cfargotunnel.com", Enabled: true},
+		},
+	}}
+	now := metav1.Now()
+	tunnel := newTestTunnel("default")
+	tunnel.DeletionTimestamp = &now
+	tunnel.Finalizers = []string{constants.Finalizer}
+	tunnel.Spec.LoadBalancer = &cfv2.CloudflareTunnelLoadBalancer{Pool: "app"}
+	tunnel.Status.TunnelID = "tunnel-id"
+	r := newReconcileFixture(remote, tunnel)
+
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{
+		NamespacedName: types.NamespacedName{Name: "tunnel", Namespace: "default"},
+	}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if origins := remote.Pools[0].Origins; len(origins) != 1 || origins[0].Name != "other" {
+		t.Errorf("expected only the origin of the deleted tunnel to be removed, got %v", origins)
+	}
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+// MetadataCache keeps metadata looked up from the Cloudflare API, like zone IDs, for a limited time,
+// so that the resources sharing an account or a zone do not all fetch it on every reconcile.
+// It is shared by the concurrent reconciles. The entries are keyed by a hash of the token they have been
+// fetched with, so that a token never gets to see what has been looked up with another one.
+type MetadataCache struct {
+	ttl     time.Duration
+	now     func() time.Time
+	mutex   sync.Mutex
+	entries map[metadataKey]metadataEntry
+}
+
+type metadataKey struct {
+	token [sha256.Size]byte
+	kind  string
+	name  string
+}
+
+type metadataEntry struct {
+	value   string
+	expires time.Time
+}
+
+// NewMetadataCache creates a cache keeping the entries for ttl, nothing is cached if ttl is not positive
+func NewMetadataCache(ttl time.Duration) *MetadataCache {
+	return &MetadataCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: map[metadataKey]metadataEntry{},
+	}
+}
+
+// get returns the cached value of the given kind and name, calling load to fetch it if it is missing or expired.
+// Errors are not cached. A nil cache always calls load.
+func (c *MetadataCache) get(token, kind, name string, load func() (string, error)) (string, error) {
+	if c == nil || c.ttl <= 0 {
+		return load()
+	}
+	key := metadataKey{token: sha256.Sum256([]byte(token)), kind: kind, name: name}
+
+	c.mutex.Lock()
+	entry, ok := c.entries[key]
+	c.mutex.Unlock()
+	if ok && c.now().Before(entry.expires) {
+		return entry.value, nil
+	}
+
+	// the lock is not held while loading, concurrent misses may load the same value which is harmless
+	value, err := load()
+	if err != nil {
+		return "", err
+	}
+	c.mutex.Lock()
+	c.entries[key] = metadataEntry{value: value, expires: c.now().Add(c.ttl)}
+	c.mutex.Unlock()
+	return value, nil
+}
+
+// invalidate removes all the entries fetched with the given token
+func (c *MetadataCache) invalidate(token string) {
+	if c == nil {
+		return
+	}
+	hash := sha256.Sum256([]byte(token))
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for key := range c.entries {
+		if key.token == hash {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// isAuthError reports whether err has been caused by the token being rejected by the Cloudflare API
+func isAuthError(err error) bool {
+	var authenticationError *cloudflare.AuthenticationError
+	var authorizationError *cloudflare.AuthorizationError
+	return errors.As(err, &authenticationError) || errors.As(err, &authorizationError) ||
+		hasStatus(err, http.StatusUnauthorized) || hasStatus(err, http.StatusForbidden)
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+func TestMetadataCacheParallel(t *testing.T) {
+	cache := NewMetadataCache(time.Minute)
+	var loads int32
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			token := fmt.Sprintf("token-%d", i%4)
+			value, err := cache.get(token, "zone", "example.com", func() (string, error) {
+				atomic.AddInt32(&loads, 1)
+				return "zone-of-" + token, nil
+			})
+			if err != nil {
+				errs <- err
+			} else if value != "zone-of-"+token {
+				errs <- fmt.Errorf("token %s got the zone %s", token, value)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if loads < 4 {
+		t.Errorf("expected the zone to be loaded at least once per token, got %d loads", loads)
+	}
+
+	// once warm, nothing is loaded anymore
+	atomic.StoreInt32(&loads, 0)
+	for i := 0; i < 4; i++ {
+		if _, err := cache.get(fmt.Sprintf("token-%d", i), "zone", "example.com", func() (string, error) {
+			atomic.AddInt32(&loads, 1)
+			return "", nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if loads != 0 {
+		t.Errorf("expected the cached zones to be used, got %d loads", loads)
+	}
+}
+
+func TestMetadataCacheExpiryAndInvalidation(t *testing.T) {
+	now := time.Now()
+	cache := NewMetadataCache(time.Minute)
+	cache.now = func() time.Time { return now }
+	loads := 0
+	load := func() (string, error) {
+		loads++
+		return fmt.Sprintf("zone-%d", loads), nil
+	}
+
+	steps := []struct {
+		name   string
+		before func()
+		want   string
+	}{
+		{name: "miss", want: "zone-1"},
+		{name: "hit", want: "zone-1"},
+		{name: "expired", before: func() { now = now.Add(2 * time.Minute) }, want: "zone-2"},
+		{name: "invalidated", before: func() { cache.invalidate("token") }, want: "zone-3"},
+	}
+	for _, step := range steps {
+		if step.before != nil {
+			step.before()
+		}
+		value, err := cache.get("token", "zone", "example.com", load)
+		if err != nil || value != step.want {
+			t.Errorf("%s: expected %s, got %s %v", step.name, step.want, value, err)
+		}
+	}
+
+	if _, err := cache.get("token", "zone", "failing.com", func() (string, error) {
+		return "", &cloudflare.AuthorizationError{}
+	}); !isAuthError(err) {
+		t.Errorf("expected the authorization error to be returned, got %v", err)
+	}
+	if value, _ := cache.get("token", "zone", "failing.com", load); value != "zone-4" {
+		t.Errorf("expected errors not to be cached, got %s", value)
+	}
+
+	var disabled *MetadataCache
+	if value, _ := disabled.get("token", "zone", "example.com", load); value != "zone-5" {
+		t.Errorf("expected a nil cache to always load, got %s", value)
+	}
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	reconcileResults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cloudflare_tunnel_reconcile_total",
+		Help: "Reconciles of the CloudflareTunnel resources by outcome: success, requeue or error",
+	}, []string{"outcome"})
+	cloudflareAPIDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cloudflare_tunnel_api_request_duration_seconds",
+		Help:    "Duration of the calls to the Cloudflare API by operation, including their retries",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+	tunnelsNotReady = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cloudflare_tunnel_not_ready",
+		Help: "CloudflareTunnel resources whose Ready condition is not true",
+	})
+	tunnelReadiness = &readinessTracker{gauge: tunnelsNotReady, notReady: map[types.NamespacedName]bool{}}
+)
+
+func init() {
+	// the metrics are served on the /metrics endpoint of the manager
+	metrics.Registry.MustRegister(reconcileResults, cloudflareAPIDuration, tunnelsNotReady)
+}
+
+// observeAPIDuration records the duration of a call to the Cloudflare API
+func observeAPIDuration(operation string, duration time.Duration) {
+	cloudflareAPIDuration.WithLabelValues(operation).Observe(duration.Seconds())
+}
+
+// reconcileOutcome classifies the result of a reconcile. A reconcile requeued before the resync interval is waiting
+// on something, like a rollout or the rate limit of the API.
+func (r *CloudflareTunnelReconciler) reconcileOutcome(result ctrl.Result, err error) string {
+	switch {
+	case err != nil:
+		return "error"
+	case result.Requeue || (result.RequeueAfter > 0 && result.RequeueAfter < r.resyncInterval()):
+		return "requeue"
+	}
+	return "success"
+}
+
+// readinessTracker keeps the gauge of the resources which are not ready up to date. The readiness of each resource
+// is kept, as the reconciles only know about their own resource.
+type readinessTracker struct {
+	gauge    prometheus.Gauge
+	mutex    sync.Mutex
+	notReady map[types.NamespacedName]bool
+}
+
+// set records whether the resource is ready
+func (t *readinessTracker) set(name types.NamespacedName, ready bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if ready {
+		delete(t.notReady, name)
+	} else {
+		t.notReady[name] = true
+	}
+	t.gauge.Set(float64(len(t.notReady)))
+}
+
+// forget drops a resource which has been deleted
+func (t *readinessTracker) forget(name types.NamespacedName) {
+	t.set(name, true)
+}
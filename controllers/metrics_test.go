@@ -0,0 +1,116 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	cfclient "github.com/beezlabs-org/cloudflare-tunnel-operator/internal/cloudflare"
+)
+
+func TestReconcileMetrics(t *testing.T) {
+	remote := cfclient.NewFake("example.com")
+	tunnel := newTestTunnel("metrics")
+	r := newReconcileFixture(remote, tunnel)
+	request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "tunnel", Namespace: "metrics"}}
+	failed := testutil.ToFloat64(reconcileResults.WithLabelValues("error"))
+	requeued := testutil.ToFloat64(reconcileResults.WithLabelValues("requeue"))
+	notReady := testutil.ToFloat64(tunnelsNotReady)
+
+	// the target service is missing
+	service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "metrics"}}
+	if err := r.Client.Delete(context.Background(), service); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(context.Background(), request); err == nil {
+		t.Fatal("expected an error without the target service")
+	}
+	if got := testutil.ToFloat64(reconcileResults.WithLabelValues("error")); got != failed+1 {
+		t.Errorf("expected the error to be counted, got %v instead of %v", got, failed+1)
+	}
+	if got := testutil.ToFloat64(tunnelsNotReady); got != notReady+1 {
+		t.Errorf("expected the tunnel to be counted as not ready, got %v instead of %v", got, notReady+1)
+	}
+
+	service.ResourceVersion = ""
+	service.Spec.Ports = []corev1.ServicePort{{Port: 80}}
+	if err := r.Client.Create(context.Background(), service); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(context.Background(), request); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	// the pods of the new deployment are still starting, so the tunnel is checked again soon
+	if got := testutil.ToFloat64(reconcileResults.WithLabelValues("requeue")); got != requeued+1 {
+		t.Errorf("expected the requeue to be counted, got %v instead of %v", got, requeued+1)
+	}
+	if got := testutil.ToFloat64(tunnelsNotReady); got != notReady {
+		t.Errorf("expected the tunnel to be ready, got %v instead of %v", got, notReady)
+	}
+	if testutil.CollectAndCount(cloudflareAPIDuration) == 0 {
+		t.Errorf("expected the calls to the Cloudflare API to be timed")
+	}
+}
+
+func TestReconcileDeletedTunnel(t *testing.T) {
+	r := newTestReconciler()
+	name := types.NamespacedName{Name: "deleted", Namespace: "metrics"}
+	tunnelReadiness.set(name, false)
+	failed := testutil.ToFloat64(reconcileResults.WithLabelValues("error"))
+	notReady := testutil.ToFloat64(tunnelsNotReady)
+
+	result, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: name})
+	if err != nil || result != (ctrl.Result{}) {
+		t.Fatalf("expected a deleted tunnel not to be retried, got %v, %v", result, err)
+	}
+	if got := testutil.ToFloat64(reconcileResults.WithLabelValues("error")); got != failed {
+		t.Errorf("expected no error to be counted, got %v instead of %v", got, failed)
+	}
+	if got := testutil.ToFloat64(tunnelsNotReady); got != notReady-1 {
+		t.Errorf("expected the deleted tunnel to be forgotten, got %v instead of %v", got, notReady-1)
+	}
+}
+
+func TestReconcileOutcome(t *testing.T) {
+	r := &CloudflareTunnelReconciler{ResyncInterval: time.Minute}
+	tests := []struct {
+		name   string
+		result ctrl.Result
+		err    error
+		want   string
+	}{
+		{name: "resync", result: ctrl.Result{RequeueAfter: time.Minute}, want: "success"},
+		{name: "no requeue", want: "success"},
+		{name: "waiting", result: ctrl.Result{RequeueAfter: time.Second}, want: "requeue"},
+		{name: "error", err: context.Canceled, want: "error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := r.reconcileOutcome(tt.result, tt.err); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
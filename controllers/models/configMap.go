@@ -18,24 +18,64 @@ package models
 
 import (
 	"bytes"
+	"fmt"
+	"strings"
 	"text/template"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
+	cfv2 "github.com/beezlabs-org/cloudflare-tunnel-operator/api/v1alpha2"
 	"github.com/beezlabs-org/cloudflare-tunnel-operator/controllers/constants"
 	"github.com/beezlabs-org/cloudflare-tunnel-operator/controllers/templates"
-	cfv2 "github.com/beezlabs-org/cloudflare-tunnel-operator/api/v1alpha2"
 )
 
 type ConfigMapModel struct {
-	Name       string
-	Namespace  string
-	Service    string
-	TunnelID   string
-	Domain     string
-	ConfigsDir string
-	OriginRequest []*cfv2.CloudflareTunnelServiceOriginRequest
+	Name            string
+	Namespace       string
+	OwnerUID        string // UID of the owning resource
+	Service         string
+	TunnelID        string
+	Domain          string
+	ConfigsDir      string
+	OriginRequest   []*cfv2.CloudflareTunnelServiceOriginRequest
+	ProxyAddress    string
+	ProxyPort       int32
+	ProxyType       string
+	NoHappyEyeballs bool
+	ConnectTimeout  string
+	TLSTimeout      string
+	TCPKeepAlive    string
+	Retries         *int32
+	Path            string
+	TLSPassthrough  bool
+	Ingress         []IngressRule // rules routing each hostname to its own origin, replacing the rule of Service if set
+	Files           FileNames
+}
+
+// IngressRule routes the requests for a hostname to an origin
+type IngressRule struct {
+	Hostname        string
+	Service         string
+	Path            string
+	TLSPassthrough  bool
+	OriginRequest   []*cfv2.CloudflareTunnelServiceOriginRequest
+	ProxyAddress    string
+	ProxyPort       int32
+	ProxyType       string
+	NoHappyEyeballs bool
+	ConnectTimeout  string
+	TLSTimeout      string
+	TCPKeepAlive    string
+}
+
+// renderedRule is an ingress rule as rendered in the config
+type renderedRule struct {
+	IngressRule
+	// MatchHostname is unset for the rules without hostname and for the rule of Service without TLS passthrough,
+	// which then match any hostname
+	MatchHostname bool
 }
 
 func ConfigMap(model ConfigMapModel) *ConfigMapModel {
@@ -43,6 +83,18 @@ func ConfigMap(model ConfigMapModel) *ConfigMapModel {
 }
 
 func (cm *ConfigMapModel) GetConfigMap() (*corev1.ConfigMap, error) {
+	for _, rule := range cm.Rules() {
+		if err := rule.validate(); err != nil {
+			if len(cm.Ingress) != 0 {
+				return nil, fmt.Errorf("invalid rule for %s: %w", rule.Hostname, err)
+			}
+			return nil, err
+		}
+	}
+	if cm.Retries != nil && *cm.Retries < 0 {
+		return nil, fmt.Errorf("invalid retries %d", *cm.Retries)
+	}
+	cm.Files = cm.Files.withDefaults(cm.TunnelID)
 	configMap, err := cm.generateConfigMap()
 	if err != nil {
 		return nil, err
@@ -51,18 +103,148 @@ func (cm *ConfigMapModel) GetConfigMap() (*corev1.ConfigMap, error) {
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      cm.Name + "-" + constants.ResourceSuffix,
 			Namespace: cm.Namespace,
-			Labels: map[string]string{
-				"app.kubernetes.io/name":       cm.Name,
-				"app.kubernetes.io/component":  "controller",
-				"app.kubernetes.io/created-by": constants.OperatorName,
-			},
+			Labels:    resourceLabels(cm.Name, "controller", cm.OwnerUID),
 		},
 		Data: map[string]string{
-			"config.yaml": configMap,
+			cm.Files.Config: configMap,
 		},
 	}, nil
 }
 
+// Rules returns the ingress rules rendered in the config, either Ingress or the single rule routing Domain to Service
+func (cm *ConfigMapModel) Rules() []renderedRule {
+	if len(cm.Ingress) == 0 {
+		return []renderedRule{{
+			IngressRule: IngressRule{
+				Hostname:        cm.Domain,
+				Service:         cm.Service,
+				Path:            cm.Path,
+				TLSPassthrough:  cm.TLSPassthrough,
+				OriginRequest:   cm.OriginRequest,
+				ProxyAddress:    cm.ProxyAddress,
+				ProxyPort:       cm.ProxyPort,
+				ProxyType:       cm.ProxyType,
+				NoHappyEyeballs: cm.NoHappyEyeballs,
+				ConnectTimeout:  cm.ConnectTimeout,
+				TLSTimeout:      cm.TLSTimeout,
+				TCPKeepAlive:    cm.TCPKeepAlive,
+			},
+			// the hostname is only matched when required, so that existing configs are left untouched
+			MatchHostname: cm.TLSPassthrough,
+		}}
+	}
+	rules := make([]renderedRule, 0, len(cm.Ingress))
+	for _, rule := range cm.Ingress {
+		rules = append(rules, renderedRule{IngressRule: rule, MatchHostname: rule.Hostname != ""})
+	}
+	return rules
+}
+
+// httpOriginRequests are the origin request settings which only apply to HTTP origins
+var httpOriginRequests = map[string]bool{
+	"originServerName":       true,
+	"caPool":                 true,
+	"noTLSVerify":            true,
+	"tlsTimeout":             true,
+	"http2Origin":            true,
+	"httpHostHeader":         true,
+	"disableChunkedEncoding": true,
+	"keepAliveConnections":   true,
+	"keepAliveTimeout":       true,
+}
+
+// HTTPOrigin reports whether cloudflared proxies HTTP requests to the origin, as opposed to the raw connections
+// proxied to tcp, ssh and rdp origins
+func (rule renderedRule) HTTPOrigin() bool {
+	return strings.HasPrefix(rule.Service, "http://") || strings.HasPrefix(rule.Service, "https://") ||
+		strings.HasPrefix(rule.Service, "unix:") || strings.HasPrefix(rule.Service, "unix+tls:")
+}
+
+// OriginRequests returns the origin request settings of the rule, without the HTTP ones for the other origins
+func (rule renderedRule) OriginRequests() []*cfv2.CloudflareTunnelServiceOriginRequest {
+	if rule.HTTPOrigin() {
+		return rule.OriginRequest
+	}
+	var originRequests []*cfv2.CloudflareTunnelServiceOriginRequest
+	for _, originRequest := range rule.OriginRequest {
+		if !httpOriginRequests[originRequest.Name] {
+			originRequests = append(originRequests, originRequest)
+		}
+	}
+	return originRequests
+}
+
+// CatchAll reports whether the rules do not match all the requests, in which case cloudflared requires a last rule
+// matching the remaining ones
+func (cm *ConfigMapModel) CatchAll() bool {
+	if len(cm.Ingress) != 0 {
+		return !cm.Ingress[len(cm.Ingress)-1].catchAll()
+	}
+	return cm.TLSPassthrough || cm.Path != ""
+}
+
+// catchAll reports whether the rule matches all the requests
+func (rule *IngressRule) catchAll() bool {
+	return rule.Hostname == "" && rule.Path == ""
+}
+
+func (rule *IngressRule) validate() error {
+	if err := rule.validateProxy(); err != nil {
+		return err
+	}
+	if err := rule.validateTimeouts(); err != nil {
+		return err
+	}
+	return rule.validatePassthrough()
+}
+
+func (rule *IngressRule) validateProxy() error {
+	if rule.ProxyAddress == "" && (rule.ProxyPort != 0 || rule.ProxyType != "") {
+		return fmt.Errorf("proxy address is required when the proxy port or type is set")
+	}
+	if rule.ProxyPort < 0 || rule.ProxyPort > 65535 {
+		return fmt.Errorf("invalid proxy port %d", rule.ProxyPort)
+	}
+	if rule.ProxyType != "" && rule.ProxyType != "socks" {
+		return fmt.Errorf("invalid proxy type %s", rule.ProxyType)
+	}
+	return nil
+}
+
+func (rule *IngressRule) validateTimeouts() error {
+	for name, value := range map[string]string{
+		"connectTimeout": rule.ConnectTimeout,
+		"tlsTimeout":     rule.TLSTimeout,
+		"tcpKeepAlive":   rule.TCPKeepAlive,
+	} {
+		if value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+		if duration <= 0 {
+			return fmt.Errorf("invalid %s %s: must be positive", name, value)
+		}
+	}
+	return nil
+}
+
+// validatePassthrough rejects the settings that require the HTTP requests to be decrypted
+func (rule *IngressRule) validatePassthrough() error {
+	if !rule.TLSPassthrough {
+		return nil
+	}
+	if rule.Path != "" {
+		return fmt.Errorf("path routing cannot be combined with TLS passthrough")
+	}
+	if !strings.HasPrefix(rule.Service, "tcp://") {
+		return fmt.Errorf("TLS passthrough requires a tcp origin, got %s", rule.Service)
+	}
+	return nil
+}
+
 func (cm *ConfigMapModel) generateConfigMap() (string, error) {
 	templateEngine, err := template.New("config").Parse(templates.CONFIG)
 	if err != nil {
@@ -70,7 +252,7 @@ func (cm *ConfigMapModel) generateConfigMap() (string, error) {
 	}
 
 	var dataBuffer bytes.Buffer
-	err = templateEngine.Execute(&dataBuffer, &cm)
+	err = templateEngine.Execute(&dataBuffer, cm)
 	if err != nil {
 		return "", err
 	}
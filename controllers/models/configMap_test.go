@@ -0,0 +1,348 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package models
+
+import (
+	"strings"
+	"testing"
+
+	cfv2 "github.com/beezlabs-org/cloudflare-tunnel-operator/api/v1alpha2"
+)
+
+func TestConfigMapProxy(t *testing.T) {
+	tests := []struct {
+		name      string
+		model     ConfigMapModel
+		want      []string
+		wantNot   []string
+		wantError bool
+	}{
+		{
+			name:    "no proxy",
+			model:   ConfigMapModel{},
+			wantNot: []string{"proxyAddress", "proxyPort", "proxyType"},
+		},
+		{
+			name:  "socks proxy",
+			model: ConfigMapModel{ProxyAddress: "127.0.0.1", ProxyPort: 1080, ProxyType: "socks"},
+			want:  []string{"proxyAddress: 127.0.0.1", "proxyPort: 1080", "proxyType: socks"},
+		},
+		{
+			name:      "port without address",
+			model:     ConfigMapModel{ProxyPort: 1080},
+			wantError: true,
+		},
+		{
+			name:      "invalid type",
+			model:     ConfigMapModel{ProxyAddress: "127.0.0.1", ProxyType: "http"},
+			wantError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.model.Name = "tunnel"
+			tt.model.TunnelID = "tunnel-id"
+			tt.model.Service = "http://app.default:80"
+
+			configMap, err := ConfigMap(tt.model).GetConfigMap()
+			if (err != nil) != tt.wantError {
+				t.Fatalf("expected error %v, got %v", tt.wantError, err)
+			}
+			if err != nil {
+				return
+			}
+			config := configMap.Data["config.yaml"]
+			for _, want := range tt.want {
+				if !strings.Contains(config, want) {
+					t.Errorf("expected config to contain %q, got\n%s", want, config)
+				}
+			}
+			for _, wantNot := range tt.wantNot {
+				if strings.Contains(config, wantNot) {
+					t.Errorf("expected config not to contain %q, got\n%s", wantNot, config)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigMapNoHappyEyeballs(t *testing.T) {
+	for _, noHappyEyeballs := range []bool{false, true} {
+		configMap, err := ConfigMap(ConfigMapModel{
+			Name:            "tunnel",
+			TunnelID:        "tunnel-id",
+			Service:         "http://app.default:80",
+			NoHappyEyeballs: noHappyEyeballs,
+		}).GetConfigMap()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		config := configMap.Data["config.yaml"]
+		if rendered := strings.Contains(config, "noHappyEyeballs: true"); rendered != noHappyEyeballs {
+			t.Errorf("expected noHappyEyeballs to be rendered %v, got\n%s", noHappyEyeballs, config)
+		}
+	}
+}
+
+func TestConfigMapTimeouts(t *testing.T) {
+	retries := int32(7)
+	negativeRetries := int32(-1)
+	tests := []struct {
+		name      string
+		model     ConfigMapModel
+		want      []string
+		wantNot   []string
+		wantError bool
+	}{
+		{
+			name:    "defaults",
+			model:   ConfigMapModel{},
+			wantNot: []string{"connectTimeout", "tlsTimeout", "tcpKeepAlive", "retries"},
+		},
+		{
+			name:  "custom timeouts",
+			model: ConfigMapModel{ConnectTimeout: "10s", TLSTimeout: "5s", TCPKeepAlive: "1m", Retries: &retries},
+			want:  []string{"connectTimeout: 10s", "tlsTimeout: 5s", "tcpKeepAlive: 1m", "retries: 7"},
+		},
+		{
+			name:      "invalid duration",
+			model:     ConfigMapModel{ConnectTimeout: "ten seconds"},
+			wantError: true,
+		},
+		{
+			name:      "negative duration",
+			model:     ConfigMapModel{TLSTimeout: "-5s"},
+			wantError: true,
+		},
+		{
+			name:      "negative retries",
+			model:     ConfigMapModel{Retries: &negativeRetries},
+			wantError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.model.Name = "tunnel"
+			tt.model.TunnelID = "tunnel-id"
+			tt.model.Service = "http://app.default:80"
+
+			configMap, err := ConfigMap(tt.model).GetConfigMap()
+			if (err != nil) != tt.wantError {
+				t.Fatalf("expected error %v, got %v", tt.wantError, err)
+			}
+			if err != nil {
+				return
+			}
+			config := configMap.Data["config.yaml"]
+			for _, want := range tt.want {
+				if !strings.Contains(config, want) {
+					t.Errorf("expected config to contain %q, got\n%s", want, config)
+				}
+			}
+			for _, wantNot := range tt.wantNot {
+				if strings.Contains(config, wantNot) {
+					t.Errorf("expected config not to contain %q, got\n%s", wantNot, config)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigMapTLSPassthrough(t *testing.T) {
+	tests := []struct {
+		name      string
+		model     ConfigMapModel
+		want      []string
+		wantNot   []string
+		wantError bool
+	}{
+		{
+			name:    "terminated",
+			model:   ConfigMapModel{Service: "https://app.default:443"},
+			want:    []string{"originServerName: app.example.com"},
+			wantNot: []string{"hostname:", "http_status:404"},
+		},
+		{
+			name:    "passthrough",
+			model:   ConfigMapModel{Service: "tcp://app.default:443", TLSPassthrough: true},
+			want:    []string{"service: tcp://app.default:443", "hostname: app.example.com", "service: http_status:404"},
+			wantNot: []string{"originServerName"},
+		},
+		{
+			name:  "path routing",
+			model: ConfigMapModel{Service: "https://app.default:443", Path: "^/api/.*"},
+			want:  []string{`path: "^/api/.*"`, "service: http_status:404"},
+		},
+		{
+			name:      "passthrough with path",
+			model:     ConfigMapModel{Service: "tcp://app.default:443", TLSPassthrough: true, Path: "/api"},
+			wantError: true,
+		},
+		{
+			name:      "passthrough to an http origin",
+			model:     ConfigMapModel{Service: "https://app.default:443", TLSPassthrough: true},
+			wantError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.model.Name = "tunnel"
+			tt.model.TunnelID = "tunnel-id"
+			tt.model.Domain = "app.example.com"
+
+			configMap, err := ConfigMap(tt.model).GetConfigMap()
+			if (err != nil) != tt.wantError {
+				t.Fatalf("expected error %v, got %v", tt.wantError, err)
+			}
+			if err != nil {
+				return
+			}
+			config := configMap.Data["config.yaml"]
+			for _, want := range tt.want {
+				if !strings.Contains(config, want) {
+					t.Errorf("expected config to contain %q, got\n%s", want, config)
+				}
+			}
+			for _, wantNot := range tt.wantNot {
+				if strings.Contains(config, wantNot) {
+					t.Errorf("expected config not to contain %q, got\n%s", wantNot, config)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigMapIngress(t *testing.T) {
+	configMap, err := ConfigMap(ConfigMapModel{
+		Name:     "tunnel",
+		TunnelID: "tunnel-id",
+		Ingress: []IngressRule{
+			{Hostname: "app.example.com", Service: "http://app.default:80"},
+			{Hostname: "api.example.com", Service: "https://api.default:443", Path: "^/v1/"},
+			{Hostname: "db.example.com", Service: "tcp://db.default:5432", TLSPassthrough: true},
+		},
+	}).GetConfigMap()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	config := configMap.Data["config.yaml"]
+	for _, want := range []string{
+		"  - service: http://app.default:80\n    hostname: app.example.com\n",
+		"  - service: https://api.default:443\n    hostname: api.example.com\n    path: \"^/v1/\"\n",
+		"originServerName: api.example.com",
+		"  - service: tcp://db.default:5432\n    hostname: db.example.com\n",
+	} {
+		if !strings.Contains(config, want) {
+			t.Errorf("expected config to contain %q, got\n%s", want, config)
+		}
+	}
+	if !strings.HasSuffix(config, "  - service: http_status:404\n") {
+		t.Errorf("expected the config to end with the catch-all rule, got\n%s", config)
+	}
+
+	configMap, err = ConfigMap(ConfigMapModel{
+		Name:     "tunnel",
+		TunnelID: "tunnel-id",
+		Ingress: []IngressRule{
+			{Hostname: "app.example.com", Service: "http://app.default:80"},
+			{Service: "http://static.default:80", Path: "^/assets/"},
+			{Service: "http://fallback.default:80"},
+		},
+	}).GetConfigMap()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	config = configMap.Data["config.yaml"]
+	if !strings.Contains(config, "  - service: http://static.default:80\n    path: \"^/assets/\"\n") {
+		t.Errorf("expected the rule without hostname to match any hostname, got\n%s", config)
+	}
+	if !strings.HasSuffix(config, "  - service: http://fallback.default:80\n    originRequest:\n") || strings.Contains(config, "http_status:404") {
+		t.Errorf("expected the catch-all rule to replace the default one, got\n%s", config)
+	}
+
+	_, err = ConfigMap(ConfigMapModel{
+		Name:     "tunnel",
+		TunnelID: "tunnel-id",
+		Ingress:  []IngressRule{{Hostname: "app.example.com", Service: "http://app.default:80", ProxyPort: 1080}},
+	}).GetConfigMap()
+	if err == nil || !strings.Contains(err.Error(), "app.example.com") {
+		t.Errorf("expected the invalid rule to be reported, got %v", err)
+	}
+}
+
+func TestConfigMapRawOrigins(t *testing.T) {
+	tests := []struct {
+		name    string
+		service string
+		want    []string
+		wantNot []string
+	}{
+		{
+			name:    "http",
+			service: "https://app.default:443",
+			want:    []string{"service: https://app.default:443", "originServerName: app.example.com", "tlsTimeout: 5s", "noTLSVerify: true", "connectTimeout: 10s"},
+		},
+		{
+			name:    "tcp",
+			service: "tcp://postgres.default:5432",
+			want:    []string{"service: tcp://postgres.default:5432", "connectTimeout: 10s", "bastionMode: false"},
+			wantNot: []string{"originServerName", "tlsTimeout", "noTLSVerify"},
+		},
+		{
+			name:    "ssh",
+			service: "ssh://bastion.default:22",
+			want:    []string{"service: ssh://bastion.default:22", "connectTimeout: 10s"},
+			wantNot: []string{"originServerName", "tlsTimeout", "noTLSVerify"},
+		},
+		{
+			name:    "rdp",
+			service: "rdp://desktop.default:3389",
+			want:    []string{"service: rdp://desktop.default:3389", "connectTimeout: 10s"},
+			wantNot: []string{"originServerName", "tlsTimeout", "noTLSVerify"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configMap, err := ConfigMap(ConfigMapModel{
+				Name:           "tunnel",
+				TunnelID:       "tunnel-id",
+				Domain:         "app.example.com",
+				Service:        tt.service,
+				ConnectTimeout: "10s",
+				TLSTimeout:     "5s",
+				OriginRequest: []*cfv2.CloudflareTunnelServiceOriginRequest{
+					{Name: "noTLSVerify", Value: "true"},
+					{Name: "bastionMode", Value: "false"},
+				},
+			}).GetConfigMap()
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			config := configMap.Data["config.yaml"]
+			for _, want := range tt.want {
+				if !strings.Contains(config, want) {
+					t.Errorf("expected config to contain %q, got\n%s", want, config)
+				}
+			}
+			for _, wantNot := range tt.wantNot {
+				if strings.Contains(config, wantNot) {
+					t.Errorf("expected config not to contain %q, got\n%s", wantNot, config)
+				}
+			}
+		})
+	}
+}
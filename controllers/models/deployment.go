@@ -17,25 +17,63 @@ limitations under the License.
 package models
 
 import (
+	"strconv"
+
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 
+	cfv2 "github.com/beezlabs-org/cloudflare-tunnel-operator/api/v1alpha2"
 	"github.com/beezlabs-org/cloudflare-tunnel-operator/controllers/constants"
 )
 
+const (
+	metricsPort = 9090
+	// nonRootUID is the UID of the distroless nonroot user the cloudflared image runs as
+	nonRootUID = 65532
+	// gracePeriodMargin is the time left to cloudflared to exit once its grace period has elapsed
+	gracePeriodMargin = 5
+)
+
 type DeploymentModel struct {
-	Name            string
-	Namespace       string
-	Replicas        int32
-	TunnelID        string
-	Image           string
-	ConfigsDir      string
-	ImagePullPolicy corev1.PullPolicy
-	Command         []string
-	Args            []string
-	Secret          *corev1.Secret
-	ConfigMap       *corev1.ConfigMap
+	Name                     string
+	Namespace                string
+	OwnerUID                 string // UID of the owning resource
+	Replicas                 int32
+	TunnelID                 string
+	Image                    string
+	ContainerName            string
+	PodLabels                map[string]string
+	AutomountToken           *bool  // mounts the service account token in the pods, not mounted if nil
+	ServiceAccountName       string // the default service account of the namespace is used if empty
+	ImagePullSecrets         []corev1.LocalObjectReference
+	ConfigsDir               string
+	ImagePullPolicy          corev1.PullPolicy
+	Command                  []string
+	Args                     []string
+	Size                     cfv2.CloudflareTunnelSize       // preset of the container resources, ignored if Resources is set
+	Resources                *corev1.ResourceRequirements    // container resources, the default ones are set if nil and Size is empty
+	TerminationMessagePolicy corev1.TerminationMessagePolicy // the Kubernetes default is used if empty
+	SecurityContext          *corev1.SecurityContext         // security context of the container, a restricted one if nil
+	SocketVolume             *corev1.VolumeSource            // volume containing the unix socket of the origin, mounted if set
+	MetricsExposed           bool                            // whether the metrics are served to the metrics service
+	LivenessProbe            *cfv2.CloudflareTunnelLivenessProbe
+	ReadinessProbe           *cfv2.CloudflareTunnelReadinessProbe
+	NodeSelector             map[string]string
+	Tolerations              []corev1.Toleration
+	Affinity                 *corev1.Affinity
+	GracePeriod              *int32                         // cloudflared grace period in seconds, the cloudflared default is used if nil
+	LogLevel                 cfv2.CloudflareTunnelLogLevel  // the cloudflared default is used if empty
+	TransportLogLevel        cfv2.CloudflareTunnelLogLevel  // the cloudflared default is used if empty
+	Transport                cfv2.CloudflareTunnelTransport // the cloudflared default is used if empty
+	Files                    FileNames
+	RefreshedAt              string // time of the last token refresh, a change rolls the pods
+	RestartedAt              string // restart trigger copied from the resource, a change rolls the pods
+	ConfigChecksum           string // hash of the config, a change rolls the pods
+	Secret                   *corev1.Secret
+	ConfigMap                *corev1.ConfigMap
 }
 
 func Deployment(model DeploymentModel) *DeploymentModel {
@@ -43,7 +81,7 @@ func Deployment(model DeploymentModel) *DeploymentModel {
 }
 
 func (d *DeploymentModel) GetDeployment() *appsv1.Deployment {
-	image := "cloudflare/cloudflared:latest"
+	image := cfv2.DefaultImage
 	if d.Image != "" {
 		image = d.Image
 	}
@@ -55,25 +93,105 @@ func (d *DeploymentModel) GetDeployment() *appsv1.Deployment {
 	if len(d.Command) != 0 {
 		command = d.Command
 	}
+	files := d.Files.withDefaults(d.TunnelID)
+	var livenessProbe, readinessProbe *corev1.Probe
+	if len(d.Args) == 0 {
+		livenessProbe = d.getLivenessProbe()
+		readinessProbe = d.getReadinessProbe()
+	}
+	// the metrics server only listens on all interfaces when the probes or the metrics service have to reach it
+	metricsHost := "localhost"
+	if livenessProbe != nil || readinessProbe != nil || d.MetricsExposed {
+		metricsHost = "0.0.0.0"
+	}
 	args := []string{
 		"tunnel",
-		"--metrics", "localhost:9090",
-		"--config", d.ConfigsDir + "/config.yaml",
+		"--metrics", metricsHost + ":" + strconv.Itoa(metricsPort),
+		"--config", d.ConfigsDir + "/" + files.Config,
 		"--no-autoupdate",
-		"run",
 	}
+	if d.GracePeriod != nil {
+		args = append(args, "--grace-period", strconv.Itoa(int(*d.GracePeriod))+"s")
+	}
+	if d.LogLevel != "" {
+		args = append(args, "--loglevel", string(d.LogLevel))
+	}
+	if d.TransportLogLevel != "" {
+		args = append(args, "--transport-loglevel", string(d.TransportLogLevel))
+	}
+	if d.Transport != "" {
+		args = append(args, "--protocol", string(d.Transport))
+	}
+	args = append(args, "run")
 	if len(d.Args) != 0 {
 		args = d.Args
 	}
+	containerName := "cloudflared"
+	if d.ContainerName != "" {
+		containerName = d.ContainerName
+	}
+	// the selector label is always set last so that it cannot be overridden by the user provided labels
+	podLabels := map[string]string{}
+	for key, value := range d.PodLabels {
+		podLabels[key] = value
+	}
+	podLabels["app.kubernetes.io/name"] = d.Name
+	podAnnotations := map[string]string{
+		constants.TunnelIDAnnotation: d.TunnelID,
+	}
+	if d.RefreshedAt != "" {
+		podAnnotations[constants.TokenRefreshedAnnotation] = d.RefreshedAt
+	}
+	if d.RestartedAt != "" {
+		podAnnotations[constants.RestartedAtAnnotation] = d.RestartedAt
+	}
+	if d.ConfigChecksum != "" {
+		podAnnotations[constants.ConfigChecksumAnnotation] = d.ConfigChecksum
+	}
+	volumeMounts := []corev1.VolumeMount{
+		{
+			Name:      "cloudflared-config",
+			MountPath: d.ConfigsDir + "/" + files.Config,
+			SubPath:   files.Config,
+		},
+		{
+			Name:      "cloudflared-creds",
+			MountPath: d.ConfigsDir + "/" + files.Credentials,
+			SubPath:   files.Credentials,
+		},
+		{
+			Name:      "cloudflared-creds",
+			MountPath: d.ConfigsDir + "/" + files.OriginCert,
+			SubPath:   files.OriginCert,
+		},
+	}
+	volumes := []corev1.Volume{
+		{
+			Name: "cloudflared-config",
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: d.Name + "-" + constants.ResourceSuffix},
+				},
+			},
+		},
+		{
+			Name: "cloudflared-creds",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: d.Name + "-" + constants.ResourceSuffix,
+				},
+			},
+		},
+	}
+	if d.SocketVolume != nil {
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{Name: "origin-socket", MountPath: constants.SocketDir})
+		volumes = append(volumes, corev1.Volume{Name: "origin-socket", VolumeSource: *d.SocketVolume})
+	}
 	return &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      d.Name + "-" + constants.ResourceSuffix,
 			Namespace: d.Namespace,
-			Labels: map[string]string{
-				"app.kubernetes.io/name":       d.Name,
-				"app.kubernetes.io/component":  "controller",
-				"app.kubernetes.io/created-by": constants.OperatorName,
-			},
+			Labels:    resourceLabels(d.Name, "controller", d.OwnerUID),
 		},
 		Spec: appsv1.DeploymentSpec{
 			Replicas: &d.Replicas,
@@ -84,64 +202,177 @@ func (d *DeploymentModel) GetDeployment() *appsv1.Deployment {
 			},
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
-					Labels: map[string]string{
-						"app.kubernetes.io/name": d.Name,
-					},
+					Labels: podLabels,
+					// the pods are rolled when the tunnel changes, as the mounted files are not updated in place
+					Annotations: podAnnotations,
 				},
 				Spec: corev1.PodSpec{
+					TerminationGracePeriodSeconds: d.getTerminationGracePeriodSeconds(),
+					AutomountServiceAccountToken:  d.getAutomountToken(),
+					ServiceAccountName:            d.ServiceAccountName,
+					ImagePullSecrets:              d.ImagePullSecrets,
+					NodeSelector:                  d.NodeSelector,
+					Tolerations:                   d.Tolerations,
+					Affinity:                      d.Affinity,
 					Containers: []corev1.Container{
 						{
-							Name:            "cloudflared",
-							Image:           image,
-							ImagePullPolicy: imagePullPolicy,
-							Command:         command,
-							Args:            args,
+							Name:                     containerName,
+							Image:                    image,
+							ImagePullPolicy:          imagePullPolicy,
+							Command:                  command,
+							Args:                     args,
+							LivenessProbe:            livenessProbe,
+							ReadinessProbe:           readinessProbe,
+							Resources:                d.getResources(),
+							TerminationMessagePolicy: d.TerminationMessagePolicy,
+							SecurityContext:          d.getSecurityContext(),
 							Ports: []corev1.ContainerPort{
 								{
 									Name:          "metrics",
-									ContainerPort: 9090,
+									ContainerPort: metricsPort,
 									Protocol:      corev1.ProtocolTCP,
 								},
 							},
-							VolumeMounts: []corev1.VolumeMount{
-								{
-									Name:      "cloudflared-config",
-									MountPath: d.ConfigsDir + "/config.yaml",
-									SubPath:   "config.yaml",
-								},
-								{
-									Name:      "cloudflared-creds",
-									MountPath: d.ConfigsDir + "/" + d.TunnelID + ".json",
-									SubPath:   d.TunnelID + ".json",
-								},
-								{
-									Name:      "cloudflared-creds",
-									MountPath: d.ConfigsDir + "/cert.pem",
-									SubPath:   "cert.pem",
-								},
-							},
-						},
-					},
-					Volumes: []corev1.Volume{
-						{
-							Name: "cloudflared-config",
-							VolumeSource: corev1.VolumeSource{
-								ConfigMap: &corev1.ConfigMapVolumeSource{
-									LocalObjectReference: corev1.LocalObjectReference{Name: d.Name + "-" + constants.ResourceSuffix},
-								},
-							},
-						},
-						{
-							Name: "cloudflared-creds",
-							VolumeSource: corev1.VolumeSource{
-								Secret: &corev1.SecretVolumeSource{
-									SecretName: d.Name + "-" + constants.ResourceSuffix,
-								},
-							},
+							VolumeMounts: volumeMounts,
 						},
 					},
+					Volumes: volumes,
 				},
 			},
 		},
 	}
 }
+
+// getLivenessProbe returns a probe against the `/ready` endpoint of the metrics server, which fails once cloudflared
+// has no connections to the edge, or nil unless it is set. The defaults are conservative to not restart on short
+// network blips.
+func (d *DeploymentModel) getLivenessProbe() *corev1.Probe {
+	if d.LivenessProbe == nil || d.LivenessProbe.Enabled != nil && !*d.LivenessProbe.Enabled {
+		return nil
+	}
+	probe := &corev1.Probe{
+		ProbeHandler: corev1.ProbeHandler{
+			HTTPGet: &corev1.HTTPGetAction{
+				Path: "/ready",
+				Port: intstr.FromInt(metricsPort),
+			},
+		},
+		InitialDelaySeconds: 30,
+		PeriodSeconds:       10,
+		TimeoutSeconds:      5,
+		FailureThreshold:    6,
+	}
+	if d.LivenessProbe.InitialDelaySeconds != 0 {
+		probe.InitialDelaySeconds = d.LivenessProbe.InitialDelaySeconds
+	}
+	if d.LivenessProbe.PeriodSeconds != 0 {
+		probe.PeriodSeconds = d.LivenessProbe.PeriodSeconds
+	}
+	if d.LivenessProbe.FailureThreshold != 0 {
+		probe.FailureThreshold = d.LivenessProbe.FailureThreshold
+	}
+	return probe
+}
+
+// getReadinessProbe returns a probe against the `/ready` endpoint of the metrics server, which succeeds once
+// cloudflared has a connection to the edge. Unlike the liveness probe it reacts quickly, as it only holds the rollout.
+func (d *DeploymentModel) getReadinessProbe() *corev1.Probe {
+	probe := &corev1.Probe{
+		ProbeHandler: corev1.ProbeHandler{
+			HTTPGet: &corev1.HTTPGetAction{
+				Path: "/ready",
+				Port: intstr.FromInt(metricsPort),
+			},
+		},
+		PeriodSeconds:    5,
+		TimeoutSeconds:   5,
+		FailureThreshold: 3,
+	}
+	if d.ReadinessProbe == nil {
+		return probe
+	}
+	if d.ReadinessProbe.Enabled != nil && !*d.ReadinessProbe.Enabled {
+		return nil
+	}
+	if d.ReadinessProbe.InitialDelaySeconds != 0 {
+		probe.InitialDelaySeconds = d.ReadinessProbe.InitialDelaySeconds
+	}
+	if d.ReadinessProbe.PeriodSeconds != 0 {
+		probe.PeriodSeconds = d.ReadinessProbe.PeriodSeconds
+	}
+	if d.ReadinessProbe.FailureThreshold != 0 {
+		probe.FailureThreshold = d.ReadinessProbe.FailureThreshold
+	}
+	return probe
+}
+
+// getAutomountToken returns whether the service account token is mounted, which is only the case if requested
+func (d *DeploymentModel) getAutomountToken() *bool {
+	automount := d.AutomountToken != nil && *d.AutomountToken
+	return &automount
+}
+
+// getSecurityContext returns the security context set explicitly, or else one allowed by the restricted Pod Security
+// Standard, since cloudflared needs neither root, capabilities nor to write to its root filesystem.
+func (d *DeploymentModel) getSecurityContext() *corev1.SecurityContext {
+	if d.SecurityContext != nil {
+		return d.SecurityContext
+	}
+	runAsNonRoot, readOnlyRootFilesystem, allowPrivilegeEscalation := true, true, false
+	// the image sets the user by name, which the kubelet cannot verify to be non-root
+	runAsUser := int64(nonRootUID)
+	return &corev1.SecurityContext{
+		RunAsNonRoot:             &runAsNonRoot,
+		RunAsUser:                &runAsUser,
+		ReadOnlyRootFilesystem:   &readOnlyRootFilesystem,
+		AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+		Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+		SeccompProfile:           &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault},
+	}
+}
+
+// getTerminationGracePeriodSeconds returns a termination grace period long enough for cloudflared to drain its
+// connections, as the pod would otherwise be killed before the grace period of cloudflared has elapsed.
+// nil leaves the Kubernetes default, which is longer than the default grace period of cloudflared.
+func (d *DeploymentModel) getTerminationGracePeriodSeconds() *int64 {
+	if d.GracePeriod == nil {
+		return nil
+	}
+	seconds := int64(*d.GracePeriod) + gracePeriodMargin
+	if seconds < corev1.DefaultTerminationGracePeriodSeconds {
+		seconds = corev1.DefaultTerminationGracePeriodSeconds
+	}
+	return &seconds
+}
+
+// sizeResources maps each size to the requested CPU and memory and the memory limit.
+// CPU is not limited, as throttling cloudflared would slow down all the traffic of the tunnel.
+var sizeResources = map[cfv2.CloudflareTunnelSize][3]string{
+	cfv2.SizeSmall:  {"50m", "64Mi", "128Mi"},
+	cfv2.SizeMedium: {"200m", "128Mi", "256Mi"},
+	cfv2.SizeLarge:  {"500m", "256Mi", "512Mi"},
+}
+
+// defaultResources are used when neither the resources nor the size are set, so that the pods are admitted in the
+// namespaces enforcing a resource quota and are not the first ones to be evicted under memory pressure
+var defaultResources = [3]string{"100m", "128Mi", "256Mi"}
+
+// getResources returns the resources set explicitly, or else the ones of the size, or else the default ones
+func (d *DeploymentModel) getResources() corev1.ResourceRequirements {
+	if d.Resources != nil {
+		return *d.Resources
+	}
+	size, ok := sizeResources[d.Size]
+	if !ok {
+		size = defaultResources
+	}
+	return corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse(size[0]),
+			corev1.ResourceMemory: resource.MustParse(size[1]),
+		},
+		Limits: corev1.ResourceList{
+			corev1.ResourceMemory: resource.MustParse(size[2]),
+		},
+	}
+}
@@ -0,0 +1,558 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package models
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	cfv2 "github.com/beezlabs-org/cloudflare-tunnel-operator/api/v1alpha2"
+	"github.com/beezlabs-org/cloudflare-tunnel-operator/controllers/constants"
+)
+
+func TestDeploymentContainerNameAndPodLabels(t *testing.T) {
+	deployment := Deployment(DeploymentModel{
+		Name:          "tunnel",
+		Namespace:     "default",
+		TunnelID:      "tunnel-id",
+		ConfigsDir:    "/etc/cloudflared",
+		ContainerName: "connector",
+		PodLabels: map[string]string{
+			"sidecar.istio.io/inject": "false",
+			"app.kubernetes.io/name":  "overridden",
+		},
+	}).GetDeployment()
+
+	podTemplate := deployment.Spec.Template
+	if name := podTemplate.Spec.Containers[0].Name; name != "connector" {
+		t.Errorf("expected container name connector, got %s", name)
+	}
+	if value := podTemplate.Labels["sidecar.istio.io/inject"]; value != "false" {
+		t.Errorf("expected sidecar.istio.io/inject label to be false, got %q", value)
+	}
+	if value := podTemplate.Labels["app.kubernetes.io/name"]; value != "tunnel" {
+		t.Errorf("expected selector label to be preserved, got %q", value)
+	}
+}
+
+func TestDeploymentDefaultContainerName(t *testing.T) {
+	deployment := Deployment(DeploymentModel{Name: "tunnel", TunnelID: "tunnel-id"}).GetDeployment()
+
+	if name := deployment.Spec.Template.Spec.Containers[0].Name; name != "cloudflared" {
+		t.Errorf("expected default container name cloudflared, got %s", name)
+	}
+}
+
+func TestDeploymentReadinessProbe(t *testing.T) {
+	falsePointer := false
+	tests := []struct {
+		name          string
+		model         DeploymentModel
+		wantProbe     bool
+		wantThreshold int32
+		wantPeriod    int32
+	}{
+		{
+			name:          "defaults",
+			model:         DeploymentModel{},
+			wantProbe:     true,
+			wantThreshold: 3,
+			wantPeriod:    5,
+		},
+		{
+			name:          "custom thresholds",
+			model:         DeploymentModel{ReadinessProbe: &cfv2.CloudflareTunnelReadinessProbe{PeriodSeconds: 2, FailureThreshold: 1}},
+			wantProbe:     true,
+			wantThreshold: 1,
+			wantPeriod:    2,
+		},
+		{
+			name:  "disabled",
+			model: DeploymentModel{ReadinessProbe: &cfv2.CloudflareTunnelReadinessProbe{Enabled: &falsePointer}},
+		},
+		{
+			name:  "custom args",
+			model: DeploymentModel{Args: []string{"tunnel", "run"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.model.Name = "tunnel"
+			tt.model.TunnelID = "tunnel-id"
+			container := Deployment(tt.model).GetDeployment().Spec.Template.Spec.Containers[0]
+			probe := container.ReadinessProbe
+			if (probe != nil) != tt.wantProbe {
+				t.Fatalf("expected probe %v, got %v", tt.wantProbe, probe)
+			}
+			if probe == nil {
+				return
+			}
+			if probe.HTTPGet.Path != "/ready" || probe.HTTPGet.Port.IntValue() != metricsPort {
+				t.Errorf("unexpected probe target %s:%s", probe.HTTPGet.Port.String(), probe.HTTPGet.Path)
+			}
+			if probe.FailureThreshold != tt.wantThreshold || probe.PeriodSeconds != tt.wantPeriod {
+				t.Errorf("expected threshold %d and period %d, got %d and %d",
+					tt.wantThreshold, tt.wantPeriod, probe.FailureThreshold, probe.PeriodSeconds)
+			}
+		})
+	}
+}
+
+func TestDeploymentLivenessProbe(t *testing.T) {
+	falsePointer := false
+	tests := []struct {
+		name          string
+		model         DeploymentModel
+		wantProbe     bool
+		wantThreshold int32
+		wantPeriod    int32
+	}{
+		{
+			name:  "unset",
+			model: DeploymentModel{},
+		},
+		{
+			name:          "defaults",
+			model:         DeploymentModel{LivenessProbe: &cfv2.CloudflareTunnelLivenessProbe{}},
+			wantProbe:     true,
+			wantThreshold: 6,
+			wantPeriod:    10,
+		},
+		{
+			name:          "custom thresholds",
+			model:         DeploymentModel{LivenessProbe: &cfv2.CloudflareTunnelLivenessProbe{PeriodSeconds: 5, FailureThreshold: 3}},
+			wantProbe:     true,
+			wantThreshold: 3,
+			wantPeriod:    5,
+		},
+		{
+			name:  "disabled",
+			model: DeploymentModel{LivenessProbe: &cfv2.CloudflareTunnelLivenessProbe{Enabled: &falsePointer}},
+		},
+		{
+			name:  "custom args",
+			model: DeploymentModel{Args: []string{"tunnel", "run"}, LivenessProbe: &cfv2.CloudflareTunnelLivenessProbe{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.model.Name = "tunnel"
+			tt.model.TunnelID = "tunnel-id"
+			probe := Deployment(tt.model).GetDeployment().Spec.Template.Spec.Containers[0].LivenessProbe
+			if (probe != nil) != tt.wantProbe {
+				t.Fatalf("expected probe %v, got %v", tt.wantProbe, probe)
+			}
+			if probe == nil {
+				return
+			}
+			if probe.HTTPGet.Path != "/ready" || probe.HTTPGet.Port.IntValue() != metricsPort {
+				t.Errorf("unexpected probe target %s:%s", probe.HTTPGet.Port.String(), probe.HTTPGet.Path)
+			}
+			if probe.FailureThreshold != tt.wantThreshold || probe.PeriodSeconds != tt.wantPeriod {
+				t.Errorf("expected threshold %d and period %d, got %d and %d",
+					tt.wantThreshold, tt.wantPeriod, probe.FailureThreshold, probe.PeriodSeconds)
+			}
+		})
+	}
+}
+
+func TestDeploymentMetricsAddress(t *testing.T) {
+	falsePointer := false
+	noReadiness := &cfv2.CloudflareTunnelReadinessProbe{Enabled: &falsePointer}
+	tests := []struct {
+		name  string
+		model DeploymentModel
+		want  string
+	}{
+		{name: "readiness probe", model: DeploymentModel{}, want: "0.0.0.0:9090"},
+		{name: "no probes", model: DeploymentModel{ReadinessProbe: noReadiness}, want: "localhost:9090"},
+		{
+			name:  "liveness probe",
+			model: DeploymentModel{ReadinessProbe: noReadiness, LivenessProbe: &cfv2.CloudflareTunnelLivenessProbe{}},
+			want:  "0.0.0.0:9090",
+		},
+		{name: "metrics service", model: DeploymentModel{ReadinessProbe: noReadiness, MetricsExposed: true}, want: "0.0.0.0:9090"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.model.Name = "tunnel"
+			tt.model.TunnelID = "tunnel-id"
+			args := Deployment(tt.model).GetDeployment().Spec.Template.Spec.Containers[0].Args
+
+			var got string
+			for i, arg := range args {
+				if arg == "--metrics" && i+1 < len(args) {
+					got = args[i+1]
+				}
+			}
+			if got != tt.want {
+				t.Errorf("expected the metrics server to listen on %s, got args %v", tt.want, args)
+			}
+		})
+	}
+}
+
+func TestDeploymentGracePeriod(t *testing.T) {
+	short, long := int32(10), int32(120)
+	tests := []struct {
+		name            string
+		gracePeriod     *int32
+		wantArg         string
+		wantTermination *int64
+	}{
+		{name: "unset"},
+		{name: "shorter than the default", gracePeriod: &short, wantArg: "10s", wantTermination: int64Pointer(30)},
+		{name: "longer than the default", gracePeriod: &long, wantArg: "120s", wantTermination: int64Pointer(125)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			podSpec := Deployment(DeploymentModel{
+				Name:        "tunnel",
+				TunnelID:    "tunnel-id",
+				GracePeriod: tt.gracePeriod,
+			}).GetDeployment().Spec.Template.Spec
+
+			args := podSpec.Containers[0].Args
+			gotArg := ""
+			for i, arg := range args {
+				if arg == "--grace-period" && i+1 < len(args) {
+					gotArg = args[i+1]
+				}
+			}
+			if gotArg != tt.wantArg {
+				t.Errorf("expected grace period argument %q, got args %v", tt.wantArg, args)
+			}
+			got := podSpec.TerminationGracePeriodSeconds
+			if (got == nil) != (tt.wantTermination == nil) || (got != nil && *got != *tt.wantTermination) {
+				t.Fatalf("expected termination grace period %v, got %v", tt.wantTermination, got)
+			}
+			if got != nil && *got <= int64(*tt.gracePeriod) {
+				t.Errorf("termination grace period %d does not exceed the cloudflared grace period %d", *got, *tt.gracePeriod)
+			}
+		})
+	}
+}
+
+func int64Pointer(value int64) *int64 {
+	return &value
+}
+
+func TestDeploymentAutomountServiceAccountToken(t *testing.T) {
+	truePointer, falsePointer := true, false
+	tests := []struct {
+		name      string
+		automount *bool
+		want      bool
+	}{
+		{name: "default", want: false},
+		{name: "disabled", automount: &falsePointer, want: false},
+		{name: "opted in", automount: &truePointer, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			podSpec := Deployment(DeploymentModel{
+				Name:           "tunnel",
+				TunnelID:       "tunnel-id",
+				AutomountToken: tt.automount,
+			}).GetDeployment().Spec.Template.Spec
+
+			got := podSpec.AutomountServiceAccountToken
+			if got == nil || *got != tt.want {
+				t.Errorf("expected automountServiceAccountToken %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestDeploymentServiceAccountAndPullSecrets(t *testing.T) {
+	podSpec := Deployment(DeploymentModel{
+		Name:     "tunnel",
+		TunnelID: "tunnel-id",
+	}).GetDeployment().Spec.Template.Spec
+	if podSpec.ServiceAccountName != "" || podSpec.ImagePullSecrets != nil {
+		t.Errorf("expected the defaults of the namespace, got %q and %v", podSpec.ServiceAccountName, podSpec.ImagePullSecrets)
+	}
+
+	pullSecrets := []corev1.LocalObjectReference{{Name: "mirror"}}
+	podSpec = Deployment(DeploymentModel{
+		Name:               "tunnel",
+		TunnelID:           "tunnel-id",
+		ServiceAccountName: "cloudflared",
+		ImagePullSecrets:   pullSecrets,
+	}).GetDeployment().Spec.Template.Spec
+	if podSpec.ServiceAccountName != "cloudflared" {
+		t.Errorf("expected the pods to run as cloudflared, got %q", podSpec.ServiceAccountName)
+	}
+	if !reflect.DeepEqual(podSpec.ImagePullSecrets, pullSecrets) {
+		t.Errorf("expected the pull secrets %v, got %v", pullSecrets, podSpec.ImagePullSecrets)
+	}
+}
+
+func TestDeploymentSecurityContext(t *testing.T) {
+	container := Deployment(DeploymentModel{
+		Name:     "tunnel",
+		TunnelID: "tunnel-id",
+	}).GetDeployment().Spec.Template.Spec.Containers[0]
+	restricted := container.SecurityContext
+	if restricted == nil {
+		t.Fatal("expected a security context by default")
+	}
+	if restricted.RunAsNonRoot == nil || !*restricted.RunAsNonRoot ||
+		restricted.RunAsUser == nil || *restricted.RunAsUser == 0 {
+		t.Errorf("expected to run as a non-root user, got %v and %v", restricted.RunAsNonRoot, restricted.RunAsUser)
+	}
+	if restricted.AllowPrivilegeEscalation == nil || *restricted.AllowPrivilegeEscalation {
+		t.Errorf("expected privilege escalation to be disallowed, got %v", restricted.AllowPrivilegeEscalation)
+	}
+	if restricted.ReadOnlyRootFilesystem == nil || !*restricted.ReadOnlyRootFilesystem {
+		t.Errorf("expected a read-only root filesystem, got %v", restricted.ReadOnlyRootFilesystem)
+	}
+	if restricted.Capabilities == nil || !reflect.DeepEqual(restricted.Capabilities.Drop, []corev1.Capability{"ALL"}) {
+		t.Errorf("expected all capabilities to be dropped, got %v", restricted.Capabilities)
+	}
+	if restricted.SeccompProfile == nil || restricted.SeccompProfile.Type != corev1.SeccompProfileTypeRuntimeDefault {
+		t.Errorf("expected the runtime default seccomp profile, got %v", restricted.SeccompProfile)
+	}
+
+	privileged := true
+	override := &corev1.SecurityContext{Privileged: &privileged}
+	container = Deployment(DeploymentModel{
+		Name:            "tunnel",
+		TunnelID:        "tunnel-id",
+		SecurityContext: override,
+	}).GetDeployment().Spec.Template.Spec.Containers[0]
+	if !reflect.DeepEqual(container.SecurityContext, override) {
+		t.Errorf("expected the security context to be replaced, got %v", container.SecurityContext)
+	}
+}
+
+func TestDeploymentResources(t *testing.T) {
+	explicit := &corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")},
+	}
+	tests := []struct {
+		name        string
+		size        cfv2.CloudflareTunnelSize
+		resources   *corev1.ResourceRequirements
+		wantCPU     string
+		wantMemory  string
+		wantLimit   string
+		wantNoLimit bool
+	}{
+		{name: "unset", wantCPU: "100m", wantMemory: "128Mi", wantLimit: "256Mi"},
+		{name: "no resources", resources: &corev1.ResourceRequirements{}, wantNoLimit: true},
+		{name: "small", size: cfv2.SizeSmall, wantCPU: "50m", wantMemory: "64Mi", wantLimit: "128Mi"},
+		{name: "medium", size: cfv2.SizeMedium, wantCPU: "200m", wantMemory: "128Mi", wantLimit: "256Mi"},
+		{name: "large", size: cfv2.SizeLarge, wantCPU: "500m", wantMemory: "256Mi", wantLimit: "512Mi"},
+		{name: "explicit resources override the size", size: cfv2.SizeLarge, resources: explicit, wantCPU: "1", wantNoLimit: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resources := Deployment(DeploymentModel{
+				Name:      "tunnel",
+				TunnelID:  "tunnel-id",
+				Size:      tt.size,
+				Resources: tt.resources,
+			}).GetDeployment().Spec.Template.Spec.Containers[0].Resources
+
+			quantities := []struct {
+				want string
+				got  resource.Quantity
+			}{
+				{tt.wantCPU, resources.Requests[corev1.ResourceCPU]},
+				{tt.wantMemory, resources.Requests[corev1.ResourceMemory]},
+				{tt.wantLimit, resources.Limits[corev1.ResourceMemory]},
+			}
+			for _, quantity := range quantities {
+				if quantity.want != "" && quantity.got.Cmp(resource.MustParse(quantity.want)) != 0 {
+					t.Errorf("expected %s, got resources %v", quantity.want, resources)
+				}
+			}
+			if _, limited := resources.Limits[corev1.ResourceCPU]; limited {
+				t.Errorf("expected CPU not to be limited, got %v", resources.Limits)
+			}
+			if tt.wantNoLimit && len(resources.Limits) != 0 {
+				t.Errorf("expected no limits, got %v", resources.Limits)
+			}
+		})
+	}
+}
+
+func TestDeploymentSocketVolume(t *testing.T) {
+	socketVolume := &corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/run/app"}}
+	podSpec := Deployment(DeploymentModel{
+		Name:         "tunnel",
+		TunnelID:     "tunnel-id",
+		SocketVolume: socketVolume,
+	}).GetDeployment().Spec.Template.Spec
+
+	mounted := false
+	for _, mount := range podSpec.Containers[0].VolumeMounts {
+		if mount.Name == "origin-socket" && mount.MountPath == constants.SocketDir {
+			mounted = true
+		}
+	}
+	if !mounted {
+		t.Errorf("expected the socket volume to be mounted at %s, got %v", constants.SocketDir, podSpec.Containers[0].VolumeMounts)
+	}
+	if volume := podSpec.Volumes[len(podSpec.Volumes)-1]; volume.Name != "origin-socket" || volume.HostPath == nil {
+		t.Errorf("expected the socket volume, got %v", volume)
+	}
+}
+
+func TestDeploymentTerminationMessagePolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy corev1.TerminationMessagePolicy
+	}{
+		{name: "default"},
+		{name: "fallback to logs", policy: corev1.TerminationMessageFallbackToLogsOnError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			container := Deployment(DeploymentModel{
+				Name:                     "tunnel",
+				TunnelID:                 "tunnel-id",
+				TerminationMessagePolicy: tt.policy,
+			}).GetDeployment().Spec.Template.Spec.Containers[0]
+
+			if container.TerminationMessagePolicy != tt.policy {
+				t.Errorf("expected termination message policy %q, got %q", tt.policy, container.TerminationMessagePolicy)
+			}
+		})
+	}
+}
+
+func TestDeploymentScheduling(t *testing.T) {
+	podSpec := Deployment(DeploymentModel{Name: "tunnel", TunnelID: "tunnel-id"}).GetDeployment().Spec.Template.Spec
+	if podSpec.NodeSelector != nil || podSpec.Tolerations != nil {
+		t.Errorf("expected no node selector nor tolerations by default, got %v and %v", podSpec.NodeSelector, podSpec.Tolerations)
+	}
+	if podSpec.Affinity != nil {
+		t.Errorf("expected no affinity by default, got %v", podSpec.Affinity)
+	}
+
+	affinity := &corev1.Affinity{
+		NodeAffinity: &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+				NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+					MatchExpressions: []corev1.NodeSelectorRequirement{
+						{Key: "topology.kubernetes.io/zone", Operator: corev1.NodeSelectorOpIn, Values: []string{"eu-west-1a"}},
+					},
+				}},
+			},
+		},
+	}
+	podSpec = Deployment(DeploymentModel{
+		Name:         "tunnel",
+		TunnelID:     "tunnel-id",
+		NodeSelector: map[string]string{"node-role.kubernetes.io/egress": ""},
+		Tolerations: []corev1.Toleration{
+			{Key: "egress", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoSchedule},
+		},
+		Affinity: affinity,
+	}).GetDeployment().Spec.Template.Spec
+	if _, ok := podSpec.NodeSelector["node-role.kubernetes.io/egress"]; !ok || len(podSpec.NodeSelector) != 1 {
+		t.Errorf("expected the node selector to be set, got %v", podSpec.NodeSelector)
+	}
+	if len(podSpec.Tolerations) != 1 || podSpec.Tolerations[0].Key != "egress" {
+		t.Errorf("expected the toleration to be set, got %v", podSpec.Tolerations)
+	}
+	if podSpec.Affinity != affinity {
+		t.Errorf("expected the affinity to be set, got %v", podSpec.Affinity)
+	}
+}
+
+func TestDeploymentLogLevels(t *testing.T) {
+	tests := []struct {
+		name              string
+		logLevel          cfv2.CloudflareTunnelLogLevel
+		transportLogLevel cfv2.CloudflareTunnelLogLevel
+		want              []string
+	}{
+		{name: "default"},
+		{name: "log level", logLevel: cfv2.LogLevelWarn, want: []string{"--loglevel", "warn"}},
+		{name: "transport log level", transportLogLevel: cfv2.LogLevelDebug, want: []string{"--transport-loglevel", "debug"}},
+		{
+			name:              "both",
+			logLevel:          cfv2.LogLevelError,
+			transportLogLevel: cfv2.LogLevelDebug,
+			want:              []string{"--loglevel", "error", "--transport-loglevel", "debug"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := Deployment(DeploymentModel{
+				Name:              "tunnel",
+				TunnelID:          "tunnel-id",
+				LogLevel:          tt.logLevel,
+				TransportLogLevel: tt.transportLogLevel,
+			}).GetDeployment().Spec.Template.Spec.Containers[0].Args
+
+			var got []string
+			for i, arg := range args {
+				if (arg == "--loglevel" || arg == "--transport-loglevel") && i+1 < len(args) {
+					got = append(got, arg, args[i+1])
+				}
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("expected log level arguments %v, got args %v", tt.want, args)
+			}
+			if args[len(args)-1] != "run" {
+				t.Errorf("expected run to be the last argument, got %v", args)
+			}
+		})
+	}
+}
+
+func TestDeploymentTransport(t *testing.T) {
+	tests := []struct {
+		name      string
+		transport cfv2.CloudflareTunnelTransport
+		want      string
+	}{
+		{name: "default"},
+		{name: "http2", transport: cfv2.TransportHTTP2, want: "--protocol http2"},
+		{name: "quic", transport: cfv2.TransportQUIC, want: "--protocol quic"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := Deployment(DeploymentModel{
+				Name:      "tunnel",
+				TunnelID:  "tunnel-id",
+				Transport: tt.transport,
+			}).GetDeployment().Spec.Template.Spec.Containers[0].Args
+
+			var got string
+			for i, arg := range args {
+				if arg == "--protocol" && i+1 < len(args) {
+					got = arg + " " + args[i+1]
+				}
+			}
+			if got != tt.want {
+				t.Errorf("expected protocol argument %q, got args %v", tt.want, args)
+			}
+			if args[len(args)-1] != "run" {
+				t.Errorf("expected run to be the last argument, got %v", args)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package models
+
+import "fmt"
+
+// FileNames are the keys of the config map and secret, which are also the names of the files mounted in cloudflared.
+// The same value has to be passed to all the models so that the mounts match the generated keys.
+type FileNames struct {
+	Config      string
+	Credentials string
+	OriginCert  string
+}
+
+// withDefaults fills the unset names with the ones used by cloudflared by default
+func (f FileNames) withDefaults(tunnelID string) FileNames {
+	if f.Config == "" {
+		f.Config = "config.yaml"
+	}
+	if f.Credentials == "" {
+		f.Credentials = tunnelID + ".json"
+	}
+	if f.OriginCert == "" {
+		f.OriginCert = "cert.pem"
+	}
+	return f
+}
+
+// Validate checks that the credentials and the origin certificate, which share the same secret, do not collide
+func (f FileNames) Validate(tunnelID string) error {
+	f = f.withDefaults(tunnelID)
+	if f.Credentials == f.OriginCert {
+		return fmt.Errorf("the credentials and the origin certificate cannot both be named %s", f.Credentials)
+	}
+	return nil
+}
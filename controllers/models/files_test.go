@@ -0,0 +1,106 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFileNamesFlowIntoDeploymentMounts(t *testing.T) {
+	tests := []struct {
+		name  string
+		files FileNames
+		want  FileNames
+	}{
+		{
+			name:  "defaults",
+			files: FileNames{},
+			want:  FileNames{Config: "config.yaml", Credentials: "tunnel-id.json", OriginCert: "cert.pem"},
+		},
+		{
+			name:  "custom",
+			files: FileNames{Config: "cloudflared.yml", Credentials: "credentials.json", OriginCert: "origin.pem"},
+			want:  FileNames{Config: "cloudflared.yml", Credentials: "credentials.json", OriginCert: "origin.pem"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configMap, err := ConfigMap(ConfigMapModel{
+				Name:       "tunnel",
+				TunnelID:   "tunnel-id",
+				Service:    "http://app.default.svc:80",
+				ConfigsDir: "/etc/cloudflared",
+				Files:      tt.files,
+			}).GetConfigMap()
+			if err != nil {
+				t.Fatal(err)
+			}
+			secret, err := Secret(SecretModel{
+				Name:        "tunnel",
+				TunnelToken: `{"a":"account","s":"secret","t":"tunnel-id"}`,
+				Files:       tt.files,
+			}).GetSecret()
+			if err != nil {
+				t.Fatal(err)
+			}
+			deployment := Deployment(DeploymentModel{
+				Name:       "tunnel",
+				TunnelID:   "tunnel-id",
+				ConfigsDir: "/etc/cloudflared",
+				Files:      tt.files,
+			}).GetDeployment()
+
+			config, ok := configMap.Data[tt.want.Config]
+			if !ok {
+				t.Fatalf("expected config map key %s, got %v", tt.want.Config, configMap.Data)
+			}
+			for _, path := range []string{"/etc/cloudflared/" + tt.want.Credentials, "/etc/cloudflared/" + tt.want.OriginCert} {
+				if !strings.Contains(config, path) {
+					t.Errorf("expected config to reference %s, got %s", path, config)
+				}
+			}
+			for _, key := range []string{tt.want.Credentials, tt.want.OriginCert} {
+				if _, ok := secret.StringData[key]; !ok {
+					t.Errorf("expected secret key %s, got %v", key, secret.StringData)
+				}
+			}
+
+			mounts := map[string]string{}
+			for _, mount := range deployment.Spec.Template.Spec.Containers[0].VolumeMounts {
+				mounts[mount.SubPath] = mount.MountPath
+			}
+			for _, key := range []string{tt.want.Config, tt.want.Credentials, tt.want.OriginCert} {
+				if mounts[key] != "/etc/cloudflared/"+key {
+					t.Errorf("expected %s to be mounted at /etc/cloudflared/%s, got mounts %v", key, key, mounts)
+				}
+			}
+			if !strings.Contains(strings.Join(deployment.Spec.Template.Spec.Containers[0].Args, " "), "--config /etc/cloudflared/"+tt.want.Config) {
+				t.Errorf("expected cloudflared to be started with the mounted config")
+			}
+		})
+	}
+}
+
+func TestFileNamesValidate(t *testing.T) {
+	if err := (FileNames{Credentials: "cert.pem"}).Validate("tunnel-id"); err == nil {
+		t.Error("expected colliding secret keys to be rejected")
+	}
+	if err := (FileNames{Config: "cert.pem"}).Validate("tunnel-id"); err != nil {
+		t.Errorf("expected keys of different objects not to collide, got %v", err)
+	}
+}
@@ -0,0 +1,34 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package models
+
+import "github.com/beezlabs-org/cloudflare-tunnel-operator/controllers/constants"
+
+// resourceLabels returns the labels shared by all the resources generated for a CloudflareTunnel.
+// The instance label is only set when the UID of the owner is known, so that all of its resources
+// can be selected at once regardless of their kind or name.
+func resourceLabels(name, component, ownerUID string) map[string]string {
+	labels := map[string]string{
+		"app.kubernetes.io/name":       name,
+		"app.kubernetes.io/component":  component,
+		"app.kubernetes.io/created-by": constants.OperatorName,
+	}
+	if ownerUID != "" {
+		labels[constants.InstanceLabel] = ownerUID
+	}
+	return labels
+}
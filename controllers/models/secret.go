@@ -31,11 +31,13 @@ import (
 type SecretModel struct {
 	Name              string
 	Namespace         string
+	OwnerUID          string // UID of the owning resource
 	TunnelToken       string
 	AccountTag        string
 	TunnelSecret      string
 	TunnelID          string
 	OriginCertificate string
+	Files             FileNames
 }
 
 type tunnelToken struct {
@@ -53,19 +55,16 @@ func (s *SecretModel) GetSecret() (*corev1.Secret, error) {
 	if err != nil {
 		return nil, err
 	}
+	files := s.Files.withDefaults(s.TunnelID)
 	return &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      s.Name + "-" + constants.ResourceSuffix,
 			Namespace: s.Namespace,
-			Labels: map[string]string{
-				"app.kubernetes.io/name":       s.Name,
-				"app.kubernetes.io/component":  "controller",
-				"app.kubernetes.io/created-by": constants.OperatorName,
-			},
+			Labels:    resourceLabels(s.Name, "controller", s.OwnerUID),
 		},
 		StringData: map[string]string{
-			s.TunnelID + ".json": secret,
-			"cert.pem":           s.OriginCertificate,
+			files.Credentials: secret,
+			files.OriginCert:  s.OriginCertificate,
 		},
 		Type: corev1.SecretTypeOpaque,
 	}, nil
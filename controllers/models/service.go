@@ -0,0 +1,73 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package models
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	"github.com/beezlabs-org/cloudflare-tunnel-operator/controllers/constants"
+)
+
+// MetricsTargetLabels are the labels of the metrics service identifying the tunnel. They are meant to be copied
+// to the scraped metrics, e.g. with the targetLabels of a ServiceMonitor, to tell the metrics of the tunnels apart.
+var MetricsTargetLabels = []string{constants.TunnelLabel, constants.TunnelIDLabel}
+
+type MetricsServiceModel struct {
+	Name      string
+	Namespace string
+	OwnerUID  string // UID of the owning resource
+	TunnelID  string
+}
+
+func MetricsService(model MetricsServiceModel) *MetricsServiceModel {
+	return &model
+}
+
+// GetService returns a ClusterIP service exposing the metrics port of the cloudflared pods
+func (s *MetricsServiceModel) GetService() *corev1.Service {
+	labels := resourceLabels(s.Name, "metrics", s.OwnerUID)
+	labels[constants.TunnelLabel] = s.Name
+	labels[constants.TunnelIDLabel] = s.TunnelID
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      MetricsServiceName(s.Name),
+			Namespace: s.Namespace,
+			Labels:    labels,
+		},
+		Spec: corev1.ServiceSpec{
+			Type: corev1.ServiceTypeClusterIP,
+			Selector: map[string]string{
+				"app.kubernetes.io/name": s.Name,
+			},
+			Ports: []corev1.ServicePort{
+				{
+					Name:       "metrics",
+					Port:       metricsPort,
+					TargetPort: intstr.FromString("metrics"),
+					Protocol:   corev1.ProtocolTCP,
+				},
+			},
+		},
+	}
+}
+
+// MetricsServiceName returns the name of the metrics service of the given tunnel
+func MetricsServiceName(name string) string {
+	return name + "-" + constants.ResourceSuffix + "-metrics"
+}
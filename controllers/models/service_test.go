@@ -0,0 +1,40 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package models
+
+import (
+	"testing"
+
+	"github.com/beezlabs-org/cloudflare-tunnel-operator/controllers/constants"
+)
+
+func TestMetricsServiceTargetLabels(t *testing.T) {
+	service := MetricsService(MetricsServiceModel{Name: "tunnel", Namespace: "default", TunnelID: "tunnel-id"}).GetService()
+
+	want := map[string]string{
+		constants.TunnelLabel:   "tunnel",
+		constants.TunnelIDLabel: "tunnel-id",
+	}
+	for _, label := range MetricsTargetLabels {
+		if value, ok := service.Labels[label]; !ok || value != want[label] {
+			t.Errorf("expected the metrics service to be labeled %s=%s, got %q", label, want[label], value)
+		}
+	}
+	if len(MetricsTargetLabels) != len(want) {
+		t.Errorf("expected the target labels %v, got %v", want, MetricsTargetLabels)
+	}
+}
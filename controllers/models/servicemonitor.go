@@ -0,0 +1,80 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package models
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// ServiceMonitorGVK is the kind of the ServiceMonitor of the Prometheus Operator. It is handled as unstructured, so
+// that the operator does not depend on the Prometheus Operator being installed.
+var ServiceMonitorGVK = schema.GroupVersionKind{Group: "monitoring.coreos.com", Version: "v1", Kind: "ServiceMonitor"}
+
+type ServiceMonitorModel struct {
+	Name      string
+	Namespace string
+	OwnerUID  string // UID of the owning resource
+	Interval  string // between the scrapes, the one of Prometheus if empty
+	Labels    map[string]string
+}
+
+func ServiceMonitor(model ServiceMonitorModel) *ServiceMonitorModel {
+	return &model
+}
+
+// GetServiceMonitor returns a ServiceMonitor scraping the metrics service, which copies the target labels to the
+// metrics so that the tunnels can be told apart
+func (s *ServiceMonitorModel) GetServiceMonitor() *unstructured.Unstructured {
+	labels := map[string]interface{}{}
+	for key, value := range resourceLabels(s.Name, "metrics", s.OwnerUID) {
+		labels[key] = value
+	}
+	for key, value := range s.Labels {
+		labels[key] = value
+	}
+	selector := map[string]interface{}{}
+	for key, value := range resourceLabels(s.Name, "metrics", s.OwnerUID) {
+		selector[key] = value
+	}
+	endpoint := map[string]interface{}{
+		"port": "metrics",
+		"path": "/metrics",
+	}
+	if s.Interval != "" {
+		endpoint["interval"] = s.Interval
+	}
+	targetLabels := make([]interface{}, 0, len(MetricsTargetLabels))
+	for _, label := range MetricsTargetLabels {
+		targetLabels = append(targetLabels, label)
+	}
+
+	serviceMonitor := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"name":      MetricsServiceName(s.Name),
+			"namespace": s.Namespace,
+			"labels":    labels,
+		},
+		"spec": map[string]interface{}{
+			"selector":     map[string]interface{}{"matchLabels": selector},
+			"endpoints":    []interface{}{endpoint},
+			"targetLabels": targetLabels,
+		},
+	}}
+	serviceMonitor.SetGroupVersionKind(ServiceMonitorGVK)
+	return serviceMonitor
+}
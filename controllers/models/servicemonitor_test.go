@@ -0,0 +1,54 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package models
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestServiceMonitorSelectsMetricsService(t *testing.T) {
+	service := MetricsService(MetricsServiceModel{Name: "tunnel", Namespace: "default", OwnerUID: "uid", TunnelID: "tunnel-id"}).GetService()
+	serviceMonitor := ServiceMonitor(ServiceMonitorModel{
+		Name:      "tunnel",
+		Namespace: "default",
+		OwnerUID:  "uid",
+		Interval:  "30s",
+		Labels:    map[string]string{"release": "prometheus"},
+	}).GetServiceMonitor()
+
+	selector, _, _ := unstructured.NestedStringMap(serviceMonitor.Object, "spec", "selector", "matchLabels")
+	for key, value := range selector {
+		if service.Labels[key] != value {
+			t.Errorf("expected the selector %s=%s to match the metrics service, got %q", key, value, service.Labels[key])
+		}
+	}
+	endpoints, _, _ := unstructured.NestedSlice(serviceMonitor.Object, "spec", "endpoints")
+	if len(endpoints) != 1 || endpoints[0].(map[string]interface{})["port"] != service.Spec.Ports[0].Name ||
+		endpoints[0].(map[string]interface{})["interval"] != "30s" {
+		t.Errorf("expected the metrics port to be scraped every 30s, got %v", endpoints)
+	}
+	targetLabels, _, _ := unstructured.NestedStringSlice(serviceMonitor.Object, "spec", "targetLabels")
+	if !reflect.DeepEqual(targetLabels, MetricsTargetLabels) {
+		t.Errorf("expected the target labels %v, got %v", MetricsTargetLabels, targetLabels)
+	}
+	if serviceMonitor.GetLabels()["release"] != "prometheus" || serviceMonitor.GetName() != service.Name {
+		t.Errorf("expected the service monitor to be named after the service and labeled, got %s and %v", serviceMonitor.GetName(), serviceMonitor.GetLabels())
+	}
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/cloudflare/cloudflare-go"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cfv2 "github.com/beezlabs-org/cloudflare-tunnel-operator/api/v1alpha2"
+)
+
+// computePhase derives the phase of the tunnel from its status:
+//   - Deleting once the resource is being deleted, whatever the state of the tunnel
+//   - Ready when everything has been reconciled and the tunnel has connections to the edge
+//   - Degraded when the tunnel has been provisioned before but is not ready anymore, or has no connections
+//   - Provisioning when the remote tunnel exists but the resources have never been fully reconciled
+//   - Pending before the remote tunnel has been created
+func computePhase(cloudflareTunnel *cfv2.CloudflareTunnel) cfv2.CloudflareTunnelPhase {
+	status := cloudflareTunnel.Status
+	if !cloudflareTunnel.DeletionTimestamp.IsZero() {
+		return cfv2.PhaseDeleting
+	}
+	if meta.IsStatusConditionTrue(status.Conditions, cfv2.ConditionReady) {
+		if len(status.Connections) == 0 {
+			return cfv2.PhaseDegraded
+		}
+		return cfv2.PhaseReady
+	}
+	switch status.Phase {
+	case cfv2.PhaseReady, cfv2.PhaseDegraded:
+		return cfv2.PhaseDegraded
+	}
+	if status.TunnelID == "" {
+		return cfv2.PhasePending
+	}
+	return cfv2.PhaseProvisioning
+}
+
+// tunnelHealth summarizes the connectors of the tunnel into its health, the number of active connections to the
+// edge and the IDs of the connected connectors. The tunnel is:
+//   - down without any active connection
+//   - degraded when a connection is pending a reconnect or fewer connectors than expected are connected
+//   - healthy otherwise
+func tunnelHealth(connectors []cloudflare.Connection, expected int32) (cfv2.CloudflareTunnelHealth, int, []string) {
+	active := 0
+	pending := false
+	var connectorIDs []string
+	for _, connector := range connectors {
+		connected := false
+		for _, connection := range connector.Connections {
+			if connection.IsPendingReconnect {
+				pending = true
+				continue
+			}
+			active++
+			connected = true
+		}
+		if connected {
+			connectorIDs = append(connectorIDs, connector.ID)
+		}
+	}
+	switch {
+	case active == 0:
+		return cfv2.TunnelDown, active, connectorIDs
+	case pending || int32(len(connectorIDs)) < expected:
+		return cfv2.TunnelDegraded, active, connectorIDs
+	}
+	return cfv2.TunnelHealthy, active, connectorIDs
+}
+
+// writeStatus updates the phase from the current status and writes the status of the resource.
+// The write is skipped if the status is unchanged, as every write triggers another reconcile.
+func (r *CloudflareTunnelReconciler) writeStatus(ctx context.Context, cloudflareTunnel *cfv2.CloudflareTunnel) error {
+	cloudflareTunnel.Status.Phase = computePhase(cloudflareTunnel)
+	cloudflareTunnel.Status.ObservedGeneration = cloudflareTunnel.Generation
+	tunnelReadiness.set(client.ObjectKeyFromObject(cloudflareTunnel), meta.IsStatusConditionTrue(cloudflareTunnel.Status.Conditions, cfv2.ConditionReady))
+	// connections is required by the schema, which rejects null
+	if cloudflareTunnel.Status.Connections == nil {
+		cloudflareTunnel.Status.Connections = []cfv2.CloudflareTunnelConnections{}
+	}
+	var current cfv2.CloudflareTunnel
+	if err := r.Client.Get(ctx, client.ObjectKeyFromObject(cloudflareTunnel), &current); err == nil &&
+		current.ResourceVersion == cloudflareTunnel.ResourceVersion &&
+		equality.Semantic.DeepEqual(current.Status, cloudflareTunnel.Status) {
+		r.logger.V(1).Info("Status unchanged, skipping update")
+		return nil
+	}
+	if err := r.Client.Status().Update(ctx, cloudflareTunnel); err != nil {
+		r.logger.Error(err, "could not update status")
+		return err
+	}
+	return nil
+}
+
+// backfillStatus fills the status fields introduced after the resource has been created by a previous version,
+// so that it reports a phase and conditions even if the first reconcile after the upgrade fails early
+func (r *CloudflareTunnelReconciler) backfillStatus(ctx context.Context, cloudflareTunnel *cfv2.CloudflareTunnel) error {
+	status := cloudflareTunnel.Status
+	if status.Phase != "" && status.Connections != nil && meta.FindStatusCondition(status.Conditions, cfv2.ConditionReady) != nil {
+		return nil
+	}
+	r.logger.V(1).Info("Backfilling status")
+	if meta.FindStatusCondition(status.Conditions, cfv2.ConditionReady) == nil {
+		meta.SetStatusCondition(&cloudflareTunnel.Status.Conditions, metav1.Condition{
+			Type:               cfv2.ConditionReady,
+			Status:             metav1.ConditionUnknown,
+			ObservedGeneration: cloudflareTunnel.Generation,
+			Reason:             "Reconciling",
+			Message:            "the resources have not been reconciled yet",
+		})
+	}
+	return r.writeStatus(ctx, cloudflareTunnel)
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	cfv2 "github.com/beezlabs-org/cloudflare-tunnel-operator/api/v1alpha2"
+	cfclient "github.com/beezlabs-org/cloudflare-tunnel-operator/internal/cloudflare"
+)
+
+func TestComputePhase(t *testing.T) {
+	ready := []metav1.Condition{{Type: cfv2.ConditionReady, Status: metav1.ConditionTrue}}
+	notReady := []metav1.Condition{{Type: cfv2.ConditionReady, Status: metav1.ConditionFalse}}
+	connections := []cfv2.CloudflareTunnelConnections{{ConnectorID: "connector"}}
+	now := metav1.Now()
+	tests := []struct {
+		name     string
+		deleting bool
+		status   cfv2.CloudflareTunnelStatus
+		want     cfv2.CloudflareTunnelPhase
+	}{
+		{name: "new", status: cfv2.CloudflareTunnelStatus{}, want: cfv2.PhasePending},
+		{name: "waiting before the tunnel is created", status: cfv2.CloudflareTunnelStatus{Conditions: notReady}, want: cfv2.PhasePending},
+		{name: "tunnel created", status: cfv2.CloudflareTunnelStatus{TunnelID: "tunnel-id", Conditions: notReady}, want: cfv2.PhaseProvisioning},
+		{name: "ready", status: cfv2.CloudflareTunnelStatus{TunnelID: "tunnel-id", Conditions: ready, Connections: connections}, want: cfv2.PhaseReady},
+		{name: "ready without connections", status: cfv2.CloudflareTunnelStatus{TunnelID: "tunnel-id", Conditions: ready}, want: cfv2.PhaseDegraded},
+		{
+			name:   "ready to failing",
+			status: cfv2.CloudflareTunnelStatus{Phase: cfv2.PhaseReady, TunnelID: "tunnel-id", Conditions: notReady, Connections: connections},
+			want:   cfv2.PhaseDegraded,
+		},
+		{
+			name:   "degraded to ready",
+			status: cfv2.CloudflareTunnelStatus{Phase: cfv2.PhaseDegraded, TunnelID: "tunnel-id", Conditions: ready, Connections: connections},
+			want:   cfv2.PhaseReady,
+		},
+		{
+			name:   "provisioning still failing",
+			status: cfv2.CloudflareTunnelStatus{Phase: cfv2.PhaseProvisioning, TunnelID: "tunnel-id", Conditions: notReady},
+			want:   cfv2.PhaseProvisioning,
+		},
+		{
+			name:     "deleting",
+			deleting: true,
+			status:   cfv2.CloudflareTunnelStatus{Phase: cfv2.PhaseReady, TunnelID: "tunnel-id", Conditions: ready, Connections: connections},
+			want:     cfv2.PhaseDeleting,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tunnel := newTestTunnel("default")
+			tunnel.Status = tt.status
+			if tt.deleting {
+				tunnel.DeletionTimestamp = &now
+			}
+			if phase := computePhase(tunnel); phase != tt.want {
+				t.Errorf("expected phase %s, got %s", tt.want, phase)
+			}
+		})
+	}
+}
+
+func TestReconcileLegacyStatus(t *testing.T) {
+	remote := cfclient.NewFake("example.com")
+	remote.TunnelList = []cloudflare.Tunnel{{ID: "legacy-id", Name: "tunnel", Secret: "secret"}}
+	// a connector that is still starting is reported without a start time
+	remote.Connections["legacy-id"] = []cloudflare.Connection{{ID: "connector", Connections: []cloudflare.TunnelConnection{{ColoName: "ams01"}}}}
+
+	// a resource created by a previous version, along with its resources
+	tunnel := newTestTunnel("default")
+	tunnel.Status = cfv2.CloudflareTunnelStatus{TunnelID: "legacy-id"}
+	children := metav1.ObjectMeta{Name: "tunnel-cf-tunnel", Namespace: "default"}
+	r := newReconcileFixture(
+		remote,
+		tunnel,
+		&corev1.Secret{ObjectMeta: children},
+		&corev1.ConfigMap{ObjectMeta: children},
+		&appsv1.Deployment{ObjectMeta: children},
+	)
+
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{
+		NamespacedName: types.NamespacedName{Name: "tunnel", Namespace: "default"},
+	}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	var fetched cfv2.CloudflareTunnel
+	if err := r.Client.Get(context.Background(), types.NamespacedName{Name: "tunnel", Namespace: "default"}, &fetched); err != nil {
+		t.Fatal(err)
+	}
+	status := fetched.Status
+	if status.TunnelID != "legacy-id" {
+		t.Errorf("expected the legacy tunnel to be kept, got %s", status.TunnelID)
+	}
+	if status.Phase != cfv2.PhaseReady {
+		t.Errorf("expected the phase to be backfilled, got %q", status.Phase)
+	}
+	if !meta.IsStatusConditionTrue(status.Conditions, cfv2.ConditionReady) {
+		t.Errorf("expected the ready condition to be backfilled, got %v", status.Conditions)
+	}
+	if len(status.Connections) != 1 || status.URL != "https://app.example.com" {
+		t.Errorf("expected the connections and endpoint to be populated, got %v and %s", status.Connections, status.URL)
+	}
+	if status.TunnelStatus != cfv2.TunnelHealthy || status.ActiveConnections != 1 || !reflect.DeepEqual(status.ConnectorIDs, []string{"connector"}) {
+		t.Errorf("expected a healthy tunnel with a single connection, got %s, %d and %v", status.TunnelStatus, status.ActiveConnections, status.ConnectorIDs)
+	}
+}
+
+func TestTunnelHealth(t *testing.T) {
+	connected := cloudflare.TunnelConnection{ColoName: "ams01"}
+	reconnecting := cloudflare.TunnelConnection{ColoName: "fra01", IsPendingReconnect: true}
+	tests := []struct {
+		name       string
+		connectors []cloudflare.Connection
+		expected   int32
+		want       cfv2.CloudflareTunnelHealth
+		wantActive int
+		wantIDs    []string
+	}{
+		{name: "no connector", expected: 1, want: cfv2.TunnelDown},
+		{
+			name:       "reconnecting only",
+			connectors: []cloudflare.Connection{{ID: "a", Connections: []cloudflare.TunnelConnection{reconnecting}}},
+			expected:   1,
+			want:       cfv2.TunnelDown,
+		},
+		{
+			name:       "all connected",
+			connectors: []cloudflare.Connection{{ID: "a", Connections: []cloudflare.TunnelConnection{connected, connected}}},
+			expected:   1,
+			want:       cfv2.TunnelHealthy,
+			wantActive: 2,
+			wantIDs:    []string{"a"},
+		},
+		{
+			name:       "connection reconnecting",
+			connectors: []cloudflare.Connection{{ID: "a", Connections: []cloudflare.TunnelConnection{connected, reconnecting}}},
+			expected:   1,
+			want:       cfv2.TunnelDegraded,
+			wantActive: 1,
+			wantIDs:    []string{"a"},
+		},
+		{
+			name:       "missing connector",
+			connectors: []cloudflare.Connection{{ID: "a", Connections: []cloudflare.TunnelConnection{connected}}, {ID: "b"}},
+			expected:   2,
+			want:       cfv2.TunnelDegraded,
+			wantActive: 1,
+			wantIDs:    []string{"a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			health, active, ids := tunnelHealth(tt.connectors, tt.expected)
+			if health != tt.want || active != tt.wantActive || !reflect.DeepEqual(ids, tt.wantIDs) {
+				t.Errorf("expected %s, %d and %v, got %s, %d and %v", tt.want, tt.wantActive, tt.wantIDs, health, active, ids)
+			}
+		})
+	}
+}
+
+func TestBackfillStatus(t *testing.T) {
+	tunnel := newTestTunnel("default")
+	tunnel.Status = cfv2.CloudflareTunnelStatus{TunnelID: "legacy-id"}
+	r := newTestReconciler(tunnel)
+	logger := logr.Discard()
+	r.logger = &logger
+
+	if err := r.backfillStatus(context.Background(), tunnel); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if tunnel.Status.Phase != cfv2.PhaseProvisioning || tunnel.Status.Connections == nil {
+		t.Errorf("expected the phase and connections to be backfilled, got %v", tunnel.Status)
+	}
+	condition := meta.FindStatusCondition(tunnel.Status.Conditions, cfv2.ConditionReady)
+	if condition == nil || condition.Status != metav1.ConditionUnknown {
+		t.Errorf("expected an unknown ready condition, got %v", condition)
+	}
+}
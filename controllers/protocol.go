@@ -0,0 +1,178 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cfv2 "github.com/beezlabs-org/cloudflare-tunnel-operator/api/v1alpha2"
+	"github.com/beezlabs-org/cloudflare-tunnel-operator/controllers/constants"
+)
+
+// protocolUnix makes cloudflared reach the origin through a unix socket instead of the target service
+const protocolUnix = "unix"
+
+// validateServiceOrigin checks that the origin can be reached with the configured protocol
+func validateServiceOrigin(spec cfv2.CloudflareTunnelSpec) error {
+	service := spec.Service
+	if service == nil {
+		return fmt.Errorf("the service is required unless dnsOnly is set")
+	}
+	if service.OriginURL != "" {
+		return validateOriginURL(spec)
+	}
+	if service.Protocol == "" {
+		return fmt.Errorf("the protocol is required unless originURL is set")
+	}
+	if service.Protocol != protocolUnix {
+		if service.Name == "" || !portSet(service.Port) {
+			return fmt.Errorf("the target service name and port are required for the %s protocol", service.Protocol)
+		}
+		return nil
+	}
+	if service.Socket == nil || service.Socket.Path == "" {
+		return fmt.Errorf("the socket is required for the unix protocol")
+	}
+	// cloudflared and the origin never share a pod, so the socket must live on a volume both can mount
+	if service.Socket.Volume.HostPath == nil && service.Socket.Volume.PersistentVolumeClaim == nil {
+		return fmt.Errorf("the socket volume must be a hostPath or a persistentVolumeClaim shared with the origin")
+	}
+	cleaned := path.Clean(service.Socket.Path)
+	if path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return fmt.Errorf("invalid socket path %q: must be relative to the volume", service.Socket.Path)
+	}
+	if service.TLSPassthrough {
+		return fmt.Errorf("tlsPassthrough cannot be used with the unix protocol")
+	}
+	if spec.ReplicasFromEndpoints != nil {
+		return fmt.Errorf("replicasFromEndpoints cannot be used with the unix protocol, as there is no target service")
+	}
+	return nil
+}
+
+// originURLSchemes are the schemes of the literal origins cloudflared can proxy to
+var originURLSchemes = map[string]bool{"http": true, "https": true, "tcp": true, "ssh": true, "rdp": true}
+
+// validateOriginURL checks that the literal origin URL of the service can be used by cloudflared as is
+func validateOriginURL(spec cfv2.CloudflareTunnelSpec) error {
+	service := spec.Service
+	parsed, err := url.Parse(service.OriginURL)
+	if err != nil {
+		return fmt.Errorf("invalid origin URL %q: %w", service.OriginURL, err)
+	}
+	if !originURLSchemes[parsed.Scheme] {
+		return fmt.Errorf("invalid origin URL %q: the scheme must be one of http, https, tcp, ssh or rdp", service.OriginURL)
+	}
+	if parsed.Hostname() == "" {
+		return fmt.Errorf("invalid origin URL %q: the host is missing", service.OriginURL)
+	}
+	// cloudflared refuses origins with a path, as it cannot proxy to another path than the requested one
+	if (parsed.Path != "" && parsed.Path != "/") || parsed.RawQuery != "" || parsed.Fragment != "" || parsed.User != nil {
+		return fmt.Errorf("invalid origin URL %q: only the scheme, host and port can be set", service.OriginURL)
+	}
+	if service.Protocol != "" && service.Protocol != parsed.Scheme {
+		return fmt.Errorf("the protocol %s does not match the origin URL %s", service.Protocol, service.OriginURL)
+	}
+	if service.Name != "" || portSet(service.Port) || service.Socket != nil {
+		return fmt.Errorf("the target service and socket cannot be set along with the origin URL")
+	}
+	if service.TLSPassthrough {
+		return fmt.Errorf("tlsPassthrough cannot be used with an origin URL")
+	}
+	if spec.ReplicasFromEndpoints != nil {
+		return fmt.Errorf("replicasFromEndpoints cannot be used with an origin URL, as there is no target service")
+	}
+	return nil
+}
+
+// originURL returns the literal origin URL of the service as cloudflared expects it, without a trailing slash
+func originURL(service *cfv2.CloudflareTunnelService) string {
+	return strings.TrimSuffix(service.OriginURL, "/")
+}
+
+// socketURL returns the address of the socket of the origin as mounted in the cloudflared pods
+func socketURL(socket *cfv2.CloudflareTunnelServiceSocket) string {
+	return protocolUnix + ":" + path.Join(constants.SocketDir, socket.Path)
+}
+
+// portProtocol guesses whether the port serves http or https from its appProtocol or, if unset, from its name
+// following the `<protocol>[-<suffix>]` convention. It returns an empty string if there is no usable hint.
+func portProtocol(port corev1.ServicePort) string {
+	hint := port.Name
+	if port.AppProtocol != nil {
+		hint = *port.AppProtocol
+	} else if i := strings.Index(hint, "-"); i >= 0 {
+		hint = hint[:i]
+	}
+	switch strings.ToLower(hint) {
+	case "http", "http2", "h2c", "kubernetes.io/h2c":
+		return "http"
+	case "https":
+		return "https"
+	}
+	return ""
+}
+
+// setServiceProtocolCondition warns when the declared protocol contradicts the hints of the target port, since
+// cloudflared would fail to reach the origin. It does not fail the reconcile, as the hints might be wrong.
+func (r *CloudflareTunnelReconciler) setServiceProtocolCondition(cloudflareTunnel *cfv2.CloudflareTunnel) {
+	condition := metav1.Condition{
+		Type:               cfv2.ConditionServiceProtocol,
+		ObservedGeneration: cloudflareTunnel.Generation,
+	}
+	declared := r.TunEx.TunSpec.Service.Protocol
+	hinted := portProtocol(r.TunEx.TargetPort)
+	switch {
+	case r.TunEx.TunSpec.Service.OriginURL != "":
+		condition.Status = metav1.ConditionUnknown
+		condition.Reason = "OriginURL"
+		condition.Message = "the origin is reached at a literal URL instead of the target service"
+	case declared == protocolUnix:
+		condition.Status = metav1.ConditionUnknown
+		condition.Reason = "UnixSocket"
+		condition.Message = "the origin is reached through a unix socket instead of the target service"
+	case r.TunEx.TunSpec.Service.TLSPassthrough:
+		condition.Status = metav1.ConditionUnknown
+		condition.Reason = "TLSPassthrough"
+		condition.Message = "the connections are forwarded without being inspected"
+	case declared != "http" && declared != "https":
+		condition.Status = metav1.ConditionUnknown
+		condition.Reason = "NotHTTP"
+		condition.Message = "the raw connections are proxied to the origin over " + declared
+	case hinted == "":
+		condition.Status = metav1.ConditionUnknown
+		condition.Reason = "NoHint"
+		condition.Message = "the target port has no appProtocol or protocol prefixed name"
+	case hinted == declared:
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "Matches"
+		condition.Message = "the target port serves " + declared
+	default:
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "ProtocolMismatch"
+		condition.Message = "the service protocol is " + declared + " but the target port seems to serve " + hinted
+		r.logger.Info("WARNING: "+condition.Message, "port", r.TunEx.TargetPort.Port)
+	}
+	meta.SetStatusCondition(&cloudflareTunnel.Status.Conditions, condition)
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	cfv2 "github.com/beezlabs-org/cloudflare-tunnel-operator/api/v1alpha2"
+	"github.com/beezlabs-org/cloudflare-tunnel-operator/controllers/constants"
+)
+
+func TestSetServiceProtocolCondition(t *testing.T) {
+	https, h2c := "https", "kubernetes.io/h2c"
+	tests := []struct {
+		name        string
+		protocol    string
+		passthrough bool
+		port        corev1.ServicePort
+		want        metav1.ConditionStatus
+		wantReason  string
+	}{
+		{name: "matching app protocol", protocol: "https", port: corev1.ServicePort{Name: "web", AppProtocol: &https}, want: metav1.ConditionTrue, wantReason: "Matches"},
+		{name: "matching name", protocol: "http", port: corev1.ServicePort{Name: "http-web"}, want: metav1.ConditionTrue, wantReason: "Matches"},
+		{name: "h2c", protocol: "http", port: corev1.ServicePort{AppProtocol: &h2c}, want: metav1.ConditionTrue, wantReason: "Matches"},
+		{name: "mismatching app protocol", protocol: "http", port: corev1.ServicePort{Name: "http", AppProtocol: &https}, want: metav1.ConditionFalse, wantReason: "ProtocolMismatch"},
+		{name: "mismatching name", protocol: "https", port: corev1.ServicePort{Name: "http"}, want: metav1.ConditionFalse, wantReason: "ProtocolMismatch"},
+		{name: "no hint", protocol: "https", port: corev1.ServicePort{Name: "web"}, want: metav1.ConditionUnknown, wantReason: "NoHint"},
+		{name: "unnamed", protocol: "http", want: metav1.ConditionUnknown, wantReason: "NoHint"},
+		{name: "passthrough", protocol: "https", passthrough: true, port: corev1.ServicePort{Name: "http"}, want: metav1.ConditionUnknown, wantReason: "TLSPassthrough"},
+		{name: "tcp", protocol: "tcp", port: corev1.ServicePort{Name: "http"}, want: metav1.ConditionUnknown, wantReason: "NotHTTP"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tunnel := newTestTunnel("default")
+			tunnel.Spec.Service.Protocol = tt.protocol
+			tunnel.Spec.Service.TLSPassthrough = tt.passthrough
+			logger := logr.Discard()
+			r := &CloudflareTunnelReconciler{
+				TunEx:  &TunnelExpanded{TunSpec: tunnel.Spec, TargetPort: tt.port},
+				logger: &logger,
+			}
+
+			r.setServiceProtocolCondition(tunnel)
+
+			condition := meta.FindStatusCondition(tunnel.Status.Conditions, cfv2.ConditionServiceProtocol)
+			if condition == nil || condition.Status != tt.want || condition.Reason != tt.wantReason {
+				t.Errorf("expected condition %s with reason %s, got %v", tt.want, tt.wantReason, condition)
+			}
+		})
+	}
+}
+
+func TestValidateServiceOrigin(t *testing.T) {
+	hostPath := corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/run/app"}}
+	tests := []struct {
+		name    string
+		service cfv2.CloudflareTunnelService
+		spec    cfv2.CloudflareTunnelSpec
+		wantErr bool
+	}{
+		{name: "service", service: cfv2.CloudflareTunnelService{Name: "app", Protocol: "http", Port: intstr.FromInt(80)}},
+		{name: "tcp service", service: cfv2.CloudflareTunnelService{Name: "postgres", Protocol: "tcp", Port: intstr.FromInt(5432)}},
+		{name: "ssh service without port", service: cfv2.CloudflareTunnelService{Name: "bastion", Protocol: "ssh"}, wantErr: true},
+		{name: "service with named port", service: cfv2.CloudflareTunnelService{Name: "app", Protocol: "http", Port: intstr.FromString("web")}},
+		{name: "service without port", service: cfv2.CloudflareTunnelService{Name: "app", Protocol: "http"}, wantErr: true},
+		{name: "service with empty port name", service: cfv2.CloudflareTunnelService{Name: "app", Protocol: "http", Port: intstr.FromString("")}, wantErr: true},
+		{
+			name:    "socket on a host path",
+			service: cfv2.CloudflareTunnelService{Protocol: "unix", Socket: &cfv2.CloudflareTunnelServiceSocket{Path: "app.sock", Volume: hostPath}},
+		},
+		{
+			name: "socket on a claim",
+			service: cfv2.CloudflareTunnelService{Protocol: "unix", Socket: &cfv2.CloudflareTunnelServiceSocket{Path: "app.sock", Volume: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "sockets"},
+			}}},
+		},
+		{name: "missing socket", service: cfv2.CloudflareTunnelService{Protocol: "unix"}, wantErr: true},
+		{
+			name: "socket on a volume that cannot be shared",
+			service: cfv2.CloudflareTunnelService{Protocol: "unix", Socket: &cfv2.CloudflareTunnelServiceSocket{Path: "app.sock", Volume: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{},
+			}}},
+			wantErr: true,
+		},
+		{
+			name:    "socket outside the volume",
+			service: cfv2.CloudflareTunnelService{Protocol: "unix", Socket: &cfv2.CloudflareTunnelServiceSocket{Path: "../app.sock", Volume: hostPath}},
+			wantErr: true,
+		},
+		{
+			name:    "socket with endpoint scaling",
+			service: cfv2.CloudflareTunnelService{Protocol: "unix", Socket: &cfv2.CloudflareTunnelServiceSocket{Path: "app.sock", Volume: hostPath}},
+			spec:    cfv2.CloudflareTunnelSpec{ReplicasFromEndpoints: &cfv2.CloudflareTunnelReplicasFromEndpoints{MaxReplicas: 2}},
+			wantErr: true,
+		},
+		{name: "missing protocol", service: cfv2.CloudflareTunnelService{Name: "app", Port: intstr.FromInt(80)}, wantErr: true},
+		{name: "origin URL", service: cfv2.CloudflareTunnelService{OriginURL: "https://internal.corp:8443"}},
+		{name: "origin URL with a matching protocol", service: cfv2.CloudflareTunnelService{OriginURL: "http://10.0.0.5/", Protocol: "http"}},
+		{name: "origin URL with another protocol", service: cfv2.CloudflareTunnelService{OriginURL: "http://10.0.0.5", Protocol: "https"}, wantErr: true},
+		{name: "origin URL without a scheme", service: cfv2.CloudflareTunnelService{OriginURL: "internal.corp:8443"}, wantErr: true},
+		{name: "origin URL with an unsupported scheme", service: cfv2.CloudflareTunnelService{OriginURL: "ftp://internal.corp"}, wantErr: true},
+		{name: "origin URL with a path", service: cfv2.CloudflareTunnelService{OriginURL: "https://internal.corp/app"}, wantErr: true},
+		{name: "origin URL with a service", service: cfv2.CloudflareTunnelService{OriginURL: "https://internal.corp", Name: "app", Port: intstr.FromInt(80)}, wantErr: true},
+		{
+			name:    "origin URL with endpoint scaling",
+			service: cfv2.CloudflareTunnelService{OriginURL: "https://internal.corp"},
+			spec:    cfv2.CloudflareTunnelSpec{ReplicasFromEndpoints: &cfv2.CloudflareTunnelReplicasFromEndpoints{MaxReplicas: 2}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.spec.Service = &tt.service
+			if err := validateServiceOrigin(tt.spec); (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestCreateConfigMapUnixSocket(t *testing.T) {
+	tunnel := newTestTunnel("default")
+	tunnel.Spec.Service = &cfv2.CloudflareTunnelService{
+		Protocol: "unix",
+		Socket: &cfv2.CloudflareTunnelServiceSocket{
+			Path:   "app/http.sock",
+			Volume: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/run/app"}},
+		},
+	}
+	existing := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "tunnel-" + constants.ResourceSuffix, Namespace: "default"}}
+	// there is no target service, the socket is reached through the volume
+	r := newTestReconciler(tunnel, existing)
+	logger := logr.Discard()
+	r.logger = &logger
+	r.TunEx = &TunnelExpanded{Name: "tunnel", Namespace: "default", TunSpec: tunnel.Spec, TunnelID: "tunnel-id", UID: "uid"}
+
+	url, err := r.getTargetURL(context.Background())
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	configMap, err := r.createConfigMap(context.Background(), *tunnel, url)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for _, config := range configMap.Data {
+		if !strings.Contains(config, "service: unix:"+constants.SocketDir+"/app/http.sock") {
+			t.Errorf("expected the ingress rule to route to the socket, got %s", config)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"sync"
+
+	"golang.org/x/time/rate"
+
+	cfclient "github.com/beezlabs-org/cloudflare-tunnel-operator/internal/cloudflare"
+)
+
+// AccountLimiters keeps a rate limiter per Cloudflare account, shared by the clients of the account across the
+// concurrent reconciles so that bursts of reconciles stay below the request limit of the account
+type AccountLimiters struct {
+	limit    rate.Limit
+	mutex    sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+// NewAccountLimiters creates limiters allowing rps requests per second to each account, nothing is limited if rps
+// is not positive
+func NewAccountLimiters(rps float64) *AccountLimiters {
+	return &AccountLimiters{
+		limit:    rate.Limit(rps),
+		limiters: map[string]*rate.Limiter{},
+	}
+}
+
+// get returns the limiter of the account, nil if requests are not limited
+func (l *AccountLimiters) get(accountID string) *rate.Limiter {
+	if l == nil || l.limit <= 0 {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	limiter, ok := l.limiters[accountID]
+	if !ok {
+		// bursts are not allowed, as the limit of the remote is enforced over a window and not per second
+		limiter = rate.NewLimiter(l.limit, 1)
+		l.limiters[accountID] = limiter
+	}
+	return limiter
+}
+
+// isRateLimited reports whether err has been caused by requests still being rate limited after the retries
+func isRateLimited(err error) bool {
+	var rateLimitError *cfclient.RateLimitError
+	return errors.As(err, &rateLimitError)
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	cfv2 "github.com/beezlabs-org/cloudflare-tunnel-operator/api/v1alpha2"
+	cfclient "github.com/beezlabs-org/cloudflare-tunnel-operator/internal/cloudflare"
+)
+
+func TestAccountLimiters(t *testing.T) {
+	limiters := NewAccountLimiters(4)
+	if limiters.get("account-a") != limiters.get("account-a") {
+		t.Error("expected the clients of an account to share its limiter")
+	}
+	if limiters.get("account-a") == limiters.get("account-b") {
+		t.Error("expected each account to have its own limiter")
+	}
+	if NewAccountLimiters(0).get("account-a") != nil {
+		t.Error("expected no limiter when the rate is not limited")
+	}
+	var disabled *AccountLimiters
+	if disabled.get("account-a") != nil {
+		t.Error("expected no limiter without limiters")
+	}
+}
+
+func TestReconcileRateLimited(t *testing.T) {
+	remote := cfclient.NewFake("example.com")
+	remote.Errors["Tunnels"] = &cfclient.RateLimitError{RetryAfter: 2 * time.Minute}
+	tunnel := newTestTunnel("default")
+	r := newReconcileFixture(remote, tunnel)
+
+	key := types.NamespacedName{Name: "tunnel", Namespace: "default"}
+	result, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: key})
+	if err != nil {
+		t.Fatalf("expected the reconcile to be requeued without an error, got %v", err)
+	}
+	if result.RequeueAfter != 2*time.Minute {
+		t.Errorf("expected a requeue after the Retry-After delay, got %v", result.RequeueAfter)
+	}
+	var fetched cfv2.CloudflareTunnel
+	if err := r.Client.Get(context.Background(), key, &fetched); err != nil {
+		t.Fatal(err)
+	}
+	condition := meta.FindStatusCondition(fetched.Status.Conditions, cfv2.ConditionReady)
+	if condition == nil || condition.Status != metav1.ConditionFalse || condition.Reason != "RateLimited" {
+		t.Errorf("unexpected ready condition %v", condition)
+	}
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	"github.com/beezlabs-org/cloudflare-tunnel-operator/controllers/constants"
+)
+
+// updateRolloutAnnotation annotates the managed deployment while its pods are replaced, to signal other controllers,
+// like GitOps tools, that the operator is in the middle of a multi-step change of the tunnel resources.
+// The annotation is set along with a change of the template, and only removed by a later reconcile once the
+// deployment has observed it and all of its replicas run it. It reports whether the annotations changed.
+func updateRolloutAnnotation(deployment *appsv1.Deployment, templateChanged bool, now time.Time) bool {
+	if templateChanged {
+		if deployment.Annotations == nil {
+			deployment.Annotations = map[string]string{}
+		}
+		deployment.Annotations[constants.RolloutInProgressAnnotation] = now.UTC().Format(time.RFC3339)
+		return true
+	}
+	if _, ok := deployment.Annotations[constants.RolloutInProgressAnnotation]; ok && deploymentRolledOut(deployment) {
+		delete(deployment.Annotations, constants.RolloutInProgressAnnotation)
+		return true
+	}
+	return false
+}
+
+// ignoreAnnotationUpdates filters out the updates of a managed object which only change its annotations, like the
+// rollout annotation written by the operator itself, so that writing them does not trigger another reconcile
+func ignoreAnnotationUpdates() predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return !annotationsOnlyChanged(e.ObjectOld, e.ObjectNew)
+		},
+	}
+}
+
+// annotationsOnlyChanged reports whether the objects only differ by their annotations and their resource version
+func annotationsOnlyChanged(old, new client.Object) bool {
+	if old == nil || new == nil {
+		return false
+	}
+	stripped := func(obj client.Object) client.Object {
+		copied := obj.DeepCopyObject().(client.Object)
+		copied.SetAnnotations(nil)
+		copied.SetResourceVersion("")
+		copied.SetManagedFields(nil)
+		return copied
+	}
+	return equality.Semantic.DeepEqual(stripped(old), stripped(new))
+}
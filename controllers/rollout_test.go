@@ -0,0 +1,98 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	"github.com/beezlabs-org/cloudflare-tunnel-operator/controllers/constants"
+)
+
+func TestRolloutInProgress(t *testing.T) {
+	ctx := context.Background()
+	tunnel := newTestTunnel("default")
+	r := newTestReconciler(tunnel)
+	logger := logr.Discard()
+	r.logger = &logger
+	r.TunEx = &TunnelExpanded{Name: tunnel.Name, Namespace: tunnel.Namespace, TunSpec: tunnel.Spec, TunnelID: "tunnel-id"}
+	key := types.NamespacedName{Name: "tunnel-" + constants.ResourceSuffix, Namespace: "default"}
+
+	annotated := func() (*appsv1.Deployment, bool) {
+		var fetched appsv1.Deployment
+		if err := r.Client.Get(ctx, key, &fetched); err != nil {
+			t.Fatal(err)
+		}
+		_, ok := fetched.Annotations[constants.RolloutInProgressAnnotation]
+		return &fetched, ok
+	}
+
+	if _, err := r.createDeployment(ctx, *tunnel, nil, nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, ok := annotated(); ok {
+		t.Fatal("expected a new deployment not to be marked as rolling out")
+	}
+
+	// a new template marks the rollout, which lasts until the deployment has rolled out
+	r.TunEx.TunnelID = "new-tunnel-id"
+	for i := 0; i < 2; i++ {
+		if _, err := r.createDeployment(ctx, *tunnel, nil, nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if _, ok := annotated(); !ok {
+			t.Fatalf("expected the rollout annotation to be set on reconcile %d", i+1)
+		}
+	}
+
+	deployment, _ := annotated()
+	deployment.Status = appsv1.DeploymentStatus{ObservedGeneration: deployment.Generation, Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1}
+	if err := r.Client.Status().Update(ctx, deployment); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.createDeployment(ctx, *tunnel, nil, nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, ok := annotated(); ok {
+		t.Error("expected the rollout annotation to be cleared once the deployment has rolled out")
+	}
+}
+
+func TestIgnoreAnnotationUpdates(t *testing.T) {
+	old := &appsv1.Deployment{}
+	old.Name = "tunnel-" + constants.ResourceSuffix
+	old.ResourceVersion = "1"
+
+	annotated := old.DeepCopy()
+	annotated.ResourceVersion = "2"
+	annotated.Annotations = map[string]string{constants.RolloutInProgressAnnotation: "2022-01-01T00:00:00Z"}
+	if ignoreAnnotationUpdates().Update(event.UpdateEvent{ObjectOld: old, ObjectNew: annotated}) {
+		t.Error("expected an update of the annotations only to be ignored")
+	}
+
+	progressed := old.DeepCopy()
+	progressed.ResourceVersion = "2"
+	progressed.Status.UpdatedReplicas = 1
+	if !ignoreAnnotationUpdates().Update(event.UpdateEvent{ObjectOld: old, ObjectNew: progressed}) {
+		t.Error("expected an update of the status to trigger a reconcile")
+	}
+}
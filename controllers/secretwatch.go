@@ -0,0 +1,96 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	cfv2 "github.com/beezlabs-org/cloudflare-tunnel-operator/api/v1alpha2"
+)
+
+// credentialsHandler enqueues the resources referencing a secret holding credentials whenever it changes, so that
+// a rotated token is used right away instead of on the next resync
+func (r *CloudflareTunnelReconciler) credentialsHandler() handler.EventHandler {
+	return handler.EnqueueRequestsFromMapFunc(r.tunnelsForSecret)
+}
+
+// tunnelsForSecret returns the resources of the shard referencing the secret as their token secret or as the token
+// secret of their Vault store
+func (r *CloudflareTunnelReconciler) tunnelsForSecret(secret client.Object) []reconcile.Request {
+	var tunnels cfv2.CloudflareTunnelList
+	if err := r.Client.List(context.Background(), &tunnels, client.InNamespace(secret.GetNamespace())); err != nil {
+		// the resources are reconciled at the next resync anyway
+		return nil
+	}
+	var requests []reconcile.Request
+	for i := range tunnels.Items {
+		tunnel := &tunnels.Items[i]
+		if !r.inShard(tunnel) || !referencesSecret(tunnel.Spec, secret.GetName()) {
+			continue
+		}
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: tunnel.Name, Namespace: tunnel.Namespace}})
+	}
+	return requests
+}
+
+// referencesSecret checks if the spec reads credentials from the secret with the given name
+func referencesSecret(spec cfv2.CloudflareTunnelSpec, name string) bool {
+	if spec.TokenSecretName == name {
+		return true
+	}
+	return spec.SecretStore != nil && spec.SecretStore.Vault != nil && spec.SecretStore.Vault.TokenSecretName == name
+}
+
+// endpointsHandler enqueues the resources deriving their replicas from the endpoints of a service whenever one of its
+// endpoint slices changes, so that the replicas follow the endpoints instead of waiting for the next resync
+func (r *CloudflareTunnelReconciler) endpointsHandler() handler.EventHandler {
+	return handler.EnqueueRequestsFromMapFunc(r.tunnelsForEndpointSlice)
+}
+
+// tunnelsForEndpointSlice returns the resources of the shard deriving their replicas from the service of the slice
+func (r *CloudflareTunnelReconciler) tunnelsForEndpointSlice(endpointSlice client.Object) []reconcile.Request {
+	service := endpointSlice.GetLabels()[discoveryv1.LabelServiceName]
+	if service == "" {
+		return nil
+	}
+	// the target service may live in another namespace than the resource
+	var tunnels cfv2.CloudflareTunnelList
+	if err := r.Client.List(context.Background(), &tunnels); err != nil {
+		// the resources are reconciled at the next resync anyway
+		return nil
+	}
+	var requests []reconcile.Request
+	for i := range tunnels.Items {
+		tunnel := &tunnels.Items[i]
+		if !r.inShard(tunnel) || tunnel.Spec.ReplicasFromEndpoints == nil {
+			continue
+		}
+		// the target service of the ingress rules is the one of the first rule
+		spec, err := applyIngress(tunnel.Spec)
+		if err != nil || spec.Service == nil || spec.Service.Name != service || spec.Service.Namespace != endpointSlice.GetNamespace() {
+			continue
+		}
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: tunnel.Name, Namespace: tunnel.Namespace}})
+	}
+	return requests
+}
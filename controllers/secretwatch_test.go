@@ -0,0 +1,112 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	cfv2 "github.com/beezlabs-org/cloudflare-tunnel-operator/api/v1alpha2"
+	"github.com/beezlabs-org/cloudflare-tunnel-operator/controllers/constants"
+)
+
+func TestCredentialsHandler(t *testing.T) {
+	tunnel := newTestTunnel("default")
+	vault := newTestTunnel("default")
+	vault.Name = "vault"
+	vault.Spec.TokenSecretName = "other"
+	vault.Spec.SecretStore = &cfv2.CloudflareTunnelSecretStore{Vault: &cfv2.CloudflareTunnelVaultStore{TokenSecretName: "credentials"}}
+	unrelated := newTestTunnel("default")
+	unrelated.Name = "unrelated"
+	unrelated.Spec.TokenSecretName = "other"
+	otherNamespace := newTestTunnel("other")
+	otherShard := newTestTunnel("default")
+	otherShard.Name = "sharded"
+	otherShard.Annotations = map[string]string{constants.ShardAnnotation: "other"}
+	r := newTestReconciler(tunnel, vault, unrelated, otherNamespace, otherShard)
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "credentials", Namespace: "default", ResourceVersion: "1"},
+		Data:       map[string][]byte{"token": []byte("token")},
+	}
+	rotated := secret.DeepCopy()
+	rotated.ResourceVersion = "2"
+	rotated.Data["token"] = []byte("rotated")
+
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer queue.ShutDown()
+	r.credentialsHandler().Update(event.UpdateEvent{ObjectOld: secret, ObjectNew: rotated}, queue)
+
+	queued := map[string]bool{}
+	for queue.Len() > 0 {
+		item, _ := queue.Get()
+		queued[item.(reconcile.Request).String()] = true
+		queue.Done(item)
+	}
+	for _, want := range []string{"default/tunnel", "default/vault", "default/sharded"} {
+		if !queued[want] {
+			t.Errorf("expected %s to be reconciled, got %v", want, queued)
+		}
+	}
+	if len(queued) != 3 {
+		t.Errorf("expected only the resources referencing the secret to be reconciled, got %v", queued)
+	}
+
+	// the resources of other shards are left to their operator
+	r.Shard = "other"
+	requests := r.tunnelsForSecret(rotated)
+	if len(requests) != 1 || requests[0].String() != "default/sharded" {
+		t.Errorf("expected only the resource of the shard to be reconciled, got %v", requests)
+	}
+}
+
+func TestTunnelsForEndpointSlice(t *testing.T) {
+	derived := newTestTunnel("default")
+	derived.Spec.ReplicasFromEndpoints = &cfv2.CloudflareTunnelReplicasFromEndpoints{MaxReplicas: 3}
+	fixed := newTestTunnel("default")
+	fixed.Name = "fixed"
+	otherService := newTestTunnel("default")
+	otherService.Name = "other-service"
+	otherService.Spec.ReplicasFromEndpoints = &cfv2.CloudflareTunnelReplicasFromEndpoints{MaxReplicas: 3}
+	otherService.Spec.Service.Name = "other"
+	// the target service may live in another namespace
+	crossNamespace := newTestTunnel("other")
+	crossNamespace.Spec.ReplicasFromEndpoints = &cfv2.CloudflareTunnelReplicasFromEndpoints{MaxReplicas: 3}
+	crossNamespace.Spec.Service.Namespace = "default"
+	r := newTestReconciler(derived, fixed, otherService, crossNamespace)
+
+	endpointSlice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-ipv4",
+			Namespace: "default",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "app"},
+		},
+	}
+	queued := map[string]bool{}
+	for _, request := range r.tunnelsForEndpointSlice(endpointSlice) {
+		queued[request.String()] = true
+	}
+	if len(queued) != 2 || !queued["default/tunnel"] || !queued["other/tunnel"] {
+		t.Errorf("expected only the resources deriving their replicas from the service to be reconciled, got %v", queued)
+	}
+}
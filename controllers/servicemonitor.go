@@ -0,0 +1,140 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cfv2 "github.com/beezlabs-org/cloudflare-tunnel-operator/api/v1alpha2"
+	"github.com/beezlabs-org/cloudflare-tunnel-operator/controllers/models"
+)
+
+//+kubebuilder:rbac:groups=monitoring.coreos.com,resources=servicemonitors,verbs=get;list;watch;create;update;patch;delete
+
+// metricsEnabled reports whether the metrics of cloudflared are exposed by the metrics service
+func metricsEnabled(spec cfv2.CloudflareTunnelSpec) bool {
+	return spec.MetricsService || serviceMonitorEnabled(spec)
+}
+
+// serviceMonitorEnabled reports whether the metrics service is to be scraped by the Prometheus Operator
+func serviceMonitorEnabled(spec cfv2.CloudflareTunnelSpec) bool {
+	return spec.Metrics != nil && spec.Metrics.Enabled
+}
+
+// serviceMonitorInstalled checks if the ServiceMonitor CRD of the Prometheus Operator is installed. The REST mapper
+// of the manager discovers the CRD again when it is missing, so it is picked up once installed.
+func (r *CloudflareTunnelReconciler) serviceMonitorInstalled() (bool, error) {
+	gvk := models.ServiceMonitorGVK
+	if _, err := r.Client.RESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version); err != nil {
+		if meta.IsNoMatchError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// createServiceMonitor creates the ServiceMonitor scraping the metrics service when enabled, and removes it otherwise.
+// Nothing is done when the Prometheus Operator is not installed.
+func (r *CloudflareTunnelReconciler) createServiceMonitor(ctx context.Context, cloudflareTunnel cfv2.CloudflareTunnel) error {
+	enabled := serviceMonitorEnabled(r.TunEx.TunSpec)
+	if !enabled && !r.TunEx.ServiceMonitor {
+		// the unstructured ServiceMonitor is read bypassing the cache, so it is not looked up if it cannot exist
+		return nil
+	}
+	installed, err := r.serviceMonitorInstalled()
+	if err != nil {
+		r.logger.Error(err, "could not check if the ServiceMonitor CRD is installed")
+		return err
+	}
+	if !installed {
+		if enabled {
+			r.logger.Info("ServiceMonitor CRD is not installed, the metrics are not scraped")
+		}
+		return nil
+	}
+
+	model := models.ServiceMonitorModel{
+		Name:      r.TunEx.Name,
+		Namespace: r.TunEx.Namespace,
+		OwnerUID:  string(r.TunEx.UID),
+	}
+	if enabled {
+		model.Interval = r.TunEx.TunSpec.Metrics.Interval
+		model.Labels = r.TunEx.TunSpec.Metrics.Labels
+	}
+	serviceMonitorCreate := models.ServiceMonitor(model).GetServiceMonitor()
+	serviceMonitorFetch := &unstructured.Unstructured{}
+	serviceMonitorFetch.SetGroupVersionKind(models.ServiceMonitorGVK)
+	if err := r.Client.Get(ctx, client.ObjectKeyFromObject(serviceMonitorCreate), serviceMonitorFetch); err != nil {
+		if !errors.IsNotFound(err) {
+			r.logger.Error(err, "could not fetch service monitor")
+			return err
+		}
+		r.TunEx.ServiceMonitor = false
+		if !enabled {
+			return nil
+		}
+		if err := ctrl.SetControllerReference(&cloudflareTunnel, serviceMonitorCreate, r.Scheme); err != nil {
+			r.logger.Error(err, "could not create controller reference in service monitor")
+			return err
+		}
+		r.logger.Info("creating service monitor...")
+		if err := r.Client.Create(ctx, serviceMonitorCreate); err != nil {
+			r.logger.Error(err, "could not create service monitor in cluster")
+			return err
+		}
+		r.TunEx.ServiceMonitor = true
+		return nil
+	}
+
+	// a service monitor created by someone else is left untouched
+	if !metav1.IsControlledBy(serviceMonitorFetch, &cloudflareTunnel) {
+		r.TunEx.ServiceMonitor = false
+		return nil
+	}
+	if !enabled {
+		r.logger.Info("deleting service monitor...")
+		if err := r.Client.Delete(ctx, serviceMonitorFetch); err != nil && !errors.IsNotFound(err) {
+			r.logger.Error(err, "could not delete service monitor")
+			return err
+		}
+		r.TunEx.ServiceMonitor = false
+		return nil
+	}
+	r.TunEx.ServiceMonitor = true
+	if equality.Semantic.DeepEqual(serviceMonitorFetch.Object["spec"], serviceMonitorCreate.Object["spec"]) &&
+		equality.Semantic.DeepEqual(serviceMonitorFetch.GetLabels(), serviceMonitorCreate.GetLabels()) {
+		return nil
+	}
+	r.logger.Info("updating service monitor...")
+	serviceMonitorFetch.Object["spec"] = serviceMonitorCreate.Object["spec"]
+	serviceMonitorFetch.SetLabels(serviceMonitorCreate.GetLabels())
+	if err := r.Client.Update(ctx, serviceMonitorFetch); err != nil {
+		r.logger.Error(err, "could not update service monitor")
+		return err
+	}
+	return nil
+}
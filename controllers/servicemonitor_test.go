@@ -0,0 +1,139 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	cfv2 "github.com/beezlabs-org/cloudflare-tunnel-operator/api/v1alpha2"
+	"github.com/beezlabs-org/cloudflare-tunnel-operator/controllers/models"
+)
+
+func TestCreateServiceMonitorWithoutCRD(t *testing.T) {
+	tunnel := newTestTunnel("default")
+	tunnel.Spec.Metrics = &cfv2.CloudflareTunnelMetrics{Enabled: true}
+	r := newTestReconciler(tunnel)
+	logger := logr.Discard()
+	r.logger = &logger
+	r.TunEx = &TunnelExpanded{Name: "tunnel", Namespace: "default", TunSpec: tunnel.Spec}
+
+	if err := r.createServiceMonitor(context.Background(), *tunnel); err != nil {
+		t.Fatalf("expected the missing CRD to be skipped, got %v", err)
+	}
+}
+
+func TestCreateServiceMonitor(t *testing.T) {
+	ctx := context.Background()
+	tunnel := newTestTunnel("default")
+	tunnel.UID = "uid"
+	tunnel.Spec.Metrics = &cfv2.CloudflareTunnelMetrics{Enabled: true, Labels: map[string]string{"release": "prometheus"}}
+	r := newTestReconciler(tunnel)
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(models.ServiceMonitorGVK, meta.RESTScopeNamespace)
+	r.Client = fake.NewClientBuilder().WithScheme(r.Scheme).WithRESTMapper(mapper).WithObjects(tunnel).Build()
+	logger := logr.Discard()
+	r.logger = &logger
+	r.TunEx = &TunnelExpanded{Name: "tunnel", Namespace: "default", UID: tunnel.UID, TunSpec: tunnel.Spec}
+	key := types.NamespacedName{Name: models.MetricsServiceName("tunnel"), Namespace: "default"}
+	fetch := func() (*unstructured.Unstructured, error) {
+		serviceMonitor := &unstructured.Unstructured{}
+		serviceMonitor.SetGroupVersionKind(models.ServiceMonitorGVK)
+		return serviceMonitor, r.Client.Get(ctx, key, serviceMonitor)
+	}
+
+	if err := r.createServiceMonitor(ctx, *tunnel); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	created, err := fetch()
+	if err != nil {
+		t.Fatalf("expected the service monitor to be created, got %v", err)
+	}
+	if !metav1.IsControlledBy(created, tunnel) || created.GetLabels()["release"] != "prometheus" {
+		t.Errorf("expected a labeled service monitor controlled by the tunnel, got %v and %v", created.GetOwnerReferences(), created.GetLabels())
+	}
+	if !metricsEnabled(tunnel.Spec) {
+		t.Errorf("expected the metrics service to be enabled along with the service monitor")
+	}
+
+	if err := r.createServiceMonitor(ctx, *tunnel); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if unchanged, err := fetch(); err != nil || unchanged.GetResourceVersion() != created.GetResourceVersion() {
+		t.Errorf("expected the service monitor not to be written again, got %v", err)
+	}
+
+	r.TunEx.TunSpec.Metrics = nil
+	if err := r.createServiceMonitor(ctx, *tunnel); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, err := fetch(); !errors.IsNotFound(err) {
+		t.Errorf("expected the service monitor to be deleted, got %v", err)
+	}
+	if r.TunEx.ServiceMonitor {
+		t.Error("expected the deleted service monitor not to be recorded anymore")
+	}
+}
+
+// countingClient counts the reads of unstructured objects, which bypass the cache
+type countingClient struct {
+	client.Client
+	unstructuredGets int
+}
+
+func (c *countingClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	if _, ok := obj.(*unstructured.Unstructured); ok {
+		c.unstructuredGets++
+	}
+	return c.Client.Get(ctx, key, obj)
+}
+
+func TestCreateServiceMonitorDisabled(t *testing.T) {
+	tunnel := newTestTunnel("default")
+	r := newTestReconciler(tunnel)
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(models.ServiceMonitorGVK, meta.RESTScopeNamespace)
+	counting := &countingClient{Client: fake.NewClientBuilder().WithScheme(r.Scheme).WithRESTMapper(mapper).WithObjects(tunnel).Build()}
+	r.Client = counting
+	logger := logr.Discard()
+	r.logger = &logger
+	r.TunEx = &TunnelExpanded{Name: "tunnel", Namespace: "default", TunSpec: tunnel.Spec}
+
+	if err := r.createServiceMonitor(context.Background(), *tunnel); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if counting.unstructuredGets != 0 {
+		t.Errorf("expected no lookup of a service monitor which was never created, got %d", counting.unstructuredGets)
+	}
+
+	r.TunEx.ServiceMonitor = true
+	if err := r.createServiceMonitor(context.Background(), *tunnel); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if counting.unstructuredGets != 1 || r.TunEx.ServiceMonitor {
+		t.Errorf("expected the recorded service monitor to be looked up once and forgotten, got %d lookups", counting.unstructuredGets)
+	}
+}
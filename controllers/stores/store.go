@@ -0,0 +1,27 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stores
+
+import "context"
+
+// Store is an external secret store that the tunnel credentials can be exported to
+type Store interface {
+	// Read returns the data stored at the given path, nil if there is none
+	Read(ctx context.Context, path string) (map[string]string, error)
+	// Write stores the data at the given path, replacing anything that was stored there before
+	Write(ctx context.Context, path string, data map[string]string) error
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stores
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultClient sends the requests of the stores without an HTTP client, its timeout keeps a Vault server which does
+// not respond from blocking the reconcile
+var defaultClient = &http.Client{Timeout: 30 * time.Second}
+
+// VaultModel writes secrets to a HashiCorp Vault KV version 2 secrets engine
+type VaultModel struct {
+	Address    string       // address of the Vault server, e.g. https://vault.example.com:8200
+	Mount      string       // mount path of the KV secrets engine
+	Token      string       // token used to authenticate to Vault
+	HTTPClient *http.Client // sends the requests to Vault, a client with a 30 seconds timeout if nil
+}
+
+func Vault(model VaultModel) *VaultModel {
+	return &model
+}
+
+func (v *VaultModel) Read(ctx context.Context, path string) (map[string]string, error) {
+	// see https://www.vaultproject.io/api-docs/secret/kv/kv-v2#read-secret-version
+	response, err := v.send(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err := responseError(response); err != nil {
+		return nil, err
+	}
+	var secret struct {
+		Data struct {
+			Data map[string]string `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&secret); err != nil {
+		return nil, fmt.Errorf("could not decode the secret read from vault: %w", err)
+	}
+	return secret.Data.Data, nil
+}
+
+func (v *VaultModel) Write(ctx context.Context, path string, data map[string]string) error {
+	body, err := json.Marshal(map[string]interface{}{"data": data})
+	if err != nil {
+		return err
+	}
+
+	// see https://www.vaultproject.io/api-docs/secret/kv/kv-v2#create-update-secret
+	response, err := v.send(ctx, http.MethodPost, path, body)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	return responseError(response)
+}
+
+// send sends a request for the secret at path to the KV secrets engine
+func (v *VaultModel) send(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	url := strings.TrimSuffix(v.Address, "/") + "/v1/" + strings.Trim(v.Mount, "/") + "/data/" + strings.Trim(path, "/")
+	request, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("X-Vault-Token", v.Token)
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	httpClient := v.HTTPClient
+	if httpClient == nil {
+		httpClient = defaultClient
+	}
+	return httpClient.Do(request)
+}
+
+// responseError returns the error reported by vault if the request failed
+func responseError(response *http.Response) error {
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		message, _ := io.ReadAll(response.Body)
+		return fmt.Errorf("vault responded with status %d: %s", response.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stores
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVaultWrite(t *testing.T) {
+	var gotPath, gotToken string
+	var gotBody struct {
+		Data map[string]string `json:"data"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotToken = r.Header.Get("X-Vault-Token")
+		if err := json.NewDecoder(r.Body).Decode(&gotBody); err != nil {
+			t.Errorf("could not decode request body: %v", err)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	vault := Vault(VaultModel{Address: server.URL, Mount: "secret", Token: "vault-token"})
+	if err := vault.Write(context.Background(), "tunnels/default/tunnel", map[string]string{"tunnel-id.json": "{}"}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if gotPath != "/v1/secret/data/tunnels/default/tunnel" {
+		t.Errorf("unexpected path %s", gotPath)
+	}
+	if gotToken != "vault-token" {
+		t.Errorf("unexpected token %s", gotToken)
+	}
+	if gotBody.Data["tunnel-id.json"] != "{}" {
+		t.Errorf("unexpected data %v", gotBody.Data)
+	}
+}
+
+func TestVaultWriteError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	vault := Vault(VaultModel{Address: server.URL, Mount: "secret", Token: "vault-token"})
+	if err := vault.Write(context.Background(), "tunnel", map[string]string{}); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestVaultRead(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/v1/secret/data/tunnels/default/tunnel" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(`{"data":{"data":{"tunnel-id.json":"{}"},"metadata":{"version":1}}}`))
+	}))
+	defer server.Close()
+
+	vault := Vault(VaultModel{Address: server.URL, Mount: "secret", Token: "vault-token"})
+	data, err := vault.Read(context.Background(), "tunnels/default/tunnel")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if data["tunnel-id.json"] != "{}" {
+		t.Errorf("unexpected data %v", data)
+	}
+
+	missing, err := vault.Read(context.Background(), "tunnels/default/other")
+	if err != nil {
+		t.Fatalf("expected no error for a missing secret, got %v", err)
+	}
+	if missing != nil {
+		t.Errorf("expected no data for a missing secret, got %v", missing)
+	}
+}
@@ -18,15 +18,52 @@ package templates
 
 const CONFIG = `
 tunnel: {{ .TunnelID }}
-credentials-file: {{ .ConfigsDir }}/{{ .TunnelID }}.json
-origincert: {{ .ConfigsDir }}/cert.pem
+credentials-file: {{ .ConfigsDir }}/{{ .Files.Credentials }}
+origincert: {{ .ConfigsDir }}/{{ .Files.OriginCert }}
+{{- if .Retries }}
+retries: {{ .Retries }}
+{{- end }}
 warp-routing:
   enabled: true
 ingress:
+  {{- range .Rules }}
   - service: {{ .Service }}
+    {{- if .MatchHostname }}
+    hostname: {{ .Hostname }}
+    {{- end }}
+    {{- if .Path }}
+    path: {{ printf "%q" .Path }}
+    {{- end }}
     originRequest:
-      originServerName: {{ .Domain }}
-      {{- range .OriginRequest }}
+      {{- if and .Hostname .HTTPOrigin }}
+      originServerName: {{ .Hostname }}
+      {{- end }}
+      {{- if .ProxyAddress }}
+      proxyAddress: {{ .ProxyAddress }}
+      {{- end }}
+      {{- if .ProxyPort }}
+      proxyPort: {{ .ProxyPort }}
+      {{- end }}
+      {{- if .ProxyType }}
+      proxyType: {{ .ProxyType }}
+      {{- end }}
+      {{- if .NoHappyEyeballs }}
+      noHappyEyeballs: true
+      {{- end }}
+      {{- if .ConnectTimeout }}
+      connectTimeout: {{ .ConnectTimeout }}
+      {{- end }}
+      {{- if and .TLSTimeout .HTTPOrigin }}
+      tlsTimeout: {{ .TLSTimeout }}
+      {{- end }}
+      {{- if .TCPKeepAlive }}
+      tcpKeepAlive: {{ .TCPKeepAlive }}
+      {{- end }}
+      {{- range .OriginRequests }}
       {{ .Name }}: {{ .Value }}
       {{- end }}
+  {{- end }}
+  {{- if .CatchAll }}
+  - service: http_status:404
+  {{- end }}
 `
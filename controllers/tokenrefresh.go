@@ -0,0 +1,48 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cfv2 "github.com/beezlabs-org/cloudflare-tunnel-operator/api/v1alpha2"
+)
+
+// tokenRefreshDue reports whether the interval has elapsed since the token has last been refreshed
+func tokenRefreshDue(last *metav1.Time, interval time.Duration, now time.Time) bool {
+	if last == nil {
+		return true
+	}
+	return !now.Before(last.Add(interval))
+}
+
+// refreshToken records a token refresh in the status when the refresh interval has elapsed.
+// The token is fetched again and written to the secret on every reconcile, so a refresh only has to roll the pods,
+// which is done by stamping the time of the refresh on the pod template. As the deployment never scales down before
+// the new pods are available, the tunnel stays connected during the rollout.
+func (r *CloudflareTunnelReconciler) refreshToken(cloudflareTunnel *cfv2.CloudflareTunnel, now time.Time) {
+	if r.TunEx.TunSpec.TokenRefreshInterval == nil {
+		return
+	}
+	if tokenRefreshDue(cloudflareTunnel.Status.LastTokenRefresh, r.TunEx.TunSpec.TokenRefreshInterval.Duration, now) {
+		r.logger.Info("Token refresh interval elapsed, rolling the tunnel pods")
+		cloudflareTunnel.Status.LastTokenRefresh = &metav1.Time{Time: now}
+	}
+	r.TunEx.TokenRefreshedAt = cloudflareTunnel.Status.LastTokenRefresh.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRefreshToken(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	recent := metav1.NewTime(now.Add(-time.Hour))
+	old := metav1.NewTime(now.Add(-48 * time.Hour))
+	tests := []struct {
+		name     string
+		interval *metav1.Duration
+		last     *metav1.Time
+		want     *metav1.Time
+	}{
+		{name: "disabled", last: &old, want: &old},
+		{name: "never refreshed", interval: &metav1.Duration{Duration: 24 * time.Hour}, want: &metav1.Time{Time: now}},
+		{name: "not due", interval: &metav1.Duration{Duration: 24 * time.Hour}, last: &recent, want: &recent},
+		{name: "due", interval: &metav1.Duration{Duration: 24 * time.Hour}, last: &old, want: &metav1.Time{Time: now}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tunnel := newTestTunnel("default")
+			tunnel.Spec.TokenRefreshInterval = tt.interval
+			tunnel.Status.LastTokenRefresh = tt.last
+			r := newTestReconciler()
+			logger := logr.Discard()
+			r.logger = &logger
+			r.TunEx = &TunnelExpanded{TunSpec: tunnel.Spec}
+
+			r.refreshToken(tunnel, now)
+
+			if !tunnel.Status.LastTokenRefresh.Equal(tt.want) {
+				t.Errorf("expected last refresh %v, got %v", tt.want, tunnel.Status.LastTokenRefresh)
+			}
+			wantStamp := ""
+			if tt.interval != nil {
+				wantStamp = tt.want.UTC().Format(time.RFC3339)
+			}
+			if r.TunEx.TokenRefreshedAt != wantStamp {
+				t.Errorf("expected the pods to be stamped with %q, got %q", wantStamp, r.TunEx.TokenRefreshedAt)
+			}
+		})
+	}
+}
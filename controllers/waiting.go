@@ -0,0 +1,174 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/cloudflare/cloudflare-go"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	cfv2 "github.com/beezlabs-org/cloudflare-tunnel-operator/api/v1alpha2"
+	"github.com/beezlabs-org/cloudflare-tunnel-operator/controllers/constants"
+	cfclient "github.com/beezlabs-org/cloudflare-tunnel-operator/internal/cloudflare"
+)
+
+// waitingError signals that the reconcile cannot progress until an external dependency becomes available,
+// like a load balancer IP being assigned. It is not a failure, so the reconcile is requeued instead of erroring.
+type waitingError struct {
+	Reason  string
+	Message string
+}
+
+func (e *waitingError) Error() string {
+	return e.Message
+}
+
+// isInsufficientScope reports whether err is a 403 returned by the Cloudflare API, which happens when the token
+// lacks a permission, e.g. because it has been downgraded while the tunnel is running.
+func isInsufficientScope(err error) bool {
+	// the client maps 403 responses to an AuthenticationError and 401 ones to an AuthorizationError
+	var forbiddenError *cloudflare.AuthenticationError
+	return errors.As(err, &forbiddenError) || hasStatus(err, http.StatusForbidden)
+}
+
+// hasStatus returns whether err is the error response with the given status to a request sent by cfclient itself
+func hasStatus(err error, status int) bool {
+	var responseError *cfclient.ResponseError
+	return errors.As(err, &responseError) && responseError.StatusCode == status
+}
+
+// handleError requeues the reconcile and reports the reason in the Ready condition if err is a waitingError.
+// If err is caused by the token lacking a permission, the credentials are reported as invalid and the reconcile is
+// not retried, since it cannot succeed until the token is fixed. The existing resources are left untouched.
+// If the Cloudflare API still rate limits the requests after retrying, the reconcile is retried once the remote allows
+// requests again, instead of right away which would only make it worse.
+// If the DNS record could not be written after retrying, the reconcile is retried at the resync interval.
+// Any other err is reported in the Ready condition and returned as is.
+func (r *CloudflareTunnelReconciler) handleError(ctx context.Context, cloudflareTunnel *cfv2.CloudflareTunnel, err error) (ctrl.Result, error) {
+	if isAuthError(err) && r.TunEx != nil {
+		// the cached metadata might not be visible to the token anymore
+		r.Metadata.invalidate(r.TunEx.AccountToken)
+		r.Clients.invalidate(r.TunEx.AccountToken)
+	}
+	if r.TunEx != nil && r.TunEx.ConfigHash != "" {
+		// the config map has been written before the failure, the next reconcile must not report it as tampered with
+		cloudflareTunnel.Status.ConfigHash = r.TunEx.ConfigHash
+	}
+	if r.TunEx != nil {
+		// the ServiceMonitor might have been created or deleted before the failure
+		cloudflareTunnel.Status.ServiceMonitor = r.TunEx.ServiceMonitor
+	}
+
+	if isInsufficientScope(err) {
+		r.logger.Error(err, "token lacks the permissions required to manage the tunnel")
+		meta.SetStatusCondition(&cloudflareTunnel.Status.Conditions, metav1.Condition{
+			Type:               cfv2.ConditionCredentialsValid,
+			Status:             metav1.ConditionFalse,
+			ObservedGeneration: cloudflareTunnel.Generation,
+			Reason:             "InsufficientScope",
+			Message:            err.Error(),
+		})
+		meta.SetStatusCondition(&cloudflareTunnel.Status.Conditions, metav1.Condition{
+			Type:               cfv2.ConditionReady,
+			Status:             metav1.ConditionFalse,
+			ObservedGeneration: cloudflareTunnel.Generation,
+			Reason:             "InsufficientScope",
+			Message:            "the token lacks the permissions required to manage the tunnel",
+		})
+		if err := r.writeStatus(ctx, cloudflareTunnel); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+
+	var rateLimited *cfclient.RateLimitError
+	if errors.As(err, &rateLimited) {
+		requeueAfter := rateLimited.RetryAfter
+		if requeueAfter <= 0 {
+			requeueAfter = constants.WaitingRequeueInterval
+		}
+		r.logger.Info("Rate limited by the Cloudflare API, retrying later", "retryAfter", requeueAfter.String())
+		meta.SetStatusCondition(&cloudflareTunnel.Status.Conditions, metav1.Condition{
+			Type:               cfv2.ConditionReady,
+			Status:             metav1.ConditionFalse,
+			ObservedGeneration: cloudflareTunnel.Generation,
+			Reason:             "RateLimited",
+			Message:            err.Error(),
+		})
+		if err := r.writeStatus(ctx, cloudflareTunnel); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{RequeueAfter: requeueAfter}, nil
+	}
+
+	if failed, ok := err.(*dnsError); ok {
+		r.logger.Error(failed.err, "could not write DNS record, retrying at the next resync")
+		// the domain might still point to a previous tunnel or domain, so the endpoint is unknown
+		cloudflareTunnel.Status.URL = ""
+		cloudflareTunnel.Status.CNAMETarget = ""
+		meta.SetStatusCondition(&cloudflareTunnel.Status.Conditions, metav1.Condition{
+			Type:               cfv2.ConditionDNSReady,
+			Status:             metav1.ConditionFalse,
+			ObservedGeneration: cloudflareTunnel.Generation,
+			Reason:             "DNSRecordFailed",
+			Message:            failed.Error(),
+		})
+		meta.SetStatusCondition(&cloudflareTunnel.Status.Conditions, metav1.Condition{
+			Type:               cfv2.ConditionReady,
+			Status:             metav1.ConditionFalse,
+			ObservedGeneration: cloudflareTunnel.Generation,
+			Reason:             "DNSRecordFailed",
+			Message:            "the DNS record could not be written",
+		})
+		if err := r.writeStatus(ctx, cloudflareTunnel); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{RequeueAfter: r.resyncInterval()}, nil
+	}
+
+	waiting, ok := err.(*waitingError)
+	if !ok {
+		meta.SetStatusCondition(&cloudflareTunnel.Status.Conditions, metav1.Condition{
+			Type:               cfv2.ConditionReady,
+			Status:             metav1.ConditionFalse,
+			ObservedGeneration: cloudflareTunnel.Generation,
+			Reason:             "ReconcileFailed",
+			Message:            err.Error(),
+		})
+		// the reconcile is retried whether the status could be written or not
+		_ = r.writeStatus(ctx, cloudflareTunnel)
+		return ctrl.Result{}, err
+	}
+
+	r.logger.Info("Waiting for external dependency", "reason", waiting.Reason, "message", waiting.Message)
+	meta.SetStatusCondition(&cloudflareTunnel.Status.Conditions, metav1.Condition{
+		Type:               cfv2.ConditionReady,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: cloudflareTunnel.Generation,
+		Reason:             waiting.Reason,
+		Message:            waiting.Message,
+	})
+	if err := r.writeStatus(ctx, cloudflareTunnel); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: constants.WaitingRequeueInterval}, nil
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cfv2 "github.com/beezlabs-org/cloudflare-tunnel-operator/api/v1alpha2"
+	cfclient "github.com/beezlabs-org/cloudflare-tunnel-operator/internal/cloudflare"
+)
+
+func TestHandleError(t *testing.T) {
+	tunnel := newTestTunnel("default")
+	r := newTestReconciler(tunnel)
+	logger := logr.Discard()
+	r.logger = &logger
+
+	result, err := r.handleError(context.Background(), tunnel, &waitingError{Reason: "WaitingForLoadBalancer", Message: "waiting"})
+	if err != nil {
+		t.Fatalf("expected no error while waiting, got %v", err)
+	}
+	if result.RequeueAfter == 0 {
+		t.Error("expected a requeue while waiting")
+	}
+	condition := meta.FindStatusCondition(tunnel.Status.Conditions, cfv2.ConditionReady)
+	if condition == nil || condition.Status != metav1.ConditionFalse || condition.Reason != "WaitingForLoadBalancer" {
+		t.Errorf("unexpected ready condition %v", condition)
+	}
+
+	failure := fmt.Errorf("failure")
+	if _, err := r.handleError(context.Background(), tunnel, failure); err != failure {
+		t.Errorf("expected the error to be returned, got %v", err)
+	}
+}
+
+func TestGetTargetURLWaitsForLoadBalancer(t *testing.T) {
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: corev1.ServiceSpec{
+			Type:  corev1.ServiceTypeLoadBalancer,
+			Ports: []corev1.ServicePort{{Port: 80}},
+		},
+	}
+	r := newTestReconciler(service)
+	logger := logr.Discard()
+	r.logger = &logger
+	r.TunEx = &TunnelExpanded{TunSpec: newTestTunnel("default").Spec}
+
+	_, err := r.getTargetURL(context.Background())
+	if _, ok := err.(*waitingError); !ok {
+		t.Fatalf("expected a waiting error, got %v", err)
+	}
+}
+
+func TestGetTargetURLLoadBalancerIngress(t *testing.T) {
+	tests := []struct {
+		name    string
+		ingress []corev1.LoadBalancerIngress
+		wantURL string
+	}{
+		{name: "ip", ingress: []corev1.LoadBalancerIngress{{IP: "203.0.113.10"}}, wantURL: "http://203.0.113.10:80"},
+		{name: "ipv6", ingress: []corev1.LoadBalancerIngress{{IP: "2001:db8::10"}}, wantURL: "http://[2001:db8::10]:80"},
+		{name: "hostname", ingress: []corev1.LoadBalancerIngress{{Hostname: "app.elb.example.com"}}, wantURL: "http://app.elb.example.com:80"},
+		{name: "ip and hostname", ingress: []corev1.LoadBalancerIngress{{IP: "203.0.113.10", Hostname: "app.elb.example.com"}}, wantURL: "http://203.0.113.10:80"},
+		{name: "neither", ingress: []corev1.LoadBalancerIngress{{}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+				Spec: corev1.ServiceSpec{
+					Type:  corev1.ServiceTypeLoadBalancer,
+					Ports: []corev1.ServicePort{{Port: 80}},
+				},
+				Status: corev1.ServiceStatus{LoadBalancer: corev1.LoadBalancerStatus{Ingress: tt.ingress}},
+			}
+			r := newTestReconciler(service)
+			logger := logr.Discard()
+			r.logger = &logger
+			r.TunEx = &TunnelExpanded{TunSpec: newTestTunnel("default").Spec}
+
+			url, err := r.getTargetURL(context.Background())
+			if tt.wantURL == "" {
+				if _, ok := err.(*waitingError); !ok {
+					t.Fatalf("expected a waiting error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if url != tt.wantURL {
+				t.Errorf("expected %s, got %s", tt.wantURL, url)
+			}
+		})
+	}
+}
+
+func TestHandleErrorInsufficientScope(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"success":false,"errors":[{"code":10000,"message":"Authentication error"}],"messages":[],"result":null}`)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name string
+		call func(r *CloudflareTunnelReconciler, tunnel *cfv2.CloudflareTunnel) error
+	}{
+		{
+			name: "dns",
+			call: func(r *CloudflareTunnelReconciler, tunnel *cfv2.CloudflareTunnel) error {
+				return r.createDNSCNAME(context.Background())
+			},
+		},
+		{
+			name: "tunnel",
+			call: func(r *CloudflareTunnelReconciler, tunnel *cfv2.CloudflareTunnel) error {
+				return r.updateStatus(context.Background(), tunnel)
+			},
+		},
+		{
+			name: "tunnel list",
+			call: func(r *CloudflareTunnelReconciler, tunnel *cfv2.CloudflareTunnel) error {
+				_, err := r.TunEx.CloudflareAPI.Tunnels(context.Background(), cloudflare.AccountIdentifier("account"),
+					cloudflare.TunnelListParams{})
+				return err
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api, err := cfclient.New("token", cloudflare.BaseURL(server.URL))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tunnel := newTestTunnel("default")
+			r := newTestReconciler(tunnel)
+			logger := logr.Discard()
+			r.logger = &logger
+			r.TunEx = &TunnelExpanded{CloudflareAPI: api, TunSpec: tunnel.Spec, TunnelID: "tunnel-id", AccountTag: "account"}
+
+			callErr := tt.call(r, tunnel)
+			if !isInsufficientScope(callErr) {
+				t.Fatalf("expected an insufficient scope error, got %v", callErr)
+			}
+			result, err := r.handleError(context.Background(), tunnel, callErr)
+			if err != nil {
+				t.Fatalf("expected the reconcile to stop without an error, got %v", err)
+			}
+			if result.Requeue || result.RequeueAfter != 0 {
+				t.Errorf("expected no requeue, got %v", result)
+			}
+			condition := meta.FindStatusCondition(tunnel.Status.Conditions, cfv2.ConditionCredentialsValid)
+			if condition == nil || condition.Status != metav1.ConditionFalse || condition.Reason != "InsufficientScope" {
+				t.Errorf("unexpected credentials condition %v", condition)
+			}
+		})
+	}
+
+	if isInsufficientScope(fmt.Errorf("failure")) {
+		t.Error("expected a generic error not to be reported as insufficient scope")
+	}
+}
@@ -0,0 +1,263 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cloudflare wraps the Cloudflare API client behind an interface, so that the reconciler can be tested
+// against the in memory Fake instead of the network.
+package cloudflare
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	cf "github.com/cloudflare/cloudflare-go"
+)
+
+// CloudflareClient covers the calls to the Cloudflare API made by the operator
+type CloudflareClient interface {
+	// Accounts lists the accounts the token has access to
+	Accounts(ctx context.Context, params cf.AccountsListParams) ([]cf.Account, cf.ResultInfo, error)
+	Tunnels(ctx context.Context, rc *cf.ResourceContainer, params cf.TunnelListParams) ([]cf.Tunnel, error)
+	CreateTunnel(ctx context.Context, rc *cf.ResourceContainer, params cf.TunnelCreateParams) (cf.Tunnel, error)
+	DeleteTunnel(ctx context.Context, rc *cf.ResourceContainer, tunnelID string) error
+	TunnelToken(ctx context.Context, rc *cf.ResourceContainer, tunnelID string) (string, error)
+	TunnelConnections(ctx context.Context, rc *cf.ResourceContainer, tunnelID string) ([]cf.Connection, error)
+	// CleanupTunnelConnections drops the connections of the tunnel, which can then be deleted
+	CleanupTunnelConnections(ctx context.Context, rc *cf.ResourceContainer, tunnelID string) error
+	ZoneIDByName(ctx context.Context, zoneName string) (string, error)
+	// ListZones lists the zones the token has access to, only the ones with the given names if any
+	ListZones(ctx context.Context, z ...string) ([]cf.Zone, error)
+	DNSRecord(ctx context.Context, zoneID, recordID string) (cf.DNSRecord, error)
+	DNSRecords(ctx context.Context, zoneID string, rr cf.DNSRecord) ([]cf.DNSRecord, error)
+	CreateDNSRecord(ctx context.Context, zoneID string, rr cf.DNSRecord) (*cf.DNSRecordResponse, error)
+	UpdateDNSRecord(ctx context.Context, zoneID, recordID string, rr cf.DNSRecord) error
+	DeleteDNSRecord(ctx context.Context, zoneID, recordID string) error
+	// DNSRecordsByComment lists the records of the given type whose comment is exactly comment
+	DNSRecordsByComment(ctx context.Context, zoneID, recordType, comment string) ([]CommentedDNSRecord, error)
+	// SetDNSRecordComment replaces the comment of the record
+	SetDNSRecordComment(ctx context.Context, zoneID, recordID, comment string) error
+	ListLoadBalancerPools(ctx context.Context) ([]cf.LoadBalancerPool, error)
+	CreateLoadBalancerPool(ctx context.Context, pool cf.LoadBalancerPool) (cf.LoadBalancerPool, error)
+	ModifyLoadBalancerPool(ctx context.Context, pool cf.LoadBalancerPool) (cf.LoadBalancerPool, error)
+	ListLoadBalancerMonitors(ctx context.Context) ([]cf.LoadBalancerMonitor, error)
+	CreateLoadBalancerMonitor(ctx context.Context, monitor cf.LoadBalancerMonitor) (cf.LoadBalancerMonitor, error)
+	ListLoadBalancers(ctx context.Context, zoneID string) ([]cf.LoadBalancer, error)
+	CreateLoadBalancer(ctx context.Context, zoneID string, lb cf.LoadBalancer) (cf.LoadBalancer, error)
+	ModifyLoadBalancer(ctx context.Context, zoneID string, lb cf.LoadBalancer) (cf.LoadBalancer, error)
+}
+
+// CommentedDNSRecord is a DNS record along with its comment, which the client does not expose yet
+type CommentedDNSRecord struct {
+	cf.DNSRecord
+	Comment string `json:"comment,omitempty"`
+}
+
+// API is the CloudflareClient backed by the Cloudflare API
+type API struct {
+	*cf.API
+	// Client sends the requests the client cannot send with a context, http.DefaultClient if nil. It should be the
+	// HTTP client of the client.
+	Client *http.Client
+}
+
+var _ CloudflareClient = &API{}
+
+// NewWithAPIKey creates a client of the Cloudflare API authenticated with the global API key of the user
+func NewWithAPIKey(key, email string, opts ...cf.Option) (*API, error) {
+	api, err := cf.New(key, email, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &API{API: api}, nil
+}
+
+// New creates a client of the Cloudflare API authenticated with the token
+func New(token string, opts ...cf.Option) (*API, error) {
+	api, err := cf.NewWithAPIToken(token, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &API{API: api}, nil
+}
+
+// ZoneIDByName returns the ID of the zone with the given name, the client only looks it up without a context
+func (api *API) ZoneIDByName(ctx context.Context, zoneName string) (string, error) {
+	zones, err := api.ListZonesContext(ctx, cf.WithZoneFilters(zoneName, api.AccountID, ""))
+	if err != nil {
+		return "", fmt.Errorf("could not list zones: %w", err)
+	}
+	switch len(zones.Result) {
+	case 0:
+		return "", errors.New("zone could not be found")
+	case 1:
+		return zones.Result[0].ID, nil
+	default:
+		return "", errors.New("ambiguous zone name; an account ID might help")
+	}
+}
+
+// ResponseError is the error response to a request sent by the API itself rather than by the client, which cannot
+// send it with a context. The controller tells it apart by its status like the typed errors of the client.
+type ResponseError struct {
+	StatusCode int
+	Errors     []cf.ResponseInfo
+}
+
+func (e *ResponseError) Error() string {
+	messages := make([]string, 0, len(e.Errors))
+	for _, info := range e.Errors {
+		messages = append(messages, fmt.Sprintf("%s (%d)", info.Message, info.Code))
+	}
+	return fmt.Sprintf("HTTP status %d: %s", e.StatusCode, strings.Join(messages, ", "))
+}
+
+// response is the envelope of the responses of the API
+type response struct {
+	Errors     []cf.ResponseInfo `json:"errors"`
+	Result     json.RawMessage   `json:"result"`
+	ResultInfo cf.ResultInfo     `json:"result_info"`
+}
+
+// send sends the request to endpoint through Client with the context, authenticated like the client
+func (api *API) send(ctx context.Context, method, endpoint string, body interface{}) (response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return response{}, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, api.BaseURL+endpoint, reader)
+	if err != nil {
+		return response{}, err
+	}
+	if api.APIEmail != "" {
+		req.Header.Set("X-Auth-Key", api.APIKey)
+		req.Header.Set("X-Auth-Email", api.APIEmail)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+api.APIToken)
+	}
+	req.Header.Set("User-Agent", api.UserAgent)
+	req.Header.Set("Content-Type", "application/json")
+	httpClient := api.Client
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return response{}, err
+	}
+	defer resp.Body.Close()
+	var decoded response
+	decodeErr := json.NewDecoder(resp.Body).Decode(&decoded)
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return response{}, &ResponseError{StatusCode: resp.StatusCode, Errors: decoded.Errors}
+	}
+	if decodeErr != nil {
+		return response{}, fmt.Errorf("could not decode the response: %w", decodeErr)
+	}
+	return decoded, nil
+}
+
+// perPage is the size of the pages requested by listAll
+const perPage = 100
+
+// listAll requests the pages of the list at endpoint one after the other, up to the total number of pages reported
+// by the first. decode appends the results of a page.
+func (api *API) listAll(ctx context.Context, endpoint string, query url.Values, decode func(json.RawMessage) error) error {
+	query.Set("per_page", strconv.Itoa(perPage))
+	for page := 1; ; page++ {
+		query.Set("page", strconv.Itoa(page))
+		resp, err := api.send(ctx, http.MethodGet, endpoint+"?"+query.Encode(), nil)
+		if err != nil {
+			return err
+		}
+		if err := decode(resp.Result); err != nil {
+			return err
+		}
+		if page >= resp.ResultInfo.TotalPages {
+			return nil
+		}
+	}
+}
+
+// Tunnels lists every tunnel of the account matching params, the client only returns the first page
+func (api *API) Tunnels(ctx context.Context, rc *cf.ResourceContainer, params cf.TunnelListParams) ([]cf.Tunnel, error) {
+	if rc.Identifier == "" {
+		return nil, cf.ErrMissingAccountID
+	}
+	query := url.Values{}
+	if params.Name != "" {
+		query.Set("name", params.Name)
+	}
+	if params.UUID != "" {
+		query.Set("uuid", params.UUID)
+	}
+	if params.IsDeleted != nil {
+		query.Set("is_deleted", strconv.FormatBool(*params.IsDeleted))
+	}
+	if params.ExistedAt != nil {
+		query.Set("existed_at", params.ExistedAt.Format(time.RFC3339))
+	}
+	var tunnels []cf.Tunnel
+	err := api.listAll(ctx, "/accounts/"+rc.Identifier+"/cfd_tunnel", query, func(raw json.RawMessage) error {
+		var page []cf.Tunnel
+		if err := json.Unmarshal(raw, &page); err != nil {
+			return fmt.Errorf("could not decode tunnels: %w", err)
+		}
+		tunnels = append(tunnels, page...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tunnels, nil
+}
+
+func (api *API) DNSRecordsByComment(ctx context.Context, zoneID, recordType, comment string) ([]CommentedDNSRecord, error) {
+	query := url.Values{}
+	query.Set("type", recordType)
+	query.Set("comment", comment)
+	var records []CommentedDNSRecord
+	err := api.listAll(ctx, "/zones/"+zoneID+"/dns_records", query, func(raw json.RawMessage) error {
+		var page []CommentedDNSRecord
+		if err := json.Unmarshal(raw, &page); err != nil {
+			return fmt.Errorf("could not decode dns records: %w", err)
+		}
+		records = append(records, page...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (api *API) SetDNSRecordComment(ctx context.Context, zoneID, recordID, comment string) error {
+	_, err := api.send(ctx, http.MethodPatch, "/zones/"+zoneID+"/dns_records/"+recordID, map[string]string{
+		"comment": comment,
+	})
+	return err
+}
@@ -0,0 +1,266 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudflare
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	cf "github.com/cloudflare/cloudflare-go"
+)
+
+func TestDNSRecordsByComment(t *testing.T) {
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query = req.URL.Query().Get("comment")
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"success":true,"errors":[],"messages":[],"result":[
+			{"id":"owned","type":"CNAME","name":"old.example.com","comment":"owner"}
+		]}`)
+	}))
+	defer server.Close()
+
+	api, err := New("token", cf.BaseURL(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := api.DNSRecordsByComment(context.Background(), "zone-id", "CNAME", "owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query != "owner" {
+		t.Errorf("expected records to be filtered by comment, got %q", query)
+	}
+	if len(records) != 1 || records[0].ID != "owned" || records[0].Comment != "owner" {
+		t.Errorf("expected the record to be decoded along with its comment, got %v", records)
+	}
+}
+
+// pagedServer serves total results of the given JSON format, numbered from 0, in the pages requested
+func pagedServer(total int, format string, queries *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		*queries = append(*queries, req.URL.RawQuery)
+		page, _ := strconv.Atoi(req.URL.Query().Get("page"))
+		size, _ := strconv.Atoi(req.URL.Query().Get("per_page"))
+		if page < 1 {
+			page = 1
+		}
+		if size < 1 {
+			size = 100
+		}
+		var results []string
+		for i := (page - 1) * size; i < page*size && i < total; i++ {
+			results = append(results, fmt.Sprintf(format, i))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"success":true,"errors":[],"messages":[],"result":[%s],
+			"result_info":{"page":%d,"per_page":%d,"count":%d,"total_count":%d,"total_pages":%d}}`,
+			strings.Join(results, ","), page, size, len(results), total, (total+size-1)/size)
+	}))
+}
+
+func TestTunnelsPaginated(t *testing.T) {
+	var queries []string
+	server := pagedServer(250, `{"id":"tunnel-%d","name":"tunnel"}`, &queries)
+	defer server.Close()
+
+	api, err := New("token", cf.BaseURL(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	falsePointer := false
+	tunnels, err := api.Tunnels(context.Background(), cf.AccountIdentifier("account"),
+		cf.TunnelListParams{Name: "tunnel", IsDeleted: &falsePointer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tunnels) != 250 || tunnels[249].ID != "tunnel-249" {
+		t.Errorf("expected the tunnels of every page, got %d", len(tunnels))
+	}
+	if len(queries) != 3 {
+		t.Fatalf("expected 3 pages to be requested, got %v", queries)
+	}
+	if !strings.Contains(queries[0], "name=tunnel") || !strings.Contains(queries[0], "is_deleted=false") {
+		t.Errorf("expected the tunnels to be filtered, got %q", queries[0])
+	}
+}
+
+func TestDNSRecordsPaginated(t *testing.T) {
+	var queries []string
+	server := pagedServer(150, `{"id":"record-%d","type":"CNAME"}`, &queries)
+	defer server.Close()
+
+	api, err := New("token", cf.BaseURL(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := api.DNSRecords(context.Background(), "zone-id", cf.DNSRecord{Type: "CNAME"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 150 || records[149].ID != "record-149" {
+		t.Errorf("expected the records of every page, got %d", len(records))
+	}
+}
+
+func TestDNSRecordsByCommentPaginated(t *testing.T) {
+	var queries []string
+	server := pagedServer(100, `{"id":"record-%d","type":"CNAME","comment":"owner"}`, &queries)
+	defer server.Close()
+
+	api, err := New("token", cf.BaseURL(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := api.DNSRecordsByComment(context.Background(), "zone-id", "CNAME", "owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the total number of pages spares the request of the next, empty, one
+	if len(records) != 100 || len(queries) != 1 {
+		t.Errorf("expected the records of every page, got %d in %d requests", len(records), len(queries))
+	}
+}
+
+func TestRequestsCancelled(t *testing.T) {
+	tests := []struct {
+		name string
+		call func(ctx context.Context, api *API) error
+	}{
+		{
+			name: "tunnels",
+			call: func(ctx context.Context, api *API) error {
+				_, err := api.Tunnels(ctx, cf.AccountIdentifier("account"), cf.TunnelListParams{})
+				return err
+			},
+		},
+		{
+			name: "dns records by comment",
+			call: func(ctx context.Context, api *API) error {
+				_, err := api.DNSRecordsByComment(ctx, "zone-id", "CNAME", "owner")
+				return err
+			},
+		},
+		{
+			name: "dns record comment",
+			call: func(ctx context.Context, api *API) error {
+				return api.SetDNSRecordComment(ctx, "zone-id", "record-id", "owner")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				<-release
+			}))
+			defer server.Close()
+			defer close(release)
+
+			api, err := New("token", cf.BaseURL(server.URL))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			done := make(chan error, 1)
+			go func() { done <- tt.call(ctx, api) }()
+			select {
+			case err := <-done:
+				if !errors.Is(err, context.DeadlineExceeded) {
+					t.Errorf("expected the request to be cut off by the context, got %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected the hanging request to return once the context is done")
+			}
+		})
+	}
+}
+
+func TestRequestErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"success":false,"errors":[{"code":10000,"message":"Authentication error"}],"messages":[],"result":null}`)
+	}))
+	defer server.Close()
+
+	api, err := New("token", cf.BaseURL(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = api.Tunnels(context.Background(), cf.AccountIdentifier("account"), cf.TunnelListParams{})
+	var responseError *ResponseError
+	if !errors.As(err, &responseError) || responseError.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected the status of the response in the error, got %v", err)
+	}
+	if len(responseError.Errors) != 1 || responseError.Errors[0].Code != 10000 {
+		t.Errorf("expected the errors of the response, got %v", responseError.Errors)
+	}
+}
+
+func TestZoneIDByNameCancelled(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"success":true,"errors":[],"messages":[],"result":[{"id":"zone-id","name":"example.com"}]}`)
+	}))
+	defer server.Close()
+
+	api, err := New("token", cf.BaseURL(server.URL), cf.UsingRetryPolicy(0, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := api.ZoneIDByName(ctx, "example.com"); err == nil {
+		t.Error("expected the lookup to fail with the cancelled context")
+	}
+	if requests != 0 {
+		t.Errorf("expected no request to be sent, got %d", requests)
+	}
+}
+
+func TestFakeTunnelToken(t *testing.T) {
+	fake := NewFake()
+	account := cf.AccountIdentifier("account")
+	tunnel, err := fake.CreateTunnel(context.Background(), account, cf.TunnelCreateParams{Name: "tunnel", Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	falsePointer := false
+	tunnels, err := fake.Tunnels(context.Background(), account, cf.TunnelListParams{Name: "tunnel", IsDeleted: &falsePointer})
+	if err != nil || len(tunnels) != 1 || tunnels[0].ID != tunnel.ID {
+		t.Fatalf("expected the created tunnel to be listed, got %v %v", tunnels, err)
+	}
+	if _, err := fake.TunnelToken(context.Background(), account, tunnel.ID); err != nil {
+		t.Errorf("expected a token for the created tunnel, got %v", err)
+	}
+
+	fake.Errors["TunnelToken"] = fmt.Errorf("failure")
+	if _, err := fake.TunnelToken(context.Background(), account, tunnel.ID); err == nil {
+		t.Error("expected the injected error to be returned")
+	}
+}
@@ -0,0 +1,423 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudflare
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	cf "github.com/cloudflare/cloudflare-go"
+)
+
+// Fake is an in memory CloudflareClient for tests.
+// Errors returns the given error from the method of the same name instead of calling it.
+type Fake struct {
+	AccountList   []cf.Account                    // accounts the token has access to
+	Zones         map[string]string               // zone IDs by zone name
+	TunnelList    []cf.Tunnel                     // tunnels of the account, including deleted ones
+	Records       map[string][]CommentedDNSRecord // DNS records by zone ID
+	Connections   map[string][]cf.Connection      // connections by tunnel ID
+	Pools         []cf.LoadBalancerPool           // load balancer pools of the account
+	Monitors      []cf.LoadBalancerMonitor        // load balancer monitors of the account
+	LoadBalancers map[string][]cf.LoadBalancer    // load balancers by zone ID
+	Errors        map[string]error                // errors to return by method name
+	Calls         []string                        // names of the called methods, in order
+
+	mutex  sync.Mutex
+	lastID int
+}
+
+var _ CloudflareClient = &Fake{}
+
+// NewFake returns a Fake serving the given zones without any tunnel or record
+func NewFake(zones ...string) *Fake {
+	fake := &Fake{
+		Zones:         map[string]string{},
+		Records:       map[string][]CommentedDNSRecord{},
+		Connections:   map[string][]cf.Connection{},
+		LoadBalancers: map[string][]cf.LoadBalancer{},
+		Errors:        map[string]error{},
+	}
+	for _, zone := range zones {
+		fake.Zones[zone] = fake.nextID("zone")
+	}
+	return fake
+}
+
+func (f *Fake) nextID(kind string) string {
+	f.lastID++
+	return fmt.Sprintf("%s-%d", kind, f.lastID)
+}
+
+// call records the call and returns the error of ctx if it is done, like the client would, or else the error
+// injected for the method, if any
+func (f *Fake) call(ctx context.Context, method string) error {
+	f.Calls = append(f.Calls, method)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return f.Errors[method]
+}
+
+func (f *Fake) Accounts(ctx context.Context, params cf.AccountsListParams) ([]cf.Account, cf.ResultInfo, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.call(ctx, "Accounts"); err != nil {
+		return nil, cf.ResultInfo{}, err
+	}
+	accounts := make([]cf.Account, len(f.AccountList))
+	copy(accounts, f.AccountList)
+	return accounts, cf.ResultInfo{Count: len(accounts), Total: len(accounts)}, nil
+}
+
+func (f *Fake) Tunnels(ctx context.Context, rc *cf.ResourceContainer, params cf.TunnelListParams) ([]cf.Tunnel, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.call(ctx, "Tunnels"); err != nil {
+		return nil, err
+	}
+	var tunnels []cf.Tunnel
+	for _, tunnel := range f.TunnelList {
+		if params.Name != "" && tunnel.Name != params.Name {
+			continue
+		}
+		if params.UUID != "" && tunnel.ID != params.UUID {
+			continue
+		}
+		if params.IsDeleted != nil && (tunnel.DeletedAt != nil) != *params.IsDeleted {
+			continue
+		}
+		tunnels = append(tunnels, tunnel)
+	}
+	return tunnels, nil
+}
+
+func (f *Fake) CreateTunnel(ctx context.Context, rc *cf.ResourceContainer, params cf.TunnelCreateParams) (cf.Tunnel, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.call(ctx, "CreateTunnel"); err != nil {
+		return cf.Tunnel{}, err
+	}
+	tunnel := cf.Tunnel{ID: f.nextID("tunnel"), Name: params.Name, Secret: params.Secret}
+	f.TunnelList = append(f.TunnelList, tunnel)
+	return tunnel, nil
+}
+
+func (f *Fake) DeleteTunnel(ctx context.Context, rc *cf.ResourceContainer, tunnelID string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.call(ctx, "DeleteTunnel"); err != nil {
+		return err
+	}
+	for i, tunnel := range f.TunnelList {
+		if tunnel.ID == tunnelID {
+			f.TunnelList = append(f.TunnelList[:i], f.TunnelList[i+1:]...)
+			return nil
+		}
+	}
+	return &cf.NotFoundError{}
+}
+
+func (f *Fake) TunnelToken(ctx context.Context, rc *cf.ResourceContainer, tunnelID string) (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.call(ctx, "TunnelToken"); err != nil {
+		return "", err
+	}
+	for _, tunnel := range f.TunnelList {
+		if tunnel.ID == tunnelID {
+			token, err := json.Marshal(map[string]string{
+				"a": rc.Identifier,
+				"s": base64.StdEncoding.EncodeToString([]byte(tunnel.Secret)),
+				"t": tunnel.ID,
+			})
+			if err != nil {
+				return "", err
+			}
+			return base64.StdEncoding.EncodeToString(token), nil
+		}
+	}
+	return "", &cf.NotFoundError{}
+}
+
+func (f *Fake) TunnelConnections(ctx context.Context, rc *cf.ResourceContainer, tunnelID string) ([]cf.Connection, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.call(ctx, "TunnelConnections"); err != nil {
+		return nil, err
+	}
+	return f.Connections[tunnelID], nil
+}
+
+func (f *Fake) CleanupTunnelConnections(ctx context.Context, rc *cf.ResourceContainer, tunnelID string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.call(ctx, "CleanupTunnelConnections"); err != nil {
+		return err
+	}
+	delete(f.Connections, tunnelID)
+	return nil
+}
+
+func (f *Fake) ZoneIDByName(ctx context.Context, zoneName string) (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.call(ctx, "ZoneIDByName"); err != nil {
+		return "", err
+	}
+	zoneID, ok := f.Zones[zoneName]
+	if !ok {
+		return "", fmt.Errorf("zone could not be found")
+	}
+	return zoneID, nil
+}
+
+func (f *Fake) ListZones(ctx context.Context, z ...string) ([]cf.Zone, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.call(ctx, "ListZones"); err != nil {
+		return nil, err
+	}
+	var zones []cf.Zone
+	for name, zoneID := range f.Zones {
+		if len(z) == 0 || containsName(z, name) {
+			zones = append(zones, cf.Zone{ID: zoneID, Name: name})
+		}
+	}
+	sort.Slice(zones, func(i, j int) bool { return zones[i].Name < zones[j].Name })
+	return zones, nil
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Fake) DNSRecord(ctx context.Context, zoneID, recordID string) (cf.DNSRecord, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.call(ctx, "DNSRecord"); err != nil {
+		return cf.DNSRecord{}, err
+	}
+	record := f.record(zoneID, recordID)
+	if record == nil {
+		return cf.DNSRecord{}, &cf.NotFoundError{}
+	}
+	return record.DNSRecord, nil
+}
+
+func (f *Fake) DNSRecords(ctx context.Context, zoneID string, rr cf.DNSRecord) ([]cf.DNSRecord, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.call(ctx, "DNSRecords"); err != nil {
+		return nil, err
+	}
+	var records []cf.DNSRecord
+	for _, record := range f.Records[zoneID] {
+		if rr.Type != "" && record.Type != rr.Type {
+			continue
+		}
+		if rr.Name != "" && !strings.EqualFold(record.Name, rr.Name) {
+			continue
+		}
+		if rr.Content != "" && record.Content != rr.Content {
+			continue
+		}
+		records = append(records, record.DNSRecord)
+	}
+	return records, nil
+}
+
+func (f *Fake) CreateDNSRecord(ctx context.Context, zoneID string, rr cf.DNSRecord) (*cf.DNSRecordResponse, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.call(ctx, "CreateDNSRecord"); err != nil {
+		return nil, err
+	}
+	rr.ID = f.nextID("record")
+	rr.ZoneID = zoneID
+	f.Records[zoneID] = append(f.Records[zoneID], CommentedDNSRecord{DNSRecord: rr})
+	return &cf.DNSRecordResponse{Result: rr}, nil
+}
+
+func (f *Fake) UpdateDNSRecord(ctx context.Context, zoneID, recordID string, rr cf.DNSRecord) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.call(ctx, "UpdateDNSRecord"); err != nil {
+		return err
+	}
+	record := f.record(zoneID, recordID)
+	if record == nil {
+		return &cf.NotFoundError{}
+	}
+	rr.ID = record.ID
+	rr.ZoneID = zoneID
+	record.DNSRecord = rr
+	return nil
+}
+
+func (f *Fake) DeleteDNSRecord(ctx context.Context, zoneID, recordID string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.call(ctx, "DeleteDNSRecord"); err != nil {
+		return err
+	}
+	for i, record := range f.Records[zoneID] {
+		if record.ID == recordID {
+			f.Records[zoneID] = append(f.Records[zoneID][:i], f.Records[zoneID][i+1:]...)
+			return nil
+		}
+	}
+	return &cf.NotFoundError{}
+}
+
+func (f *Fake) DNSRecordsByComment(ctx context.Context, zoneID, recordType, comment string) ([]CommentedDNSRecord, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.call(ctx, "DNSRecordsByComment"); err != nil {
+		return nil, err
+	}
+	var records []CommentedDNSRecord
+	for _, record := range f.Records[zoneID] {
+		if record.Type == recordType && record.Comment == comment {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+func (f *Fake) SetDNSRecordComment(ctx context.Context, zoneID, recordID, comment string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.call(ctx, "SetDNSRecordComment"); err != nil {
+		return err
+	}
+	record := f.record(zoneID, recordID)
+	if record == nil {
+		return &cf.NotFoundError{}
+	}
+	record.Comment = comment
+	return nil
+}
+
+func (f *Fake) record(zoneID, recordID string) *CommentedDNSRecord {
+	for i := range f.Records[zoneID] {
+		if f.Records[zoneID][i].ID == recordID {
+			return &f.Records[zoneID][i]
+		}
+	}
+	return nil
+}
+
+func (f *Fake) ListLoadBalancerPools(ctx context.Context) ([]cf.LoadBalancerPool, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.call(ctx, "ListLoadBalancerPools"); err != nil {
+		return nil, err
+	}
+	return append([]cf.LoadBalancerPool{}, f.Pools...), nil
+}
+
+func (f *Fake) CreateLoadBalancerPool(ctx context.Context, pool cf.LoadBalancerPool) (cf.LoadBalancerPool, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.call(ctx, "CreateLoadBalancerPool"); err != nil {
+		return cf.LoadBalancerPool{}, err
+	}
+	pool.ID = f.nextID("pool")
+	f.Pools = append(f.Pools, pool)
+	return pool, nil
+}
+
+func (f *Fake) ModifyLoadBalancerPool(ctx context.Context, pool cf.LoadBalancerPool) (cf.LoadBalancerPool, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.call(ctx, "ModifyLoadBalancerPool"); err != nil {
+		return cf.LoadBalancerPool{}, err
+	}
+	for i := range f.Pools {
+		if f.Pools[i].ID == pool.ID {
+			f.Pools[i] = pool
+			return pool, nil
+		}
+	}
+	return cf.LoadBalancerPool{}, &cf.NotFoundError{}
+}
+
+func (f *Fake) ListLoadBalancerMonitors(ctx context.Context) ([]cf.LoadBalancerMonitor, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.call(ctx, "ListLoadBalancerMonitors"); err != nil {
+		return nil, err
+	}
+	return append([]cf.LoadBalancerMonitor{}, f.Monitors...), nil
+}
+
+func (f *Fake) CreateLoadBalancerMonitor(ctx context.Context, monitor cf.LoadBalancerMonitor) (cf.LoadBalancerMonitor, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.call(ctx, "CreateLoadBalancerMonitor"); err != nil {
+		return cf.LoadBalancerMonitor{}, err
+	}
+	monitor.ID = f.nextID("monitor")
+	f.Monitors = append(f.Monitors, monitor)
+	return monitor, nil
+}
+
+func (f *Fake) ListLoadBalancers(ctx context.Context, zoneID string) ([]cf.LoadBalancer, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.call(ctx, "ListLoadBalancers"); err != nil {
+		return nil, err
+	}
+	return append([]cf.LoadBalancer{}, f.LoadBalancers[zoneID]...), nil
+}
+
+func (f *Fake) CreateLoadBalancer(ctx context.Context, zoneID string, lb cf.LoadBalancer) (cf.LoadBalancer, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.call(ctx, "CreateLoadBalancer"); err != nil {
+		return cf.LoadBalancer{}, err
+	}
+	lb.ID = f.nextID("lb")
+	f.LoadBalancers[zoneID] = append(f.LoadBalancers[zoneID], lb)
+	return lb, nil
+}
+
+func (f *Fake) ModifyLoadBalancer(ctx context.Context, zoneID string, lb cf.LoadBalancer) (cf.LoadBalancer, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.call(ctx, "ModifyLoadBalancer"); err != nil {
+		return cf.LoadBalancer{}, err
+	}
+	for i := range f.LoadBalancers[zoneID] {
+		if f.LoadBalancers[zoneID][i].ID == lb.ID {
+			f.LoadBalancers[zoneID][i] = lb
+			return lb, nil
+		}
+	}
+	return cf.LoadBalancer{}, &cf.NotFoundError{}
+}
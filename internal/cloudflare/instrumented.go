@@ -0,0 +1,159 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudflare
+
+import (
+	"context"
+	"time"
+
+	cf "github.com/cloudflare/cloudflare-go"
+)
+
+// Instrumented passes the calls to Client and reports how long each of them took to Observe, named after the
+// method of CloudflareClient
+type Instrumented struct {
+	Client  CloudflareClient
+	Observe func(operation string, duration time.Duration)
+}
+
+var _ CloudflareClient = &Instrumented{}
+
+func (i *Instrumented) observe(operation string, start time.Time) {
+	if i.Observe != nil {
+		i.Observe(operation, time.Since(start))
+	}
+}
+
+func (i *Instrumented) Accounts(ctx context.Context, params cf.AccountsListParams) ([]cf.Account, cf.ResultInfo, error) {
+	defer i.observe("Accounts", time.Now())
+	return i.Client.Accounts(ctx, params)
+}
+
+func (i *Instrumented) Tunnels(ctx context.Context, rc *cf.ResourceContainer, params cf.TunnelListParams) ([]cf.Tunnel, error) {
+	defer i.observe("Tunnels", time.Now())
+	return i.Client.Tunnels(ctx, rc, params)
+}
+
+func (i *Instrumented) CreateTunnel(ctx context.Context, rc *cf.ResourceContainer, params cf.TunnelCreateParams) (cf.Tunnel, error) {
+	defer i.observe("CreateTunnel", time.Now())
+	return i.Client.CreateTunnel(ctx, rc, params)
+}
+
+func (i *Instrumented) DeleteTunnel(ctx context.Context, rc *cf.ResourceContainer, tunnelID string) error {
+	defer i.observe("DeleteTunnel", time.Now())
+	return i.Client.DeleteTunnel(ctx, rc, tunnelID)
+}
+
+func (i *Instrumented) TunnelToken(ctx context.Context, rc *cf.ResourceContainer, tunnelID string) (string, error) {
+	defer i.observe("TunnelToken", time.Now())
+	return i.Client.TunnelToken(ctx, rc, tunnelID)
+}
+
+func (i *Instrumented) TunnelConnections(ctx context.Context, rc *cf.ResourceContainer, tunnelID string) ([]cf.Connection, error) {
+	defer i.observe("TunnelConnections", time.Now())
+	return i.Client.TunnelConnections(ctx, rc, tunnelID)
+}
+
+func (i *Instrumented) CleanupTunnelConnections(ctx context.Context, rc *cf.ResourceContainer, tunnelID string) error {
+	defer i.observe("CleanupTunnelConnections", time.Now())
+	return i.Client.CleanupTunnelConnections(ctx, rc, tunnelID)
+}
+
+func (i *Instrumented) ZoneIDByName(ctx context.Context, zoneName string) (string, error) {
+	defer i.observe("ZoneIDByName", time.Now())
+	return i.Client.ZoneIDByName(ctx, zoneName)
+}
+
+func (i *Instrumented) ListZones(ctx context.Context, z ...string) ([]cf.Zone, error) {
+	defer i.observe("ListZones", time.Now())
+	return i.Client.ListZones(ctx, z...)
+}
+
+func (i *Instrumented) DNSRecord(ctx context.Context, zoneID, recordID string) (cf.DNSRecord, error) {
+	defer i.observe("DNSRecord", time.Now())
+	return i.Client.DNSRecord(ctx, zoneID, recordID)
+}
+
+func (i *Instrumented) DNSRecords(ctx context.Context, zoneID string, rr cf.DNSRecord) ([]cf.DNSRecord, error) {
+	defer i.observe("DNSRecords", time.Now())
+	return i.Client.DNSRecords(ctx, zoneID, rr)
+}
+
+func (i *Instrumented) CreateDNSRecord(ctx context.Context, zoneID string, rr cf.DNSRecord) (*cf.DNSRecordResponse, error) {
+	defer i.observe("CreateDNSRecord", time.Now())
+	return i.Client.CreateDNSRecord(ctx, zoneID, rr)
+}
+
+func (i *Instrumented) UpdateDNSRecord(ctx context.Context, zoneID, recordID string, rr cf.DNSRecord) error {
+	defer i.observe("UpdateDNSRecord", time.Now())
+	return i.Client.UpdateDNSRecord(ctx, zoneID, recordID, rr)
+}
+
+func (i *Instrumented) DeleteDNSRecord(ctx context.Context, zoneID, recordID string) error {
+	defer i.observe("DeleteDNSRecord", time.Now())
+	return i.Client.DeleteDNSRecord(ctx, zoneID, recordID)
+}
+
+func (i *Instrumented) DNSRecordsByComment(ctx context.Context, zoneID, recordType, comment string) ([]CommentedDNSRecord, error) {
+	defer i.observe("DNSRecordsByComment", time.Now())
+	return i.Client.DNSRecordsByComment(ctx, zoneID, recordType, comment)
+}
+
+func (i *Instrumented) SetDNSRecordComment(ctx context.Context, zoneID, recordID, comment string) error {
+	defer i.observe("SetDNSRecordComment", time.Now())
+	return i.Client.SetDNSRecordComment(ctx, zoneID, recordID, comment)
+}
+
+func (i *Instrumented) ListLoadBalancerPools(ctx context.Context) ([]cf.LoadBalancerPool, error) {
+	defer i.observe("ListLoadBalancerPools", time.Now())
+	return i.Client.ListLoadBalancerPools(ctx)
+}
+
+func (i *Instrumented) CreateLoadBalancerPool(ctx context.Context, pool cf.LoadBalancerPool) (cf.LoadBalancerPool, error) {
+	defer i.observe("CreateLoadBalancerPool", time.Now())
+	return i.Client.CreateLoadBalancerPool(ctx, pool)
+}
+
+func (i *Instrumented) ModifyLoadBalancerPool(ctx context.Context, pool cf.LoadBalancerPool) (cf.LoadBalancerPool, error) {
+	defer i.observe("ModifyLoadBalancerPool", time.Now())
+	return i.Client.ModifyLoadBalancerPool(ctx, pool)
+}
+
+func (i *Instrumented) ListLoadBalancerMonitors(ctx context.Context) ([]cf.LoadBalancerMonitor, error) {
+	defer i.observe("ListLoadBalancerMonitors", time.Now())
+	return i.Client.ListLoadBalancerMonitors(ctx)
+}
+
+func (i *Instrumented) CreateLoadBalancerMonitor(ctx context.Context, monitor cf.LoadBalancerMonitor) (cf.LoadBalancerMonitor, error) {
+	defer i.observe("CreateLoadBalancerMonitor", time.Now())
+	return i.Client.CreateLoadBalancerMonitor(ctx, monitor)
+}
+
+func (i *Instrumented) ListLoadBalancers(ctx context.Context, zoneID string) ([]cf.LoadBalancer, error) {
+	defer i.observe("ListLoadBalancers", time.Now())
+	return i.Client.ListLoadBalancers(ctx, zoneID)
+}
+
+func (i *Instrumented) CreateLoadBalancer(ctx context.Context, zoneID string, lb cf.LoadBalancer) (cf.LoadBalancer, error) {
+	defer i.observe("CreateLoadBalancer", time.Now())
+	return i.Client.CreateLoadBalancer(ctx, zoneID, lb)
+}
+
+func (i *Instrumented) ModifyLoadBalancer(ctx context.Context, zoneID string, lb cf.LoadBalancer) (cf.LoadBalancer, error) {
+	defer i.observe("ModifyLoadBalancer", time.Now())
+	return i.Client.ModifyLoadBalancer(ctx, zoneID, lb)
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudflare
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimitError is returned by the RetryTransport when a request is still rate limited once the retries are
+// exhausted, or when the remote asks to wait for longer than the maximum delay between retries
+type RateLimitError struct {
+	RetryAfter time.Duration // delay the remote asked to wait for before the next request, 0 if it did not say
+}
+
+func (e *RateLimitError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("rate limited by the Cloudflare API, retry after %s", e.RetryAfter)
+	}
+	return "rate limited by the Cloudflare API"
+}
+
+// RetryTransport retries the requests which are rate limited or fail with a 5xx. It waits for the delay the remote
+// asks for in the Retry-After header, and otherwise backs off exponentially with jitter so that the requests rate
+// limited together are not retried together. Every attempt first waits on the Limiter, which can be shared by the
+// clients of the same account to stay below the limit of the account.
+type RetryTransport struct {
+	Base          http.RoundTripper // sends the requests, http.DefaultTransport if nil
+	Limiter       *rate.Limiter     // waited on before every attempt, no limit if nil
+	Retries       int               // retries of a request after the first attempt
+	MinRetryDelay time.Duration     // delay before the first retry, doubled on each retry
+	MaxRetryDelay time.Duration     // upper bound of the delay between retries, longer Retry-After are not waited for
+	Timeout       time.Duration     // timeout of a single attempt, none if 0
+
+	sleep func(ctx context.Context, d time.Duration) error // waits between attempts, replaced by the tests
+}
+
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if t.Limiter != nil {
+			if err := t.Limiter.Wait(req.Context()); err != nil {
+				return nil, err
+			}
+		}
+		resp, err := t.send(req)
+		if err == nil && resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < http.StatusInternalServerError {
+			return resp, nil
+		}
+		if req.Context().Err() != nil {
+			return resp, err
+		}
+
+		var retryAfter time.Duration
+		if err == nil {
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		}
+		delay := t.backoff(attempt)
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		next, rewound := rewind(req)
+		if attempt >= t.Retries || delay > t.MaxRetryDelay || !rewound {
+			if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+				discard(resp)
+				return nil, &RateLimitError{RetryAfter: retryAfter}
+			}
+			return resp, err
+		}
+		if err == nil {
+			discard(resp)
+		}
+		if err := t.wait(req.Context(), delay); err != nil {
+			return nil, err
+		}
+		req = next
+	}
+}
+
+// send makes a single attempt, applying the timeout until the body of the response is closed
+func (t *RetryTransport) send(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if t.Timeout <= 0 {
+		return base.RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), t.Timeout)
+	resp, err := base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// backoff returns the delay before the retry following the given attempt. Half of it is random.
+func (t *RetryTransport) backoff(attempt int) time.Duration {
+	backoff := t.MinRetryDelay
+	for i := 0; i < attempt && backoff < t.MaxRetryDelay; i++ {
+		backoff *= 2
+	}
+	if backoff > t.MaxRetryDelay {
+		backoff = t.MaxRetryDelay
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+func (t *RetryTransport) wait(ctx context.Context, d time.Duration) error {
+	if t.sleep != nil {
+		return t.sleep(ctx, d)
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// parseRetryAfter returns the delay of a Retry-After header, given either in seconds or as a date
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// rewind returns a copy of the request with its body reset so that it can be sent again, if possible
+func rewind(req *http.Request) (*http.Request, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, true
+	}
+	if req.GetBody == nil {
+		return nil, false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, false
+	}
+	next := req.Clone(req.Context())
+	next.Body = body
+	return next, true
+}
+
+// discard reads and closes the body of a response which is not returned, so that the connection can be reused
+func discard(resp *http.Response) {
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2022 Beez Innovation Labs.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudflare
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	cf "github.com/cloudflare/cloudflare-go"
+)
+
+// newRetryServer returns a server answering the first requests with the given statuses and headers, then success
+func newRetryServer(t *testing.T, failures []int, header http.Header) (*httptest.Server, *int) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+		if requests <= len(failures) {
+			for key, values := range header {
+				w.Header()[key] = values
+			}
+			w.WriteHeader(failures[requests-1])
+			fmt.Fprint(w, `{"success":false,"errors":[{"code":10000,"message":"failed"}],"messages":[],"result":null}`)
+			return
+		}
+		fmt.Fprint(w, `{"success":true,"errors":[],"messages":[],"result":[{"id":"zone-id","name":"example.com"}]}`)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestRetryTransportRetryAfter(t *testing.T) {
+	server, requests := newRetryServer(t, []int{http.StatusTooManyRequests}, http.Header{"Retry-After": []string{"2"}})
+	var delays []time.Duration
+	transport := &RetryTransport{
+		Retries:       3,
+		MinRetryDelay: time.Millisecond,
+		MaxRetryDelay: 30 * time.Second,
+		sleep: func(ctx context.Context, d time.Duration) error {
+			delays = append(delays, d)
+			return nil
+		},
+	}
+
+	api, err := New("token", cf.BaseURL(server.URL), cf.UsingRetryPolicy(0, 0, 0), cf.HTTPClient(&http.Client{Transport: transport}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := api.ZoneIDByName(context.Background(), "example.com"); err != nil {
+		t.Fatalf("expected the request to succeed after the retry, got %v", err)
+	}
+	if *requests != 2 {
+		t.Errorf("expected 2 requests, got %d", *requests)
+	}
+	if !reflect.DeepEqual(delays, []time.Duration{2 * time.Second}) {
+		t.Errorf("expected to wait for the Retry-After delay, got %v", delays)
+	}
+}
+
+func TestRetryTransportBackoff(t *testing.T) {
+	server, requests := newRetryServer(t, []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}, nil)
+	var delays []time.Duration
+	transport := &RetryTransport{
+		Retries:       3,
+		MinRetryDelay: 100 * time.Millisecond,
+		MaxRetryDelay: time.Second,
+		sleep: func(ctx context.Context, d time.Duration) error {
+			delays = append(delays, d)
+			return nil
+		},
+	}
+
+	resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || *requests != 3 {
+		t.Fatalf("expected success on the third request, got %d after %d requests", resp.StatusCode, *requests)
+	}
+	if len(delays) != 2 {
+		t.Fatalf("expected 2 delays, got %v", delays)
+	}
+	// half of the exponential backoff is random
+	for i, backoff := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond} {
+		if delays[i] < backoff/2 || delays[i] > backoff {
+			t.Errorf("expected delay %d to be between %s and %s, got %s", i, backoff/2, backoff, delays[i])
+		}
+	}
+}
+
+func TestRetryTransportRateLimited(t *testing.T) {
+	tests := []struct {
+		name           string
+		retryAfter     string
+		wantRequests   int
+		wantRetryAfter time.Duration
+	}{
+		{name: "retries exhausted", wantRequests: 3},
+		{name: "retry after longer than max delay", retryAfter: "60", wantRequests: 1, wantRetryAfter: time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.retryAfter != "" {
+				header.Set("Retry-After", tt.retryAfter)
+			}
+			statuses := []int{http.StatusTooManyRequests, http.StatusTooManyRequests, http.StatusTooManyRequests}
+			server, requests := newRetryServer(t, statuses, header)
+			transport := &RetryTransport{
+				Retries:       2,
+				MaxRetryDelay: 30 * time.Second,
+				sleep:         func(ctx context.Context, d time.Duration) error { return nil },
+			}
+
+			api, err := New("token", cf.BaseURL(server.URL), cf.UsingRetryPolicy(0, 0, 0), cf.HTTPClient(&http.Client{Transport: transport}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = api.ZoneIDByName(context.Background(), "example.com")
+			var rateLimitError *RateLimitError
+			if !errors.As(err, &rateLimitError) {
+				t.Fatalf("expected a rate limit error, got %v", err)
+			}
+			if rateLimitError.RetryAfter != tt.wantRetryAfter {
+				t.Errorf("expected to retry after %s, got %s", tt.wantRetryAfter, rateLimitError.RetryAfter)
+			}
+			if *requests != tt.wantRequests {
+				t.Errorf("expected %d requests, got %d", tt.wantRequests, *requests)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{header: "", want: 0},
+		{header: "5", want: 5 * time.Second},
+		{header: "-5", want: 0},
+		{header: "Wed, 01 Jun 2022 12:00:30 GMT", want: 30 * time.Second},
+		{header: "Wed, 01 Jun 2022 11:00:00 GMT", want: 0},
+		{header: "soon", want: 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.header, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q): expected %s, got %s", tt.header, tt.want, got)
+		}
+	}
+}
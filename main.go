@@ -19,6 +19,7 @@ package main
 import (
 	"flag"
 	"os"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -54,11 +55,59 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var shard string
+	var namespacedNames bool
+	var deletedTunnelNames string
+	var dnsAttempts int
+	var dnsRetryDelay time.Duration
+	var apiOptions controllers.CloudflareAPIOptions
+	var metadataCacheTTL time.Duration
+	var clientCacheTTL time.Duration
+	var resyncInterval time.Duration
+	var remoteTimeout time.Duration
+	var apiRateLimit float64
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&shard, "shard", "",
+		"Only reconcile resources with the annotation cloudflare-tunnel-operator.beezlabs.app/shard set to this value. "+
+			"All resources are reconciled if empty.")
+	flag.BoolVar(&namespacedNames, "namespaced-tunnel-names", false,
+		"Prefix the names of the tunnels with the namespace of the resource to avoid collisions in a shared account. "+
+			"Tunnels are looked up by name, so enabling it on an existing installation creates new tunnels; "+
+			"the previous ones have to be deleted manually once the new ones are connected.")
+	flag.StringVar(&deletedTunnelNames, "deleted-tunnel-names", string(controllers.DeletedTunnelNameIgnore),
+		"How a tunnel is created when a deleted tunnel with the same name still exists in the account. "+
+			"One of ignore (create it with the same name), rename (append the UID of the resource to the name) "+
+			"or error (fail until the deleted tunnel is gone).")
+	flag.IntVar(&dnsAttempts, "dns-attempts", 3,
+		"How many times writing a DNS record is attempted before retrying at the next resync.")
+	flag.DurationVar(&dnsRetryDelay, "dns-retry-delay", time.Second,
+		"The delay before retrying to write a DNS record, doubled on each attempt.")
+	flag.IntVar(&apiOptions.Retries, "cloudflare-api-retries", 3,
+		"How many times a request to the Cloudflare API failing with a 429 or 5xx is retried.")
+	flag.DurationVar(&apiOptions.MinRetryDelay, "cloudflare-api-min-retry-delay", time.Second,
+		"The delay before retrying a request to the Cloudflare API, doubled on each retry with jitter.")
+	flag.DurationVar(&apiOptions.MaxRetryDelay, "cloudflare-api-max-retry-delay", 30*time.Second,
+		"The maximum delay between retries of a request to the Cloudflare API. "+
+			"A longer Retry-After requeues the reconcile instead.")
+	flag.DurationVar(&apiOptions.Timeout, "cloudflare-api-timeout", 30*time.Second,
+		"The timeout of a single request to the Cloudflare API.")
+	flag.StringVar(&apiOptions.BaseURL, "cloudflare-api-base-url", os.Getenv("CLOUDFLARE_API_BASE_URL"),
+		"The base URL of the Cloudflare API, e.g. of an isolated deployment or a mock server. "+
+			"Defaults to CLOUDFLARE_API_BASE_URL, or the production API if unset.")
+	flag.DurationVar(&metadataCacheTTL, "cloudflare-metadata-cache-ttl", 10*time.Minute,
+		"How long zone IDs looked up from the Cloudflare API are cached. Disabled if 0.")
+	flag.DurationVar(&clientCacheTTL, "cloudflare-client-cache-ttl", time.Hour,
+		"How long an unused client of the Cloudflare API is kept to be reused by the next reconciles. Disabled if 0.")
+	flag.Float64Var(&apiRateLimit, "cloudflare-api-rate-limit", 4,
+		"How many requests per second are sent to the Cloudflare API for each account. Disabled if 0.")
+	flag.DurationVar(&resyncInterval, "resync-interval", 5*time.Minute,
+		"How often reconciled resources are checked again against the tunnel and DNS record in Cloudflare.")
+	flag.DurationVar(&remoteTimeout, "cloudflare-reconcile-timeout", 2*time.Minute,
+		"How long the requests to the Cloudflare API of a reconcile may take altogether before it is retried.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -67,13 +116,25 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	deletedTunnelNamePolicy, err := controllers.ParseDeletedTunnelNamePolicy(deletedTunnelNames)
+	if err != nil {
+		setupLog.Error(err, "invalid flag", "flag", "deleted-tunnel-names")
+		os.Exit(1)
+	}
+
+	// each shard needs its own leader, otherwise only one shard would be running at a time
+	leaderElectionID := "a6b1ac6f.beezlabs.app"
+	if shard != "" {
+		leaderElectionID = shard + "." + leaderElectionID
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
 		Port:                   9443,
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
-		LeaderElectionID:       "a6b1ac6f.beezlabs.app",
+		LeaderElectionID:       leaderElectionID,
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
@@ -81,12 +142,30 @@ func main() {
 	}
 
 	if err = (&controllers.CloudflareTunnelReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:             mgr.GetClient(),
+		Scheme:             mgr.GetScheme(),
+		Shard:              shard,
+		NamespacedNames:    namespacedNames,
+		DeletedTunnelNames: deletedTunnelNamePolicy,
+		DNSAttempts:        dnsAttempts,
+		DNSRetryDelay:      dnsRetryDelay,
+		ResyncInterval:     resyncInterval,
+		RemoteTimeout:      remoteTimeout,
+		APIOptions:         apiOptions,
+		Metadata:           controllers.NewMetadataCache(metadataCacheTTL),
+		Clients:            controllers.NewClientCache(clientCacheTTL),
+		Limiters:           controllers.NewAccountLimiters(apiRateLimit),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "CloudflareTunnel")
 		os.Exit(1)
 	}
+	// the webhooks need a serving certificate, so they can be disabled when running without one, e.g. locally
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = (&cloudflaretunneloperatorv1alpha2.CloudflareTunnel{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "CloudflareTunnel")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {